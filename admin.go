@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/go-chi/chi/v5"
+)
+
+// callTrace is the timestamped diagnostic timeline of one call. All methods are
+// no-ops on a nil trace, so regular calls pay nothing for it.
+type callTrace struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []traceEvent
+	sawNAT bool
+}
+
+type traceEvent struct {
+	Offset int64  `json:"t_ms"` // milliseconds since the call started
+	Event  string `json:"event"`
+}
+
+func newCallTrace() *callTrace {
+	return &callTrace{start: time.Now()}
+}
+
+func (t *callTrace) add(format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, traceEvent{
+		Offset: time.Since(t.start).Milliseconds(),
+		Event:  fmt.Sprintf(format, args...),
+	})
+}
+
+// statusNotes explains what the engine did when it reported a status.
+var statusNotes = map[string]string{
+	statusAnswered:       " (ACK sent)",
+	statusHangingUpTimer: " (BYE sent, or CANCEL if unanswered)",
+	statusTerminated:     " (487 ACKed)",
+	statusRang:           " (CANCEL sent)",
+	statusFailover:       " (dialing --backup-sip-domain)",
+}
+
+func (t *callTrace) status(m callStatusMsg) {
+	if m.Leg != "" {
+		var note string
+		if m.Code != "" {
+			note = fmt.Sprintf(" [%s] %s", m.Code, m.Code.Message())
+		}
+		t.add("%s %s%s", m.Leg, m.Status, note)
+		return
+	}
+	if m.Code != "" {
+		t.add("status %s [%s] %s", m.Status, m.Code, m.Code.Message())
+		return
+	}
+	t.add("status %s%s", m.Status, statusNotes[m.Status])
+}
+
+// response records a received response. The first one carrying Via received/rport
+// also records the address the provider sees us at, which is what NAT problems
+// (one-way audio, lost BYEs) usually come down to.
+func (t *callTrace) response(res *sip.Response, publicIP string) {
+	if t == nil {
+		return
+	}
+	t.add("⬅ %d %s", res.StatusCode, res.Reason)
+	via := res.Via()
+	if via == nil {
+		return
+	}
+	received, hasReceived := via.Params.Get("received")
+	rport, _ := via.Params.Get("rport")
+	t.mu.Lock()
+	first := !t.sawNAT && (hasReceived || rport != "")
+	t.sawNAT = t.sawNAT || first
+	t.mu.Unlock()
+	if !first {
+		return
+	}
+	if received == "" {
+		received = via.Host
+	}
+	t.add("provider sees us at %s (rport %s, sent from %s)", received, orDash(rport), via.SentBy())
+	if received != publicIP {
+		t.add("⚠ that differs from the discovered public IP %s — the Contact header may be unreachable", publicIP)
+	}
+}
+
+func (t *callTrace) Events() []traceEvent {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]traceEvent(nil), t.events...)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// testCallResult is the response of POST /api/admin/test-call.
+type testCallResult struct {
+	CallID      string       `json:"call_id"`
+	Destination string       `json:"destination"`
+	Status      string       `json:"status"`
+	Code        errorCode    `json:"code,omitempty"`
+	Answered    bool         `json:"answered"`
+	DurationMS  int64        `json:"duration_ms"`
+	Timeline    []traceEvent `json:"timeline"`
+}
+
+// testCallMu allows one test call at a time; each one holds a SIP dialog open.
+var testCallMu sync.Mutex
+
+// mountAdmin adds the admin dashboard and the /api/admin endpoints, guarded by
+// --admin-token. The page itself is public; it holds no data until it has a token.
+func mountAdmin(r chi.Router) {
+	r.Get("/admin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(adminHTML))
+	})
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(adminOnly)
+		r.Get("/overview", handleAdminOverview)
+		r.Get("/trunk", handleAdminTrunk)
+		r.Get("/calls", handleAdminCalls)
+		r.Post("/calls/{id}/hangup", handleAdminHangup)
+		r.Post("/test-call", handleTestCall)
+		r.Post("/dial", handleManualDial)
+		r.Get("/dials", handleManualDials)
+		r.Get("/telemetry", handleTelemetry)
+		r.Get("/tokens", handleTokens)
+		r.Post("/tokens", handleTokenCreate)
+		r.Delete("/tokens/{name}", handleTokenDelete)
+		r.Post("/tokens/{name}/deactivate", handleTokenActive(false))
+		r.Post("/tokens/{name}/activate", handleTokenActive(true))
+		r.Post("/tokens/{name}/anonymize", handleTokenAnonymize)
+		r.With(ownerOnly).Get("/delegations", handleDelegations)
+		r.With(ownerOnly).Post("/delegations", handleDelegationCreate)
+		r.With(ownerOnly).Delete("/delegations/{name}", handleDelegationDelete)
+		r.Get("/audit", handleAudit)
+		r.Get("/budget", handleBudget)
+		r.Post("/budget/ack", handleBudgetAck)
+		r.Get("/approvals", handleApprovals)
+		r.Post("/approvals/{id}/approve", handleApprovalDecide(true))
+		r.Post("/approvals/{id}/deny", handleApprovalDecide(false))
+	})
+}
+
+// adminOnly rejects requests without --admin-token or a delegation's token (and
+// everything while --admin-token is unset), and hides the admin endpoints on
+// scope=calls --listeners.
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if callsOnly(r) {
+			writeAPIError(w, r, http.StatusNotFound, errNotFound, "admin_not_here")
+			return
+		}
+		if cli.AdminToken == "" {
+			writeAPIError(w, r, http.StatusUnauthorized, errAuth, "admin_disabled")
+			return
+		}
+		token := tokenFromRequest(r)
+		if sameToken(token, cli.AdminToken) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch d, valid := delegations.lookup(token); {
+		case d == nil:
+			writeAPIError(w, r, http.StatusUnauthorized, errAuth, "")
+		case !valid:
+			writeAPIError(w, r, http.StatusUnauthorized, errTokenExpired, "")
+		default:
+			r = withDelegate(r, d)
+			if r.Method != http.MethodGet {
+				auditRequest(r, auditDelegateRequest, "", "")
+			}
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// handleTestCall is POST /api/admin/test-call. It places a real call to
+// --test-destination (e.g. the provider's echo service, never the gate) and blocks
+// until it is over, returning the diagnostic timeline.
+func handleTestCall(w http.ResponseWriter, r *http.Request) {
+	if cli.TestDestination == "" {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "no_test_destination")
+		return
+	}
+	if !testCallMu.TryLock() {
+		writeAPIError(w, r, http.StatusConflict, errBadRequest, "test_call_running")
+		return
+	}
+	defer testCallMu.Unlock()
+
+	cfg := cli
+	cfg.Destination, cfg.DtmfCode = cli.TestDestination, "" // the gate's code is not the echo service's business
+	trace := newCallTrace()
+	statusChan := make(chan callStatusMsg, 16)
+	opts := callOptions{Source: callSource("admin test", r), Admin: true, Trace: requestTrace(r)}
+	budget.admit(opts.Admin)
+	log := newCallLogger(newSessionID(), opts)
+	log.Printf("Admin test call to %s\n", cfg.Destination)
+	ctx, cancel := context.WithTimeout(withCallLogger(r.Context(), log), callHardCap) // the admin leaving hangs up
+	defer cancel()
+	ended := make(chan error, 1)
+	go func() { ended <- run(ctx, &cfg, opts, trace, statusChan) }()
+
+	res := testCallResult{CallID: log.id, Destination: cfg.Destination}
+	for msg := range statusChan {
+		res.Status = msg.Status
+		res.Answered = res.Answered || msg.Status == statusAnswered || msg.Status == statusRang
+	}
+	var failed *callError
+	if errors.As(<-ended, &failed) {
+		res.Code = failed.Code
+	}
+	trace.add("call ended")
+	res.DurationMS = time.Since(trace.start).Milliseconds()
+	res.Timeline = trace.Events()
+	writeJSON(w, http.StatusOK, res)
+}
+
+const adminHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0, viewport-fit=cover">
+    <title>Gate Admin</title>
+    <style>
+        :root {
+            --bg-color: #000000;
+            --main-green: #00ff41;
+            --main-grey: #666666;
+            --main-red: #ff3333;
+            --font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, Helvetica, Arial, sans-serif;
+        }
+
+        body {
+            background-color: var(--bg-color);
+            color: white;
+            font-family: var(--font-family);
+            margin: 0;
+            padding: 24px 16px;
+            display: flex;
+            justify-content: center;
+        }
+
+        main {
+            width: 100%;
+            max-width: 640px;
+        }
+
+        h1 {
+            color: var(--main-green);
+            font-size: 1.5rem;
+            margin: 0 0 16px;
+        }
+
+        h2 {
+            font-size: 1.1rem;
+            margin: 24px 0 4px;
+        }
+
+        .hint {
+            color: var(--main-grey);
+            font-size: 0.85rem;
+            margin: 0 0 12px;
+        }
+
+        .row {
+            display: flex;
+            gap: 8px;
+        }
+
+        input {
+            flex: 1;
+            padding: 10px;
+            background: #111;
+            color: white;
+            border: 1px solid var(--main-grey);
+            border-radius: 6px;
+            font-size: 1rem;
+        }
+
+        button {
+            padding: 10px 16px;
+            background: transparent;
+            color: var(--main-green);
+            border: 2px solid currentColor;
+            border-radius: 6px;
+            font-size: 1rem;
+            font-weight: 600;
+            cursor: pointer;
+        }
+
+        button:disabled {
+            color: var(--main-grey);
+            cursor: default;
+        }
+
+        #summary {
+            margin: 12px 0;
+        }
+
+        table {
+            width: 100%;
+            border-collapse: collapse;
+            font-family: monospace;
+            font-size: 0.85rem;
+        }
+
+        td {
+            padding: 4px 6px;
+            border-bottom: 1px solid #222;
+            vertical-align: top;
+        }
+
+        td.t {
+            color: var(--main-grey);
+            text-align: right;
+            white-space: nowrap;
+        }
+
+        th {
+            text-align: left;
+            color: var(--main-grey);
+            font-weight: normal;
+            padding: 4px 6px;
+        }
+
+        .ok { color: var(--main-green); }
+        .err { color: var(--main-red); }
+        .muted { color: var(--main-grey); }
+    </style>
+</head>
+<body>
+    <main>
+        <h1>Gate admin</h1>
+        <div class="row">
+            <input type="password" id="token" placeholder="Admin token" autocomplete="off">
+            <button id="save-token">Save</button>
+        </div>
+
+        <p id="server" class="hint"></p>
+
+        <h2>Trunk</h2>
+        <div class="row">
+            <div id="trunk" class="muted" style="flex: 1">—</div>
+            <button id="trunk-refresh">Check now</button>
+        </div>
+
+        <h2>Active calls</h2>
+        <p class="hint">Live. Hang up cancels a ringing call, or ends an answered one early.</p>
+        <table id="active-calls"></table>
+
+        <h2>Recent calls</h2>
+        <p class="hint">Calls that ended in the last 15 minutes.</p>
+        <table id="recent-calls"></table>
+
+        <h2>Approvals</h2>
+        <p class="hint">Calls waiting for approval before they dial, and those decided in the last 15 minutes.</p>
+        <table id="approvals"></table>
+
+        <h2>Schedules</h2>
+        <table id="schedules"></table>
+
+        <h2>Tokens</h2>
+        <table id="tokens"></table>
+
+        <h2>Test call</h2>
+        <p class="hint">Calls the configured test destination (not the gate) and shows what happened, step by step.</p>
+        <button id="test-call">Place test call</button>
+        <div id="summary"></div>
+        <table id="timeline"></table>
+
+        <h2>Manual dial</h2>
+        <p class="hint">Calls any number --dial-allow permits, e.g. the gate vendor's test line. Every attempt is audited.</p>
+        <div class="row">
+            <input type="tel" id="dial-number" placeholder="Number" autocomplete="off">
+            <input type="text" id="dial-duration" placeholder="Duration (e.g. 20s)" autocomplete="off">
+            <input type="text" id="dial-dtmf" placeholder="DTMF" autocomplete="off">
+        </div>
+        <div class="row" style="margin-top: 8px">
+            <input type="text" id="dial-reason" placeholder="Reason (for the audit log)" autocomplete="off">
+            <button id="dial">Dial</button>
+        </div>
+        <div id="dial-result" style="margin: 12px 0"></div>
+        <table id="dials"></table>
+    </main>
+
+    <script>
+        const TOKEN_KEY = 'admin_token';
+        const tokenInput = document.getElementById('token');
+        const btn = document.getElementById('test-call');
+        const summary = document.getElementById('summary');
+        const timeline = document.getElementById('timeline');
+
+        tokenInput.value = localStorage.getItem(TOKEN_KEY) || '';
+        document.getElementById('save-token').addEventListener('click', () => {
+            localStorage.setItem(TOKEN_KEY, tokenInput.value.trim());
+            refresh();
+            checkTrunk(false);
+        });
+
+        function api(path, method) {
+            return fetch(path, { method: method || 'GET', headers: { 'Authorization': 'Token ' + tokenInput.value.trim() } })
+                .then(res => res.json().then(body => res.ok ? body : Promise.reject(body)));
+        }
+
+        function time(s) {
+            return s ? new Date(s).toLocaleTimeString() : '';
+        }
+
+        // fill replaces table's rows: a header from cols, then one row per item. A
+        // column function may return a DOM node (e.g. a button) instead of text.
+        function fill(table, cols, items, empty) {
+            table.innerHTML = '';
+            if (!items.length) {
+                table.insertRow().insertCell().outerHTML = '<td class="muted">' + empty + '</td>';
+                return;
+            }
+            const head = table.insertRow();
+            cols.forEach(c => { head.appendChild(document.createElement('th')).textContent = c[0]; });
+            items.forEach(item => {
+                const tr = table.insertRow();
+                cols.forEach(c => {
+                    const v = c[1](item);
+                    const td = tr.insertCell();
+                    if (v instanceof Node) td.appendChild(v); else td.textContent = v;
+                });
+            });
+        }
+
+        const callCols = [
+            ['started', c => time(c.started_at)],
+            ['gate', c => c.gate],
+            ['by', c => c.source || ''],
+            ['status', c => c.status + (c.code ? ' [' + c.code + ']' : '')],
+            ['duration', c => (c.duration_ms / 1000).toFixed(1) + 's'],
+        ];
+
+        function hangupButton(c) {
+            const b = document.createElement('button');
+            b.textContent = 'Hang up';
+            b.style.color = 'var(--main-red)';
+            b.style.padding = '2px 8px';
+            b.onclick = () => {
+                b.disabled = true;
+                api('/api/admin/calls/' + c.id + '/hangup', 'POST')
+                    .catch(err => alert(err.error || String(err)))
+                    .finally(refreshCalls);
+            };
+            return b;
+        }
+
+        const activeCols = callCols.concat([['', hangupButton]]);
+
+        function decideButtons(a) {
+            const span = document.createElement('span');
+            if (a.state !== 'pending') {
+                span.textContent = a.state + (a.decided_by ? ' by ' + a.decided_by : '');
+                return span;
+            }
+            [['Approve', 'approve', 'var(--main-green)'], ['Deny', 'deny', 'var(--main-red)']].forEach(([label, action, color]) => {
+                const b = document.createElement('button');
+                b.textContent = label;
+                b.style.color = color;
+                b.style.padding = '2px 8px';
+                b.style.marginRight = '4px';
+                b.onclick = () => {
+                    span.querySelectorAll('button').forEach(x => x.disabled = true);
+                    api('/api/admin/approvals/' + a.id + '/' + action, 'POST')
+                        .catch(err => alert(err.error || String(err)))
+                        .finally(refresh);
+                };
+                span.appendChild(b);
+            });
+            return span;
+        }
+
+        function refreshCalls() {
+            api('/api/admin/calls').then(body => {
+                fill(document.getElementById('active-calls'), activeCols, body.calls, 'No calls in progress.');
+            }).catch(() => {});
+        }
+
+        function refreshDials() {
+            api('/api/admin/dials').then(body => {
+                document.getElementById('dial').disabled = !body.enabled;
+                fill(document.getElementById('dials'), [
+                    ['at', d => time(d.at)],
+                    ['event', d => d.event + (d.result ? ' ' + d.result : '') + (d.code ? ' [' + d.code + ']' : '')],
+                    ['number', d => d.number],
+                    ['by', d => d.by],
+                    ['reason', d => d.reason],
+                ], body.dials, body.enabled ? 'No manual dials yet.' : 'Disabled: set --dial-allow to enable manual dialing.');
+            }).catch(() => {});
+        }
+
+        function refresh() {
+            refreshDials();
+            api('/api/admin/overview').then(o => {
+                document.getElementById('server').textContent = 'Version ' + o.ui_version +
+                    ' (' + o.build.os + '/' + o.build.arch + (o.build.cgo ? ', cgo' : '') + ')' +
+                    ', up since ' + new Date(o.started_at).toLocaleString() + ', ' + o.idle.state;
+                fill(document.getElementById('active-calls'), activeCols, o.active_calls, 'No calls in progress.');
+                fill(document.getElementById('recent-calls'), callCols, o.recent_calls, 'None.');
+                fill(document.getElementById('approvals'), [
+                    ['asked', a => time(a.at)],
+                    ['gate', a => a.gate],
+                    ['by', a => a.who],
+                    ['why', a => a.reason],
+                    ['until', a => a.state === 'pending' ? time(a.expires) : ''],
+                    ['', decideButtons],
+                ], o.approvals, 'No requests.');
+                fill(document.getElementById('schedules'), [
+                    ['what', s => s.kind + ' ' + s.name],
+                    ['at', s => time(s.at)],
+                    ['status', s => s.status || 'pending'],
+                ], o.schedules, 'Nothing scheduled.');
+                fill(document.getElementById('tokens'), [
+                    ['token', t => t.name],
+                    ['grants', t => t.scope],
+                    ['', t => t.set ? 'set' : 'not set'],
+                ], o.tokens, '');
+            }).catch(err => {
+                document.getElementById('server').textContent = err.error ? err.error + ' [' + err.code + ']' : String(err);
+            });
+        }
+
+        function checkTrunk(force) {
+            const el = document.getElementById('trunk');
+            el.className = 'muted';
+            el.textContent = 'Checking…';
+            api('/api/admin/trunk' + (force ? '?refresh=1' : '')).then(t => {
+                el.className = t.ok ? 'ok' : 'err';
+                el.textContent = (t.ok ? 'Provider reachable, credentials accepted' : t.detail + ' [' + t.code + ']') +
+                    ' (' + t.latency_ms + 'ms, checked ' + time(t.checked_at) + ')';
+            }).catch(err => {
+                el.className = 'err';
+                el.textContent = err.error || String(err);
+            });
+        }
+
+        document.getElementById('trunk-refresh').addEventListener('click', () => checkTrunk(true));
+        refresh();
+        checkTrunk(false);
+        setInterval(refresh, 5000);
+        setInterval(refreshCalls, 1000);
+
+        function show(cls, text) {
+            summary.className = cls;
+            summary.textContent = text;
+        }
+
+        btn.addEventListener('click', async () => {
+            btn.disabled = true;
+            timeline.innerHTML = '';
+            show('', 'Calling… (this takes up to ~20s)');
+            try {
+                const res = await fetch('/api/admin/test-call', {
+                    method: 'POST',
+                    headers: { 'Authorization': 'Token ' + tokenInput.value.trim() },
+                });
+                const body = await res.json();
+                if (!res.ok) {
+                    show('err', body.error + ' [' + body.code + ']');
+                    return;
+                }
+                const verdict = body.answered ? 'answered' : 'not answered';
+                show(body.answered ? 'ok' : 'err',
+                    body.destination + ': ' + verdict + ', final status ' + body.status +
+                    (body.code ? ' [' + body.code + ']' : '') + ', ' + (body.duration_ms / 1000).toFixed(1) + 's');
+                body.timeline.forEach(e => {
+                    const tr = timeline.insertRow();
+                    const t = tr.insertCell();
+                    t.className = 't';
+                    t.textContent = '+' + e.t_ms + 'ms';
+                    tr.insertCell().textContent = e.event;
+                });
+            } catch (e) {
+                show('err', 'Request failed: ' + e);
+            } finally {
+                btn.disabled = false;
+                refresh();
+            }
+        });
+
+        document.getElementById('dial').addEventListener('click', async () => {
+            const b = document.getElementById('dial');
+            const result = document.getElementById('dial-result');
+            const field = id => document.getElementById(id).value.trim();
+            b.disabled = true;
+            try {
+                const res = await fetch('/api/admin/dial', {
+                    method: 'POST',
+                    headers: { 'Authorization': 'Token ' + tokenInput.value.trim(), 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ number: field('dial-number'), duration: field('dial-duration'), dtmf: field('dial-dtmf'), reason: field('dial-reason') }),
+                });
+                const body = await res.json();
+                result.className = res.ok ? 'ok' : 'err';
+                result.textContent = res.ok ? 'Dialling, call ' + body.id + ' (see Active calls)' : body.error + ' [' + body.code + ']';
+            } catch (e) {
+                result.className = 'err';
+                result.textContent = 'Request failed: ' + e;
+            } finally {
+                b.disabled = false;
+                refresh();
+            }
+        });
+    </script>
+</body>
+</html>
+`
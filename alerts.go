@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// `iftach alerts generate` prints Prometheus alerting rules for the metrics GET
+// /metrics exposes, to drop into a rule_files entry as is: the trunk being down,
+// too many calls failing, and the monthly budget running out. The rules follow the
+// configuration they are generated with: the trunk is watched through the --register
+// registration and the --sip-keepalive OPTIONS where those are on, and the budget
+// alerts fire at --budget-soft and --budget-hard. The metric names come from the
+// metrics themselves, so a rule can't name one the server doesn't have.
+
+// AlertsCmd groups monitoring helpers.
+type AlertsCmd struct {
+	Generate AlertsGenerateCmd `kong:"cmd,help='Print Prometheus alerting rules for the exposed metrics'"`
+}
+
+// AlertsGenerateCmd writes the rules for the configuration it is given.
+type AlertsGenerateCmd struct {
+	Config `kong:"embed"`
+
+	Selector    string        `kong:"help='Label matchers picking this server out in Prometheus, added to every rule',default='job=\"iftach\"'"`
+	FailureRate float64       `kong:"help='Share of calls failing (busy aside) over --failure-window that alerts',default='0.5'"`
+	FailureMin  int           `kong:"help='Calls over --failure-window below which the failure rate alerts on nothing',default='3'"`
+	Window      time.Duration `kong:"name='failure-window',help='Window the failure rate is measured over',default='1h'"`
+	TrunkFor    time.Duration `kong:"help='How long the trunk must look down before alerting',default='5m'"`
+	Out         string        `kong:"help='Write the rules to this file instead of stdout'"`
+}
+
+// alertRule is one Prometheus alerting rule.
+type alertRule struct {
+	name, expr, severity string
+	hold                 time.Duration // the rule's for: (0 = none)
+	summary, description string
+}
+
+func (c *AlertsGenerateCmd) Run() error {
+	if c.FailureRate <= 0 || c.FailureRate > 1 {
+		return fmt.Errorf("--failure-rate must be above 0 and at most 1")
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("--failure-window must be positive")
+	}
+	var w io.Writer = os.Stdout
+	if c.Out != "" {
+		f, err := os.Create(c.Out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	rules, notes := c.rules()
+	var b strings.Builder
+	b.WriteString("# Prometheus alerting rules for iftach, from `iftach alerts generate`.\n")
+	for _, n := range notes {
+		fmt.Fprintf(&b, "# %s\n", n)
+	}
+	b.WriteString("groups:\n  - name: iftach\n    rules:\n")
+	for _, r := range rules {
+		fmt.Fprintf(&b, "      - alert: %s\n        expr: %s\n", r.name, yamlString(r.expr))
+		if r.hold > 0 {
+			fmt.Fprintf(&b, "        for: %s\n", promDuration(r.hold))
+		}
+		fmt.Fprintf(&b, "        labels:\n          severity: %s\n", r.severity)
+		fmt.Fprintf(&b, "        annotations:\n          summary: %s\n          description: %s\n", yamlString(r.summary), yamlString(r.description))
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+	if c.Out != "" {
+		fmt.Fprintf(os.Stderr, "✅ Alerting rules written to %s (%d)\n", c.Out, len(rules))
+	}
+	return nil
+}
+
+// rules are the alerting rules for c, and notes on what it leaves out.
+func (c *AlertsGenerateCmd) rules() (rules []alertRule, notes []string) {
+	trunk := strings.TrimSpace("the SIP trunk " + c.SipDomain)
+	if c.Register {
+		rules = append(rules, alertRule{
+			name: "IftachTrunkUnregistered", severity: "critical", hold: c.TrunkFor,
+			expr:        fmt.Sprintf("%s == 0", c.sel(sipRegistered)),
+			summary:     "iftach is not registered with " + trunk,
+			description: "The --register registration has not been current for {{ $labels.instance }} for " + promDuration(c.TrunkFor) + "; calls will fail until it is.",
+		})
+	}
+	if c.SipReuse && c.SipKeepalive > 0 {
+		window := promDuration(max(c.TrunkFor, 2*c.SipKeepalive))
+		rules = append(rules, alertRule{
+			name: "IftachTrunkUnreachable", severity: "critical", hold: c.TrunkFor,
+			expr: fmt.Sprintf("increase(%s[%s]) > 0 unless ignoring(result) increase(%s[%s]) > 0",
+				c.sel(sipKeepalives, "result", "failed"), window, c.sel(sipKeepalives, "result", "ok"), window),
+			summary:     "No answer from " + trunk,
+			description: "No --sip-keepalive OPTIONS from {{ $labels.instance }} has been answered in " + window + ".",
+		})
+	}
+	if !c.Register && (!c.SipReuse || c.SipKeepalive == 0) {
+		notes = append(notes, "Without --register or --sip-keepalive nothing watches the trunk between calls: only IftachCallFailureRateHigh tells it is down.")
+	}
+
+	window := promDuration(c.Window)
+	all := fmt.Sprintf("sum without(gate, trigger, result) (increase(%s[%s]))", c.sel(callsTotal), window)
+	rules = append(rules, alertRule{
+		name: "IftachCallFailureRateHigh", severity: "warning",
+		expr: fmt.Sprintf("sum without(gate, trigger, result) (increase(%s[%s])) / %s > %g and %s >= %d",
+			c.sel(callsTotal, "result", "failed"), window, all, c.FailureRate, all, c.FailureMin),
+		summary:     "Gate calls are failing",
+		description: fmt.Sprintf("{{ $value | humanizePercentage }} of the calls {{ $labels.instance }} placed in the last %s failed (busy aside).", window),
+	})
+
+	if c.BudgetSoft > 0 {
+		rules = append(rules, alertRule{
+			name: "IftachBudgetSoft", severity: "warning",
+			expr:        fmt.Sprintf("%s >= %d", c.sel(budgetCalls), c.BudgetSoft),
+			summary:     "The monthly call budget is nearly used",
+			description: fmt.Sprintf("{{ $labels.instance }} placed {{ $value }} calls this month, past --budget-soft (%d).", c.BudgetSoft),
+		})
+	}
+	if c.BudgetHard > 0 {
+		rules = append(rules, alertRule{
+			name: "IftachBudgetExceeded", severity: "critical",
+			expr:        fmt.Sprintf("%s >= %d", c.sel(budgetCalls), c.BudgetHard),
+			summary:     "The monthly call budget is used up",
+			description: fmt.Sprintf("{{ $labels.instance }} placed {{ $value }} calls this month, reaching --budget-hard (%d): calls fail with E_BUDGET until an admin acknowledges it or the month ends.", c.BudgetHard),
+		})
+	}
+	if c.BudgetSoft == 0 && c.BudgetHard == 0 {
+		notes = append(notes, "No --budget-soft or --budget-hard: no budget alerts.")
+	}
+	return rules, notes
+}
+
+// sel is m selected by --selector and the given label name/value pairs.
+func (c *AlertsGenerateCmd) sel(m *metricFamily, labels ...string) string {
+	var matchers []string
+	if c.Selector != "" {
+		matchers = append(matchers, c.Selector)
+	}
+	for i := 0; i+1 < len(labels); i += 2 {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	if len(matchers) == 0 {
+		return m.name
+	}
+	return m.name + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// promDuration is d as Prometheus writes durations, e.g. 1h30m or 45s.
+func promDuration(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// yamlString quotes s for YAML: a JSON string is a YAML double-quoted one.
+func yamlString(s string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false) // keep PromQL's > and < readable
+	_ = enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
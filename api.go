@@ -0,0 +1,215 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Milestones a POST /api/call client can block on (?wait=).
+const (
+	waitAccepted  = "accepted"  // return as soon as the call is started
+	waitAnswered  = "answered"  // return on 200 OK (or when the call ends without one)
+	waitCompleted = "completed" // return when the call is over
+)
+
+type apiError struct {
+	Code  errorCode `json:"code"`
+	Error string    `json:"error"`
+}
+
+// writeAPIError sends {"code": ..., "error": ...} with the text in the request's
+// language (see i18n.go). key selects a catalog detail, formatted with args; ""
+// uses the code's own message. Every 401 is also an audit record (audit.go).
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, code errorCode, key string, args ...any) {
+	if status == http.StatusUnauthorized {
+		auditRequest(r, auditAuthFailed, code, key)
+	}
+	lang := negotiateLang(r)
+	if key == "" {
+		key = string(code)
+	}
+	w.Header().Set("Content-Language", lang)
+	writeJSON(w, status, apiError{Code: code, Error: localize(lang, key, args...)})
+}
+
+type callResponse struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"started_at"`
+	Status    string    `json:"status"`
+	Code      errorCode `json:"code,omitempty"`
+	Answered  bool      `json:"answered"`
+	Done      bool      `json:"done"`
+}
+
+func newCallResponse(s *callSession) callResponse {
+	last := s.Status()
+	return callResponse{
+		ID:        s.ID,
+		StartedAt: displayTime(s.StartedAt),
+		Status:    last.Status,
+		Code:      last.Code,
+		Answered:  s.Answered(),
+		Done:      s.Done(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// handleAPICall is POST /api/call?wait=accepted|answered|completed[&timeout=30s].
+// It starts a call and blocks until the requested milestone, the call ending, or the
+// timeout — whichever comes first. 200 means the call reached the milestone or ended;
+// 202 means it is still in progress (wait=accepted, or the timeout hit).
+//
+// An Idempotency-Key header makes retries safe: repeating a key within
+// --idempotency-ttl, with the same token and gate, returns the original call
+// (Idempotent-Replayed: true) instead of dialing again. Repeated with another
+// dry_run or callback_url, it is refused with 422.
+//
+// With ?callback_url=, the final result is also POSTed there once the call is over,
+// retried with backoff until the target accepts it.
+//
+// ?gate=NAME opens that --gates gate instead of the --destination one.
+//
+// ?dry_run=1 walks through the statuses without placing a real call.
+//
+// Clients that don't block (or whose wait timed out) poll GET /api/call/{id} with
+// the returned id instead.
+func handleAPICall(w http.ResponseWriter, r *http.Request) {
+	token, ok := callAuth(r)
+	if !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+
+	wait := r.URL.Query().Get("wait")
+	if wait == "" {
+		wait = waitAccepted
+	}
+	if wait != waitAccepted && wait != waitAnswered && wait != waitCompleted {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "wait_invalid")
+		return
+	}
+	timeout := cli.ApiWaitTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "timeout_invalid")
+			return
+		}
+		timeout = min(d, cli.ApiWaitTimeout)
+	}
+	callbackURL := r.URL.Query().Get("callback_url")
+	if callbackURL != "" {
+		if err := validateCallbackURL(callbackURL); err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "callback_url_invalid")
+			return
+		}
+	}
+
+	gate := r.URL.Query().Get("gate")
+	cfg, ok := cli.forGate(gate)
+	if !ok {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "gate_unknown", gate)
+		return
+	}
+	if !token.allows(gate) {
+		writeAPIError(w, r, http.StatusForbidden, errForbidden, "gate_forbidden", cmp.Or(gate, defaultGate))
+		return
+	}
+
+	opts := callOptions{DryRun: r.URL.Query().Get("dry_run") == "1", Gate: gate, Source: callSource("api", r), User: token.user(), Duress: token.underDuress(), Trace: requestTrace(r)}
+	if opts.DryRun {
+		token = nil // a dry run doesn't use up a one-time token
+	}
+	if !tokens.claim(token) {
+		writeAPIError(w, r, http.StatusConflict, errTokenUsed, "token_in_use")
+		return
+	}
+	params := fmt.Sprintf("dry_run=%t callback_url=%s", opts.DryRun, callbackURL)
+	s, reused, err := sessions.StartOnce(&cfg, opts, r.Header.Get("Idempotency-Key"), params, cli.IdempotencyTTL)
+	if err != nil {
+		tokens.settle(token, nil)
+		writeAPIError(w, r, http.StatusUnprocessableEntity, errBadRequest, "idempotency_key_reused")
+		return
+	}
+	if reused {
+		tokens.settle(token, nil)
+	} else {
+		tokens.settle(token, s)
+	}
+	if reused {
+		w.Header().Set("Idempotent-Replayed", "true")
+	} else if callbackURL != "" {
+		callbacks.Enqueue(callbackURL, s)
+	}
+	if wait == waitAccepted {
+		writeJSON(w, http.StatusAccepted, newCallResponse(s))
+		return
+	}
+
+	var milestone <-chan struct{} = s.done
+	if wait == waitAnswered {
+		milestone = s.answered
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-milestone:
+	case <-s.done:
+	case <-timer.C:
+		writeJSON(w, http.StatusAccepted, newCallResponse(s))
+		return
+	case <-r.Context().Done():
+		// Client went away; the call carries on regardless.
+		return
+	}
+	writeJSON(w, http.StatusOK, newCallResponse(s))
+}
+
+// handleAPICallGet is GET /api/call/{id}: the call as POST /api/call returned it,
+// now. done tells a poller to stop; a call finished more than sessionRetention ago
+// is 404.
+func handleAPICallGet(w http.ResponseWriter, r *http.Request) {
+	token, ok := callAuth(r)
+	if !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	s, ok := sessions.Get(chi.URLParam(r, "id"))
+	if !ok || !token.allows(s.Gate) {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, newCallResponse(s))
+}
+
+// handleGates is GET /api/gates: the gates a call may open, the --destination one
+// (named default) first, for the UI's buttons. A named token sees only its gates.
+func handleGates(w http.ResponseWriter, r *http.Request) {
+	token, ok := callAuth(r)
+	if !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	type gate struct {
+		Name string `json:"name"`
+	}
+	gates := []gate{}
+	for _, name := range append([]string{defaultGate}, slices.Sorted(maps.Keys(cli.Gates))...) {
+		if token.allows(name) {
+			gates = append(gates, gate{name})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"gates": gates})
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Some calls wait for someone to approve them before they dial: every call of a
+// named token created with "approval": true (a cleaner's, say), every call during
+// --approval-windows (at night), and every --visitor request. Such a call starts
+// as usual but sits in approval_wait until an admin approves it on the
+// dashboard (or POST /api/admin/approvals/{id}/approve), a resident does from the
+// --visitor link, or it is denied or nobody answers within --approval-wait; the
+// last two fail it with E_NOT_APPROVED, without dialing. Its caller follows it like
+// any call, and it lands in the history whichever way it went. A caller that goes
+// away (a WebSocket page closed, a hangup) withdraws its request.
+//
+// Admin calls and auto-closes never wait, nor do dry runs.
+
+const (
+	maxPendingApprovals = 20
+	approvalKeep        = 15 * time.Minute // how long a decided request is still listed
+)
+
+// Approval states.
+const (
+	approvalPending   = "pending"
+	approvalApproved  = "approved"
+	approvalDenied    = "denied"
+	approvalExpired   = "expired"
+	approvalWithdrawn = "withdrawn"
+)
+
+// notifyApprovalRequest is the notification event of a call waiting for approval.
+const notifyApprovalRequest = "approval_request"
+
+var approvalsTotal = newCounter("iftach_approvals_total", "Calls that waited for approval, by result (approved, denied, expired, withdrawn, refused).")
+
+// approval is a call's request to be approved.
+type approval struct {
+	ID        string    `json:"id"`
+	CallID    string    `json:"call_id"`
+	Gate      string    `json:"gate"`
+	Who       string    `json:"who"`    // the token, visitor or trigger asking
+	Reason    string    `json:"reason"` // why it needs approval
+	At        time.Time `json:"at"`
+	Expires   time.Time `json:"expires"`
+	State     string    `json:"state"`
+	DecidedBy string    `json:"decided_by,omitempty"`
+
+	user string // the named call token asking, for the audit log; "" if none
+	wait time.Duration
+	done chan struct{} // closed once it is no longer pending
+}
+
+// approvalDesk holds the pending and recently decided requests.
+type approvalDesk struct {
+	mu       sync.Mutex
+	requests map[string]*approval
+}
+
+var approvals = &approvalDesk{requests: map[string]*approval{}}
+
+// approvalWindow is one of --approval-windows, as minutes into the day; end may be
+// before start for a window across midnight.
+type approvalWindow struct{ start, end int }
+
+// parseApprovalWindow parses HH:MM-HH:MM.
+func parseApprovalWindow(s string) (approvalWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return approvalWindow{}, fmt.Errorf("%q is not HH:MM-HH:MM", s)
+	}
+	var w approvalWindow
+	for i, hm := range []string{from, to} {
+		t, err := time.Parse("15:04", strings.TrimSpace(hm))
+		if err != nil {
+			return approvalWindow{}, fmt.Errorf("%q is not HH:MM-HH:MM", s)
+		}
+		m := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			w.start = m
+		} else {
+			w.end = m
+		}
+	}
+	if w.start == w.end {
+		return approvalWindow{}, fmt.Errorf("%q is empty", s)
+	}
+	return w, nil
+}
+
+// contains reports whether t (in --timezone) falls in w.
+func (w approvalWindow) contains(t time.Time) bool {
+	t = displayTime(t)
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// approvalFor returns the approval a call with opts must wait for, nil if none.
+func approvalFor(opts callOptions) *approval {
+	if opts.Approval != nil {
+		return opts.Approval
+	}
+	if opts.DryRun || opts.Admin || opts.Close || opts.Intercom != nil {
+		return nil
+	}
+	who := cmp.Or(opts.User, opts.Source)
+	if tokens != nil && opts.User != "" {
+		tokens.mu.Lock()
+		t := tokens.tokens[opts.User]
+		needs := t != nil && t.Approval
+		tokens.mu.Unlock()
+		if needs {
+			return &approval{Who: who, Reason: "token " + opts.User + " needs approval", user: opts.User, wait: cli.ApprovalWait}
+		}
+	}
+	for _, s := range cli.ApprovalWindows {
+		if w, err := parseApprovalWindow(s); err == nil && w.contains(time.Now()) {
+			return &approval{Who: who, Reason: "during " + s, user: opts.User, wait: cli.ApprovalWait}
+		}
+	}
+	return nil
+}
+
+// submit files a as call s's request. It is refused (false) while
+// maxPendingApprovals others wait.
+func (d *approvalDesk) submit(a *approval, s *callSession) bool {
+	now := time.Now().UTC()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, old := range d.requests {
+		if old.State != approvalPending && now.Sub(old.Expires) > approvalKeep {
+			delete(d.requests, id)
+		}
+	}
+	pending := 0
+	for _, old := range d.requests {
+		if old.State == approvalPending {
+			pending++
+		}
+	}
+	a.ID, a.CallID, a.Gate = newSessionID(), s.ID, cmp.Or(s.Gate, defaultGate)
+	a.At, a.Expires, a.done = now, now.Add(a.wait), make(chan struct{})
+	if pending >= maxPendingApprovals {
+		a.State = approvalDenied
+		close(a.done)
+		return false
+	}
+	a.State = approvalPending
+	d.requests[a.ID] = a
+	time.AfterFunc(a.wait, func() { d.settle(a, approvalExpired, "") })
+	return true
+}
+
+// settle ends a pending request in state. It reports false if it was no longer
+// pending.
+func (d *approvalDesk) settle(a *approval, state, by string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if a.State != approvalPending {
+		return false
+	}
+	a.State, a.DecidedBy = state, by
+	if state != approvalExpired && state != approvalWithdrawn {
+		a.Expires = time.Now().UTC() // for approvalKeep
+	}
+	close(a.done)
+	return true
+}
+
+// get returns request id and a copy of it as it stands.
+func (d *approvalDesk) get(id string) (*approval, approval, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	a, ok := d.requests[id]
+	if !ok {
+		return nil, approval{}, false
+	}
+	return a, a.view(), true
+}
+
+// view is a copy of a with its times in --timezone. The desk's lock is held.
+func (a *approval) view() approval {
+	v := *a
+	v.At, v.Expires = displayTime(a.At), displayTime(a.Expires)
+	v.done = nil
+	return v
+}
+
+// List returns the requests, pending ones first, then newest first.
+func (d *approvalDesk) List() []approval {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]approval, 0, len(d.requests))
+	for _, a := range d.requests {
+		list = append(list, a.view())
+	}
+	slices.SortFunc(list, func(a, b approval) int {
+		if (a.State == approvalPending) != (b.State == approvalPending) {
+			if a.State == approvalPending {
+				return -1
+			}
+			return 1
+		}
+		return b.At.Compare(a.At)
+	})
+	return list
+}
+
+// runAfterApproval waits for the call's approval, then places it (budget
+// permitting), or fails it with E_NOT_APPROVED. filed is what submit returned.
+func runAfterApproval(ctx context.Context, cfg *Config, opts callOptions, filed bool, statusChan chan<- callStatusMsg) {
+	a := opts.Approval
+	log := callLog(ctx)
+	if !filed {
+		defer close(statusChan)
+		approvalsTotal.inc("result", "refused")
+		log.Failure(errNotApproved, "Not dialing: %d calls are already waiting for approval", maxPendingApprovals)
+		statusChan <- callStatusMsg{Status: statusError, Code: errNotApproved}
+		return
+	}
+	log.Printf("Waiting up to %v for approval (%s)\n", a.wait, a.Reason)
+	statusChan <- callStatusMsg{Status: statusApprovalWait}
+	if notifications != nil && opts.Source != "" && sourceKind(opts.Source) != "visit" { // the visitor page notifies its own way
+		notifications.send(notification{
+			Event: notifyApprovalRequest, Gate: a.Gate, Since: displayTime(a.At), CallID: a.CallID,
+			Text: fmt.Sprintf("%s wants to open %s (%s): approve it on the admin dashboard", a.Who, a.Gate, a.Reason),
+		})
+	}
+	select {
+	case <-a.done:
+	case <-ctx.Done():
+		if approvals.settle(a, approvalWithdrawn, "") {
+			approvalsTotal.inc("result", approvalWithdrawn)
+		}
+		close(statusChan)
+		return
+	}
+	approvalsTotal.inc("result", a.State)
+	switch a.State {
+	case approvalApproved:
+		log.Printf("Approved by %s\n", a.DecidedBy)
+	case approvalDenied:
+		defer close(statusChan)
+		log.Failure(errNotApproved, "Not dialing: denied by %s", a.DecidedBy)
+		statusChan <- callStatusMsg{Status: statusError, Code: errNotApproved}
+		return
+	default:
+		defer close(statusChan)
+		log.Failure(errNotApproved, "Not dialing: nobody approved the call within %v", a.wait)
+		statusChan <- callStatusMsg{Status: statusError, Code: errNotApproved}
+		return
+	}
+	if !cluster.active() {
+		runStandby(ctx, statusChan)
+		return
+	}
+	if !budget.admit(opts.Admin) {
+		runOverBudget(ctx, statusChan)
+		return
+	}
+	runFailover(ctx, cfg, opts, statusChan)
+}
+
+// handleApprovals is GET /api/admin/approvals.
+func handleApprovals(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"approvals": approvals.List()})
+}
+
+// handleApprovalDecide is POST /api/admin/approvals/{id}/approve and .../deny. 409
+// once the request is no longer pending.
+func handleApprovalDecide(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, _, ok := approvals.get(chi.URLParam(r, "id"))
+		if !ok {
+			writeAPIError(w, r, http.StatusNotFound, errNotFound, "")
+			return
+		}
+		if state, ok := decideApproval(r, a, approve, callSource("admin", r)); !ok {
+			writeAPIError(w, r, http.StatusConflict, errBadRequest, "approval_decided", state)
+			return
+		}
+		_, v, _ := approvals.get(a.ID)
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+// decideApproval approves or denies a for request r, by by, with the log line and
+// audit record. ok is false if a was no longer pending; state is where it stands.
+func decideApproval(r *http.Request, a *approval, approve bool, by string) (state string, ok bool) {
+	state, event := approvalDenied, auditApprovalDenied
+	if approve {
+		state, event = approvalApproved, auditApprovalApproved
+	}
+	if !approvals.settle(a, state, by) {
+		_, v, _ := approvals.get(a.ID)
+		return v.State, false
+	}
+	loggerFor(a.CallID).Printf("Call %s by %s\n", state, by)
+	auditUserRequest(r, event, a.user, fmt.Sprintf("%s: %s (%s), after %v", a.CallID, a.Who, a.Reason, time.Since(a.At).Round(time.Second)))
+	return state, true
+}
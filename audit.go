@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log records what happened to the server's access rather than its
+// calls (those are in calls.jsonl): every request refused for its token (a 401, or
+// a WebSocket close 4001/4005), every named token created, revoked, deactivated,
+// activated or anonymized, admin rights
+// delegated and what the delegates changed (see delegate.go), and the
+// configuration each run started with (which settings, from where; a restart is
+// how the configuration is reloaded). Each record has the requester's address and
+// user agent, and is appended to audit.jsonl in --data-dir; the latest
+// maxAuditRecords are also kept in memory for GET /api/admin/audit.
+
+const maxAuditRecords = 1000
+
+// Audit events.
+const (
+	auditAuthFailed       = "auth_failed"
+	auditTokenCreated     = "token_created"
+	auditTokenRevoked     = "token_revoked"
+	auditTokenDeactivated = "token_deactivated"
+	auditTokenActivated   = "token_activated"
+	auditTokenAnonymized  = "token_anonymized"
+	auditConfigLoaded     = "config_loaded"
+	auditBudgetAcked      = "budget_acknowledged"
+	auditVisitRequested   = "visit_requested"
+	auditApprovalApproved = "approval_approved"
+	auditApprovalDenied   = "approval_denied"
+
+	auditDelegationCreated = "delegation_created"
+	auditDelegationRevoked = "delegation_revoked"
+	auditDelegationExpired = "delegation_expired"
+	auditDelegateRequest   = "delegate_request" // a change made with a delegated admin token
+	auditDuress            = "duress"           // a --duress-token call raised the alarm
+)
+
+// auditRecord is one audit log entry.
+type auditRecord struct {
+	At           time.Time `json:"at"` // UTC
+	Event        string    `json:"event"`
+	Code         errorCode `json:"code,omitempty"`    // auth_failed: why
+	Request      string    `json:"request,omitempty"` // method and path, e.g. "POST /api/call"
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"` // X-Forwarded-For, set by a reverse proxy
+	UserAgent    string    `json:"user_agent,omitempty"`
+	Delegate     string    `json:"delegate,omitempty"` // the delegated admin who made the request
+	User         string    `json:"user,omitempty"`     // the named call token the record is about
+	Detail       string    `json:"detail,omitempty"`
+}
+
+var auditLog = &auditStore{}
+
+type auditStore struct {
+	mu      sync.Mutex
+	path    string
+	records []auditRecord // oldest first
+}
+
+// load reads path (audit.jsonl) into memory, skipping lines that don't parse.
+func (a *auditStore) load(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.path, a.records = path, nil
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load audit log: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec auditRecord
+		if json.Unmarshal(sc.Bytes(), &rec) == nil && rec.Event != "" {
+			a.records = append(a.records, rec)
+		}
+	}
+	if n := len(a.records); n > maxAuditRecords {
+		a.records = slices.Delete(a.records, 0, n-maxAuditRecords)
+	}
+	return sc.Err()
+}
+
+// add records rec, stamped with the time.
+func (a *auditStore) add(rec auditRecord) {
+	rec.At = time.Now().UTC()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records = append(a.records, rec)
+	if n := len(a.records); n > maxAuditRecords {
+		a.records = slices.Delete(a.records, 0, n-maxAuditRecords)
+	}
+	if a.path == "" {
+		return
+	}
+	line, _ := json.Marshal(rec)
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		err = cmp.Or(err, f.Close())
+	}
+	if err != nil {
+		logWarn("Could not write the audit record: %v\n", err)
+	}
+}
+
+// auditRequest records event for request r.
+func auditRequest(r *http.Request, event string, code errorCode, detail string) {
+	auditLog.add(requestRecord(r, event, code, "", detail))
+}
+
+// auditUserRequest records event, about named call token user, for request r.
+func auditUserRequest(r *http.Request, event, user, detail string) {
+	auditLog.add(requestRecord(r, event, "", user, detail))
+}
+
+func requestRecord(r *http.Request, event string, code errorCode, user, detail string) auditRecord {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return auditRecord{
+		Event:        event,
+		Code:         code,
+		Request:      r.Method + " " + r.URL.Path,
+		RemoteAddr:   host,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		UserAgent:    r.UserAgent(),
+		Delegate:     delegateOf(r),
+		User:         user,
+		Detail:       detail,
+	}
+}
+
+// rewriteUser replaces named call token from with to in the records about it,
+// their requests and details included, in memory and in audit.jsonl. It returns how many
+// records changed: in the file, or in memory without one.
+func (a *auditStore) rewriteUser(from, to string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	changed := 0
+	for i := range a.records {
+		if a.records[i].User == from {
+			a.records[i].anonymize(from, to)
+			changed++
+		}
+	}
+	if a.path == "" {
+		return changed, nil
+	}
+	return rewriteLines(a.path, func(line []byte) ([]byte, bool) {
+		var rec auditRecord
+		if json.Unmarshal(line, &rec) != nil || rec.User != from {
+			return nil, false
+		}
+		rec.anonymize(from, to)
+		b, _ := json.Marshal(rec)
+		return b, true
+	})
+}
+
+// anonymize replaces named call token from with to in rec.
+func (rec *auditRecord) anonymize(from, to string) {
+	rec.User, rec.Request, rec.Detail = to, replaceName(rec.Request, from, to), replaceName(rec.Detail, from, to)
+}
+
+// replaceName replaces name in s with to where it stands as a name of its own, not
+// as part of a longer one (or of a call ID).
+func replaceName(s, name, to string) string {
+	re := regexp.MustCompile(`(^|[^a-z0-9_-])` + regexp.QuoteMeta(name) + `($|[^a-z0-9_-])`)
+	for re.MatchString(s) { // again for names only a separator apart
+		s = re.ReplaceAllString(s, "${1}"+to+"${2}")
+	}
+	return s
+}
+
+// auditConfig records the settings this run started with: their names and where
+// each came from, never their values.
+func auditConfig(settings []configSetting) {
+	var parts []string
+	for _, st := range settings {
+		if st.Source != sourceDefault {
+			parts = append(parts, fmt.Sprintf("%s (%s)", st.Name, st.Source))
+		}
+	}
+	auditLog.add(auditRecord{Event: auditConfigLoaded, Detail: configFile + ": " + strings.Join(parts, ", ")})
+}
+
+// handleAudit is GET /api/admin/audit: the latest audit records, newest first,
+// filtered by ?event= and at most ?limit= of them (default 100).
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	event := r.URL.Query().Get("event")
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditRecords {
+			writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "history_limit_invalid", maxAuditRecords)
+			return
+		}
+		limit = n
+	}
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	records := []auditRecord{}
+	for _, rec := range slices.Backward(auditLog.records) {
+		if len(records) == limit {
+			break
+		}
+		if event == "" || rec.Event == event {
+			rec.At = displayTime(rec.At)
+			records = append(records, rec)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"records": records})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// pendingClose is a scheduled auto-close call for one gate.
+type pendingClose struct {
+	Gate string    `json:"gate"`
+	At   time.Time `json:"at"` // UTC
+}
+
+// autoCloser is the dead-man switch for gates that need a second call to shut
+// (--auto-close): every answered open of such a gate (re)schedules a call to its
+// close number --auto-close-after later, unless cancelled in the meantime. Pending
+// closes are persisted to path (if set), and any that fell due while the server was
+// down are placed right after startup, so a restart never leaves a gate open.
+type autoCloser struct {
+	path string
+
+	mu      sync.Mutex
+	pending map[string]*pendingClose // keyed by gate name
+	timers  map[string]*time.Timer
+}
+
+var autoClose *autoCloser
+
+func newAutoCloser(path string) (*autoCloser, error) {
+	a := &autoCloser{path: path, pending: map[string]*pendingClose{}, timers: map[string]*time.Timer{}}
+	if path != "" {
+		if err := loadJSON(path, &a.pending); err != nil {
+			return nil, fmt.Errorf("load auto-closes: %w", err)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for gate, p := range a.pending {
+		if _, ok := cli.AutoClose[gate]; !ok {
+			delete(a.pending, gate) // no longer configured
+			continue
+		}
+		logInfo("Resuming auto-close of %s at %s.\n", gate, displayTime(p.At).Format(time.TimeOnly))
+		a.armLocked(gate, time.Until(p.At))
+	}
+	a.persistLocked()
+	return a, nil
+}
+
+// Schedule (re)starts gate's auto-close countdown after an answered open. Gates
+// without a close number are ignored.
+func (a *autoCloser) Schedule(gate string) {
+	if gate == "" {
+		gate = defaultGate
+	}
+	if _, ok := cli.AutoClose[gate]; !ok {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[gate] = &pendingClose{Gate: gate, At: time.Now().UTC().Add(cli.AutoCloseAfter)}
+	a.armLocked(gate, cli.AutoCloseAfter)
+	a.persistLocked()
+	logInfo("%s will auto-close in %v.\n", gate, cli.AutoCloseAfter)
+}
+
+// Cancel drops gate's pending close, reporting whether there was one.
+func (a *autoCloser) Cancel(gate string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.pending[gate]; !ok {
+		return false
+	}
+	a.timers[gate].Stop()
+	delete(a.timers, gate)
+	delete(a.pending, gate)
+	a.persistLocked()
+	logInfo("Auto-close of %s cancelled.\n", gate)
+	return true
+}
+
+// Pending returns the scheduled closes, soonest first.
+func (a *autoCloser) Pending() []pendingClose {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := []pendingClose{}
+	for _, p := range a.pending {
+		list = append(list, *p)
+	}
+	slices.SortFunc(list, func(x, y pendingClose) int { return x.At.Compare(y.At) })
+	return list
+}
+
+func (a *autoCloser) armLocked(gate string, d time.Duration) {
+	if t, ok := a.timers[gate]; ok {
+		t.Stop()
+	}
+	a.timers[gate] = time.AfterFunc(max(d, 0), func() { a.fire(gate) })
+}
+
+// fire places the close call. A close that isn't answered is only logged: the
+// gate may still be open, and retrying blindly could re-open a gate that toggles.
+func (a *autoCloser) fire(gate string) {
+	a.mu.Lock()
+	if _, ok := a.pending[gate]; !ok {
+		a.mu.Unlock()
+		return // cancelled while the timer was firing
+	}
+	delete(a.pending, gate)
+	delete(a.timers, gate)
+	a.persistLocked()
+	a.mu.Unlock()
+
+	cfg, _ := cli.forGate(gate)
+	cfg.Destination = cli.AutoClose[gate]
+	s := sessions.Start(&cfg, callOptions{Gate: gate, Close: true, Source: "auto-close"})
+	s.log.Printf("Auto-closing %s\n", gate)
+	go func() {
+		<-s.done
+		if !s.Answered() {
+			s.log.Errorf("Auto-close call for %s was not answered — the gate may still be open.\n", gate)
+		}
+	}()
+}
+
+func (a *autoCloser) persistLocked() {
+	if a.path == "" {
+		return
+	}
+	if err := saveJSON(a.path, a.pending); err != nil {
+		logWarn("Could not persist auto-closes: %v\n", err)
+	}
+}
+
+// handleAutoClose is GET /api/autoclose: the pending closes, each with the seconds
+// left so the UI can count down without trusting its own clock.
+func handleAutoClose(w http.ResponseWriter, r *http.Request) {
+	if _, ok := callAuth(r); !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	type entry struct {
+		Gate        string    `json:"gate"`
+		At          time.Time `json:"at"`
+		SecondsLeft int       `json:"seconds_left"`
+	}
+	list := []entry{}
+	for _, p := range autoClose.Pending() {
+		list = append(list, entry{p.Gate, displayTime(p.At), int(max(time.Until(p.At), 0).Seconds())})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"pending": list})
+}
+
+// handleAutoCloseCancel is DELETE /api/autoclose/{gate}.
+func handleAutoCloseCancel(w http.ResponseWriter, r *http.Request) {
+	token, ok := callAuth(r)
+	if !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	gate := chi.URLParam(r, "gate")
+	if !token.allows(gate) {
+		writeAPIError(w, r, http.StatusForbidden, errForbidden, "gate_forbidden", gate)
+		return
+	}
+	if !autoClose.Cancel(gate) {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "autoclose_not_pending", gate)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultGate is the name of the --destination gate in --gates lookups and batches.
+const defaultGate = "default"
+
+// gateName matches names usable in --gates (and in URLs and metrics later on).
+var gateName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// gateNumber resolves a gate name to the number to dial. "" is the default gate.
+func (c *Config) gateNumber(name string) (string, bool) {
+	if name == "" || name == defaultGate {
+		return c.Destination, true
+	}
+	n, ok := c.Gates[name]
+	return n, ok
+}
+
+// gateDurations is a duration per gate name, for --gate-duration.
+type gateDurations map[string]time.Duration
+
+// forGate returns the configuration a call opening gate runs with: the gate's
+// number as Destination, and its --gate-outgoing, --gate-duration and
+// --gate-ring-only where given. ok is false for an unknown gate.
+func (c *Config) forGate(gate string) (cfg Config, ok bool) {
+	cfg = *c
+	if cfg.Destination, ok = c.gateNumber(gate); !ok {
+		return cfg, false
+	}
+	name := cmp.Or(gate, defaultGate)
+	if n, ok := c.GateOutgoing[name]; ok {
+		cfg.OutgoingNumber = n
+	}
+	if d, ok := c.GateDuration[name]; ok {
+		cfg.CallDuration = d
+	}
+	if d, ok := c.GateRingOnly[name]; ok {
+		cfg.RingOnly = d
+	}
+	return cfg, true
+}
+
+// Limits on a single batch, so one request can't tie the line up for hours.
+const (
+	maxBatchSteps = 20
+	maxBatchWait  = 10 * time.Minute
+)
+
+// dtmfDigits matches what a DTMF step may key in (see sendDTMF).
+var dtmfDigits = regexp.MustCompile(`^[0-9*#A-D]{1,32}$`)
+
+// batchStep is one step of a batch or macro: open a gate (optionally keying in
+// DTMF once it answers), pause, or POST to a webhook. Exactly one of Gate, Wait
+// and Webhook is set.
+type batchStep struct {
+	Gate    string `json:"gate,omitempty"`
+	DTMF    string `json:"dtmf,omitempty"`
+	Wait    string `json:"wait,omitempty"`    // duration, e.g. "20s"
+	Webhook string `json:"webhook,omitempty"` // gets {"job_id","macro","step"}; must answer 2xx
+
+	wait time.Duration
+}
+
+// Batch job and event statuses, on top of the call statuses relayed from each step.
+const (
+	batchRunning       = "running"
+	batchWaiting       = "waiting"
+	batchWebhook       = "webhook"
+	batchWebhookFailed = "webhook_failed"
+	batchStepDone      = "step_done"
+	batchCompleted     = "completed"
+	batchFailed        = "failed"
+)
+
+// batchEvent is one entry of a job's combined status stream. Call statuses carry
+// the step's gate and call ID; waiting marks a pause and webhook a POST; every
+// step that succeeds ends with step_done; the last event is the job's
+// completed/failed.
+type batchEvent struct {
+	At      time.Time `json:"at"`
+	Step    int       `json:"step"`
+	Gate    string    `json:"gate,omitempty"`
+	CallID  string    `json:"call_id,omitempty"`
+	Status  string    `json:"status"`
+	Code    errorCode `json:"code,omitempty"`
+	Wait    string    `json:"wait,omitempty"`
+	Webhook string    `json:"webhook,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// batchJob runs its steps in order: every call must be answered before the next
+// step starts, and the first one that isn't fails the job.
+type batchJob struct {
+	ID        string
+	Macro     string    // set when the job runs a configured macro
+	StartedAt time.Time // UTC
+
+	mu        sync.Mutex
+	status    string
+	events    []batchEvent
+	listeners []chan batchEvent
+	done      chan struct{}
+}
+
+type batchResponse struct {
+	ID        string       `json:"id"`
+	Macro     string       `json:"macro,omitempty"`
+	StartedAt time.Time    `json:"started_at"`
+	Status    string       `json:"status"`
+	Events    []batchEvent `json:"events"`
+}
+
+func (j *batchJob) snapshot() batchResponse {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	events := make([]batchEvent, len(j.events))
+	for i, e := range j.events {
+		e.At = displayTime(e.At)
+		events[i] = e
+	}
+	return batchResponse{ID: j.ID, Macro: j.Macro, StartedAt: displayTime(j.StartedAt), Status: j.status, Events: events}
+}
+
+// Subscribe replays the events so far and then follows the job; closed when it ends.
+func (j *batchJob) Subscribe() <-chan batchEvent {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ch := make(chan batchEvent, len(j.events)+64)
+	for _, e := range j.events {
+		ch <- e
+	}
+	select {
+	case <-j.done:
+		close(ch)
+	default:
+		j.listeners = append(j.listeners, ch)
+	}
+	return ch
+}
+
+func (j *batchJob) publish(e batchEvent) {
+	e.At = time.Now().UTC()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.events = append(j.events, e)
+	for _, ch := range j.listeners {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (j *batchJob) finish(status string, step int) {
+	j.publish(batchEvent{Step: step, Status: status})
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = status
+	close(j.done)
+	for _, ch := range j.listeners {
+		close(ch)
+	}
+	j.listeners = nil
+}
+
+func (j *batchJob) run(cfg Config, steps []batchStep, opts callOptions) {
+	logInfo("Batch %s: %d steps\n", j.ID, len(steps))
+	for i, st := range steps {
+		switch {
+		case st.Wait != "":
+			j.publish(batchEvent{Step: i, Status: batchWaiting, Wait: st.Wait})
+			time.Sleep(st.wait)
+		case st.Webhook != "":
+			j.publish(batchEvent{Step: i, Status: batchWebhook, Webhook: st.Webhook})
+			if opts.DryRun {
+				break
+			}
+			if err := j.postWebhook(st.Webhook, i, opts.Trace); err != nil {
+				logWarn("Batch %s failed at step %d (webhook %s: %v)\n", j.ID, i, st.Webhook, err)
+				j.publish(batchEvent{Step: i, Status: batchWebhookFailed, Webhook: st.Webhook, Error: err.Error()})
+				j.finish(batchFailed, i)
+				return
+			}
+		default:
+			stepCfg, _ := cfg.forGate(st.Gate)
+			stepOpts := opts
+			stepOpts.DTMF, stepOpts.Gate = st.DTMF, st.Gate
+			stepOpts.Source = "batch " + j.ID
+			if j.Macro != "" {
+				stepOpts.Source = "macro " + j.Macro
+			}
+			s := sessions.Start(&stepCfg, stepOpts)
+			s.log.Printf("Batch %s step %d: opening %s\n", j.ID, i, st.Gate)
+			for msg := range s.Subscribe() {
+				j.publish(batchEvent{Step: i, Gate: st.Gate, CallID: s.ID, Status: msg.Status, Code: msg.Code})
+			}
+			if !s.Answered() {
+				logWarn("Batch %s failed at step %d (%s not answered)\n", j.ID, i, st.Gate)
+				j.finish(batchFailed, i)
+				return
+			}
+		}
+		j.publish(batchEvent{Step: i, Status: batchStepDone})
+	}
+	logInfo("Batch %s completed\n", j.ID)
+	j.finish(batchCompleted, len(steps)-1)
+}
+
+// webhookClient posts webhook steps. A step fails on any non-2xx answer; there are
+// no retries, since later steps shouldn't run on a half-done scene.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (j *batchJob) postWebhook(url string, step int, trace traceParent) error {
+	body, err := json.Marshal(map[string]any{"job_id": j.ID, "macro": j.Macro, "step": step})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	trace.child().setHeader(req.Header)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+var batchJobs = struct {
+	mu   sync.Mutex
+	jobs map[string]*batchJob
+}{jobs: map[string]*batchJob{}}
+
+func startBatch(cfg Config, macro string, steps []batchStep, opts callOptions) *batchJob {
+	j := &batchJob{ID: newSessionID(), Macro: macro, StartedAt: time.Now().UTC(), status: batchRunning, done: make(chan struct{})}
+	batchJobs.mu.Lock()
+	batchJobs.jobs[j.ID] = j
+	batchJobs.mu.Unlock()
+	go func() {
+		j.run(cfg, steps, opts)
+		time.AfterFunc(sessionRetention, func() {
+			batchJobs.mu.Lock()
+			delete(batchJobs.jobs, j.ID)
+			batchJobs.mu.Unlock()
+		})
+	}()
+	return j
+}
+
+// parseBatchSteps validates steps against cfg's gates and the batch limits.
+func parseBatchSteps(cfg *Config, steps []batchStep) error {
+	if len(steps) == 0 || len(steps) > maxBatchSteps {
+		return fmt.Errorf("steps must have 1 to %d entries", maxBatchSteps)
+	}
+	actions := 0
+	for i := range steps {
+		st := &steps[i]
+		set := 0
+		for _, f := range []string{st.Gate, st.Wait, st.Webhook} {
+			if f != "" {
+				set++
+			}
+		}
+		switch {
+		case set != 1:
+			return fmt.Errorf("step %d: set exactly one of gate, wait or webhook", i)
+		case st.DTMF != "" && st.Gate == "":
+			return fmt.Errorf("step %d: dtmf goes with a gate step", i)
+		case st.Gate != "":
+			if _, ok := cfg.gateNumber(st.Gate); !ok {
+				return fmt.Errorf("step %d: unknown gate %q", i, st.Gate)
+			}
+			if st.DTMF != "" && !dtmfDigits.MatchString(st.DTMF) {
+				return fmt.Errorf("step %d: dtmf must be up to 32 of 0-9 * # A-D", i)
+			}
+			actions++
+		case st.Webhook != "":
+			if err := validateCallbackURL(st.Webhook); err != nil {
+				return fmt.Errorf("step %d: webhook must be an absolute http(s) URL", i)
+			}
+			actions++
+		default:
+			d, err := time.ParseDuration(st.Wait)
+			if err != nil || d <= 0 || d > maxBatchWait {
+				return fmt.Errorf("step %d: wait must be a duration up to %v", i, maxBatchWait)
+			}
+			st.wait = d
+		}
+	}
+	if actions == 0 {
+		return fmt.Errorf("steps must open a gate or call a webhook")
+	}
+	return nil
+}
+
+// handleBatch is POST /api/batch with {"steps": [{"gate": "outer"}, {"wait": "20s"},
+// {"gate": "inner"}]}. It starts the job and returns 202 with its ID; GET
+// /api/batch/{id} polls it. With ?stream=1 the response is instead the job's
+// combined event stream as NDJSON, ending with the completed/failed event.
+// ?dry_run=1 applies to every call in the job.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	token, ok := callAuth(r)
+	if !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	var req struct {
+		Steps []batchStep `json:"steps"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16384)).Decode(&req); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+		return
+	}
+	if err := parseBatchSteps(&cli, req.Steps); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "batch_invalid", err)
+		return
+	}
+	if token != nil && token.OneTime {
+		writeAPIError(w, r, http.StatusForbidden, errForbidden, "token_one_time")
+		return
+	}
+	if gate, ok := token.allowsSteps(req.Steps); !ok {
+		writeAPIError(w, r, http.StatusForbidden, errForbidden, "gate_forbidden", gate)
+		return
+	}
+
+	opts := callOptions{DryRun: r.URL.Query().Get("dry_run") == "1", User: token.user(), Duress: token.underDuress(), Trace: requestTrace(r)}
+	serveBatch(w, r, startBatch(cli, "", req.Steps, opts))
+}
+
+// serveBatch answers a request that started j: 202 with its snapshot, or with
+// ?stream=1 the job's combined event stream as NDJSON.
+func serveBatch(w http.ResponseWriter, r *http.Request, j *batchJob) {
+	if r.URL.Query().Get("stream") != "1" {
+		writeJSON(w, http.StatusAccepted, j.snapshot())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Batch-ID", j.ID)
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	for e := range j.Subscribe() {
+		e.At = displayTime(e.At)
+		if enc.Encode(e) != nil {
+			return // client went away; the job carries on
+		}
+		_ = rc.Flush()
+	}
+}
+
+// handleBatchGet is GET /api/batch/{id}.
+func handleBatchGet(w http.ResponseWriter, r *http.Request) {
+	if _, ok := callAuth(r); !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	batchJobs.mu.Lock()
+	j, ok := batchJobs.jobs[chi.URLParam(r, "id")]
+	batchJobs.mu.Unlock()
+	if !ok {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, j.snapshot())
+}
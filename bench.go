@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// BenchCmd load-tests a running server's HTTP/WebSocket layer. Every call is made with
+// ?dry_run=1, so the server walks through the statuses without any SIP traffic.
+type BenchCmd struct {
+	URL         string        `kong:"arg,help='Server base URL, e.g. http://127.0.0.1:8080'"`
+	Token       string        `kong:"help='Call token',env='IFTACH_CALL_TOKEN'"`
+	Concurrency int           `kong:"short='c',help='Concurrent WebSocket clients',default='10'"`
+	Requests    int           `kong:"short='n',help='Total calls to make',default='100'"`
+	Timeout     time.Duration `kong:"help='Per-call timeout',default='30s'"`
+}
+
+// benchResult is the outcome of one dry-run call.
+type benchResult struct {
+	connect time.Duration // dial + WebSocket handshake
+	first   time.Duration // until the first status message
+	total   time.Duration // until the server closed the socket
+	err     error
+}
+
+func (c *BenchCmd) Run() error {
+	if c.Concurrency < 1 || c.Requests < 1 {
+		return errors.New("--concurrency and --requests must be at least 1")
+	}
+	wsURL, err := benchWebSocketURL(c.URL, c.Token)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("🏋️  %d dry-run calls, %d concurrent, against %s\n", c.Requests, c.Concurrency, c.URL)
+	jobs := make(chan struct{})
+	results := make(chan benchResult, c.Requests)
+	var wg sync.WaitGroup
+	started := time.Now()
+	for range c.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				results <- c.call(wsURL)
+			}
+		}()
+	}
+	for range c.Requests {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+	elapsed := time.Since(started)
+
+	var connect, first, total []time.Duration
+	failures := map[string]int{}
+	for r := range results {
+		if r.err != nil {
+			failures[r.err.Error()]++
+			continue
+		}
+		connect = append(connect, r.connect)
+		first = append(first, r.first)
+		total = append(total, r.total)
+	}
+
+	ok := len(total)
+	fmt.Printf("\nCompleted in %v — %.1f calls/s, %d ok, %d failed (%.1f%% errors)\n",
+		elapsed.Round(time.Millisecond), float64(c.Requests)/elapsed.Seconds(),
+		ok, c.Requests-ok, 100*float64(c.Requests-ok)/float64(c.Requests))
+	if ok > 0 {
+		fmt.Printf("\n%-14s %10s %10s %10s %10s\n", "latency", "p50", "p90", "p99", "max")
+		printPercentiles("connect", connect)
+		printPercentiles("first status", first)
+		printPercentiles("full call", total)
+	}
+	if len(failures) > 0 {
+		fmt.Println("\nErrors:")
+		for msg, n := range failures {
+			fmt.Printf("  %5d × %s\n", n, msg)
+		}
+	}
+	return nil
+}
+
+// call places one dry-run call over the WebSocket and times it.
+func (c *BenchCmd) call(wsURL string) benchResult {
+	var res benchResult
+	start := time.Now()
+	dialer := websocket.Dialer{HandshakeTimeout: c.Timeout}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		res.err = fmt.Errorf("dial: %w", err)
+		return res
+	}
+	defer conn.Close()
+	res.connect = time.Since(start)
+	// Handshake like the UI does, so the server doesn't wait out helloWait.
+	if err := conn.WriteJSON(clientMessage{Type: "hello", UIVersion: "bench", Protocol: wsProtocol}); err != nil {
+		res.err = fmt.Errorf("hello: %w", err)
+		return res
+	}
+	_ = conn.SetReadDeadline(start.Add(c.Timeout))
+
+	for {
+		var msg callStatusMsg
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			var ce *websocket.CloseError
+			switch {
+			case errors.As(err, &ce) && ce.Code == 4001:
+				res.err = errors.New("wrong credentials (4001)")
+			case errors.As(err, &ce) || errors.Is(err, websocket.ErrCloseSent) || strings.Contains(err.Error(), "EOF"):
+				// Normal end of call.
+				if res.first == 0 {
+					res.err = errors.New("closed without any status")
+				}
+			default:
+				res.err = err
+			}
+			res.total = time.Since(start)
+			return res
+		}
+		if msg.Status == "" {
+			continue // hello reply
+		}
+		if res.first == 0 {
+			res.first = time.Since(start)
+		}
+		if msg.Status == statusError {
+			res.err = fmt.Errorf("status error (%s)", msg.Code)
+		}
+	}
+}
+
+// benchWebSocketURL turns http(s)://host[:port] into ws(s)://host[:port]/call?dry_run=1&token=...
+func benchWebSocketURL(base, token string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/call"
+	q := url.Values{"dry_run": {"1"}}
+	if token != "" {
+		q.Set("token", token)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func printPercentiles(label string, d []time.Duration) {
+	slices.Sort(d)
+	pct := func(p float64) time.Duration {
+		return d[min(len(d)-1, int(p*float64(len(d))))].Round(time.Microsecond * 100)
+	}
+	fmt.Printf("%-14s %10v %10v %10v %10v\n", label, pct(0.50), pct(0.90), pct(0.99), d[len(d)-1].Round(time.Microsecond*100))
+}
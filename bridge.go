@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// Bridged calls join two call legs instead of just ringing the gate. Unlike run(),
+// which never completes an offer/answer exchange, a bridge needs real dialogs, so
+// it uses sipgo's dialog layer: WaitAnswer handles digest auth and CANCEL, and the
+// far ends' BYEs are read by a server on the same user agent.
+
+// How a bridged call treats its legs, past what --bridge-ring, --bridge-cap
+// and --bridge-on-drop set.
+const (
+	bridgeRingTimeout = 30 * time.Second // legs not in --bridge-ring
+	bridgeMaxRedials  = 2                // per leg, for --bridge-on-drop redial
+)
+
+// --bridge-on-drop actions.
+const (
+	dropHangup = "hangup" // hang up the other leg too, ending the call
+	dropRedial = "redial" // call the dropped leg again while the other waits
+)
+
+// bridgeLegs are the legs --bridge-ring and --bridge-on-drop name: the phone (both
+// modes), the gate (ring-me) and the intercom (intercom mode).
+var bridgeLegs = []string{"phone", "gate", "intercom"}
+
+// legDurations is a duration per leg name, for --bridge-ring.
+type legDurations map[string]time.Duration
+
+// errBridgeCapped is the cause of a bridged call's context ending at --bridge-cap.
+var errBridgeCapped = errors.New("reached --bridge-cap")
+
+// bridgeStack is the SIP user agent of one bridged call, and where it reports the
+// progress of each of its legs.
+type bridgeStack struct {
+	cfg     *Config
+	ua      *sipgo.UserAgent
+	dialogs *sipgo.DialogClientCache
+	report  statusSink
+	trace   *callTrace
+	user    string // the named call token placing the call, for the SIP header templates
+}
+
+func newBridgeStack(cfg *Config, publicIP, user string, report statusSink, trace *callTrace) (*bridgeStack, error) {
+	ua, err := newSIPUA(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sipgo.NewClient(ua)
+	if err != nil {
+		ua.Close()
+		return nil, err
+	}
+	srv, err := sipgo.NewServer(ua)
+	if err != nil {
+		ua.Close()
+		return nil, err
+	}
+	contact := sip.ContactHeader{Address: cfg.sipContact(cfg.SipUser, publicIP)}
+	b := &bridgeStack{cfg: cfg, ua: ua, dialogs: sipgo.NewDialogClientCache(client, contact), report: report, trace: trace, user: user}
+	srv.OnBye(func(req *sip.Request, tx sip.ServerTransaction) {
+		if err := b.dialogs.ReadBye(req, tx); err != nil {
+			_ = tx.Respond(sip.NewResponseFromRequest(req, 481, "Call/Transaction Does Not Exist", nil))
+		}
+	})
+	sipUAsOpen.add(1)
+	return b, nil
+}
+
+func (b *bridgeStack) Close() {
+	b.ua.Close()
+	sipUAsOpen.add(-1)
+}
+
+// bridgeLeg is one call of a bridge.
+type bridgeLeg struct {
+	name   string // what the far end is, for logs and traces: "phone", "gate"
+	number string // after the dial plan
+	dialog *sipgo.DialogClientSession
+}
+
+// errLegUnanswered is dial's error when the leg rang out.
+var errLegUnanswered = errors.New("not answered")
+
+// dial INVITEs the leg with offer as its SDP (nil asks the far end to make the
+// offer, in its 200 OK) and waits for the answer for the leg's --bridge-ring. A leg
+// that doesn't answer in time is cancelled.
+func (b *bridgeStack) dial(ctx context.Context, leg *bridgeLeg, gate string, offer []byte) error {
+	err := b.invite(ctx, leg, gate, offer)
+	switch {
+	case err == nil:
+		b.report.leg(leg.name, statusLegUp, "")
+	case ctx.Err() == nil:
+		b.report.leg(leg.name, statusLegFailed, legErrorCode(err))
+	}
+	return err
+}
+
+func (b *bridgeStack) invite(ctx context.Context, leg *bridgeLeg, gate string, offer []byte) error {
+	cfg, trace := b.cfg, b.trace
+	log := callLog(ctx)
+	if err := registrar.failFast(cfg); err != nil {
+		return err
+	}
+	uri := cfg.sipURI(leg.number)
+	hdrs, err := cfg.renderSIPHeaders(sipTemplateData{Gate: gate, User: b.user, Account: cfg.SipUser, Destination: leg.number, Time: displayTime(time.Now())})
+	if err != nil {
+		return fmt.Errorf("SIP header template: %w", err)
+	}
+	from := &sip.FromHeader{Address: sip.Uri{User: hdrs.FromUser, Host: cfg.SipDomain}, Params: sip.NewParams()}
+	from.Params.Add("tag", sip.GenerateTagN(16))
+	headers := []sip.Header{from, &sip.ToHeader{Address: sip.Uri{User: leg.number, Host: cfg.SipDomain}, Params: sip.NewParams()}}
+	if hdrs.PAI != "" {
+		headers = append(headers, sip.NewHeader("P-Asserted-Identity", hdrs.PAI))
+	}
+	headers = append(headers, hdrs.Extra...)
+	if offer != nil {
+		headers = append(headers, sip.NewHeader("Content-Type", "application/sdp"))
+	}
+
+	ringCtx, cancel := context.WithTimeout(ctx, cfg.bridgeRing(leg.name))
+	defer cancel()
+	b.report.leg(leg.name, statusLegRinging, "")
+	log.Printf("Calling the %s, %s@%s (%s)...\n", leg.name, leg.number, cfg.SipDomain, transportName(cfg))
+	trace.add("INVITE %s sip:%s@%s (%s)", leg.name, leg.number, cfg.SipDomain, sdpNote(offer))
+	leg.dialog, err = b.dialogs.Invite(ringCtx, uri, offer, headers...)
+	if err != nil {
+		return err
+	}
+	err = leg.dialog.WaitAnswer(ringCtx, sipgo.AnswerOptions{
+		Username: cfg.SipUser,
+		Password: cfg.SipPass,
+		OnResponse: func(res *sip.Response) error {
+			log.Printf("%s: %d %s\n", leg.name, res.StatusCode, res.Reason)
+			trace.add("⬅ %s %d %s", leg.name, res.StatusCode, res.Reason)
+			return nil
+		},
+	})
+	if err != nil && ringCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return errLegUnanswered
+	}
+	return err
+}
+
+// dialFailed reports a leg that couldn't be brought up (what describes it in the
+// log), unless the call was stopped meanwhile: hung up by an admin, or capped.
+func (b *bridgeStack) dialFailed(ctx context.Context, what string, err error) {
+	if bridgeStopped(ctx) {
+		b.report.status(statusBridgeEnded)
+		return
+	}
+	code := legErrorCode(err)
+	callLog(ctx).Failure(code, "%s: %v", what, err)
+	b.report.fail(statusError, code)
+}
+
+// bridgeStopped reports whether the call's context is over, logging it if that is
+// --bridge-cap. (An admin's hangup is logged, and reported, by Hangup.)
+func bridgeStopped(ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	if context.Cause(ctx) == errBridgeCapped {
+		callLog(ctx).Printf("Bridged call %v — hanging up.\n", errBridgeCapped)
+	}
+	return true
+}
+
+// legErrorCode classifies a dial error for the call's status.
+func legErrorCode(err error) errorCode {
+	var res *sipgo.ErrDialogResponse
+	switch {
+	case errors.As(err, &res):
+		return sipErrorCode(res.Res)
+	case errors.Is(err, errLegUnanswered):
+		return errNoAnswer
+	default:
+		return errProviderDown
+	}
+}
+
+// ack confirms the leg's answer, carrying body as the SDP answer when the leg's
+// 200 OK made the offer (sipgo's own Ack sends no body).
+func (leg *bridgeLeg) ack(ctx context.Context, body []byte) error {
+	d := leg.dialog
+	if body == nil {
+		return d.Ack(ctx)
+	}
+	recipient := d.InviteRequest.Recipient
+	if c := d.InviteResponse.Contact(); c != nil {
+		recipient = c.Address
+	}
+	ack := sip.NewRequest(sip.ACK, *recipient.Clone())
+	sip.CopyHeaders("Route", d.InviteRequest, ack)
+	ack.AppendHeader(sip.HeaderClone(d.InviteRequest.From()))
+	ack.AppendHeader(sip.HeaderClone(d.InviteResponse.To()))
+	ack.AppendHeader(sip.HeaderClone(d.InviteRequest.CallID()))
+	ack.AppendHeader(&sip.CSeqHeader{SeqNo: d.InviteRequest.CSeq().SeqNo, MethodName: sip.ACK})
+	ack.AppendHeader(sip.HeaderClone(d.InviteRequest.Contact()))
+	ack.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+	ack.SetBody(body)
+	ack.SetTransport(d.InviteRequest.Transport())
+	ack.Laddr = d.InviteRequest.Laddr
+	return d.WriteAck(ctx, ack)
+}
+
+// hangup sends BYE on the leg if it is still up. It doesn't take the call's
+// context, which is usually what has just been cancelled.
+func (b *bridgeStack) hangup(leg *bridgeLeg) {
+	if leg.dialog == nil || leg.dialog.LoadState() == sip.DialogStateEnded {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = leg.dialog.Bye(ctx)
+	b.report.leg(leg.name, statusLegEnded, "")
+}
+
+// dropped reports the far end of a leg hanging up.
+func (b *bridgeStack) dropped(ctx context.Context, name string) {
+	callLog(ctx).Printf("The %s hung up.\n", name)
+	b.report.leg(name, statusLegDropped, "")
+}
+
+// ended is closed once the far end hangs up (or the dialog is otherwise over).
+func (leg *bridgeLeg) ended() <-chan struct{} {
+	return leg.dialog.Context().Done()
+}
+
+var sdpMediaPort = regexp.MustCompile(`(?m)^(m=[a-z]+ )[0-9]+`)
+
+// rejectOffer answers offer with every stream refused (port 0, RFC 3264 §6),
+// for an offer that must be answered in the ACK when there is nothing to bridge
+// it to; a BYE follows.
+func rejectOffer(offer []byte) []byte {
+	return sdpMediaPort.ReplaceAll(offer, []byte("${1}0"))
+}
+
+func hasSDP(body []byte) bool {
+	return len(bytes.TrimSpace(body)) > 0
+}
+
+func sdpNote(sdp []byte) string {
+	if !hasSDP(sdp) {
+		return "no SDP"
+	}
+	return "with SDP offer"
+}
+
+func (c *Config) bridgeRing(leg string) time.Duration {
+	return cmp.Or(c.BridgeRing[leg], bridgeRingTimeout)
+}
+
+// checkBridge reports --bridge-* problems for check().
+func (c *Config) checkBridge() []string {
+	var problems []string
+	if c.BridgeCap <= 0 {
+		problems = append(problems, "--bridge-cap must be positive")
+	}
+	for _, leg := range slices.Sorted(maps.Keys(c.BridgeRing)) {
+		switch d := c.BridgeRing[leg]; {
+		case leg != "phone" && leg != "gate":
+			problems = append(problems, fmt.Sprintf("--bridge-ring leg %q must be phone or gate", leg))
+		case d <= 0 || d >= c.BridgeCap:
+			problems = append(problems, fmt.Sprintf("--bridge-ring %s=%v must be positive and less than --bridge-cap", leg, d))
+		}
+	}
+	for _, leg := range slices.Sorted(maps.Keys(c.BridgeOnDrop)) {
+		switch action := c.BridgeOnDrop[leg]; {
+		case !slices.Contains(bridgeLegs, leg):
+			problems = append(problems, fmt.Sprintf("--bridge-on-drop leg %q must be one of %s", leg, strings.Join(bridgeLegs, ", ")))
+		case action != dropHangup && action != dropRedial:
+			problems = append(problems, fmt.Sprintf("--bridge-on-drop %s=%q must be %s or %s", leg, action, dropHangup, dropRedial))
+		case action == dropRedial && leg != "phone":
+			problems = append(problems, fmt.Sprintf("--bridge-on-drop %s=%s: only the phone of intercom calls can be redialled", leg, action))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --budget-soft and --budget-hard cap the calls placed in a calendar month (in
+// --timezone), against an automation gone wrong dialing the trunk hundreds of
+// times. Reaching the soft limit logs a warning and POSTs a budget_soft event to
+// --notify-url; reaching the hard limit does the same with budget_hard and fails
+// every further call with E_BUDGET, without dialing, until an admin acknowledges it
+// (POST /api/admin/budget/ack) or the month ends. Admin calls (a manual dial, a
+// test call) are counted but never held back. The count is kept in budget.json in
+// --data-dir, so a restart doesn't reset it.
+
+// Budget notification events.
+const (
+	notifyBudgetSoft = "budget_soft"
+	notifyBudgetHard = "budget_hard"
+)
+
+var budgetCalls = newGaugeFunc("iftach_budget_calls", "Calls placed this month, as --budget-soft and --budget-hard count them.",
+	func() float64 {
+		budget.mu.Lock()
+		defer budget.mu.Unlock()
+		if budget.state.Month != budgetMonth(time.Now()) {
+			return 0
+		}
+		return float64(budget.state.Calls)
+	})
+
+// budgetState is this month's usage, as saved in budget.json.
+type budgetState struct {
+	Month        string    `json:"month"` // e.g. 2026-10
+	Calls        int       `json:"calls"`
+	SoftSent     bool      `json:"soft_sent,omitempty"`
+	HardSent     bool      `json:"hard_sent,omitempty"`
+	Acknowledged time.Time `json:"acknowledged,omitzero"` // UTC; the hard limit no longer blocks
+	AckedBy      string    `json:"acked_by,omitempty"`
+}
+
+type budgetKeeper struct {
+	mu    sync.Mutex
+	path  string
+	soft  int // 0 = none
+	hard  int
+	state budgetState
+}
+
+var budget = &budgetKeeper{}
+
+// load reads path (budget.json), keeping the limits to enforce.
+func (b *budgetKeeper) load(path string, soft, hard int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.path, b.soft, b.hard, b.state = path, soft, hard, budgetState{}
+	if path == "" {
+		return nil
+	}
+	if err := loadJSON(path, &b.state); err != nil {
+		return fmt.Errorf("load budget: %w", err)
+	}
+	return nil
+}
+
+func budgetMonth(t time.Time) string {
+	return displayTime(t).Format("2006-01")
+}
+
+// admit counts a call about to be placed, or reports that the hard limit holds it
+// back. admin calls are always admitted.
+func (b *budgetKeeper) admit(admin bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.soft == 0 && b.hard == 0 {
+		return true
+	}
+	if month := budgetMonth(time.Now()); b.state.Month != month {
+		b.state = budgetState{Month: month}
+	}
+	if !admin && b.blockedLocked() {
+		return false
+	}
+	b.state.Calls++
+	switch {
+	case b.hard > 0 && b.state.Calls >= b.hard && !b.state.HardSent:
+		b.state.HardSent, b.state.SoftSent = true, true
+		b.alertLocked(notifyBudgetHard, fmt.Sprintf("%d calls this month reached the hard limit of %d: calls are blocked until an admin acknowledges it", b.state.Calls, b.hard))
+	case b.soft > 0 && b.state.Calls >= b.soft && !b.state.SoftSent:
+		b.state.SoftSent = true
+		b.alertLocked(notifyBudgetSoft, fmt.Sprintf("%d calls this month reached the soft limit of %d", b.state.Calls, b.soft))
+	}
+	b.saveLocked()
+	return true
+}
+
+// blockedLocked reports whether the hard limit holds non-admin calls back.
+func (b *budgetKeeper) blockedLocked() bool {
+	return b.hard > 0 && b.state.Calls >= b.hard && b.state.Acknowledged.IsZero()
+}
+
+func (b *budgetKeeper) alertLocked(event, text string) {
+	logWarn("Call budget: %s\n", text)
+	if notifications != nil {
+		notifications.send(notification{Event: event, Since: displayTime(time.Now()), Text: "call budget: " + text})
+	}
+}
+
+func (b *budgetKeeper) saveLocked() {
+	if b.path == "" {
+		return
+	}
+	if err := saveJSON(b.path, b.state); err != nil {
+		logWarn("Saving the call budget: %v\n", err)
+	}
+}
+
+// budgetStatus is GET /api/admin/budget.
+type budgetStatus struct {
+	Month        string    `json:"month"`
+	Calls        int       `json:"calls"`
+	Soft         int       `json:"soft,omitempty"`
+	Hard         int       `json:"hard,omitempty"`
+	Blocked      bool      `json:"blocked"`
+	Acknowledged time.Time `json:"acknowledged,omitzero"`
+	AckedBy      string    `json:"acked_by,omitempty"`
+}
+
+func (b *budgetKeeper) status() budgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := budgetStatus{Month: budgetMonth(time.Now()), Soft: b.soft, Hard: b.hard}
+	if b.state.Month == st.Month {
+		st.Calls, st.Blocked, st.AckedBy = b.state.Calls, b.blockedLocked(), b.state.AckedBy
+		if !b.state.Acknowledged.IsZero() {
+			st.Acknowledged = displayTime(b.state.Acknowledged)
+		}
+	}
+	return st
+}
+
+// handleBudget is GET /api/admin/budget: this month's calls against the limits.
+func handleBudget(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, budget.status())
+}
+
+// handleBudgetAck is POST /api/admin/budget/ack: lift the hard limit's block for
+// the rest of the month. 409 if nothing is blocked.
+func handleBudgetAck(w http.ResponseWriter, r *http.Request) {
+	budget.mu.Lock()
+	if !budget.blockedLocked() || budget.state.Month != budgetMonth(time.Now()) {
+		budget.mu.Unlock()
+		writeAPIError(w, r, http.StatusConflict, errBadRequest, "budget_not_blocked")
+		return
+	}
+	by := callSource("admin", r)
+	budget.state.Acknowledged, budget.state.AckedBy = time.Now().UTC(), by
+	budget.saveLocked()
+	calls := budget.state.Calls
+	budget.mu.Unlock()
+	logInfo("Call budget acknowledged by %s after %d calls: calls are allowed again this month\n", by, calls)
+	auditRequest(r, auditBudgetAcked, "", fmt.Sprintf("%d calls", calls))
+	writeJSON(w, http.StatusOK, budget.status())
+}
+
+// runOverBudget is the call the hard limit holds back: it fails at once with
+// E_BUDGET, without dialing.
+func runOverBudget(ctx context.Context, statusChan chan<- callStatusMsg) {
+	defer close(statusChan)
+	callLog(ctx).Failure(errBudget, "Not dialing: this month's calls reached --budget-hard (an admin can acknowledge it)")
+	statusChan <- callStatusMsg{Status: statusError, Code: errBudget}
+}
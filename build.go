@@ -0,0 +1,29 @@
+package main
+
+import "runtime"
+
+// Iftach stays pure Go: it ships as one static binary (the Docker image builds it
+// with CGO_ENABLED=0) to ARM boards and MIPS routers that have no C toolchain or
+// libc to link against. TLS and the digest auth come from crypto/*, state under
+// --data-dir is JSON files, and --media's G.711 is encoded in media.go, so nothing
+// needs cgo today. A feature that can only be had through cgo (a SQLite driver,
+// an audio codec library) goes behind a cgo build constraint with a pure-Go
+// implementation in a !cgo file next to it, as cgo.go and nocgo.go do for
+// cgoBuild, so a CGO_ENABLED=0 build keeps the full feature set:
+//
+//	CGO_ENABLED=0 GOOS=linux GOARCH=mipsle GOMIPS=softfloat go build .
+//
+// make check builds and vets it that way too (make nocgo on its own), so a change
+// that only compiles with cgo fails there rather than in the release build.
+
+// buildInfo is how the running binary was built, shown on the admin dashboard.
+type buildInfo struct {
+	Go   string `json:"go"`
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	Cgo  bool   `json:"cgo"`
+}
+
+func currentBuild() buildInfo {
+	return buildInfo{Go: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH, Cgo: cgoBuild}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Callback retry policy: exponential backoff from callbackBaseDelay, capped at
+// callbackMaxDelay, giving up after callbackMaxAttempts.
+const (
+	callbackBaseDelay   = 5 * time.Second
+	callbackMaxDelay    = time.Hour
+	callbackMaxAttempts = 12
+)
+
+// pendingCallback is a final call result still to be POSTed to its callback URL.
+type pendingCallback struct {
+	URL      string       `json:"url"`
+	Payload  callResponse `json:"payload"`
+	Attempts int          `json:"attempts"`
+	NextAt   time.Time    `json:"next_at"`               // UTC
+	Trace    string       `json:"traceparent,omitempty"` // sent as the traceparent header
+}
+
+// callbackDispatcher delivers call results to callback URLs, retrying with backoff.
+// Undelivered callbacks are persisted to path (if set) and resumed after a restart.
+type callbackDispatcher struct {
+	path   string
+	client *http.Client
+	wake   chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]*pendingCallback // keyed by call ID
+}
+
+var callbacks *callbackDispatcher
+
+func newCallbackDispatcher(path string) (*callbackDispatcher, error) {
+	d := &callbackDispatcher{
+		path:    path,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		wake:    make(chan struct{}, 1),
+		pending: map[string]*pendingCallback{},
+	}
+	if path != "" {
+		if err := loadJSON(path, &d.pending); err != nil {
+			return nil, fmt.Errorf("load callbacks: %w", err)
+		}
+	}
+	if n := len(d.pending); n > 0 {
+		logInfo("Resuming %d undelivered callback(s).\n", n)
+	}
+	return d, nil
+}
+
+// validateCallbackURL accepts only absolute http(s) URLs.
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+// Enqueue schedules delivery of the final result of s to callbackURL once the call is over.
+func (d *callbackDispatcher) Enqueue(callbackURL string, s *callSession) {
+	go func() {
+		<-s.done
+		d.mu.Lock()
+		d.pending[s.ID] = &pendingCallback{URL: callbackURL, Payload: newCallResponse(s), NextAt: time.Now().UTC(), Trace: s.Trace.child().String()}
+		d.persistLocked()
+		d.mu.Unlock()
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// Run delivers due callbacks until ctx is cancelled.
+func (d *callbackDispatcher) Run(ctx context.Context) {
+	for {
+		wait := d.deliverDue(ctx)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue attempts every callback whose NextAt has passed and returns how long
+// to sleep until the next one is due.
+func (d *callbackDispatcher) deliverDue(ctx context.Context) time.Duration {
+	d.mu.Lock()
+	now := time.Now().UTC()
+	var due []string
+	for id, cb := range d.pending {
+		if !cb.NextAt.After(now) {
+			due = append(due, id)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, id := range due {
+		d.mu.Lock()
+		cb := *d.pending[id]
+		d.mu.Unlock()
+
+		err := d.post(ctx, cb)
+
+		d.mu.Lock()
+		switch {
+		case err == nil:
+			loggerFor(id).Printf("Callback delivered to %s.\n", cb.URL)
+			delete(d.pending, id)
+		case cb.Attempts+1 >= callbackMaxAttempts:
+			loggerFor(id).Errorf("Callback to %s failed %d times — giving up: %v\n", cb.URL, cb.Attempts+1, err)
+			delete(d.pending, id)
+		default:
+			p := d.pending[id]
+			p.Attempts++
+			delay := callbackBackoff(p.Attempts)
+			p.NextAt = time.Now().UTC().Add(delay)
+			loggerFor(id).Warnf("Callback to %s failed (attempt %d): %v — retrying in %v.\n", cb.URL, p.Attempts, err, delay.Round(time.Second))
+		}
+		d.persistLocked()
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	next := callbackMaxDelay
+	for _, cb := range d.pending {
+		next = min(next, time.Until(cb.NextAt))
+	}
+	return max(next, time.Second)
+}
+
+func (d *callbackDispatcher) post(ctx context.Context, cb pendingCallback) error {
+	body, err := json.Marshal(cb.Payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cb.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(callIDHeader, cb.Payload.ID)
+	if cb.Trace != "" {
+		req.Header.Set("traceparent", cb.Trace)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// callbackBackoff is the delay before retry number attempt (1-based), with ±20% jitter
+// so a batch of failed callbacks doesn't hammer a recovering target in lockstep.
+func callbackBackoff(attempt int) time.Duration {
+	delay := callbackMaxDelay
+	if attempt < 20 {
+		delay = min(callbackBaseDelay<<(attempt-1), callbackMaxDelay)
+	}
+	jitter := 0.8 + 0.4*rand.Float64()
+	return time.Duration(float64(delay) * jitter)
+}
+
+func (d *callbackDispatcher) persistLocked() {
+	if d.path == "" {
+		return
+	}
+	if err := saveJSON(d.path, d.pending); err != nil {
+		logWarn("Could not persist callbacks: %v\n", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+// callJS is the /call WebSocket client, served as /ui/call.js so every page that
+// places calls shares one implementation of the handshake, status stream and
+// reconnects. Pages load it with ?v=uiVersion, so an upgrade never pairs a new
+// page with a cached older script.
+//
+// A socket that drops mid-call (phone switching networks, a proxy restart) is
+// reconnected with jittered exponential backoff and resumes the same call via
+// /call?resume=ID: the server replays its statuses so far and follows it live.
+// Reconnects never place a second call; a socket that drops before the server
+// told us the call ID only retries if it never opened, i.e. no call was started.
+const callJS = `// Iftach /call client. Exposes window.IftachCall.
+(function () {
+    'use strict';
+
+    // /call message protocol this script understands (wsProtocol in ws.go).
+    const PROTOCOL = 6;
+    const BACKOFF_BASE_MS = 500;
+    const BACKOFF_MAX_MS = 10000;
+    const MAX_RETRIES = 6;
+
+    const FAILURES = ['error', 'watchdog_killed', 'hung_up', 'client_left', 'cancelled'];
+
+    function isFailure(status) {
+        return FAILURES.indexOf(status) >= 0;
+    }
+
+    // Equal jitter: half the exponential delay, plus up to as much again at random,
+    // so a gateful of phones that lost Wi-Fi together don't reconnect in lockstep.
+    function backoff(attempt) {
+        const d = Math.min(BACKOFF_MAX_MS, BACKOFF_BASE_MS * Math.pow(2, attempt));
+        return d / 2 + Math.random() * d / 2;
+    }
+
+    // placeCall starts a call. opts:
+    //   token, uiVersion  sent to the server
+    //   gate              --gates gate to open ('' or unset for the default one)
+    //   onOpen()                      connected, call placed (or resumed)
+    //   onStatus(msg)                 a status message {status, code}
+    //   onUpgrade()                   server speaks a newer protocol: reload
+    //   onReconnecting(attempt, ms)   socket dropped, retrying in ms
+    //   onEnd(result)                 'done', 'error', 'auth', 'upgrade' or 'lost'
+    // onEnd is called exactly once. It returns {cancel()}, which hangs the call up
+    // (its last status is then cancelled).
+    function placeCall(opts) {
+        let callId = null;
+        let attempt = 0;
+        let ended = false;
+        let socket = null;
+
+        function end(result) {
+            if (ended) return;
+            ended = true;
+            if (opts.onEnd) opts.onEnd(result);
+        }
+
+        function url() {
+            let u = (location.protocol === 'https:' ? 'wss:' : 'ws:') + '//' + location.host + '/call';
+            if (opts.gate) u += '/' + encodeURIComponent(opts.gate);
+            const q = [];
+            if (opts.token) q.push('token=' + encodeURIComponent(opts.token));
+            if (callId) q.push('resume=' + encodeURIComponent(callId));
+            return q.length ? u + '?' + q.join('&') : u;
+        }
+
+        function connect() {
+            const ws = new WebSocket(url());
+            socket = ws;
+            let opened = false;
+
+            ws.onopen = function () {
+                opened = true;
+                attempt = 0;
+                ws.send(JSON.stringify({ type: 'hello', ui_version: opts.uiVersion, protocol: PROTOCOL }));
+                if (opts.onOpen) opts.onOpen();
+            };
+
+            ws.onmessage = function (ev) {
+                let msg;
+                try {
+                    msg = JSON.parse(ev.data);
+                } catch (e) {
+                    return;
+                }
+                if (msg.type === 'hello') return;
+                if (msg.type === 'call') {
+                    callId = msg.call_id;
+                    return;
+                }
+                if (msg.type === 'upgrade_required') {
+                    if (opts.onUpgrade) opts.onUpgrade();
+                    end('upgrade');
+                    return;
+                }
+                if (opts.onStatus) opts.onStatus(msg);
+                if (isFailure(msg.status)) {
+                    end('error');
+                    ws.close();
+                }
+            };
+
+            ws.onclose = function (ev) {
+                if (ended) return;
+                switch (ev.code) {
+                case 1000:
+                    end('done');
+                    return;
+                case 4001:
+                    end('auth');
+                    return;
+                case 4002:
+                    end('upgrade');
+                    return;
+                case 4003: // a named token that may not open the gate
+                    end('forbidden');
+                    return;
+                case 4005: // a named token outside its validity window, or used up
+                    end(ev.reason === 'E_TOKEN_USED' ? 'used' : 'expired');
+                    return;
+                case 4004: // resumed call no longer known to the server, or no such gate
+                    end(callId ? 'lost' : 'error');
+                    return;
+                case 4011: // busy: the status said so, as with 1000 before
+                    end('done');
+                    return;
+                case 4010: // the call failed (the code is the reason)
+                case 4012:
+                case 4013:
+                    end('error');
+                    return;
+                }
+                if ((callId || !opened) && attempt < MAX_RETRIES) {
+                    const delay = backoff(attempt++);
+                    if (opts.onReconnecting) opts.onReconnecting(attempt, delay);
+                    setTimeout(connect, delay);
+                    return;
+                }
+                end(opened && !callId ? 'lost' : 'error');
+            };
+        }
+
+        connect();
+        return {
+            cancel: function () {
+                if (!ended && socket && socket.readyState === WebSocket.OPEN) {
+                    socket.send(JSON.stringify({ type: 'cancel' }));
+                }
+            },
+        };
+    }
+
+    window.IftachCall = { PROTOCOL: PROTOCOL, placeCall: placeCall, isFailure: isFailure };
+})();
+`
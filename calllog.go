@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// callLogger logs a call's lines with the call's fields: its ID, what triggered it,
+// the gate it opens, the named call token that placed it and its trace ID (if the
+// trigger was traced). The text log shows them as a prefix, e.g. "[call 3f9a… via
+// ws 203.0.113.7 gate outer] Received: 200 OK", so the output of concurrent
+// calls can be told apart; json and ecs as fields (log.go). It rides in the call's
+// context from sessions.Start down to the BYE, and so also notes the call's final
+// SIP response for its history record.
+type callLogger struct {
+	id       string // "" outside a call
+	attrs    []any  // slog key-value pairs
+	sipFinal atomic.Int32
+}
+
+type callLoggerKey struct{}
+
+// callIDHeader carries the call ID on what the server POSTs about a call
+// (callbacks, --notify-url), next to the call_id in the body, so a receiver's
+// access log can be matched to ours.
+const callIDHeader = "X-Iftach-Call-Id"
+
+func newCallLogger(callID string, opts callOptions) *callLogger {
+	attrs := []any{"call_id", callID}
+	if opts.Source != "" {
+		attrs = append(attrs, "source", opts.Source)
+	}
+	if opts.Gate != "" {
+		attrs = append(attrs, "gate", opts.Gate)
+	}
+	if opts.User != "" {
+		attrs = append(attrs, "token", opts.User)
+	}
+	if opts.Trace.Valid() {
+		attrs = append(attrs, "trace_id", opts.Trace.TraceID)
+	}
+	return &callLogger{id: callID, attrs: attrs}
+}
+
+// componentLogger is a callLogger for the lines of a background part of the server
+// that borrows call code, e.g. the IP cache's lookups, shown as "[name] ...".
+func componentLogger(name string) *callLogger {
+	return &callLogger{attrs: []any{"component", name}}
+}
+
+// loggerFor is the logger of call id: the call's own while the server still has
+// it, one with just the ID after that (a callback delivered after a restart, say).
+func loggerFor(id string) *callLogger {
+	if s, ok := sessions.Get(id); ok {
+		return s.log
+	}
+	return &callLogger{id: id, attrs: []any{"call_id", id}}
+}
+
+func withCallLogger(ctx context.Context, l *callLogger) context.Context {
+	return context.WithValue(ctx, callLoggerKey{}, l)
+}
+
+// callLog returns ctx's call logger, or one without fields outside a call.
+func callLog(ctx context.Context) *callLogger {
+	if l, ok := ctx.Value(callLoggerKey{}).(*callLogger); ok {
+		return l
+	}
+	return &callLogger{}
+}
+
+// log logs msg at level with the call's fields and attrs.
+func (l *callLogger) log(level slog.Level, msg string, attrs ...any) {
+	slog.Default().Log(context.Background(), level, msg, append(l.attrs[:len(l.attrs):len(l.attrs)], attrs...)...)
+}
+
+func (l *callLogger) logf(level slog.Level, format string, args ...any) {
+	if slog.Default().Enabled(context.Background(), level) {
+		l.log(level, fmt.Sprintf(format, args...))
+	}
+}
+
+// Printf logs one line at info; leading newlines stay in front of the prefix.
+func (l *callLogger) Printf(format string, args ...any) { l.logf(slog.LevelInfo, format, args...) }
+
+// Debugf logs one line at debug: detail that is noise until something goes wrong.
+func (l *callLogger) Debugf(format string, args ...any) { l.logf(slog.LevelDebug, format, args...) }
+
+// Warnf logs one line at warn.
+func (l *callLogger) Warnf(format string, args ...any) { l.logf(slog.LevelWarn, format, args...) }
+
+// Errorf logs one line at error, for a failure of no errorCode (see Failure).
+func (l *callLogger) Errorf(format string, args ...any) { l.logf(slog.LevelError, format, args...) }
+
+func (l *callLogger) Println(msg string) {
+	l.log(slog.LevelInfo, msg)
+}
+
+// Response logs a SIP response the call received, noting it if final.
+func (l *callLogger) Response(res *sip.Response) {
+	l.log(slog.LevelInfo, fmt.Sprintf("Received: %d %s", res.StatusCode, res.Reason), "sip_status", res.StatusCode)
+	if res.StatusCode >= 200 {
+		l.sipFinal.Store(int32(res.StatusCode))
+	}
+}
+
+// Failure logs a failure at error, tagged with its code, e.g. "[E_NO_TRYING] ...".
+func (l *callLogger) Failure(code errorCode, format string, args ...any) {
+	l.log(slog.LevelError, fmt.Sprintf("[%s] %s", code, fmt.Sprintf(format, args...)), "code", string(code))
+}
+
+// recoverCall, deferred by a call engine (run, runRingMe, runIntercom), turns a
+// panic into an E_INTERNAL failure of that one call: it runs on its own goroutine,
+// where a panic would otherwise take the whole server down.
+func recoverCall(ctx context.Context, report statusSink) {
+	if p := recover(); p != nil {
+		callLog(ctx).Failure(errInternal, "Call engine panic: %v\n%s", p, debug.Stack())
+		report.fail(statusError, errInternal)
+	}
+}
+
+// callSource describes who triggered a call from r, e.g. "api 203.0.113.7".
+func callSource(kind string, r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return kind + " " + host
+}
@@ -0,0 +1,6 @@
+//go:build cgo
+
+package main
+
+// cgoBuild: built with cgo. Nothing needs it; see build.go.
+const cgoBuild = true
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/go-chi/chi/v5"
+)
+
+// chaosSettings are failures injected into the call engine by the /test/chaos
+// endpoints (only mounted with --test-endpoints). Meant for staging: they let
+// automations be tested against a misbehaving provider on demand.
+type chaosSettings struct {
+	Drop100     bool   `json:"drop_100"`     // ignore 100 Trying, so the no-Trying timeout fires
+	Force503    bool   `json:"force_503"`    // answer every INVITE with a synthetic 503, nothing is sent
+	AnswerDelay string `json:"answer_delay"` // hold each 200 OK this long before handling it (e.g. "5s")
+}
+
+var chaos struct {
+	mu          sync.Mutex
+	settings    chaosSettings
+	answerDelay time.Duration
+}
+
+func currentChaos() (chaosSettings, time.Duration) {
+	chaos.mu.Lock()
+	defer chaos.mu.Unlock()
+	return chaos.settings, chaos.answerDelay
+}
+
+// chaosForced503 returns a synthetic 503 for req if force_503 is on, else nil.
+func chaosForced503(log *callLogger, req *sip.Request) *sip.Response {
+	if s, _ := currentChaos(); !s.Force503 {
+		return nil
+	}
+	log.Println("Chaos: answering INVITE with a synthetic 503.")
+	return sip.NewResponseFromRequest(req, 503, "Service Unavailable (chaos)", nil)
+}
+
+// chaosFilter applies drop_100/answer_delay to a received response. It returns
+// false when the response should be treated as never received.
+func chaosFilter(log *callLogger, res *sip.Response) bool {
+	s, delay := currentChaos()
+	if s.Drop100 && res.StatusCode == 100 {
+		log.Println("Chaos: dropping 100 Trying.")
+		return false
+	}
+	if delay > 0 && res.StatusCode == 200 {
+		log.Printf("Chaos: delaying 200 OK by %v.\n", delay)
+		time.Sleep(delay)
+	}
+	return true
+}
+
+// mountTestEndpoints adds GET/PUT/DELETE /test/chaos, guarded by the call token.
+func mountTestEndpoints(r chi.Router) {
+	logInfo("Test endpoints enabled (/test/chaos) — do not use in production.")
+	r.Route("/test", func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := callAuth(r); !ok {
+					writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+		r.Get("/chaos", func(w http.ResponseWriter, r *http.Request) {
+			s, _ := currentChaos()
+			writeJSON(w, http.StatusOK, s)
+		})
+		r.Put("/chaos", func(w http.ResponseWriter, r *http.Request) {
+			var s chaosSettings
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&s); err != nil {
+				writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+				return
+			}
+			var delay time.Duration
+			if s.AnswerDelay != "" {
+				d, err := time.ParseDuration(s.AnswerDelay)
+				if err != nil || d < 0 {
+					writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "answer_delay_invalid")
+					return
+				}
+				delay = d
+			}
+			chaos.mu.Lock()
+			chaos.settings, chaos.answerDelay = s, delay
+			chaos.mu.Unlock()
+			logInfo("Chaos settings: %+v\n", s)
+			writeJSON(w, http.StatusOK, s)
+		})
+		r.Delete("/chaos", func(w http.ResponseWriter, r *http.Request) {
+			chaos.mu.Lock()
+			chaos.settings, chaos.answerDelay = chaosSettings{}, 0
+			chaos.mu.Unlock()
+			logInfo("Chaos settings cleared.")
+			w.WriteHeader(http.StatusNoContent)
+		})
+	})
+}
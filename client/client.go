@@ -0,0 +1,376 @@
+// Package client talks to a running Iftach server over its REST and WebSocket
+// API, so Go programs (and the CLI's client-side subcommands) can open gates
+// without linking the SIP engine.
+//
+//	c := client.New("http://gate.local:8080", token)
+//	call, err := c.StartCall(ctx, client.StartOptions{Gate: "outer", Wait: client.WaitAnswered})
+//	if client.IsCode(err, client.CodeBusy) { ... }
+//
+// Requests that are safe to repeat are retried on network errors, 429 and 5xx
+// answers, with backoff; StartCall is made safe to repeat with an Idempotency-Key.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol is the /call message protocol this package speaks (wsProtocol on the
+// server).
+const Protocol = 6
+
+// Milestones StartCall can block until (StartOptions.Wait).
+const (
+	WaitAccepted  = "accepted"
+	WaitAnswered  = "answered"
+	WaitCompleted = "completed"
+)
+
+// Error codes the server answers with; see errors.go in the server for the full
+// list, which only ever grows.
+const (
+	CodeAuth         = "E_AUTH"
+	CodeForbidden    = "E_FORBIDDEN"
+	CodeTokenExpired = "E_TOKEN_EXPIRED"
+	CodeTokenUsed    = "E_TOKEN_USED"
+	CodeNotFound     = "E_NOT_FOUND"
+	CodeRateLimited  = "E_RATE_LIMITED"
+	CodeBusy         = "E_BUSY"
+	CodeNoTrying     = "E_NO_TRYING"
+	CodeProviderDown = "E_PROVIDER_DOWN"
+	CodeInternal     = "E_INTERNAL"
+)
+
+// Error is a failure the server reported: an API error answer, a WebSocket close
+// with an error code, or a call that ended with one.
+type Error struct {
+	HTTPStatus int    // 0 for WebSocket closes and failed calls
+	Code       string // E_...
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.HTTPStatus != 0 {
+		return fmt.Sprintf("iftach: %d %s: %s", e.HTTPStatus, e.Code, e.Message)
+	}
+	return fmt.Sprintf("iftach: %s: %s", e.Code, e.Message)
+}
+
+// IsCode reports whether err is an *Error with code.
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// Client is a server's address and credentials. Its fields may be changed until
+// it is first used.
+type Client struct {
+	BaseURL    string // e.g. http://gate.local:8080
+	Token      string // --call-token, or a named call token
+	AdminToken string // --admin-token, for History
+	HTTP       *http.Client
+	Retries    int           // attempts after the first, for requests safe to repeat
+	Backoff    time.Duration // before the first retry, doubling after each
+}
+
+// New returns a client of the server at baseURL that authenticates with the call
+// token token.
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Token:   token,
+		HTTP:    &http.Client{Timeout: 90 * time.Second}, // past the server's longest ?wait=
+		Retries: 2,
+		Backoff: 500 * time.Millisecond,
+	}
+}
+
+// Call is a call's state, as POST /api/call and GET /api/call/{id} answer.
+type Call struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"started_at"`
+	Status    string    `json:"status"`
+	Code      string    `json:"code,omitempty"`
+	Answered  bool      `json:"answered"`
+	Done      bool      `json:"done"`
+}
+
+// Err returns the call's failure as an *Error, or nil.
+func (c *Call) Err() error {
+	if c.Code == "" {
+		return nil
+	}
+	return &Error{Code: c.Code, Message: "call " + c.ID + " ended with " + c.Status}
+}
+
+// Status is one status message of a call.
+type Status struct {
+	Status  string `json:"status"`
+	Code    string `json:"code,omitempty"`
+	Leg     string `json:"leg,omitempty"`
+	RetryIn int    `json:"retry_in,omitempty"`
+}
+
+// StartOptions are StartCall's parameters; the zero value opens the default gate
+// and returns at once.
+type StartOptions struct {
+	Gate           string
+	Wait           string        // WaitAccepted (default), WaitAnswered or WaitCompleted
+	Timeout        time.Duration // of Wait, capped by the server's --api-wait-timeout
+	DryRun         bool
+	CallbackURL    string
+	IdempotencyKey string // made up if empty, so retries never place a second call
+}
+
+// StartCall places a call (POST /api/call).
+func (c *Client) StartCall(ctx context.Context, opts StartOptions) (*Call, error) {
+	q := url.Values{}
+	if opts.Gate != "" {
+		q.Set("gate", opts.Gate)
+	}
+	if opts.Wait != "" {
+		q.Set("wait", opts.Wait)
+	}
+	if opts.Timeout > 0 {
+		q.Set("timeout", opts.Timeout.String())
+	}
+	if opts.DryRun {
+		q.Set("dry_run", "1")
+	}
+	if opts.CallbackURL != "" {
+		q.Set("callback_url", opts.CallbackURL)
+	}
+	key := opts.IdempotencyKey
+	if key == "" {
+		key = newKey()
+	}
+	var call Call
+	err := c.do(ctx, http.MethodPost, "/api/call?"+q.Encode(), c.Token, nil, http.Header{"Idempotency-Key": {key}}, &call)
+	if err != nil {
+		return nil, err
+	}
+	return &call, nil
+}
+
+// GetCall returns a call's state (GET /api/call/{id}). Calls are kept for 15
+// minutes after they end.
+func (c *Client) GetCall(ctx context.Context, id string) (*Call, error) {
+	var call Call
+	if err := c.do(ctx, http.MethodGet, "/api/call/"+url.PathEscape(id), c.Token, nil, nil, &call); err != nil {
+		return nil, err
+	}
+	return &call, nil
+}
+
+// StreamStatus follows call id over WebSocket /call?resume=, calling fn with every
+// status from its first until it is over. It returns the call's failure as an
+// *Error, if it failed, and nil once it finished; closing on ctx leaves the call
+// running, as it was not started by this stream.
+func (c *Client) StreamStatus(ctx context.Context, id string, fn func(Status)) error {
+	u, err := url.Parse(c.BaseURL + "/call")
+	if err != nil {
+		return err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.RawQuery = url.Values{"resume": {id}}.Encode()
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), http.Header{"Authorization": {"Token " + c.Token}})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if err := conn.WriteJSON(map[string]any{"type": "hello", "ui_version": "go-client", "protocol": Protocol}); err != nil {
+		return err
+	}
+
+	var last Status
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) {
+				return err
+			}
+			failed := ce.Code >= 4010 && ce.Code <= 4013 // the call failed, its code the reason
+			if ce.Code != websocket.CloseNormalClosure && !failed {
+				return &Error{Code: closeCode(ce), Message: ce.Text}
+			}
+			if failed && last.Code == "" {
+				last.Code = ce.Text
+			}
+			if last.Code != "" {
+				return &Error{Code: last.Code, Message: "call " + id + " ended with " + last.Status}
+			}
+			return nil
+		}
+		var msg struct {
+			Type string `json:"type"`
+			Status
+		}
+		if json.Unmarshal(data, &msg) != nil || msg.Type != "" {
+			continue // hello and call messages
+		}
+		if msg.Leg == "" {
+			last = msg.Status
+		}
+		fn(msg.Status)
+	}
+}
+
+// closeCode maps /call's close codes to error codes.
+func closeCode(ce *websocket.CloseError) string {
+	switch ce.Code {
+	case 4001:
+		return CodeAuth
+	case 4003:
+		return CodeForbidden
+	case 4004:
+		return CodeNotFound
+	case 4005:
+		if ce.Text == CodeTokenUsed {
+			return CodeTokenUsed
+		}
+		return CodeTokenExpired
+	}
+	return fmt.Sprintf("WS_%d", ce.Code)
+}
+
+// HistoryCall is a finished call, as History returns it from the server's call
+// history.
+type HistoryCall struct {
+	At         time.Time `json:"at"` // when it was placed, in the server's --timezone
+	ID         string    `json:"call_id"`
+	User       string    `json:"user,omitempty"` // the named call token, "" for --call-token
+	Source     string    `json:"source"`
+	Gate       string    `json:"gate"`
+	Result     string    `json:"result"` // answered, busy or failed
+	Code       string    `json:"code,omitempty"`
+	SIPCode    int       `json:"sip_code,omitempty"` // the final SIP response, 0 if none came
+	DurationMS int64     `json:"duration_ms"`
+	AnswerMS   int64     `json:"answer_ms,omitempty"` // until the 200 OK
+	Trunk      string    `json:"trunk,omitempty"`
+}
+
+// Answered reports whether the call was answered.
+func (h *HistoryCall) Answered() bool { return h.Result == ResultAnswered }
+
+// Results of a HistoryCall.
+const (
+	ResultAnswered = "answered"
+	ResultBusy     = "busy"
+	ResultFailed   = "failed"
+)
+
+// HistoryQuery are History's filters; the zero value asks for the newest page of
+// every call.
+type HistoryQuery struct {
+	Gate   string
+	User   string // a named call token, or "-" for --call-token
+	Result string // ResultAnswered, ResultBusy or ResultFailed
+	Since  time.Time
+	Until  time.Time
+	Limit  int    // per page, 50 if 0, at most 500
+	Cursor string // History's next cursor, for the page after
+}
+
+// History returns a page of the server's call history (GET /api/history), newest
+// first, and the cursor of the next page, "" after the last. It needs AdminToken.
+func (c *Client) History(ctx context.Context, hq HistoryQuery) (calls []HistoryCall, next string, err error) {
+	q := url.Values{}
+	for name, v := range map[string]string{"gate": hq.Gate, "user": hq.User, "result": hq.Result, "cursor": hq.Cursor} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	if !hq.Since.IsZero() {
+		q.Set("since", hq.Since.Format(time.RFC3339))
+	}
+	if !hq.Until.IsZero() {
+		q.Set("until", hq.Until.Format(time.RFC3339))
+	}
+	if hq.Limit > 0 {
+		q.Set("limit", strconv.Itoa(hq.Limit))
+	}
+	var res struct {
+		Calls      []HistoryCall `json:"calls"`
+		NextCursor string        `json:"next_cursor"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/history?"+q.Encode(), c.AdminToken, nil, nil, &res); err != nil {
+		return nil, "", err
+	}
+	return res.Calls, res.NextCursor, nil
+}
+
+// do sends a request, retrying network errors, 429 and 5xx answers, and decodes a
+// 2xx answer into out or an error answer into an *Error.
+func (c *Client) do(ctx context.Context, method, path, token string, body []byte, header http.Header, out any) error {
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Authorization", "Token "+token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res, err := c.HTTP.Do(req)
+		var apiErr *Error
+		wait := backoff
+		if err == nil {
+			data, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+			res.Body.Close()
+			if res.StatusCode >= 200 && res.StatusCode < 300 {
+				return json.Unmarshal(data, out)
+			}
+			apiErr = &Error{HTTPStatus: res.StatusCode, Message: res.Status}
+			var e struct {
+				Code  string `json:"code"`
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(data, &e) == nil && e.Code != "" {
+				apiErr.Code, apiErr.Message = e.Code, e.Error
+			}
+			err = apiErr
+			if s, perr := strconv.Atoi(res.Header.Get("Retry-After")); perr == nil {
+				wait = time.Duration(s) * time.Second
+			}
+		}
+		retryable := apiErr == nil || apiErr.HTTPStatus == http.StatusTooManyRequests || apiErr.HTTPStatus >= 500
+		if !retryable || attempt >= c.Retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+func newKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// A device whose RTC battery died boots far in the past and, until NTP fixes it
+// (if ever), providers that put a timestamp in their nonces reject every digest
+// answer as stale: auth keeps failing with nothing wrong with the credentials.
+// Every SIP response is checked for the two tells, its Date header being far from
+// our clock and stale=true challenges to credentials we did send, and either adds
+// the clock_skew_suspected diagnostic to auth failures and the trunk status.
+
+const (
+	diagClockSkew   = "clock_skew_suspected"
+	clockSkewMax    = 2 * time.Minute // further off than this, it's our clock
+	staleNonceLimit = 2               // stale challenges in a row
+)
+
+var clockSkew struct {
+	mu     sync.Mutex
+	skew   time.Duration // the provider's Date minus our clock, last seen
+	dated  bool          // skew is set
+	stale  int           // stale=true challenges in a row
+	warned bool          // the suspicion was logged
+}
+
+var clockSkewSeconds = newGaugeFunc("iftach_clock_skew_seconds",
+	"How far the SIP provider's Date header was ahead of our clock in its last response (negative: behind).",
+	func() float64 {
+		clockSkew.mu.Lock()
+		defer clockSkew.mu.Unlock()
+		return clockSkew.skew.Seconds()
+	})
+
+// observeSIPClock checks res for clock skew. authed is whether the request it
+// answers carried credentials.
+func observeSIPClock(res *sip.Response, authed bool) {
+	clockSkew.mu.Lock()
+	defer clockSkew.mu.Unlock()
+	if h := res.GetHeader("Date"); h != nil {
+		if t, err := http.ParseTime(h.Value()); err == nil {
+			clockSkew.skew, clockSkew.dated = time.Until(t).Round(time.Second), true
+		}
+	}
+	switch {
+	case authed && (res.StatusCode == 401 || res.StatusCode == 407) && staleChallenge(res):
+		clockSkew.stale++
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		clockSkew.stale = 0
+	}
+	detail := clockSkewLocked()
+	if detail != "" && !clockSkew.warned {
+		logWarn("[%s] %s: check the system clock and NTP (a dead RTC battery?)\n", diagClockSkew, detail)
+	}
+	clockSkew.warned = detail != ""
+}
+
+// staleChallenge reports whether res challenges with stale=true, i.e. accepted our
+// credentials but not the nonce they were computed with.
+func staleChallenge(res *sip.Response) bool {
+	for _, name := range []string{"WWW-Authenticate", "Proxy-Authenticate"} {
+		if h := res.GetHeader(name); h != nil && strings.Contains(strings.ToLower(strings.ReplaceAll(h.Value(), " ", "")), "stale=true") {
+			return true
+		}
+	}
+	return false
+}
+
+// clockSkewLocked describes why clock skew is suspected, or is "".
+func clockSkewLocked() string {
+	switch {
+	case clockSkew.dated && clockSkew.skew > clockSkewMax:
+		return fmt.Sprintf("the provider's clock is %v ahead of ours", clockSkew.skew.Round(time.Minute))
+	case clockSkew.dated && clockSkew.skew < -clockSkewMax:
+		return fmt.Sprintf("the provider's clock is %v behind ours", -clockSkew.skew.Round(time.Minute))
+	case clockSkew.stale >= staleNonceLimit:
+		return fmt.Sprintf("%d stale-nonce challenges in a row", clockSkew.stale)
+	}
+	return ""
+}
+
+// clockSkewSuspected returns diagClockSkew if clock skew is suspected, else "".
+func clockSkewSuspected() string {
+	clockSkew.mu.Lock()
+	defer clockSkew.mu.Unlock()
+	if clockSkewLocked() == "" {
+		return ""
+	}
+	return diagClockSkew
+}
+
+// withClockSkew appends the clock_skew_suspected diagnostic, if any, to an auth
+// failure's detail.
+func withClockSkew(detail string) string {
+	clockSkew.mu.Lock()
+	defer clockSkew.mu.Unlock()
+	if why := clockSkewLocked(); why != "" {
+		return fmt.Sprintf("%s (%s: %s)", detail, diagClockSkew, why)
+	}
+	return detail
+}
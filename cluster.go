@@ -0,0 +1,294 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// --cluster-db runs two instances (say, a Pi at the gate and a spare one) as one:
+// both keep the named call tokens and the call history in the same Postgres
+// database instead of --data-dir, and they take turns holding a lease on placing
+// calls. Only the instance holding it dials, and keeps the --register
+// registration; the other one serves the UI and the API as usual, but refuses
+// calls with E_STANDBY. The holder renews the lease every third of --cluster-lease;
+// if it dies, or loses the database, the lease runs out and the standby takes it
+// over, so calls work again at most --cluster-lease later.
+//
+// The lease's expiry is the database's clock, so the instances' clocks needn't
+// agree; an instance that can't renew stops dialing when its own lease would run
+// out, before the other one may take it.
+//
+// GET /api/cluster answers 200 on the instance holding the lease and 503 on the
+// standby, for a load balancer's health check to send the UI's calls to the
+// holder. Tokens changed on one instance reach the other within a lease renewal;
+// changing the same tokens on both at once, the last change wins.
+
+const clusterLeaseName = "calls"
+
+var clusterLeader = newGauge("iftach_cluster_leader", "1 while this instance holds the --cluster-db call lease.")
+
+const clusterSchema = `
+CREATE TABLE IF NOT EXISTS iftach_lease (
+	name    text PRIMARY KEY,
+	holder  text NOT NULL,
+	expires timestamptz NOT NULL
+);
+CREATE TABLE IF NOT EXISTS iftach_state (
+	key     text PRIMARY KEY,
+	value   jsonb NOT NULL,
+	updated timestamptz NOT NULL
+);
+CREATE TABLE IF NOT EXISTS iftach_calls (
+	seq     bigserial PRIMARY KEY,
+	call_id text UNIQUE NOT NULL,
+	record  jsonb NOT NULL
+);`
+
+// cluster is the --cluster-db membership, nil without it.
+var cluster *clusterNode
+
+type clusterNode struct {
+	db    *sql.DB
+	name  string
+	lease time.Duration
+
+	mu      sync.Mutex
+	holding bool      // this instance holds the lease
+	until   time.Time // by this instance's clock, when the lease it holds runs out
+	holder  string    // who holds the lease, as last read
+	since   time.Time // UTC, when holding last changed
+}
+
+// clusterStatus is the cluster membership, as GET /api/status and GET /api/cluster
+// report it.
+type clusterStatus struct {
+	Node   string    `json:"node"`
+	Role   string    `json:"role"` // active or standby
+	Holder string    `json:"holder,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// clusterSubsystem joins the --cluster-db cluster, taking the call lease if nobody
+// holds it. The stores that live in the database come after it.
+func clusterSubsystem() subsystem {
+	return subsystem{
+		name:  "cluster",
+		after: []string{"store"},
+		start: func(ctx context.Context) error {
+			c, err := openCluster(ctx, &cli)
+			if err != nil {
+				return err
+			}
+			cluster = c
+			c.renew(ctx)
+			if st := c.Status(); st.Role != "active" {
+				logInfo("%s is on standby: %s places the calls.\n", c.name, cmp.Or(st.Holder, "nobody"))
+			}
+			go c.loop(ctx)
+			return nil
+		},
+		stop: func(ctx context.Context) error {
+			cluster.release(ctx)
+			return cluster.db.Close()
+		},
+	}
+}
+
+func openCluster(ctx context.Context, cfg *Config) (*clusterNode, error) {
+	name := cfg.ClusterNode
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	db, err := sql.Open("postgres", cfg.ClusterDb)
+	if err != nil {
+		return nil, fmt.Errorf("--cluster-db: %w", err)
+	}
+	db.SetMaxOpenConns(4)
+	if _, err := db.ExecContext(ctx, clusterSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("--cluster-db: %w", err)
+	}
+	logInfo("Joined the cluster in --cluster-db as %s\n", name)
+	return &clusterNode{db: db, name: name, lease: cfg.ClusterLease, since: time.Now().UTC()}, nil
+}
+
+func (c *clusterNode) loop(ctx context.Context) {
+	t := time.NewTicker(c.lease / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		c.renew(ctx)
+		if err := tokens.reload(); err != nil {
+			logWarn("--cluster-db: could not reload the call tokens: %v\n", err)
+		}
+	}
+}
+
+// renew takes the lease if it is free or has run out, or extends it if this
+// instance holds it.
+func (c *clusterNode) renew(ctx context.Context) {
+	began := time.Now()
+	qctx, cancel := context.WithTimeout(ctx, c.lease/3)
+	defer cancel()
+	var holder string
+	err := c.db.QueryRowContext(qctx, `
+INSERT INTO iftach_lease (name, holder, expires) VALUES ($1, $2, now() + $3 * interval '1 millisecond')
+ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires = EXCLUDED.expires
+	WHERE iftach_lease.holder = EXCLUDED.holder OR iftach_lease.expires < now()
+RETURNING holder`, clusterLeaseName, c.name, c.lease.Milliseconds()).Scan(&holder)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = c.db.QueryRowContext(qctx, `SELECT holder FROM iftach_lease WHERE name = $1`, clusterLeaseName).Scan(&holder)
+	}
+
+	c.mu.Lock()
+	was := c.holding
+	switch {
+	case err == nil:
+		if holder == c.name {
+			c.until = began.Add(c.lease)
+		}
+		c.holding, c.holder = holder == c.name, holder
+	case c.holding && time.Now().After(c.until):
+		logWarn("--cluster-db unreachable, the call lease ran out: %v\n", err)
+		c.holding, c.holder = false, ""
+	case !c.holding:
+		c.holder = ""
+	}
+	c.mu.Unlock()
+	c.changed(was)
+}
+
+// changed starts or stops what only the lease holder runs, if holding the lease
+// changed from was.
+func (c *clusterNode) changed(was bool) {
+	c.mu.Lock()
+	holding, holder := c.holding, c.holder
+	if holding != was {
+		c.since = time.Now().UTC()
+	}
+	c.mu.Unlock()
+	switch {
+	case holding == was:
+	case holding:
+		logInfo("%s holds the call lease: placing calls.\n", c.name)
+		clusterLeader.add(1)
+		if registrar != nil {
+			idle.Kick("register")
+		}
+	default:
+		logInfo("%s is on standby: %s places the calls.\n", c.name, cmp.Or(holder, "nobody"))
+		clusterLeader.add(-1)
+		if registrar != nil {
+			registrar.stop()
+		}
+	}
+}
+
+// release gives the lease up on shutdown, so the standby takes over at once rather
+// than once it runs out.
+func (c *clusterNode) release(ctx context.Context) {
+	c.mu.Lock()
+	was := c.holding
+	c.holding, c.holder = false, ""
+	c.mu.Unlock()
+	c.changed(was)
+	if !was {
+		return
+	}
+	if _, err := c.db.ExecContext(ctx, `DELETE FROM iftach_lease WHERE name = $1 AND holder = $2`, clusterLeaseName, c.name); err != nil {
+		logWarn("--cluster-db: could not release the call lease: %v\n", err)
+	}
+}
+
+// active reports whether this instance may place calls: it holds the lease, or
+// there is no cluster.
+func (c *clusterNode) active() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.holding && time.Now().Before(c.until)
+}
+
+// Status is the membership for GET /api/status, nil without --cluster-db.
+func (c *clusterNode) Status() *clusterStatus {
+	if c == nil {
+		return nil
+	}
+	active := c.active()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := &clusterStatus{Node: c.name, Role: "standby", Holder: c.holder, Since: displayTime(c.since)}
+	if active {
+		st.Role = "active"
+	}
+	return st
+}
+
+// loadState reads the document stored under key into v, reporting when it was
+// last written; v is left alone if there is none newer than after.
+func (c *clusterNode) loadState(key string, after time.Time, v any) (time.Time, error) {
+	var b []byte
+	var updated time.Time
+	err := c.db.QueryRow(`SELECT value, updated FROM iftach_state WHERE key = $1 AND updated > $2`, key, after).Scan(&b, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return after, nil
+	}
+	if err != nil {
+		return after, err
+	}
+	return updated, json.Unmarshal(b, v)
+}
+
+// saveState stores v under key, returning when it was written.
+func (c *clusterNode) saveState(key string, v any) (time.Time, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var updated time.Time
+	err = c.db.QueryRow(`
+INSERT INTO iftach_state (key, value, updated) VALUES ($1, $2, clock_timestamp())
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated = EXCLUDED.updated
+RETURNING updated`, key, b).Scan(&updated)
+	return updated, err
+}
+
+// runStandby is a call on the standby: it fails at once with E_STANDBY, without
+// dialing.
+func runStandby(ctx context.Context, statusChan chan<- callStatusMsg) {
+	defer close(statusChan)
+	callLog(ctx).Failure(errStandby, "Not dialing: this instance is on --cluster-db standby")
+	statusChan <- callStatusMsg{Status: statusError, Code: errStandby}
+}
+
+// handleCluster is GET /api/cluster: the membership, with 200 on the instance
+// holding the call lease (and without --cluster-db) and 503 on the standby. It
+// takes no token, for load balancers' health checks.
+func handleCluster(w http.ResponseWriter, r *http.Request) {
+	st := cluster.Status()
+	if st == nil {
+		writeJSON(w, http.StatusOK, map[string]string{"role": "active"})
+		return
+	}
+	code := http.StatusOK
+	if st.Role != "active" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, st)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// completion prints a shell completion script generated from the command tree, so
+// it never falls behind the flags: subcommands, the flags of each (its parents'
+// included) and the values of enum flags.
+//
+//	source <(iftach completion bash)
+//	iftach completion fish > ~/.config/fish/completions/iftach.fish
+
+// CompletionCmd prints a shell completion script.
+type CompletionCmd struct {
+	Shell string `kong:"arg,help='Shell to complete in: bash, zsh or fish',enum='bash,zsh,fish'"`
+}
+
+func (c *CompletionCmd) Run(kctx *kong.Context) error {
+	prog := strings.ToLower(kctx.Model.Name)
+	switch c.Shell {
+	case "fish":
+		writeFishCompletion(os.Stdout, prog, kctx.Model.Node)
+	case "zsh":
+		// zsh runs bash completion functions through bashcompinit.
+		fmt.Fprintln(os.Stdout, "autoload -U +X bashcompinit && bashcompinit")
+		writeBashCompletion(os.Stdout, prog, kctx.Model.Node)
+	default:
+		writeBashCompletion(os.Stdout, prog, kctx.Model.Node)
+	}
+	return nil
+}
+
+// commandNodes returns n and every command below it, depth first.
+func commandNodes(n *kong.Node) []*kong.Node {
+	nodes := []*kong.Node{n}
+	for _, child := range n.Children {
+		if child.Type == kong.CommandNode && !child.Hidden {
+			nodes = append(nodes, commandNodes(child)...)
+		}
+	}
+	return nodes
+}
+
+// commandPath is n's subcommand names below the application, space-separated.
+func commandPath(n *kong.Node) string {
+	var names []string
+	for ; n != nil && n.Type != kong.ApplicationNode; n = n.Parent {
+		names = append(names, n.Name)
+	}
+	slices.Reverse(names)
+	return strings.Join(names, " ")
+}
+
+// completionFlags returns the flags usable on n: its own and its parents', and
+// with a default command (serve), that command's too.
+func completionFlags(n *kong.Node) []*kong.Flag {
+	var flags []*kong.Flag
+	for _, group := range n.AllFlags(true) {
+		flags = append(flags, group...)
+	}
+	if n.DefaultCmd != nil {
+		for _, f := range n.DefaultCmd.Flags {
+			if !f.Hidden {
+				flags = append(flags, f)
+			}
+		}
+	}
+	return flags
+}
+
+func writeBashCompletion(w io.Writer, prog string, root *kong.Node) {
+	fn := "_" + strings.ReplaceAll(prog, "-", "_")
+	fmt.Fprintf(w, "# bash completion for %s, generated by %s completion bash\n", prog, prog)
+	fmt.Fprintf(w, "%s_node() {\n\tcase \"$1\" in\n", fn)
+	for _, n := range commandNodes(root) {
+		var cmds, flags []string
+		for _, child := range n.Children {
+			if child.Type == kong.CommandNode && !child.Hidden {
+				cmds = append(cmds, child.Name)
+			}
+		}
+		for _, f := range completionFlags(n) {
+			flags = append(flags, "--"+f.Name)
+			if f.Negated {
+				flags = append(flags, "--no-"+f.Name)
+			}
+		}
+		fmt.Fprintf(w, "\t%q) cmds=%q flags=%q ;;\n", commandPath(n), strings.Join(cmds, " "), strings.Join(flags, " "))
+	}
+	fmt.Fprintf(w, "\tesac\n}\n\n")
+
+	fmt.Fprintf(w, "%s_enum() {\n\tcase \"$1\" in\n", fn)
+	seen := map[string]bool{}
+	for _, n := range commandNodes(root) {
+		for _, f := range completionFlags(n) {
+			if f.Enum == "" || seen[f.Name] {
+				continue
+			}
+			seen[f.Name] = true
+			fmt.Fprintf(w, "\t--%s) vals=%q ;;\n", f.Name, strings.Join(slices.DeleteFunc(f.EnumSlice(), func(v string) bool { return v == "" }), " "))
+		}
+	}
+	fmt.Fprintf(w, "\t*) vals= ;;\n\tesac\n}\n\n")
+
+	fmt.Fprintf(w, `%[1]s() {
+	local cur=${COMP_WORDS[COMP_CWORD]} path= cmds flags vals w
+	%[1]s_node ""
+	for w in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+		if [[ $w != -* && " $cmds " == *" $w "* ]]; then
+			path=${path:+$path }$w
+			%[1]s_node "$path"
+		fi
+	done
+	case $cur in
+	--*=*)
+		%[1]s_enum "${cur%%%%=*}"
+		COMPREPLY=($(compgen -P "${cur%%%%=*}=" -W "$vals" -- "${cur#*=}"))
+		;;
+	-*) COMPREPLY=($(compgen -W "$flags" -- "$cur")) ;;
+	*) COMPREPLY=($(compgen -W "$cmds" -- "$cur")) ;;
+	esac
+}
+complete -o default -F %[1]s %[2]s
+`, fn, prog)
+}
+
+func writeFishCompletion(w io.Writer, prog string, root *kong.Node) {
+	fmt.Fprintf(w, "# fish completion for %s, generated by %s completion fish\n", prog, prog)
+	for _, n := range commandNodes(root) {
+		// Where n's subcommands and flags apply: before any subcommand at the top,
+		// after n's name below it.
+		cond := "__fish_use_subcommand"
+		if n != root {
+			cond = "__fish_seen_subcommand_from " + n.Name
+		}
+		for _, child := range n.Children {
+			if child.Type == kong.CommandNode && !child.Hidden {
+				fmt.Fprintf(w, "complete -c %s -n '%s' -f -a %s -d %s\n", prog, cond, child.Name, fishQuote(child.Help))
+			}
+		}
+		flags := n.Flags
+		if n.DefaultCmd != nil {
+			flags = append(slices.Clone(flags), n.DefaultCmd.Flags...)
+		}
+		for _, f := range flags {
+			if f.Hidden {
+				continue
+			}
+			line := fmt.Sprintf("complete -c %s -n '%s' -l %s -d %s", prog, cond, f.Name, fishQuote(f.Help))
+			if f.Enum != "" {
+				line += " -x -a " + fishQuote(strings.Join(f.EnumSlice(), " "))
+			} else if !f.IsBool() {
+				line += " -r"
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// fishQuote single-quotes the first sentence of help for a fish description.
+func fishQuote(help string) string {
+	help, _, _ = strings.Cut(help, "; ")
+	if r := []rune(help); len(r) > 80 {
+		help = string(r[:77]) + "..."
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(help) + "'"
+}
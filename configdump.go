@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+// Where a setting's effective value came from, highest precedence first.
+const (
+	sourceFlag     = "flag"
+	sourceEnv      = "env"
+	sourceFile     = "file"
+	sourceSetup    = "setup"    // saved by the setup wizard this run
+	sourcePrompt   = "prompt"   // typed in at the terminal this run (prompt.go)
+	sourceProvider = "provider" // from the --provider preset
+	sourceDefault  = "default"
+)
+
+// secretFlags are redacted wherever the configuration is printed.
+var secretFlags = map[string]bool{"sip-pass": true, "call-token": true, "admin-token": true, "webhook-secrets": true, "dtmf-code": true, "mqtt-pass": true, "captcha-secret": true, "telegram-token": true, "duress-token": true, "backup-sip-pass": true, "cluster-db": true}
+
+// notSettings are flags of the command tree that aren't part of Config.
+var notSettings = map[string]bool{"help": true, "config": true, "format": true, "no-prompt": true}
+
+// configSetting is one effective setting, as `config dump` prints it.
+type configSetting struct {
+	Name   string `json:"name"`
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+	Env    string `json:"env,omitempty"` // the env var, when that is the source
+}
+
+// configSettings lists the Config flags of kctx's command with their current
+// values and sources. wizard marks values that weren't given as flags or env vars
+// as coming from the setup wizard. Secrets only show whether they are set.
+func configSettings(kctx *kong.Context, wizard bool) []configSetting {
+	var list []configSetting
+	for _, flag := range kctx.Flags() {
+		if notSettings[flag.Name] || !flag.Target.IsValid() {
+			continue
+		}
+		st := configSetting{Name: flag.Name, Value: flag.Target.Interface(), Source: sourceDefault}
+		if d, ok := st.Value.(time.Duration); ok {
+			st.Value = d.String()
+		}
+		if secretFlags[flag.Name] {
+			switch v := st.Value.(type) {
+			case string:
+				st.Value = redacted(v)
+			case map[string]string:
+				secrets := make(map[string]string, len(v))
+				for name, secret := range v {
+					secrets[name] = redacted(secret)
+				}
+				st.Value = secrets
+			}
+		}
+		switch {
+		case flagOnCommandLine(kctx, flag):
+			st.Source = sourceFlag
+		case envFor(flag) != "":
+			st.Source, st.Env = sourceEnv, envFor(flag)
+		case wizard:
+			st.Source = sourceSetup
+		case fromPrompt[flag.Name]:
+			st.Source = sourcePrompt
+		case fromConfigFile[flag.Name]:
+			st.Source = sourceFile
+		case fromProvider[flag.Name]:
+			st.Source = sourceProvider
+		}
+		list = append(list, st)
+	}
+	return list
+}
+
+func flagOnCommandLine(kctx *kong.Context, flag *kong.Flag) bool {
+	for _, p := range kctx.Path {
+		if p.Flag == flag && !p.Resolved {
+			return true
+		}
+	}
+	return false
+}
+
+// envFor returns the flag's env var if it is set. Empty counts as unset, as in
+// configPath's resolver.
+func envFor(flag *kong.Flag) string {
+	for _, env := range flag.Envs {
+		if os.Getenv(env) != "" {
+			return env
+		}
+	}
+	return ""
+}
+
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// logConfigBanner prints the startup summary: every setting that isn't at its
+// default, tagged with its source, on one line.
+func logConfigBanner(settings []configSetting) {
+	var parts []string
+	defaults := 0
+	for _, st := range settings {
+		if st.Source == sourceDefault {
+			defaults++
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s (%s)", st.Name, settingText(st.Value), st.Source))
+	}
+	logInfo("Config from %s: %s; %d at default\n", configFile, strings.Join(parts, ", "), defaults)
+}
+
+// settingText formats a value the way it would be given as a flag.
+func settingText(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case map[string]string:
+		var pairs []string
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			pairs = append(pairs, k+"="+v[k])
+		}
+		return strings.Join(pairs, ";")
+	case macroSet:
+		return strings.Join(slices.Sorted(maps.Keys(v)), ";")
+	case legDurations:
+		return durationPairs(v)
+	case gateDurations:
+		return durationPairs(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// durationPairs formats a duration map as name=duration pairs, e.g. phone=45s;gate=20s.
+func durationPairs(m map[string]time.Duration) string {
+	var pairs []string
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		pairs = append(pairs, k+"="+m[k].String())
+	}
+	return strings.Join(pairs, ";")
+}
+
+// ConfigCmd groups configuration helpers.
+type ConfigCmd struct {
+	Dump ConfigDumpCmd `kong:"cmd,help='Print the effective configuration and where each value came from (secrets redacted)'"`
+}
+
+// ConfigDumpCmd prints the configuration serve would run with, resolved from the
+// same flags, env vars and config file.
+type ConfigDumpCmd struct {
+	Config `kong:"embed"`
+
+	Format string `kong:"help='Output format',enum='text,json',default='text'"`
+}
+
+func (c *ConfigDumpCmd) Run(kctx *kong.Context) error {
+	settings := configSettings(kctx, false)
+	if c.Format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]any{"config_file": configFile, "settings": settings})
+	}
+	fmt.Printf("# config file: %s\n", configFile)
+	for _, st := range settings {
+		src := st.Source
+		if st.Env != "" {
+			src += " " + st.Env
+		}
+		fmt.Printf("%-18s %-40s %s\n", st.Name, settingText(st.Value), src)
+	}
+	return nil
+}
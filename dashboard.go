@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// serverStartedAt is shown on the admin dashboard.
+var serverStartedAt = time.Now().UTC()
+
+// adminCall is a call session as the admin dashboard lists it.
+type adminCall struct {
+	callResponse
+	Gate       string `json:"gate"`
+	Source     string `json:"source,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+func newAdminCall(s *callSession) adminCall {
+	gate := s.Gate
+	if gate == "" {
+		gate = defaultGate
+	}
+	return adminCall{newCallResponse(s), gate, s.Source, s.Duration().Milliseconds()}
+}
+
+// adminToken describes a configured token without giving any of it away.
+type adminToken struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+	Set   bool   `json:"set"`
+}
+
+func newAdminToken(name, scope, token string) adminToken {
+	return adminToken{Name: name, Scope: scope, Set: token != ""}
+}
+
+// adminTokens lists the configured tokens.
+func adminTokens() []adminToken {
+	return []adminToken{
+		newAdminToken("call", "open gates: UI, /call and /api/*", cli.CallToken),
+		newAdminToken("admin", "this dashboard and manual dialing, /api/admin/*, /api/graphql, /metrics, /debug/pprof", cli.AdminToken),
+	}
+}
+
+// adminSchedule is something due to happen later: a pending auto-close, or a
+// batch/macro job still working through its steps.
+type adminSchedule struct {
+	Kind   string    `json:"kind"` // auto-close, batch or macro
+	Name   string    `json:"name"` // gate, job ID or macro name
+	At     time.Time `json:"at,omitzero"`
+	Status string    `json:"status,omitempty"`
+}
+
+type adminOverview struct {
+	UIVersion   string          `json:"ui_version"`
+	Build       buildInfo       `json:"build"`
+	StartedAt   time.Time       `json:"started_at"`
+	Idle        statusResponse  `json:"idle"`
+	ActiveCalls []adminCall     `json:"active_calls"`
+	RecentCalls []adminCall     `json:"recent_calls"` // finished within sessionRetention
+	Tokens      []adminToken    `json:"tokens"`
+	Schedules   []adminSchedule `json:"schedules"`
+	Approvals   []approval      `json:"approvals"` // pending first (see approval.go)
+}
+
+// handleAdminOverview is GET /api/admin/overview, everything the dashboard shows
+// except the trunk check (which talks to the provider, so it has its own endpoint).
+func handleAdminOverview(w http.ResponseWriter, r *http.Request) {
+	o := adminOverview{
+		UIVersion:   uiVersion,
+		Build:       currentBuild(),
+		StartedAt:   displayTime(serverStartedAt),
+		Idle:        idle.status(),
+		ActiveCalls: []adminCall{},
+		RecentCalls: []adminCall{},
+		Tokens:      adminTokens(),
+		Schedules:   []adminSchedule{},
+		Approvals:   approvals.List(),
+	}
+	for _, s := range sessions.List() {
+		if s.Done() {
+			o.RecentCalls = append(o.RecentCalls, newAdminCall(s))
+		} else {
+			o.ActiveCalls = append(o.ActiveCalls, newAdminCall(s))
+		}
+	}
+	for _, p := range autoClose.Pending() {
+		o.Schedules = append(o.Schedules, adminSchedule{Kind: "auto-close", Name: p.Gate, At: displayTime(p.At)})
+	}
+	batchJobs.mu.Lock()
+	for _, j := range batchJobs.jobs {
+		st := j.snapshot()
+		if st.Status != batchRunning {
+			continue
+		}
+		if st.Macro != "" {
+			o.Schedules = append(o.Schedules, adminSchedule{Kind: "macro", Name: st.Macro, At: st.StartedAt, Status: st.Status})
+		} else {
+			o.Schedules = append(o.Schedules, adminSchedule{Kind: "batch", Name: st.ID, At: st.StartedAt, Status: st.Status})
+		}
+	}
+	batchJobs.mu.Unlock()
+	slices.SortFunc(o.Schedules, func(a, b adminSchedule) int { return a.At.Compare(b.At) })
+	writeJSON(w, http.StatusOK, o)
+}
+
+// trunkCacheFor keeps the dashboard's polling from REGISTERing every few seconds.
+const trunkCacheFor = 30 * time.Second
+
+type trunkStatus struct {
+	OK         bool      `json:"ok"`
+	Code       errorCode `json:"code,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	Diagnostic string    `json:"diagnostic,omitempty"` // clock_skew_suspected (see clockskew.go)
+	CheckedAt  time.Time `json:"checked_at"`
+	LatencyMS  int64     `json:"latency_ms"`
+}
+
+var trunk struct {
+	mu   sync.Mutex
+	last trunkStatus
+}
+
+// handleAdminTrunk is GET /api/admin/trunk: whether the provider answers and accepts
+// our credentials, via the setup wizard's REGISTER query. ?refresh=1 skips the cache.
+func handleAdminTrunk(w http.ResponseWriter, r *http.Request) {
+	trunk.mu.Lock()
+	defer trunk.mu.Unlock()
+	if r.URL.Query().Get("refresh") != "1" && time.Since(trunk.last.CheckedAt) < trunkCacheFor {
+		writeJSON(w, http.StatusOK, trunk.last)
+		return
+	}
+	start := time.Now()
+	cfg := cli
+	code, detail := probeSIP(r.Context(), &cfg)
+	trunk.last = trunkStatus{
+		OK:         code == "",
+		Code:       code,
+		Detail:     detail,
+		Diagnostic: clockSkewSuspected(),
+		CheckedAt:  displayTime(start),
+		LatencyMS:  time.Since(start).Milliseconds(),
+	}
+	writeJSON(w, http.StatusOK, trunk.last)
+}
+
+// handleAdminCalls is GET /api/admin/calls: the calls in progress, for the
+// dashboard's live view.
+func handleAdminCalls(w http.ResponseWriter, r *http.Request) {
+	calls := []adminCall{}
+	for _, s := range sessions.List() {
+		if !s.Done() {
+			calls = append(calls, newAdminCall(s))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"calls": calls})
+}
+
+// handleAdminHangup is POST /api/admin/calls/{id}/hangup: cancel the call if it is
+// still ringing, hang up if answered. 202 once the hangup is under way.
+func handleAdminHangup(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessions.Get(chi.URLParam(r, "id"))
+	if !ok {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "")
+		return
+	}
+	if !s.Hangup(callSource("admin", r)) {
+		writeAPIError(w, r, http.StatusConflict, errBadRequest, "call_finished")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, newAdminCall(s))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Resource gauges for spotting leaks over weeks of uptime: on an idle server all
+// but iftach_goroutines should sit at 0, and iftach_goroutines should come back to
+// its baseline once calls are over. session_test.go checks the same in CI.
+var (
+	sessionsActive = newGauge("iftach_call_sessions_active", "Call sessions whose run() hasn't returned yet.")
+	sipTxOpen      = newGauge("iftach_sip_transactions_open", "INVITE client transactions not yet terminated.")
+	sipUAsOpen     = newGauge("iftach_sip_user_agents_open", "Per-call SIP user agents not yet closed.")
+	_              = newGaugeFunc("iftach_goroutines", "Goroutines in the process.", func() float64 { return float64(runtime.NumGoroutine()) })
+)
+
+// trackTx counts tx in iftach_sip_transactions_open until it terminates.
+func trackTx(tx sip.ClientTransaction) {
+	sipTxOpen.add(1)
+	go func() {
+		<-tx.Done()
+		sipTxOpen.add(-1)
+	}()
+}
+
+// mountDebug serves net/http/pprof under /debug/pprof/ for admins, e.g.
+// go tool pprof 'http://host:8080/debug/pprof/goroutine?token=...'.
+func mountDebug(r chi.Router) {
+	r.With(adminOnly).Mount("/debug", middleware.Profiler())
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The admin can hand their rights to someone else for a while, say a neighbour
+// while they are on vacation: POST /api/admin/delegations creates a delegated admin
+// token that works wherever --admin-token does (the dashboard, /api/admin/*,
+// /api/graphql, /metrics, /debug/pprof) until it expires, at most maxDelegation
+// after it was created, when it is removed. A delegate can't create, list or
+// revoke delegations; only --admin-token can. Every change a delegate makes (any
+// request but a GET) is audited under their name, as are creating, revoking and
+// expiring a delegation. Delegations are kept in delegations.json in --data-dir,
+// hashed like named call tokens.
+
+const (
+	maxDelegationDays = 31
+	maxDelegation     = maxDelegationDays * 24 * time.Hour
+)
+
+// delegation is a delegated admin token.
+type delegation struct {
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash,omitempty"` // SHA-256 of the token, hex
+	Created  time.Time `json:"created"`
+	By       string    `json:"by"` // who created it
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"last_used,omitzero"`
+
+	timer *time.Timer // removes it once it expires
+}
+
+// delegationStore holds the delegations, keyed by name.
+type delegationStore struct {
+	path string
+
+	mu          sync.Mutex
+	delegations map[string]*delegation
+}
+
+var delegations *delegationStore
+
+// delegateKey is the context key of the name of the delegate making a request.
+type delegateKey struct{}
+
+// delegateOf returns the delegate making r, "" for --admin-token (or no admin).
+func delegateOf(r *http.Request) string {
+	name, _ := r.Context().Value(delegateKey{}).(string)
+	return name
+}
+
+func newDelegationStore(path string) (*delegationStore, error) {
+	s := &delegationStore{path: path, delegations: map[string]*delegation{}}
+	if path != "" {
+		if err := loadJSON(path, &s.delegations); err != nil {
+			return nil, fmt.Errorf("load delegations: %w", err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.delegations {
+		s.scheduleLocked(d) // one that expired while we were down goes at once
+	}
+	return s, nil
+}
+
+// scheduleLocked arranges for d to be removed when it expires.
+func (s *delegationStore) scheduleLocked(d *delegation) {
+	d.timer = time.AfterFunc(time.Until(d.Expires), func() { s.expire(d) })
+}
+
+// expire removes d, which ran out, unless it was revoked or replaced meanwhile.
+func (s *delegationStore) expire(d *delegation) {
+	s.mu.Lock()
+	if s.delegations[d.Name] != d {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.delegations, d.Name)
+	s.persistLocked()
+	s.mu.Unlock()
+	logInfo("Delegated admin %s expired\n", d.Name)
+	auditLog.add(auditRecord{Event: auditDelegationExpired, Detail: d.describe()})
+}
+
+// lookup returns the delegation that token is, and whether it hasn't expired.
+func (s *delegationStore) lookup(token string) (d *delegation, valid bool) {
+	if s == nil || token == "" {
+		return nil, false
+	}
+	hash := hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.delegations {
+		if subtle.ConstantTimeCompare([]byte(d.Hash), []byte(hash)) == 1 {
+			now := time.Now()
+			valid := now.Before(d.Expires)
+			if valid {
+				d.LastUsed = now.UTC() // not persisted on its own; the next change saves it
+			}
+			return d, valid
+		}
+	}
+	return nil, false
+}
+
+func (s *delegationStore) persistLocked() {
+	if s.path == "" {
+		return
+	}
+	if err := saveJSON(s.path, s.delegations); err != nil {
+		logWarn("Could not persist delegations: %v\n", err)
+	}
+}
+
+// describe is d's name and expiry, for the audit log.
+func (d *delegation) describe() string {
+	return d.Name + ", until " + d.Expires.Format(time.RFC3339)
+}
+
+// List returns the delegations (without their hashes), sorted by name.
+func (s *delegationStore) List() []delegation {
+	list := []delegation{}
+	if s == nil {
+		return list
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range slices.Sorted(maps.Keys(s.delegations)) {
+		d := *s.delegations[name]
+		d.Hash, d.timer = "", nil
+		d.Created, d.Expires = displayTime(d.Created), displayTime(d.Expires)
+		if !d.LastUsed.IsZero() {
+			d.LastUsed = displayTime(d.LastUsed)
+		}
+		list = append(list, d)
+	}
+	return list
+}
+
+// ownerOnly keeps delegates out of the routes it guards, which adminOnly already
+// does everyone else.
+func ownerOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if delegateOf(r) != "" {
+			writeAPIError(w, r, http.StatusForbidden, errForbidden, "delegate_forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withDelegate is r as made by delegate d.
+func withDelegate(r *http.Request, d *delegation) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), delegateKey{}, d.Name))
+}
+
+// handleDelegations is GET /api/admin/delegations.
+func handleDelegations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"delegations": delegations.List()})
+}
+
+// handleDelegationCreate is POST /api/admin/delegations with {"name", "expires_in"}
+// or {"name", "valid_until"}: a delegated admin token until then, at most
+// maxDelegation away. The answer is the only place the token appears. An existing
+// name is replaced, revoking its old token.
+func handleDelegationCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name       string    `json:"name"`
+		ValidUntil time.Time `json:"valid_until"`
+		ExpiresIn  string    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+		return
+	}
+	if !gateName.MatchString(req.Name) {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "token_name_invalid")
+		return
+	}
+	now := time.Now().UTC()
+	expires := req.ValidUntil.UTC()
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || !req.ValidUntil.IsZero() {
+			writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "delegation_expiry_bad", maxDelegationDays)
+			return
+		}
+		expires = now.Add(d)
+	}
+	if !expires.After(now) || expires.Sub(now) > maxDelegation {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "delegation_expiry_bad", maxDelegationDays)
+		return
+	}
+	token := newToken()
+	d := &delegation{Name: req.Name, Hash: hashToken(token), Created: now, By: callSource("admin", r), Expires: expires}
+
+	delegations.mu.Lock()
+	if old, ok := delegations.delegations[d.Name]; ok {
+		old.timer.Stop()
+	}
+	delegations.delegations[d.Name] = d
+	delegations.scheduleLocked(d)
+	delegations.persistLocked()
+	delegations.mu.Unlock()
+	logInfo("Admin rights delegated to %s by %s\n", d.describe(), d.By)
+	auditRequest(r, auditDelegationCreated, "", d.describe())
+	created := *d
+	created.Hash, created.timer = "", nil
+	writeJSON(w, http.StatusCreated, map[string]any{"token": token, "info": created})
+}
+
+// handleDelegationDelete is DELETE /api/admin/delegations/{name}: revoke a
+// delegation before it expires.
+func handleDelegationDelete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	delegations.mu.Lock()
+	d, ok := delegations.delegations[name]
+	if ok {
+		d.timer.Stop()
+		delete(delegations.delegations, name)
+		delegations.persistLocked()
+	}
+	delegations.mu.Unlock()
+	if !ok {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "")
+		return
+	}
+	logInfo("Delegated admin %s revoked by %s\n", name, callSource("admin", r))
+	auditRequest(r, auditDelegationRevoked, "", d.describe())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// The 2xx to a call's INVITE establishes a dialog (RFC 3261 12.1.2), and the
+// ACK, INFO and BYE that follow are built from it rather than from the INVITE
+// alone: the INVITE's Call-ID and From, the To with the tag the 2xx added, the
+// remote target (the 2xx Contact) as the Request-URI, and the route set (its
+// Record-Route, reversed) as Route headers, a strict router (no ;lr) taking the
+// Request-URI itself (12.2.1.1). With a route set the requests go to its first
+// hop; without one they go where the INVITE went, over the same connection, as
+// the Contact of a trunk behind NAT or a load balancer often can't be reached
+// directly. The ACK repeats the INVITE's CSeq and the others count up from it.
+// The BYE is a transaction of its own, answered (and retransmitted over UDP)
+// like any, and a 401/407 to it is answered once with our credentials.
+//
+// Before the 2xx, hanging up is a CANCEL. It is answered at once, but the INVITE
+// it cancels then ends with a 487 of its own, which the INVITE transaction ACKs;
+// the call waits up to cancelWait for it rather than leaving the 487 to be
+// retransmitted at a transaction that is gone. A 2xx that crossed the CANCEL is
+// ACKed and hung up with a BYE.
+
+const (
+	byeTimeout = 5 * time.Second
+	cancelWait = 5 * time.Second
+)
+
+// sipDialog is the dialog of an answered call.
+type sipDialog struct {
+	cfg    *Config
+	invite *sip.Request
+	to     *sip.ToHeader // with the remote tag
+	target sip.Uri       // the remote target
+	routes []string      // the route set, as Route header values
+	strict bool          // the first route is a strict router
+	dest   string        // where requests go: the strict router, or the INVITE's destination without routes
+
+	mu    sync.Mutex
+	cseq  uint32
+	ended bool // a BYE was sent
+}
+
+// newSIPDialog is the dialog res, a 2xx, established for invite.
+func newSIPDialog(cfg *Config, invite *sip.Request, res *sip.Response) *sipDialog {
+	d := &sipDialog{cfg: cfg, invite: invite, to: res.To(), target: *invite.Recipient.Clone(), cseq: invite.CSeq().SeqNo}
+	if c := res.Contact(); c != nil {
+		d.target = *c.Address.Clone()
+	}
+	rr := res.GetHeaders("Record-Route")
+	for i := len(rr) - 1; i >= 0; i-- {
+		entries := splitAddressList(rr[i].Value())
+		for j := len(entries) - 1; j >= 0; j-- {
+			d.routes = append(d.routes, entries[j])
+		}
+	}
+	switch {
+	case len(d.routes) == 0:
+		d.dest = invite.Destination()
+	case !strings.Contains(strings.ToLower(d.routes[0]), ";lr"):
+		var first sip.Uri
+		if err := sip.ParseUri(strings.Trim(strings.TrimSpace(d.routes[0]), "<>"), &first); err == nil {
+			d.strict = true
+			if first.Port == 0 {
+				first.Port = cfg.sipPort()
+			}
+			d.dest = first.HostPort()
+		}
+	}
+	return d
+}
+
+// splitAddressList splits a header value listing addresses at its commas, except
+// those inside <> or quotes.
+func splitAddressList(v string) []string {
+	var parts []string
+	depth, quoted, start := 0, false, 0
+	for i, c := range v {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			depth++
+		case c == '>':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(v[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(v[start:]))
+}
+
+// request is a new request in the dialog. An ACK takes the INVITE's CSeq, any
+// other method the next one.
+func (d *sipDialog) request(method sip.RequestMethod) *sip.Request {
+	d.mu.Lock()
+	seq := d.invite.CSeq().SeqNo
+	if method != sip.ACK {
+		d.cseq++
+		seq = d.cseq
+	}
+	d.mu.Unlock()
+
+	uri, routes := d.target, d.routes
+	if d.strict {
+		var first sip.Uri
+		_ = sip.ParseUri(strings.Trim(strings.TrimSpace(routes[0]), "<>"), &first)
+		uri, routes = first, append(append([]string{}, routes[1:]...), "<"+d.target.String()+">")
+	}
+	req := sip.NewRequest(method, *uri.Clone())
+	for _, r := range routes {
+		req.AppendHeader(sip.NewHeader("Route", r))
+	}
+	req.AppendHeader(sip.HeaderClone(d.invite.From()))
+	req.AppendHeader(sip.HeaderClone(d.to))
+	req.AppendHeader(sip.HeaderClone(d.invite.CallID()))
+	req.AppendHeader(&sip.CSeqHeader{SeqNo: seq, MethodName: method})
+	if method == sip.ACK {
+		if c := d.invite.Contact(); c != nil {
+			req.AppendHeader(sip.HeaderClone(c))
+		}
+	}
+	if d.dest != "" {
+		req.SetDestination(d.dest)
+	}
+	req.SetTransport(d.invite.Transport())
+	req.Laddr = d.invite.Laddr
+	return req
+}
+
+// ack confirms the 2xx. ACKs aren't answered; a lost one shows as the 2xx being
+// retransmitted.
+func (d *sipDialog) ack(client *sipgo.Client) error {
+	return client.WriteRequest(d.request(sip.ACK))
+}
+
+// bye ends the dialog, once: a second call does nothing. It doesn't take the
+// call's context, which is usually what has just been cancelled.
+func (d *sipDialog) bye(log *callLogger, client *sipgo.Client) {
+	d.mu.Lock()
+	if d.ended {
+		d.mu.Unlock()
+		return
+	}
+	d.ended = true
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), byeTimeout)
+	defer cancel()
+	bye := d.request(sip.BYE)
+	res, err := client.Do(ctx, bye)
+	if err == nil && (res.StatusCode == 401 || res.StatusCode == 407) {
+		res, err = client.DoDigestAuth(ctx, bye, res, sipgo.DigestAuth{Username: d.cfg.SipUser, Password: d.cfg.SipPass})
+	}
+	switch {
+	case err != nil:
+		log.Printf("BYE sent, no answer: %v\n", err)
+	case res.StatusCode >= 300:
+		log.Printf("BYE sent, refused: %d %s\n", res.StatusCode, res.Reason)
+	default:
+		log.Println("BYE sent.")
+	}
+}
+
+// callDialog is a call's INVITE and, once answered, its dialog: hanging up sends
+// CANCEL until then and BYE after.
+type callDialog struct {
+	cfg    *Config
+	client *sipgo.Client
+
+	mu     sync.Mutex
+	invite *sip.Request
+	tx     sip.ClientTransaction // the INVITE's current transaction
+	dialog *sipDialog
+}
+
+// sent records tx as the INVITE's transaction, replacing any before it (digest
+// auth, Retry-After and redirects each send the INVITE again).
+func (c *callDialog) sent(tx sip.ClientTransaction) {
+	c.mu.Lock()
+	c.tx = tx
+	c.mu.Unlock()
+}
+
+// renew replaces the INVITE with req, a new attempt at the call (a retry after its
+// transaction ended), before req is sent.
+func (c *callDialog) renew(req *sip.Request) {
+	c.mu.Lock()
+	c.invite = req
+	c.mu.Unlock()
+}
+
+// terminate ends the INVITE's transaction, once the call is over.
+func (c *callDialog) terminate() {
+	c.mu.Lock()
+	tx := c.tx
+	c.mu.Unlock()
+	if tx != nil {
+		tx.Terminate()
+	}
+}
+
+// established records the dialog of 2xx res.
+func (c *callDialog) established(res *sip.Response) *sipDialog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := newSIPDialog(c.cfg, c.invite, res)
+	c.dialog = d
+	return d
+}
+
+// hangup ends the call: BYE once it is answered, CANCEL before. It reports whether
+// the provider confirmed a CANCEL with 487 Request Terminated.
+func (c *callDialog) hangup(log *callLogger) (terminated bool) {
+	c.mu.Lock()
+	d, tx, invite := c.dialog, c.tx, c.invite
+	c.mu.Unlock()
+	if d != nil {
+		d.bye(log, c.client)
+		return false
+	}
+	if !sendCANCEL(log, c.client, invite) || tx == nil {
+		return false
+	}
+	return c.awaitCancelled(log, tx)
+}
+
+// awaitCancelled waits up to cancelWait for the final response to the INVITE of
+// tx, just cancelled (RFC 3261 9.1): a 487, or whatever answer crossed the CANCEL.
+// The transaction ACKs a non-2xx itself, and answers its retransmissions; a 2xx
+// means the call was answered anyway, and is ACKed and hung up with a BYE.
+func (c *callDialog) awaitCancelled(log *callLogger, tx sip.ClientTransaction) bool {
+	timeout := time.NewTimer(cancelWait)
+	defer timeout.Stop()
+	for {
+		select {
+		case res, ok := <-tx.Responses():
+			if !ok {
+				return false
+			}
+			if res.StatusCode < 200 {
+				continue
+			}
+			log.Response(res)
+			switch {
+			case res.StatusCode < 300:
+				log.Println("Answered as it was cancelled — ACKing and hanging up.")
+				d := c.established(res)
+				if err := d.ack(c.client); err != nil {
+					log.Warnf("ACK could not be sent: %v\n", err)
+				}
+				d.bye(log, c.client)
+				return false
+			case res.StatusCode == 487:
+				log.Println("CANCEL confirmed (487 ACKed).")
+				return true
+			default:
+				return false
+			}
+		case <-tx.Done():
+			return false
+		case <-timeout.C:
+			log.Printf("No final response to the cancelled INVITE within %v.\n", cancelWait)
+			return false
+		}
+	}
+}
+
+// sendCANCEL cancels invite (RFC 3261 9.1): the same Request-URI, Call-ID, From,
+// To and top Via, and its CSeq number. It reports whether the CANCEL went out.
+func sendCANCEL(log *callLogger, client *sipgo.Client, invite *sip.Request) bool {
+	cancelReq := sip.NewRequest(sip.CANCEL, *invite.Recipient.Clone())
+	cancelReq.SetDestination(invite.Destination())
+	cancelReq.AppendHeader(sip.HeaderClone(invite.Via()))
+	cancelReq.AppendHeader(sip.HeaderClone(invite.From()))
+	cancelReq.AppendHeader(sip.HeaderClone(invite.To()))
+	cancelReq.AppendHeader(sip.HeaderClone(invite.CallID()))
+	cancelReq.AppendHeader(&sip.CSeqHeader{SeqNo: invite.CSeq().SeqNo, MethodName: sip.CANCEL})
+	cancelReq.SetTransport(invite.Transport())
+	cancelReq.Laddr = invite.Laddr
+	if err := client.WriteRequest(cancelReq); err != nil {
+		log.Printf("CANCEL could not be sent: %v\n", err)
+		return false
+	}
+	log.Println("CANCEL sent.")
+	return true
+}
+
+// String is d's remote target and route set, for the call's log.
+func (d *sipDialog) String() string {
+	s := "target " + d.target.String()
+	if len(d.routes) > 0 {
+		s += fmt.Sprintf(", route %s", strings.Join(d.routes, ", "))
+	}
+	return s
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// dialPlanAll is the --dial-plan key whose rules apply to gates without their own.
+const dialPlanAll = "*"
+
+// dialPrefix is what strip and add take: a piece of a dialableNumber.
+var dialPrefix = regexp.MustCompile(`^\+?[0-9*#]{0,10}$`)
+
+var dialRefused = newPersistentCounter("iftach_dial_refused_total", "Calls refused because the number matched no --dial-allow pattern, by gate.")
+
+// dialAllowed reports whether number may be dialled: it fully matches one of the
+// --dial-allow patterns, or there are none. The allowlist is the last line of
+// defence against a typo'd number being dialled over and over by schedules, so
+// it is checked in run() on the number actually put in the Request-URI.
+func (c *Config) dialAllowed(number string) bool {
+	if len(c.DialAllow) == 0 {
+		return true
+	}
+	for _, p := range c.DialAllow {
+		if re, err := regexp.Compile(`^(?:` + p + `)$`); err == nil && re.MatchString(number) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialRule is one --dial-plan step. Rules run in order on the number to dial,
+// right before the Request-URI is built:
+//
+//	e164:CC      national 0... and international 00... numbers to +E.164 (CC = country code)
+//	national:CC  +CC... back to the national 0... form
+//	strip:P      drop prefix P if the number starts with it
+//	add:P        prepend P (a provider routing prefix, say)
+type dialRule struct {
+	op, arg string
+}
+
+func (r dialRule) String() string {
+	return r.op + ":" + r.arg
+}
+
+// parseDialRules parses a comma-separated rule list, e.g. "e164:972,strip:+".
+func parseDialRules(s string) ([]dialRule, error) {
+	var rules []dialRule
+	for _, f := range strings.Split(s, ",") {
+		op, arg, _ := strings.Cut(strings.TrimSpace(f), ":")
+		r := dialRule{op, arg}
+		switch op {
+		case "e164", "national":
+			if !isDigits(arg) || len(arg) > 3 {
+				return nil, fmt.Errorf("%s needs a country code, e.g. %s:972", op, op)
+			}
+		case "strip", "add":
+			if arg == "" || !dialPrefix.MatchString(arg) {
+				return nil, fmt.Errorf("%s needs a prefix of digits, +, * or #", op)
+			}
+		default:
+			return nil, fmt.Errorf("unknown rule %q (want e164, national, strip or add)", f)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+func (r dialRule) apply(n string) string {
+	switch r.op {
+	case "e164":
+		switch {
+		case strings.HasPrefix(n, "+"):
+		case strings.HasPrefix(n, "00"):
+			n = "+" + n[2:]
+		case strings.HasPrefix(n, "0"):
+			n = "+" + r.arg + n[1:]
+		}
+	case "national":
+		if rest, ok := strings.CutPrefix(n, "+"+r.arg); ok {
+			n = "0" + rest
+		}
+	case "strip":
+		n = strings.TrimPrefix(n, r.arg)
+	case "add":
+		n = r.arg + n
+	}
+	return n
+}
+
+// dialRules returns the rules for gate ("" is the default gate).
+func (c *Config) dialRules(gate string) ([]dialRule, error) {
+	if gate == "" {
+		gate = defaultGate
+	}
+	s, ok := c.DialPlan[gate]
+	if !ok {
+		s, ok = c.DialPlan[dialPlanAll]
+	}
+	if !ok {
+		return nil, nil
+	}
+	return parseDialRules(s)
+}
+
+// dialFailure is the error code for a dialNumber error: a bad number, or a dial
+// plan that can't be used.
+func dialFailure(err error) errorCode {
+	if errors.Is(err, errInvalidNumber) {
+		return errBadNumber
+	}
+	return errSipSetup
+}
+
+// dialStep is one rule applied to a number, for traces and `dialplan test`.
+type dialStep struct {
+	Rule   dialRule
+	Number string // after the rule
+}
+
+// dialNumber runs number through gate's dial plan, returning the number to put in
+// the Request-URI and the steps that got it there. With --default-region the
+// number is first normalized to +E.164 (shown as a region:XX step), and an
+// invalid one is an error wrapping errInvalidNumber.
+func (c *Config) dialNumber(gate, number string) (string, []dialStep, error) {
+	rules, err := c.dialRules(gate)
+	if err != nil {
+		return "", nil, err
+	}
+	var steps []dialStep
+	if c.DefaultRegion != "" && !isFeatureCode(number) {
+		if number, err = parsePhoneNumber(number, c.DefaultRegion); err != nil {
+			return "", nil, err
+		}
+		steps = append(steps, dialStep{dialRule{"region", strings.ToUpper(c.DefaultRegion)}, number})
+	}
+	for _, r := range rules {
+		number = r.apply(number)
+		steps = append(steps, dialStep{r, number})
+	}
+	if !dialableNumber.MatchString(number) {
+		return "", steps, fmt.Errorf("dial plan turns it into %q, which is not dialable", number)
+	}
+	return number, steps, nil
+}
+
+// checkDialPlan reports --dial-plan, --dial-allow and --default-region problems for
+// check(): unknown gates, bad rules, patterns or regions, and configured numbers
+// that are not valid or would end up undialable or refused.
+func (c *Config) checkDialPlan() []string {
+	var problems []string
+	for gate, s := range c.DialPlan {
+		if _, ok := c.gateNumber(gate); !ok && gate != dialPlanAll {
+			problems = append(problems, fmt.Sprintf("--dial-plan gate %q is not configured", gate))
+		}
+		if _, err := parseDialRules(s); err != nil {
+			problems = append(problems, fmt.Sprintf("--dial-plan %s: %v", gate, err))
+		}
+	}
+	if _, ok := phoneRegions[strings.ToUpper(c.DefaultRegion)]; c.DefaultRegion != "" && !ok {
+		problems = append(problems, fmt.Sprintf("--default-region %q is not supported (want one of %s)", c.DefaultRegion, phoneRegionNames()))
+	}
+	for _, p := range c.DialAllow {
+		if _, err := regexp.Compile(p); err != nil {
+			problems = append(problems, fmt.Sprintf("--dial-allow %q is not a valid regular expression", p))
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	// Every configured number must survive its plan and the allowlist, or the gate
+	// could never be opened.
+	type target struct{ what, gate, number string }
+	targets := []target{{"--destination", defaultGate, c.Destination}}
+	for gate, n := range c.Gates {
+		targets = append(targets, target{"--gates " + gate, gate, n})
+	}
+	for gate, n := range c.AutoClose {
+		targets = append(targets, target{"--auto-close " + gate, gate, n})
+	}
+	if c.TestDestination != "" {
+		targets = append(targets, target{"--test-destination", defaultGate, c.TestDestination})
+	}
+	for name, n := range c.RingMe {
+		targets = append(targets, target{"--ring-me " + name, dialPlanAll, n})
+	}
+	for _, t := range targets {
+		if t.number == "" {
+			continue
+		}
+		n, _, err := c.dialNumber(t.gate, t.number)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s %s: %v", t.what, t.number, err))
+		case !c.dialAllowed(n):
+			problems = append(problems, fmt.Sprintf("%s dials %s, which matches no --dial-allow pattern", t.what, n))
+		}
+	}
+	return problems
+}
+
+// DialplanCmd groups dial plan helpers.
+type DialplanCmd struct {
+	Test DialplanTestCmd `kong:"cmd,help='Show what the dial plan makes of a number'"`
+}
+
+// DialplanTestCmd runs a number through a gate's --dial-plan rules, step by step.
+type DialplanTestCmd struct {
+	Config `kong:"embed"`
+
+	Number string `kong:"arg,help='Number to dial'"`
+	Gate   string `kong:"help='Gate whose rules to apply',default='default'"`
+}
+
+func (c *DialplanTestCmd) Run() error {
+	rules, err := c.Config.dialRules(c.Gate)
+	if err != nil {
+		return fmt.Errorf("--dial-plan %s: %w", c.Gate, err)
+	}
+	if len(rules) == 0 {
+		fmt.Printf("No dial plan for %s: %s is dialled as is.\n", c.Gate, c.Number)
+	}
+	n, steps, err := c.Config.dialNumber(c.Gate, c.Number)
+	fmt.Printf("  %s\n", c.Number)
+	for _, st := range steps {
+		fmt.Printf("  → %-16s %s\n", st.Rule, st.Number)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ %s dials %s\n", c.Gate, n)
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Discovery finds SIP devices on the LAN (an intercom, a local PBX) for setups that
+// dial one directly rather than through a provider. Two scans run at once:
+//   - mDNS/DNS-SD: devices advertising _sip._udp or _sip._tcp, SIP-capable by
+//     definition;
+//   - SSDP (UPnP): every device that answers an M-SEARCH, most of which aren't SIP,
+//     so each is sent a SIP OPTIONS on port 5060 and kept only if it answers.
+//
+// The setup wizard offers what it finds as the SIP domain (POST /setup/discover),
+// and iftach discover lists it.
+
+const (
+	discoverWait  = 2 * time.Second // for answers to each scan
+	sipProbePort  = 5060
+	sipProbeWait  = time.Second
+	ssdpGroupAddr = "239.255.255.250:1900"
+)
+
+var discoverServices = []string{"_sip._udp.local.", "_sip._tcp.local."}
+
+// discoveredDevice is a SIP device found on the LAN.
+type discoveredDevice struct {
+	Name      string `json:"name"` // the DNS-SD instance name, or the SSDP friendly server string
+	Host      string `json:"host"` // IPv4 address
+	Port      int    `json:"port"`
+	Transport string `json:"transport"`       // udp or tcp
+	Via       string `json:"via"`             // mdns or ssdp
+	Agent     string `json:"agent,omitempty"` // its SIP Server or User-Agent header, if probed
+}
+
+// discoverSIPDevices scans the LAN, returning the devices found sorted by address.
+func discoverSIPDevices(ctx context.Context) []discoveredDevice {
+	var (
+		mu      sync.Mutex
+		devices []discoveredDevice
+		wg      sync.WaitGroup
+	)
+	add := func(d ...discoveredDevice) {
+		mu.Lock()
+		devices = append(devices, d...)
+		mu.Unlock()
+	}
+	wg.Go(func() { add(browseMDNS(ctx)...) })
+	wg.Go(func() { add(searchSSDP(ctx)...) })
+	wg.Wait()
+
+	slices.SortFunc(devices, func(a, b discoveredDevice) int {
+		return strings.Compare(fmt.Sprintf("%s:%05d %s", a.Host, a.Port, a.Via), fmt.Sprintf("%s:%05d %s", b.Host, b.Port, b.Via))
+	})
+	// A device found by both scans is listed once, as mDNS names it.
+	return slices.CompactFunc(devices, func(a, b discoveredDevice) bool { return a.Host == b.Host && a.Port == b.Port })
+}
+
+// browseMDNS asks for the SIP services with the unicast-response bit set, so
+// responders answer this socket directly, and collects their PTR, SRV and A records.
+func browseMDNS(ctx context.Context) []discoveredDevice {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	query := make([]byte, 12)
+	binary.BigEndian.PutUint16(query[4:], uint16(len(discoverServices)))
+	for _, service := range discoverServices {
+		query = append(query, dnsName(service)...)
+		query = binary.BigEndian.AppendUint16(query, dnsTypePTR)
+		query = binary.BigEndian.AppendUint16(query, dnsClassIN|mdnsUnicast)
+	}
+	if _, err := conn.WriteToUDP(query, &net.UDPAddr{IP: mdnsGroup, Port: mdnsPort}); err != nil {
+		return nil
+	}
+
+	type instance struct{ name, transport string }
+	instances := map[string]instance{} // by lowercased name
+	type target struct {
+		host string
+		port int
+	}
+	srv := map[string]target{}
+	addrs := map[string]net.IP{}
+	readUntil(ctx, conn, func(msg []byte, _ *net.UDPAddr) {
+		for _, rr := range parseDNSRecords(msg) {
+			switch rr.rtype {
+			case dnsTypePTR:
+				if slices.Contains(discoverServices, rr.name) {
+					if name, _, ok := readDNSName(msg, rr.rdata); ok {
+						instances[strings.ToLower(name)] = instance{name, strings.TrimPrefix(strings.Split(rr.name, ".")[1], "_")}
+					}
+				}
+			case dnsTypeSRV:
+				if rr.rdlen >= 7 {
+					port := int(binary.BigEndian.Uint16(msg[rr.rdata+4:]))
+					if host, _, ok := readDNSName(msg, rr.rdata+6); ok {
+						srv[rr.name] = target{strings.ToLower(host), port}
+					}
+				}
+			case dnsTypeA:
+				if rr.rdlen == 4 {
+					addrs[rr.name] = net.IP(slices.Clone(msg[rr.rdata : rr.rdata+4]))
+				}
+			}
+		}
+	})
+
+	var devices []discoveredDevice
+	for key, in := range instances {
+		t, ok := srv[key]
+		if !ok {
+			continue
+		}
+		ip, ok := addrs[t.host]
+		if !ok {
+			continue // no A record came with it; the .local name alone isn't dialable from here
+		}
+		name, _, _ := strings.Cut(in.name, "._sip.")
+		devices = append(devices, discoveredDevice{Name: name, Host: ip.String(), Port: t.port, Transport: in.transport, Via: "mdns"})
+	}
+	return devices
+}
+
+// searchSSDP sends an M-SEARCH for every UPnP device and probes each that answers
+// for SIP.
+func searchSSDP(ctx context.Context) []discoveredDevice {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	group, err := net.ResolveUDPAddr("udp4", ssdpGroupAddr)
+	if err != nil {
+		return nil
+	}
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: " + ssdpGroupAddr + "\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: ssdp:all\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), group); err != nil {
+		return nil
+	}
+
+	servers := map[string]string{} // address -> SERVER header
+	readUntil(ctx, conn, func(msg []byte, from *net.UDPAddr) {
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(msg)), nil)
+		if err != nil {
+			return
+		}
+		res.Body.Close()
+		host := from.IP.String()
+		if loc, err := url.Parse(res.Header.Get("Location")); err == nil && loc.Hostname() != "" {
+			host = loc.Hostname()
+		}
+		if _, seen := servers[host]; !seen || servers[host] == "" {
+			servers[host] = res.Header.Get("Server")
+		}
+	})
+
+	var (
+		mu      sync.Mutex
+		devices []discoveredDevice
+		wg      sync.WaitGroup
+	)
+	for host, server := range servers {
+		wg.Go(func() {
+			agent, ok := probeSIPOptions(net.JoinHostPort(host, strconv.Itoa(sipProbePort)))
+			if !ok {
+				return
+			}
+			mu.Lock()
+			devices = append(devices, discoveredDevice{Name: server, Host: host, Port: sipProbePort, Transport: "udp", Via: "ssdp", Agent: agent})
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	return devices
+}
+
+// readUntil hands fn every datagram conn receives within discoverWait.
+func readUntil(ctx context.Context, conn *net.UDPConn, fn func(msg []byte, from *net.UDPAddr)) {
+	deadline := time.Now().Add(discoverWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetReadDeadline(deadline)
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		fn(buf[:n], from)
+	}
+}
+
+// probeSIPOptions sends a SIP OPTIONS over UDP to addr and reports whether anything
+// SIP answered, with its Server or User-Agent header. Any status will do: a 401 or
+// 404 is still a SIP device.
+func probeSIPOptions(addr string) (agent string, ok bool) {
+	conn, err := net.Dial("udp4", addr)
+	if err != nil {
+		return "", false
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr)
+	tag := newSessionID()
+	req := fmt.Sprintf("OPTIONS sip:%[1]s SIP/2.0\r\n"+
+		"Via: SIP/2.0/UDP %[2]s;branch=z9hG4bK%[3]s;rport\r\n"+
+		"Max-Forwards: 70\r\n"+
+		"From: <sip:iftach@%[2]s>;tag=%[3]s\r\n"+
+		"To: <sip:%[1]s>\r\n"+
+		"Call-ID: %[3]s@%[2]s\r\n"+
+		"CSeq: 1 OPTIONS\r\n"+
+		"Accept: application/sdp\r\n"+
+		"Content-Length: 0\r\n\r\n", addr, local.String(), tag)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return "", false
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(sipProbeWait))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil || !bytes.HasPrefix(buf[:n], []byte("SIP/2.0 ")) {
+		return "", false
+	}
+	for line := range strings.SplitSeq(string(buf[:n]), "\r\n") {
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "Server") || strings.EqualFold(name, "User-Agent") {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", true
+}
+
+// dnsRR is a resource record of a DNS message, its data left in place (offsets
+// into the message) so names in it can be decompressed.
+type dnsRR struct {
+	name  string
+	rtype uint16
+	rdata int // offset of the data
+	rdlen int
+}
+
+// parseDNSRecords returns every answer, authority and additional record of msg,
+// stopping at the first that doesn't parse.
+func parseDNSRecords(msg []byte) []dnsRR {
+	if len(msg) < 12 {
+		return nil
+	}
+	off := 12
+	for range binary.BigEndian.Uint16(msg[4:]) {
+		_, next, ok := readDNSName(msg, off)
+		if !ok {
+			return nil
+		}
+		off = next + 4
+	}
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	var records []dnsRR
+	for range count {
+		name, next, ok := readDNSName(msg, off)
+		if !ok || next+10 > len(msg) {
+			break
+		}
+		rr := dnsRR{name: strings.ToLower(name), rtype: binary.BigEndian.Uint16(msg[next:]), rdata: next + 10, rdlen: int(binary.BigEndian.Uint16(msg[next+8:]))}
+		if rr.rdata+rr.rdlen > len(msg) {
+			break
+		}
+		records = append(records, rr)
+		off = rr.rdata + rr.rdlen
+	}
+	return records
+}
+
+// DiscoverCmd lists the SIP devices on the LAN.
+type DiscoverCmd struct{}
+
+func (c *DiscoverCmd) Run() error {
+	fmt.Println("🔎 Looking for SIP devices on the LAN (mDNS and SSDP)...")
+	devices := discoverSIPDevices(context.Background())
+	if len(devices) == 0 {
+		fmt.Println("Nothing found. Devices on another subnet or VLAN can't be discovered.")
+		return nil
+	}
+	for _, d := range devices {
+		fmt.Printf("   %s:%d/%s  %s (%s)", d.Host, d.Port, d.Transport, d.Name, d.Via)
+		if d.Agent != "" {
+			fmt.Printf(" — %s", d.Agent)
+		}
+		fmt.Println()
+	}
+	fmt.Println("Dial one with --sip-domain=ADDRESS --sip-port=PORT --use-tls=false.")
+	return nil
+}
+
+// handleDiscover is POST /setup/discover with {"code"}: the SIP devices on the LAN,
+// for the wizard to offer as the SIP domain.
+func (s *setupWizard) handleDiscover(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+		return
+	}
+	if !s.checkCode(req.Code) {
+		writeAPIError(w, r, http.StatusUnauthorized, errAuth, "setup_code_wrong")
+		return
+	}
+	devices := discoverSIPDevices(r.Context())
+	if devices == nil {
+		devices = []discoveredDevice{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
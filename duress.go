@@ -0,0 +1,111 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --duress-token is for a resident made to open the gate against their will: it
+// works wherever --call-token does, and nothing the caller sees differs (the call,
+// its statuses, its history entry), but every call placed with it also raises a
+// silent alarm. The alarm is a duress notification with priority high, POSTed to
+// --notify-url and every --duress-urls, and a Telegram message to
+// --telegram-chats. Unlike failure notifications and other Telegram messages,
+// each is tried duressAttempts times. Duress calls within duressQuiet of the alarm
+// (a batch opening both gates, say) raise no new one. The alarm is also in the
+// audit log, which the caller can't read.
+//
+// During --approval-windows a duress call waits for approval like any other call,
+// since letting it through at once would tell the caller something is different.
+// The alarm goes out as the call is placed, before the wait, so whoever is asked to
+// approve it has already been told why.
+
+const (
+	duressAttempts = 3
+	duressRetry    = 5 * time.Second
+	duressQuiet    = 2 * time.Minute
+)
+
+// notifyDuress is the notification event of a duress alarm.
+const notifyDuress = "duress"
+
+var duressAlarms = newCounter("iftach_duress_alarms_total", "Duress alarms raised by --duress-token calls.")
+
+// duressToken stands for --duress-token where callAuth returns a named token: it
+// behaves like --call-token (no name, every gate) but marks the calls it places.
+var duressToken = &namedToken{duress: true}
+
+// underDuress reports whether t is --duress-token.
+func (t *namedToken) underDuress() bool {
+	return t != nil && t.duress
+}
+
+// duressAlarm raises the alarm for duress calls, once per duressQuiet.
+type duressAlarm struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+var duress = &duressAlarm{}
+
+// raise sends the alarm for call s, placed under duress with opts.
+func (d *duressAlarm) raise(opts callOptions, s *callSession) {
+	now := time.Now()
+	d.mu.Lock()
+	quiet := now.Sub(d.last) < duressQuiet
+	if !quiet {
+		d.last = now
+	}
+	d.mu.Unlock()
+	if quiet {
+		return
+	}
+	duressAlarms.inc()
+	gate := cmp.Or(opts.Gate, defaultGate)
+	note := notification{
+		Event: notifyDuress, Priority: "high", Gate: gate, Since: displayTime(s.StartedAt), CallID: s.ID,
+		Text: fmt.Sprintf("DURESS: the duress token is opening %s (%s); the caller may be forced", gate, opts.Source),
+	}
+	s.log.Warnf("Duress token used to open %s: raising the alarm\n", gate)
+	auditLog.add(auditRecord{Event: auditDuress, Detail: fmt.Sprintf("%s: %s, %s", s.ID, gate, opts.Source)})
+	urls := cli.DuressUrls
+	if cli.NotifyURL != "" {
+		urls = append([]string{cli.NotifyURL}, urls...)
+	}
+	for _, u := range urls {
+		go d.post(u, note)
+	}
+	if cli.TelegramToken != "" {
+		for _, chat := range cli.TelegramChats {
+			go d.deliver("Telegram chat "+chat, func() error { return postTelegram(chat, "🚨 "+note.Text, "") })
+		}
+	}
+}
+
+// post sends note to url, trying duressAttempts times.
+func (d *duressAlarm) post(url string, note notification) {
+	n := &notifyDispatcher{url: url, client: notifyClient}
+	result := "ok"
+	if d.deliver(url, func() error { return n.post(note) }) != nil {
+		result = "failed"
+	}
+	notificationsSent.inc("event", note.Event, "result", result)
+}
+
+// deliver calls send until it succeeds, duressAttempts times at most, logging the
+// alarm to to as lost if it never does.
+func (d *duressAlarm) deliver(to string, send func() error) error {
+	var err error
+	for attempt := range duressAttempts {
+		if attempt > 0 {
+			time.Sleep(duressRetry)
+		}
+		if err = send(); err == nil {
+			return nil
+		}
+	}
+	logWarn("Duress alarm to %s could not be sent: %v\n", to, err)
+	return err
+}
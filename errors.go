@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// errorCode is a stable, machine-readable failure reason. The same codes appear in
+// WebSocket status messages, REST error bodies and log lines, so integrations can
+// branch on them; never rename one, only add.
+type errorCode string
+
+const (
+	errAuth         errorCode = "E_AUTH"          // missing or wrong API/WebSocket token
+	errForbidden    errorCode = "E_FORBIDDEN"     // the named call token may not open this gate
+	errTokenExpired errorCode = "E_TOKEN_EXPIRED" // the named call token is outside its validity window
+	errTokenUsed    errorCode = "E_TOKEN_USED"    // the one-time call token was used up (or is in use)
+	errBadRequest   errorCode = "E_BAD_REQUEST"   // malformed API request
+	errNotFound     errorCode = "E_NOT_FOUND"     // unknown call ID or resource
+	errRateLimited  errorCode = "E_RATE_LIMITED"  // too many requests from this client
+	errIPDiscovery  errorCode = "E_IP_DISCOVERY"  // public IP for the Contact header unavailable
+	errSipSetup     errorCode = "E_SIP_SETUP"     // local SIP stack could not be created
+	errSipAuth      errorCode = "E_SIP_AUTH"      // provider rejected our digest credentials
+	errNoTrying     errorCode = "E_NO_TRYING"     // no 100 Trying within the wait window
+	errBusy         errorCode = "E_BUSY"          // 486 Busy Here / 600 Busy Everywhere
+	errSip4xx       errorCode = "E_SIP_4XX"       // other 4xx final response
+	errSip5xx       errorCode = "E_SIP_5XX"       // other 5xx final response
+	errSip6xx       errorCode = "E_SIP_6XX"       // other 6xx final response
+	errRedirect     errorCode = "E_REDIRECT"      // a 3xx with no usable Contact, or past maxRedirects
+	errProviderDown errorCode = "E_PROVIDER_DOWN" // transport/transaction failure or 503
+	errDialRefused  errorCode = "E_DIAL_REFUSED"  // number outside --dial-allow; never dialled
+	errBadNumber    errorCode = "E_BAD_NUMBER"    // number invalid for --default-region; never dialled
+	errNoAnswer     errorCode = "E_NO_ANSWER"     // a bridged call's leg rang out
+	errIntercom     errorCode = "E_INTERCOM"      // the intercom's leg failed: unusable offer, no ACK
+	errBudget       errorCode = "E_BUDGET"        // this month's calls reached --budget-hard; never dialled
+	errNotApproved  errorCode = "E_NOT_APPROVED"  // the call needed approval and was denied, or nobody answered; never dialled
+	errStandby      errorCode = "E_STANDBY"       // another --cluster-db instance holds the call lease; never dialled
+	errInternal     errorCode = "E_INTERNAL"      // anything else
+)
+
+// Message returns the code's human-readable text in defaultLang (see catalog in
+// i18n.go; API responses use the request's language instead).
+func (c errorCode) Message() string {
+	return localize(defaultLang, string(c))
+}
+
+// callError is how run failed a call: the status and error code of the failure
+// it reported.
+type callError struct {
+	Status string
+	Code   errorCode
+}
+
+func (e *callError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Code.Message())
+}
+
+// sipErrorCode classifies a final (>=300) SIP response.
+func sipErrorCode(res *sip.Response) errorCode {
+	switch {
+	case res.StatusCode == 486 || res.StatusCode == 600:
+		return errBusy
+	case res.StatusCode == 401 || res.StatusCode == 407:
+		return errSipAuth
+	case res.StatusCode == 503:
+		return errProviderDown
+	case res.StatusCode >= 600:
+		return errSip6xx
+	case res.StatusCode >= 500:
+		return errSip5xx
+	case res.StatusCode < 400:
+		return errRedirect
+	default:
+		return errSip4xx
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --backup-sip-domain is a second SIP trunk, with an account of its own
+// (--backup-sip-user, --backup-sip-pass, --backup-sip-port; the transport, TLS and
+// everything else are shared), for when the primary can't place calls. A call goes
+// through the backup when:
+//
+//   - the --register registration with --sip-domain has failed: the primary isn't
+//     tried at all;
+//   - failoverAfter calls in a row failed on the primary: calls go straight to the
+//     backup for failoverHold, then the primary gets another chance;
+//   - it failed on the primary with E_PROVIDER_DOWN, E_SIP_5XX or E_NO_TRYING (after
+//     any --retry): it is placed again through the backup at once.
+//
+// A call reports failover before dialing the backup, and the history records which
+// trunk each call went through.
+const (
+	failoverAfter = 3
+	failoverHold  = 5 * time.Minute
+)
+
+var trunkFailovers = newCounter("iftach_trunk_failovers_total", "Calls placed through --backup-sip-domain, by reason (registration, held, failed).")
+
+// primaryTrunk tracks the primary trunk's failures in a row.
+var primaryTrunk = &trunkState{}
+
+type trunkState struct {
+	mu       sync.Mutex
+	failures int       // calls in a row that failed on the trunk
+	heldTill time.Time // calls skip the trunk until then
+}
+
+// result records how a call through the trunk went: failed on the trunk, or not.
+func (t *trunkState) result(failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !failed {
+		t.failures = 0
+		return
+	}
+	t.failures++
+	if t.failures >= failoverAfter {
+		logWarn("%d calls in a row failed on %s — using --backup-sip-domain for %v.\n", t.failures, cli.SipDomain, failoverHold)
+		t.failures, t.heldTill = 0, time.Now().Add(failoverHold)
+	}
+}
+
+// held reports whether calls skip the trunk for now.
+func (t *trunkState) held() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().Before(t.heldTill)
+}
+
+// trunkFailure reports whether a call failing with code says the trunk is down,
+// rather than the number or the account being the problem.
+func trunkFailure(code errorCode) bool {
+	return code == errProviderDown || code == errSip5xx || code == errNoTrying
+}
+
+// backupTrunk is c with the --backup-sip-domain account in place of the primary's,
+// nil without one.
+func (c *Config) backupTrunk() *Config {
+	if c.BackupSipDomain == "" {
+		return nil
+	}
+	b := *c
+	b.SipDomain, b.SipPort = c.BackupSipDomain, c.BackupSipPort
+	b.SipUser, b.SipPass = cmp.Or(c.BackupSipUser, c.SipUser), cmp.Or(c.BackupSipPass, c.SipPass)
+	b.SipProxies = nil // the primary's edges
+	b.BackupSipDomain = ""
+	return &b
+}
+
+// failoverAllowance is how much longer than callHardCap a call may run for failing
+// over: the backup's attempt, and its --retry attempts, after the primary's.
+func (c *Config) failoverAllowance() time.Duration {
+	if c.BackupSipDomain == "" {
+		return 0
+	}
+	return c.Wait100Timeout + c.CallDuration + cancelWait + c.retryAllowance()
+}
+
+// runFailover places a call like run, through the backup trunk when there is one
+// and the primary is down or fails the call.
+func runFailover(ctx context.Context, cfg *Config, opts callOptions, statusChan chan<- callStatusMsg) {
+	backup := cfg.backupTrunk()
+	if backup == nil {
+		run(ctx, cfg, opts, nil, statusChan)
+		return
+	}
+	log := callLog(ctx)
+	forward := func(m callStatusMsg) {
+		select {
+		case statusChan <- m:
+		default:
+		}
+	}
+	failover := func(reason, why string) {
+		trunkFailovers.inc("reason", reason)
+		log.Printf("%s — dialing through the backup trunk %s.\n", why, backup.SipDomain)
+		forward(callStatusMsg{Status: statusFailover})
+	}
+
+	switch st := registrar.Status(); {
+	case st != nil && st.State == regFailed:
+		failover("registration", fmt.Sprintf("Not registered with %s [%s]", cfg.SipDomain, st.Code))
+		run(ctx, backup, opts, nil, statusChan)
+		return
+	case primaryTrunk.held():
+		failover("held", fmt.Sprintf("%s failed the last calls", cfg.SipDomain))
+		run(ctx, backup, opts, nil, statusChan)
+		return
+	}
+
+	// The primary's failure is held back until its run is over: only then is it
+	// known to be the last word, or the backup's to come.
+	primary := make(chan callStatusMsg, cap(statusChan))
+	go run(ctx, cfg, opts, nil, primary)
+	var failed *callStatusMsg
+	for m := range primary {
+		if failed != nil {
+			forward(*failed)
+			failed = nil
+		}
+		if m.Status == statusError && trunkFailure(m.Code) {
+			failed = &m
+			continue
+		}
+		forward(m)
+	}
+	if ctx.Err() == nil {
+		primaryTrunk.result(failed != nil)
+	}
+	if failed == nil || ctx.Err() != nil {
+		if failed != nil {
+			forward(*failed)
+		}
+		close(statusChan)
+		return
+	}
+	failover("failed", fmt.Sprintf("%s failed the call [%s]", cfg.SipDomain, failed.Code))
+	run(ctx, backup, opts, nil, statusChan)
+}
+
+// trunkLocked is the trunk s went through, "" without --backup-sip-domain. s.mu is
+// held.
+func (s *callSession) trunkLocked() string {
+	if cli.BackupSipDomain == "" {
+		return ""
+	}
+	for _, st := range s.statuses {
+		if st.Status == statusFailover {
+			return cli.BackupSipDomain
+		}
+	}
+	return cli.SipDomain
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/icholy/digest"
+)
+
+// The button-to-INVITE fast path: pressing the button should cost the SIP round
+// trips and nothing else, so what a call would otherwise wait for is done ahead
+// of it. The public IP comes from --ip-cache and the user agent is the shared one
+// of --sip-reuse; on top of those,
+//
+//   - --dns-cache keeps the provider's DNS answers (sipTargets), looked up again
+//     in the background once half of it has passed, so a call only waits for a
+//     lookup when there is no answer at all. A provider with a single address gets
+//     the INVITE sent there directly, skipping sipgo's own lookup;
+//   - --sip-preauth sends the INVITE with the answer to the provider's previous
+//     digest challenge (nc counted up), saving the 401 round trip for as long as
+//     the provider accepts the nonce. A stale nonce gets challenged as usual.
+//
+// How long the path took, from run being handed the call to the INVITE being
+// written, is summed in iftach_invite_seconds_total; a call over --invite-budget
+// is logged. BenchmarkButtonToInvite (fastpath_test.go) measures the same path
+// against a local UAS and fails over IFTACH_INVITE_BUDGET (default 300ms).
+
+var (
+	inviteSeconds = newCounter("iftach_invite_seconds_total", "Seconds from taking a call to its INVITE going out, summed over calls.")
+	invitesSent   = newCounter("iftach_invites_sent_total", "Calls whose INVITE went out, by budget (within, over --invite-budget).")
+)
+
+// invited records that the call taken at begin has sent its INVITE.
+func invited(log *callLogger, trace *callTrace, cfg *Config, begin time.Time) {
+	took := time.Since(begin)
+	inviteSeconds.add(took.Seconds())
+	trace.add("INVITE out %v after taking the call", took.Round(time.Microsecond))
+	if cfg.InviteBudget > 0 && took > cfg.InviteBudget {
+		invitesSent.inc("budget", "over")
+		log.Printf("The INVITE went out %v after taking the call, over --invite-budget (%v).\n", took.Round(time.Millisecond), cfg.InviteBudget)
+		return
+	}
+	invitesSent.inc("budget", "within")
+}
+
+// providerDNS is the --dns-cache copy of every trunk's sipTargets.
+var providerDNS = &dnsCache{entries: map[string]*dnsEntry{}}
+
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]*dnsEntry // by transport, domain and port
+}
+
+type dnsEntry struct {
+	targets    []string
+	at         time.Time // when targets were looked up
+	refreshing bool
+}
+
+// sipTargets is lookupSIPTargets, from --dns-cache while it has an answer.
+func (c *Config) sipTargets(ctx context.Context) []string {
+	if c.DnsCache <= 0 {
+		return c.lookupSIPTargets(ctx)
+	}
+	key := fmt.Sprintf("%s %s:%d", c.sipTransport(), c.SipDomain, c.sipPort())
+	d := providerDNS
+	d.mu.Lock()
+	e := d.entries[key]
+	if e != nil && time.Since(e.at) < c.DnsCache {
+		if time.Since(e.at) >= c.DnsCache/2 && !e.refreshing {
+			e.refreshing = true
+			go d.refresh(key, c)
+		}
+		targets := e.targets
+		d.mu.Unlock()
+		return targets
+	}
+	d.mu.Unlock()
+	targets := c.lookupSIPTargets(ctx)
+	d.store(key, targets)
+	return targets
+}
+
+// sipAddress is where to send the INVITE when --dns-cache found the provider at a
+// single address, "" to leave the lookup to sipgo.
+func (c *Config) sipAddress(targets []string) string {
+	if c.DnsCache <= 0 || len(targets) != 1 || len(c.SipProxies) > 0 {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(targets[0]); err != nil || net.ParseIP(host) == nil {
+		return "" // an SRV target, looked up by name
+	}
+	return targets[0]
+}
+
+// refresh looks key up again in the background, keeping the old answer if that
+// finds nothing.
+func (d *dnsCache) refresh(key string, c *Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), sipRaceTimeout)
+	defer cancel()
+	targets := c.lookupSIPTargets(ctx)
+	d.mu.Lock()
+	if e := d.entries[key]; e != nil {
+		e.refreshing = false
+	}
+	d.mu.Unlock()
+	d.store(key, targets)
+}
+
+// store caches targets for key. No answer isn't cached: the next call asks again.
+func (d *dnsCache) store(key string, targets []string) {
+	if len(targets) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[key] = &dnsEntry{targets: targets, at: time.Now()}
+}
+
+// sipChallenges keeps each trunk's latest digest challenge for --sip-preauth.
+var sipChallenges = &challengeCache{entries: map[string]*cachedChallenge{}}
+
+type challengeCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedChallenge // by user@domain
+}
+
+type cachedChallenge struct {
+	header string // Authorization, or Proxy-Authorization for a 407
+	chal   *digest.Challenge
+	count  int // nc of the last answer
+}
+
+// remember keeps the challenge of 401/407 res for cfg's trunk.
+func (c *challengeCache) remember(cfg *Config, res *sip.Response) {
+	header, from := "Authorization", "WWW-Authenticate"
+	if res.StatusCode == 407 {
+		header, from = "Proxy-Authorization", "Proxy-Authenticate"
+	}
+	h := res.GetHeader(from)
+	if h == nil {
+		return
+	}
+	chal, err := digest.ParseChallenge(h.Value())
+	if err != nil || !digest.CanDigest(chal) {
+		return
+	}
+	chal.Algorithm = sip.ASCIIToUpper(chal.Algorithm) // as sipgo answers it
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cfg.SipUser+"@"+cfg.SipDomain] = &cachedChallenge{header: header, chal: chal}
+}
+
+// apply adds the answer to the last challenge of cfg's trunk to req, reporting
+// whether there was one.
+func (c *challengeCache) apply(cfg *Config, req *sip.Request) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[cfg.SipUser+"@"+cfg.SipDomain]
+	if e == nil {
+		return false
+	}
+	e.count++
+	cred, err := digest.Digest(e.chal, digest.Options{
+		Method: req.Method.String(), URI: req.Recipient.Addr(), Count: e.count,
+		Username: cfg.SipUser, Password: cfg.SipPass,
+	})
+	if err != nil {
+		return false
+	}
+	req.RemoveHeader(e.header)
+	req.AppendHeader(sip.NewHeader(e.header, cred.String()))
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/icholy/digest"
+)
+
+// BenchmarkButtonToInvite times the fast path as serve runs it (shared UA, cached
+// IP and DNS, --sip-preauth) from run taking a call to its INVITE reaching a UAS on
+// loopback, which challenges the first INVITE and answers the rest 486. It fails
+// when the mean is over IFTACH_INVITE_BUDGET (default 300ms), to run on the
+// reference hardware: go test -run=^$ -bench=ButtonToInvite
+func BenchmarkButtonToInvite(b *testing.B) {
+	budget := 300 * time.Millisecond
+	if v := os.Getenv("IFTACH_INVITE_BUDGET"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			b.Fatalf("IFTACH_INVITE_BUDGET: %v", err)
+		}
+		budget = d
+	}
+
+	srvUA, err := sipgo.NewUA()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srvUA.Close()
+	srv, err := sipgo.NewServer(srvUA)
+	if err != nil {
+		b.Fatal(err)
+	}
+	arrived := make(chan time.Time, 16)
+	var seen sync.Map // Call-IDs whose first INVITE arrived
+	srv.OnInvite(func(req *sip.Request, tx sip.ServerTransaction) {
+		if _, dup := seen.LoadOrStore(req.CallID().Value(), true); !dup {
+			arrived <- time.Now()
+		}
+		if req.GetHeader("Authorization") == nil {
+			res := sip.NewResponseFromRequest(req, 401, "Unauthorized", nil)
+			chal := digest.Challenge{Realm: "bench", Nonce: "c0ffee", Algorithm: "MD5"}
+			res.AppendHeader(sip.NewHeader("WWW-Authenticate", chal.String()))
+			_ = tx.Respond(res)
+			return
+		}
+		_ = tx.Respond(sip.NewResponseFromRequest(req, 486, "Busy Here", nil))
+	})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() { _ = srv.ServeUDP(conn) }()
+	defer conn.Close()
+
+	cfg := &Config{
+		SipDomain: "127.0.0.1", SipPort: conn.LocalAddr().(*net.UDPAddr).Port, SipUser: "u", SipPass: "p",
+		Destination: "123", CallDuration: 5 * time.Second, Wait100Timeout: 2 * time.Second, SipUdpMax: 1300,
+		SipReuse: true, DnsCache: time.Minute, SipPreauth: true, IpCache: time.Hour,
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	prevCaller, prevIPCache, stdout := caller, ipCache, os.Stdout
+	caller = &sipCaller{cfg: cfg}
+	ipCache = &publicIPCache{cfg: cfg, ttl: cfg.IpCache}
+	ipCache.set("127.0.0.1")
+	os.Stdout = devNull // the log lines are written, as serve writes them, but not shown
+	b.Cleanup(func() {
+		caller.drop(nil)
+		caller, ipCache, os.Stdout = prevCaller, prevIPCache, stdout
+		devNull.Close()
+	})
+
+	call := func() time.Duration {
+		begin := time.Now()
+		done := make(chan callStatusMsg, 16)
+		go run(context.Background(), cfg, callOptions{}, nil, done)
+		var took time.Duration
+		select {
+		case at := <-arrived:
+			took = at.Sub(begin)
+		case <-time.After(5 * time.Second):
+			b.Fatal("no INVITE arrived")
+		}
+		for range done {
+		}
+		return took
+	}
+	call() // warm up: the shared UA, and the challenge --sip-preauth answers
+
+	var total time.Duration
+	b.ResetTimer()
+	for range b.N {
+		total += call()
+	}
+	b.StopTimer()
+	mean := total / time.Duration(b.N)
+	b.ReportMetric(float64(mean.Microseconds())/1000, "ms/invite")
+	if mean > budget {
+		b.Fatalf("button to INVITE took %v on average, over the %v budget", mean, budget)
+	}
+}
@@ -7,6 +7,9 @@ require (
 	github.com/emiago/sipgo v1.2.0
 	github.com/go-chi/chi/v5 v5.2.5
 	github.com/gorilla/websocket v1.5.3
+	github.com/icholy/digest v1.1.0
+	github.com/lib/pq v1.10.9
+	golang.org/x/sys v0.33.0
 )
 
 require (
@@ -15,9 +18,7 @@ require (
 	github.com/gobwas/ws v1.4.0 // indirect
 	github.com/google/go-cmp v0.7.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/icholy/digest v1.1.0 // indirect
 	github.com/stretchr/testify v1.11.1 // indirect
 	golang.org/x/sync v0.16.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	gotest.tools/v3 v3.5.2 // indirect
 )
@@ -0,0 +1,1207 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+// /api/graphql serves what the admin dashboard shows (calls, the call history, gates
+// and who may use the server) as GraphQL, for dashboards built on a GraphQL client,
+// with live call statuses as subscriptions over the graphql-transport-ws WebSocket
+// protocol. It is guarded by --admin-token like /api/admin.
+//
+// The executor is a small one over the fixed schema below: queries and
+// subscriptions with arguments, variables, aliases, fragments and @include/@skip.
+// There are no mutations (placing calls stays with /api/call) and no introspection
+// beyond __typename; GET /api/graphql/schema returns the SDL for code generators.
+
+var gqlOperations = newCounter("iftach_graphql_operations_total", "GraphQL operations run, by type (query or subscription).")
+
+// gqlFieldDef describes a field of the schema.
+type gqlFieldDef struct {
+	typ  string            // GraphQL type, e.g. [Call!]!
+	args map[string]string // argument name: GraphQL type
+	doc  string
+}
+
+var gqlSchema = map[string]map[string]gqlFieldDef{
+	"Query": {
+		"calls":   {typ: "[Call!]!", doc: "Calls in progress, newest first."},
+		"call":    {typ: "Call", args: map[string]string{"id": "ID!"}, doc: "A call in progress or finished within the last 15 minutes."},
+		"history": {typ: "[HistoryCall!]!", args: map[string]string{"gate": "String", "user": "String", "result": "String", "since": "String", "until": "String", "cursor": "ID", "limit": "Int"}, doc: "Finished calls from the call history, newest first, as GET /api/history filters them: user - is --call-token, since and until are RFC 3339, and cursor is the id of the last call of the previous page. At most limit (default 50, at most 500)."},
+		"gates":   {typ: "[Gate!]!", doc: "The configured gates, by name."},
+		"users":   {typ: "[User!]!", doc: "The tokens that give access to the server (never their values)."},
+	},
+	"Subscription": {
+		"callStatus": {typ: "CallStatus!", args: map[string]string{"id": "ID"}, doc: "Every status of call id from its start, or of every call from now on."},
+	},
+	"Call": {
+		"id":         {typ: "ID!"},
+		"startedAt":  {typ: "String!", doc: "RFC 3339, in --timezone."},
+		"status":     {typ: "String", doc: "Latest status of the call as a whole, null before the first."},
+		"code":       {typ: "String", doc: "Error code of a failed call (E_...)."},
+		"answered":   {typ: "Boolean!"},
+		"done":       {typ: "Boolean!"},
+		"gate":       {typ: "String!"},
+		"source":     {typ: "String", doc: "What triggered the call, e.g. ws 203.0.113.7."},
+		"durationMs": {typ: "Int!"},
+		"statuses":   {typ: "[CallStatus!]!", doc: "Every status so far, legs of bridged calls included."},
+	},
+	"HistoryCall": {
+		"id":         {typ: "ID!"},
+		"startedAt":  {typ: "String!", doc: "RFC 3339, in --timezone."},
+		"user":       {typ: "String", doc: "The named call token that placed it, null for --call-token."},
+		"source":     {typ: "String!", doc: "What triggered the call, e.g. ws 203.0.113.7."},
+		"gate":       {typ: "String!"},
+		"result":     {typ: "String!", doc: "answered, busy or failed."},
+		"answered":   {typ: "Boolean!"},
+		"code":       {typ: "String", doc: "Error code of a failed call (E_...)."},
+		"sipCode":    {typ: "Int", doc: "The final SIP response, null if none came."},
+		"durationMs": {typ: "Int!"},
+		"answerMs":   {typ: "Int", doc: "Until the 200 OK, null if unanswered."},
+		"trunk":      {typ: "String", doc: "The SIP domain it went through, with --backup-sip-domain."},
+	},
+	"CallStatus": {
+		"callId": {typ: "ID!"},
+		"status": {typ: "String!"},
+		"code":   {typ: "String"},
+		"leg":    {typ: "String", doc: "phone, gate or intercom on leg statuses of bridged calls."},
+	},
+	"Gate": {
+		"name":        {typ: "String!"},
+		"number":      {typ: "String!"},
+		"default":     {typ: "Boolean!", doc: "Whether this is the --destination gate."},
+		"autoCloseAt": {typ: "String", doc: "When a pending auto-close fires, RFC 3339."},
+	},
+	"User": {
+		"name":  {typ: "String!"},
+		"scope": {typ: "String!"},
+		"set":   {typ: "Boolean!"},
+	},
+}
+
+// gqlResolver computes a field's value when a query selects it, from the field's
+// coerced arguments.
+type gqlResolver func(args map[string]any) (any, error)
+
+// gqlQuery is the root Query object. Objects are maps from field name to value
+// (a scalar, an object, a []any of either) or to a gqlResolver.
+func gqlQuery() map[string]any {
+	return map[string]any{
+		"calls": gqlResolver(func(map[string]any) (any, error) {
+			calls := []any{}
+			for _, s := range sessions.List() {
+				if !s.Done() {
+					calls = append(calls, gqlCall(s))
+				}
+			}
+			return calls, nil
+		}),
+		"call": gqlResolver(func(args map[string]any) (any, error) {
+			if s, ok := sessions.Get(args["id"].(string)); ok {
+				return gqlCall(s), nil
+			}
+			return nil, nil
+		}),
+		"history": gqlResolver(func(args map[string]any) (any, error) {
+			f := historyFilter{}
+			f.gate, _ = args["gate"].(string)
+			f.result, _ = args["result"].(string)
+			f.cursor, _ = args["cursor"].(string)
+			f.limit, _ = args["limit"].(int)
+			if f.limit > maxHistoryPage {
+				return nil, fmt.Errorf("limit is at most %d", maxHistoryPage)
+			}
+			if user, ok := args["user"].(string); ok {
+				if user == "-" {
+					user = ""
+				}
+				f.user = &user
+			}
+			for name, t := range map[string]*time.Time{"since": &f.since, "until": &f.until} {
+				if v, ok := args[name].(string); ok {
+					parsed, err := time.Parse(time.RFC3339, v)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %w", name, err)
+					}
+					*t = parsed
+				}
+			}
+			page, _ := callHistory.query(f)
+			calls := []any{}
+			for _, rec := range page {
+				calls = append(calls, gqlHistoryCall(rec))
+			}
+			return calls, nil
+		}),
+		"gates": gqlResolver(func(map[string]any) (any, error) {
+			numbers := map[string]string{defaultGate: cli.Destination}
+			maps.Copy(numbers, cli.Gates)
+			closing := map[string]time.Time{}
+			for _, p := range autoClose.Pending() {
+				closing[p.Gate] = p.At
+			}
+			gates := []any{}
+			for _, name := range slices.Sorted(maps.Keys(numbers)) {
+				gates = append(gates, map[string]any{
+					"name":        name,
+					"number":      numbers[name],
+					"default":     name == defaultGate,
+					"autoCloseAt": gqlTime(closing[name]),
+				})
+			}
+			return gates, nil
+		}),
+		"users": gqlResolver(func(map[string]any) (any, error) {
+			users := []any{}
+			for _, t := range adminTokens() {
+				users = append(users, map[string]any{"name": t.Name, "scope": t.Scope, "set": t.Set})
+			}
+			return users, nil
+		}),
+	}
+}
+
+func gqlCall(s *callSession) map[string]any {
+	c := newAdminCall(s)
+	return map[string]any{
+		"id":         c.ID,
+		"startedAt":  gqlTime(c.StartedAt),
+		"status":     gqlString(c.Status),
+		"code":       gqlString(string(c.Code)),
+		"answered":   c.Answered,
+		"done":       c.Done,
+		"gate":       c.Gate,
+		"source":     gqlString(c.Source),
+		"durationMs": int(c.DurationMS),
+		"statuses": gqlResolver(func(map[string]any) (any, error) {
+			statuses := []any{}
+			for _, m := range s.Statuses() {
+				statuses = append(statuses, gqlStatus(s.ID, m))
+			}
+			return statuses, nil
+		}),
+	}
+}
+
+func gqlHistoryCall(rec callRecord) map[string]any {
+	var sipCode, answerMS any
+	if rec.SIPCode != 0 {
+		sipCode = rec.SIPCode
+	}
+	if rec.AnswerMS != 0 {
+		answerMS = int(rec.AnswerMS)
+	}
+	return map[string]any{
+		"id":         rec.CallID,
+		"startedAt":  gqlTime(rec.At),
+		"user":       gqlString(rec.User),
+		"source":     rec.Source,
+		"gate":       rec.Gate,
+		"result":     rec.Result,
+		"answered":   rec.Result == "answered",
+		"code":       gqlString(string(rec.Code)),
+		"sipCode":    sipCode,
+		"durationMs": int(rec.DurationMS),
+		"answerMs":   answerMS,
+		"trunk":      gqlString(rec.Trunk),
+	}
+}
+
+func gqlStatus(callID string, m callStatusMsg) map[string]any {
+	return map[string]any{"callId": callID, "status": m.Status, "code": gqlString(string(m.Code)), "leg": gqlString(m.Leg)}
+}
+
+// gqlString is s, or null for "".
+func gqlString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// gqlTime is t as RFC 3339 in --timezone, or null for the zero time.
+func gqlTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return displayTime(t).Format(time.RFC3339Nano)
+}
+
+// gqlSubscriptions are the Subscription fields: each sends its events, objects of
+// the field's type, until ctx ends or it runs out and closes the channel.
+var gqlSubscriptions = map[string]func(ctx context.Context, args map[string]any) (<-chan map[string]any, error){
+	"callStatus": func(ctx context.Context, args map[string]any) (<-chan map[string]any, error) {
+		events := make(chan map[string]any, 16)
+		follow := func(s *callSession) {
+			statuses := s.Subscribe()
+			for {
+				select {
+				case m, ok := <-statuses:
+					if !ok {
+						return
+					}
+					select {
+					case events <- gqlStatus(s.ID, m):
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		if id, ok := args["id"].(string); ok {
+			s, ok := sessions.Get(id)
+			if !ok {
+				return nil, fmt.Errorf("call %q not found", id)
+			}
+			go func() {
+				defer close(events)
+				follow(s)
+			}()
+			return events, nil
+		}
+		// Watch before listing, so a call starting meanwhile is in one or both.
+		started := sessions.Watch(ctx)
+		go func() {
+			var wg sync.WaitGroup
+			defer close(events)
+			defer wg.Wait()
+			seen := map[string]bool{}
+			for _, s := range sessions.List() {
+				if !s.Done() {
+					seen[s.ID] = true
+					wg.Go(func() { follow(s) })
+				}
+			}
+			for s := range started {
+				if !seen[s.ID] {
+					wg.Go(func() { follow(s) })
+				}
+			}
+		}()
+		return events, nil
+	},
+}
+
+// mountGraphQL adds /api/graphql, guarded by --admin-token.
+func mountGraphQL(r chi.Router) {
+	r.Route("/api/graphql", func(r chi.Router) {
+		r.Use(adminOnly)
+		r.Get("/", handleGraphQL)
+		r.Post("/", handleGraphQL)
+		r.Get("/schema", handleGraphQLSchema)
+	})
+}
+
+type gqlRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+	OperationName string         `json:"operationName"`
+}
+
+type gqlError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+type gqlResponse struct {
+	Data   *gqlMap    `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// handleGraphQL is /api/graphql: POST {"query", "variables", "operationName"} (or
+// GET ?query=&variables=&operationName=) runs a query; a WebSocket speaking
+// graphql-transport-ws runs subscriptions (and queries).
+func handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		handleGraphQLWS(w, r)
+		return
+	}
+	var req gqlRequest
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, gqlFailure(fmt.Errorf("invalid request body: %w", err)))
+			return
+		}
+	} else {
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeJSON(w, http.StatusBadRequest, gqlFailure(fmt.Errorf("invalid variables: %w", err)))
+				return
+			}
+		}
+	}
+	e, op, err := prepareGraphQL(req)
+	if err == nil && op.kind == "subscription" {
+		err = fmt.Errorf("subscriptions need the WebSocket transport (graphql-transport-ws)")
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, gqlFailure(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, e.query(op))
+}
+
+func gqlFailure(err error) gqlResponse {
+	return gqlResponse{Errors: []gqlError{{Message: err.Error()}}}
+}
+
+// handleGraphQLSchema is GET /api/graphql/schema: the schema in SDL.
+func handleGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	b.WriteString("schema {\n  query: Query\n  subscription: Subscription\n}\n")
+	for _, name := range slices.Sorted(maps.Keys(gqlSchema)) {
+		fmt.Fprintf(&b, "\ntype %s {\n", name)
+		for _, field := range slices.Sorted(maps.Keys(gqlSchema[name])) {
+			def := gqlSchema[name][field]
+			if def.doc != "" {
+				fmt.Fprintf(&b, "  %q\n", def.doc)
+			}
+			var args []string
+			for _, arg := range slices.Sorted(maps.Keys(def.args)) {
+				args = append(args, arg+": "+def.args[arg])
+			}
+			if len(args) > 0 {
+				field += "(" + strings.Join(args, ", ") + ")"
+			}
+			fmt.Fprintf(&b, "  %s: %s\n", field, def.typ)
+		}
+		b.WriteString("}\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// gqlInitWait is how long a graphql-transport-ws client has to send connection_init.
+const gqlInitWait = 10 * time.Second
+
+// gqlWSMessage is a graphql-transport-ws message, in either direction.
+type gqlWSMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+var gqlUpgrader = websocket.Upgrader{
+	Subprotocols: []string{"graphql-transport-ws"},
+	CheckOrigin:  func(r *http.Request) bool { return true },
+}
+
+// handleGraphQLWS serves the graphql-transport-ws protocol: connection_init, then
+// any number of concurrent subscribe/complete pairs by ID, each answered with next
+// messages and a complete (or an error), plus ping/pong.
+func handleGraphQLWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := gqlUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var wmu sync.Mutex
+	send := func(typ, id string, payload any) {
+		msg := gqlWSMessage{Type: typ, ID: id}
+		if payload != nil {
+			msg.Payload, _ = json.Marshal(payload)
+		}
+		wmu.Lock()
+		defer wmu.Unlock()
+		_ = conn.WriteJSON(msg)
+	}
+	closeWith := func(code int, reason string) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	}
+	if conn.Subprotocol() == "" {
+		closeWith(4406, "subprotocol not acceptable")
+		return
+	}
+	conn.SetReadLimit(64 << 10)
+
+	conn.SetReadDeadline(time.Now().Add(gqlInitWait))
+	var init gqlWSMessage
+	if err := conn.ReadJSON(&init); err != nil {
+		closeWith(4408, "connection initialisation timeout")
+		return
+	}
+	if init.Type != "connection_init" {
+		closeWith(4401, "unauthorized")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	send("connection_ack", "", nil)
+
+	var (
+		mu      sync.Mutex
+		running = map[string]context.CancelFunc{}
+		wg      sync.WaitGroup
+	)
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	for {
+		var msg gqlWSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				closeWith(4400, "invalid message")
+			}
+			return
+		}
+		switch msg.Type {
+		case "ping":
+			send("pong", "", nil)
+		case "pong":
+		case "connection_init":
+			closeWith(4429, "too many initialisation requests")
+			return
+		case "complete":
+			mu.Lock()
+			if stop, ok := running[msg.ID]; ok {
+				stop()
+				delete(running, msg.ID)
+			}
+			mu.Unlock()
+		case "subscribe":
+			var req gqlRequest
+			if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil {
+				closeWith(4400, "invalid subscribe message")
+				return
+			}
+			mu.Lock()
+			if _, ok := running[msg.ID]; ok {
+				mu.Unlock()
+				closeWith(4409, "subscriber for "+msg.ID+" already exists")
+				return
+			}
+			subCtx, stop := context.WithCancel(ctx)
+			running[msg.ID] = stop
+			mu.Unlock()
+			wg.Go(func() {
+				defer stop()
+				if err := runGraphQLWS(subCtx, req, func(res gqlResponse) { send("next", msg.ID, res) }); err != nil {
+					send("error", msg.ID, []gqlError{{Message: err.Error()}})
+				} else if subCtx.Err() == nil {
+					send("complete", msg.ID, nil)
+				}
+				// Completed by the client, it is gone already (and its ID may be reused).
+				if subCtx.Err() == nil {
+					mu.Lock()
+					delete(running, msg.ID)
+					mu.Unlock()
+				}
+			})
+		default:
+			closeWith(4400, "unknown message type "+msg.Type)
+			return
+		}
+	}
+}
+
+// runGraphQLWS runs one subscribe message's operation, sending each result.
+func runGraphQLWS(ctx context.Context, req gqlRequest, next func(gqlResponse)) error {
+	e, op, err := prepareGraphQL(req)
+	if err != nil {
+		return err
+	}
+	if op.kind == "query" {
+		next(e.query(op))
+		return nil
+	}
+	return e.subscribe(ctx, op, next)
+}
+
+// gqlExec runs one operation of a parsed document.
+type gqlExec struct {
+	doc  *gqlDocument
+	vars map[string]any
+	errs []gqlError
+}
+
+// prepareGraphQL parses req, picks the operation to run and validates it against
+// the schema, so nothing runs for a request with mistakes in it.
+func prepareGraphQL(req gqlRequest) (*gqlExec, *gqlOperation, error) {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return nil, nil, err
+	}
+	var op *gqlOperation
+	for _, o := range doc.operations {
+		if req.OperationName == "" && len(doc.operations) == 1 || req.OperationName != "" && o.name == req.OperationName {
+			op = o
+		}
+	}
+	switch {
+	case op == nil && req.OperationName == "":
+		return nil, nil, fmt.Errorf("operationName is required for a document with several operations")
+	case op == nil:
+		return nil, nil, fmt.Errorf("no operation named %q", req.OperationName)
+	}
+	root := map[string]string{"query": "Query", "subscription": "Subscription"}[op.kind]
+	if root == "" {
+		return nil, nil, fmt.Errorf("%s operations are not supported", op.kind)
+	}
+	e := &gqlExec{doc: doc, vars: map[string]any{}}
+	for _, v := range op.vars {
+		val, ok := req.Variables[v.name]
+		if !ok && v.hasDef {
+			val, ok = v.def, true
+		}
+		if (!ok || val == nil) && strings.HasSuffix(v.typ, "!") {
+			return nil, nil, fmt.Errorf("variable $%s of type %s is required", v.name, v.typ)
+		}
+		e.vars[v.name] = val
+	}
+	if err := e.validate(root, op.sel, map[string]bool{}); err != nil {
+		return nil, nil, err
+	}
+	if fields := e.collect(op.sel, nil); op.kind == "subscription" && (len(fields) != 1 || fields[0].name == "__typename") {
+		return nil, nil, fmt.Errorf("a subscription must select exactly one field")
+	}
+	gqlOperations.inc("type", op.kind)
+	return e, op, nil
+}
+
+// validate checks a selection on an object of type typ: that its fields exist,
+// take the arguments given, and have subfields exactly when they are objects.
+func (e *gqlExec) validate(typ string, sel []gqlSelection, spreading map[string]bool) error {
+	for _, s := range sel {
+		for _, d := range s.directives {
+			if d.name != "include" && d.name != "skip" || d.args["if"] == nil {
+				return fmt.Errorf("unsupported directive @%s (only @include(if:) and @skip(if:))", d.name)
+			}
+		}
+		switch {
+		case s.spread != "":
+			f := e.doc.fragments[s.spread]
+			switch {
+			case f == nil:
+				return fmt.Errorf("unknown fragment %q", s.spread)
+			case spreading[s.spread]:
+				return fmt.Errorf("fragment %q spreads itself", s.spread)
+			case f.on != typ:
+				return fmt.Errorf("fragment %q on %s cannot be spread within %s", s.spread, f.on, typ)
+			}
+			spreading[s.spread] = true
+			if err := e.validate(typ, f.sel, spreading); err != nil {
+				return err
+			}
+			delete(spreading, s.spread)
+		case s.inline:
+			if s.on != "" && s.on != typ {
+				return fmt.Errorf("fragment on %s cannot be spread within %s", s.on, typ)
+			}
+			if err := e.validate(typ, s.sel, spreading); err != nil {
+				return err
+			}
+		case s.name == "__typename":
+			if s.sel != nil {
+				return fmt.Errorf("__typename has no subfields")
+			}
+		default:
+			def, ok := gqlSchema[typ][s.name]
+			if !ok {
+				return fmt.Errorf("cannot query field %q on type %s", s.name, typ)
+			}
+			for name := range s.args {
+				if _, ok := def.args[name]; !ok {
+					return fmt.Errorf("unknown argument %q on field %s.%s", name, typ, s.name)
+				}
+			}
+			for name, argType := range def.args {
+				if strings.HasSuffix(argType, "!") && s.args[name] == nil {
+					return fmt.Errorf("argument %q of type %s is required on field %s.%s", name, argType, typ, s.name)
+				}
+			}
+			named := strings.Trim(def.typ, "[]!")
+			_, object := gqlSchema[named]
+			switch {
+			case object && s.sel == nil:
+				return fmt.Errorf("field %s.%s of type %s must have a selection of subfields", typ, s.name, def.typ)
+			case !object && s.sel != nil:
+				return fmt.Errorf("field %s.%s of type %s has no subfields", typ, s.name, def.typ)
+			case object:
+				if err := e.validate(named, s.sel, spreading); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// collect flattens fragments and @include/@skip out of sel, merging fields selected
+// more than once under the same response key.
+func (e *gqlExec) collect(sel []gqlSelection, into []gqlSelection) []gqlSelection {
+	for _, s := range sel {
+		if !e.included(s.directives) {
+			continue
+		}
+		switch {
+		case s.spread != "":
+			into = e.collect(e.doc.fragments[s.spread].sel, into)
+		case s.inline:
+			into = e.collect(s.sel, into)
+		default:
+			if i := slices.IndexFunc(into, func(f gqlSelection) bool { return f.key() == s.key() }); i >= 0 {
+				into[i].sel = append(slices.Clip(into[i].sel), s.sel...)
+			} else {
+				into = append(into, s)
+			}
+		}
+	}
+	return into
+}
+
+func (e *gqlExec) included(directives []gqlDirective) bool {
+	for _, d := range directives {
+		on, _ := e.value(d.args["if"]).(bool)
+		if d.name == "skip" && on || d.name == "include" && !on {
+			return false
+		}
+	}
+	return true
+}
+
+// value substitutes variables in an argument value.
+func (e *gqlExec) value(v any) any {
+	switch v := v.(type) {
+	case gqlVariable:
+		return e.vars[string(v)]
+	case []any:
+		list := make([]any, len(v))
+		for i := range v {
+			list[i] = e.value(v[i])
+		}
+		return list
+	case map[string]any:
+		obj := make(map[string]any, len(v))
+		for k := range v {
+			obj[k] = e.value(v[k])
+		}
+		return obj
+	}
+	return v
+}
+
+// args coerces a field's arguments to the types def declares.
+func (e *gqlExec) args(s gqlSelection, def gqlFieldDef) (map[string]any, error) {
+	args := map[string]any{}
+	for name, typ := range def.args {
+		v := e.value(s.args[name])
+		if v == nil {
+			if strings.HasSuffix(typ, "!") {
+				return nil, fmt.Errorf("argument %q must not be null", name)
+			}
+			continue
+		}
+		switch strings.TrimSuffix(typ, "!") {
+		case "Int":
+			if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) <= math.MaxInt32 {
+				v = int(f)
+			}
+			if _, ok := v.(int); !ok {
+				return nil, fmt.Errorf("argument %q must be an Int", name)
+			}
+		case "ID":
+			if n, ok := v.(int); ok {
+				v = strconv.Itoa(n)
+			}
+			fallthrough
+		case "String":
+			if _, ok := v.(string); !ok {
+				return nil, fmt.Errorf("argument %q must be a %s", name, strings.TrimSuffix(typ, "!"))
+			}
+		}
+		args[name] = v
+	}
+	return args, nil
+}
+
+// query runs a query operation.
+func (e *gqlExec) query(op *gqlOperation) gqlResponse {
+	data := e.object("Query", gqlQuery(), op.sel, nil)
+	return gqlResponse{Data: data, Errors: e.errs}
+}
+
+// subscribe runs a subscription operation, sending a result per event until ctx
+// ends or the events run out.
+func (e *gqlExec) subscribe(ctx context.Context, op *gqlOperation, next func(gqlResponse)) error {
+	s := e.collect(op.sel, nil)[0]
+	def := gqlSchema["Subscription"][s.name]
+	args, err := e.args(s, def)
+	if err != nil {
+		return err
+	}
+	events, err := gqlSubscriptions[s.name](ctx, args)
+	if err != nil {
+		return err
+	}
+	for ev := range events {
+		e.errs = nil
+		data := &gqlMap{}
+		data.set(s.key(), e.complete(def.typ, ev, s.sel, []any{s.key()}))
+		next(gqlResponse{Data: data, Errors: e.errs})
+	}
+	return nil
+}
+
+// object resolves sel on obj, a value of type typ. A field that fails is null,
+// with the error reported at its path.
+func (e *gqlExec) object(typ string, obj map[string]any, sel []gqlSelection, path []any) *gqlMap {
+	out := &gqlMap{}
+	for _, s := range e.collect(sel, nil) {
+		key := s.key()
+		if s.name == "__typename" {
+			out.set(key, typ)
+			continue
+		}
+		def := gqlSchema[typ][s.name]
+		fieldPath := append(slices.Clip(path), key)
+		v := obj[s.name]
+		if resolve, ok := v.(gqlResolver); ok {
+			args, err := e.args(s, def)
+			if err == nil {
+				v, err = resolve(args)
+			}
+			if err != nil {
+				e.errs = append(e.errs, gqlError{Message: err.Error(), Path: fieldPath})
+				v = nil
+			}
+		}
+		out.set(key, e.complete(def.typ, v, s.sel, fieldPath))
+	}
+	return out
+}
+
+// complete turns a resolved value of GraphQL type typ into its result.
+func (e *gqlExec) complete(typ string, v any, sel []gqlSelection, path []any) any {
+	typ = strings.TrimSuffix(typ, "!")
+	switch v := v.(type) {
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = e.complete(typ[1:len(typ)-1], item, sel, append(slices.Clip(path), i))
+		}
+		return list
+	case map[string]any:
+		return e.object(typ, v, sel, path)
+	}
+	return v
+}
+
+// gqlMap is a result object, which keeps its fields in the order they were selected.
+type gqlMap struct {
+	keys   []string
+	values []any
+}
+
+func (m *gqlMap) set(key string, v any) {
+	m.keys = append(m.keys, key)
+	m.values = append(m.values, v)
+}
+
+func (m *gqlMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(m.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// gqlDocument is a parsed GraphQL document.
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind string // query, mutation or subscription
+	name string
+	vars []gqlVarDef
+	sel  []gqlSelection
+}
+
+type gqlVarDef struct {
+	name   string
+	typ    string
+	def    any
+	hasDef bool
+}
+
+type gqlFragment struct {
+	on  string
+	sel []gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (spread set) or an inline fragment
+// (inline set, on its type condition if any).
+type gqlSelection struct {
+	alias, name string
+	args        map[string]any
+	directives  []gqlDirective
+	sel         []gqlSelection
+	spread      string
+	inline      bool
+	on          string
+}
+
+// key is the field's name in the result.
+func (s gqlSelection) key() string {
+	return cmp.Or(s.alias, s.name)
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]any
+}
+
+// gqlVariable is a $variable in an argument value.
+type gqlVariable string
+
+type gqlSyntaxError struct {
+	msg       string
+	line, col int
+}
+
+func (e gqlSyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %d:%d: %s", e.line, e.col, e.msg)
+}
+
+// gqlParser is a recursive descent parser of executable GraphQL documents. It
+// panics with a gqlSyntaxError on the first mistake, which parseGraphQL returns.
+type gqlParser struct {
+	src   string
+	pos   int
+	start int    // where tok starts
+	tok   string // current token; strings keep their quotes
+	kind  byte   // 'n' name, '0' number, '"' string, 'p' punctuator, 0 end of document
+}
+
+func parseGraphQL(src string) (doc *gqlDocument, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			se, ok := r.(gqlSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = se
+		}
+	}()
+	p := &gqlParser{src: src}
+	p.next()
+	doc = &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.kind != 0 {
+		switch {
+		case p.tok == "{":
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", sel: p.selectionSet()})
+		case p.tok == "fragment":
+			p.next()
+			name := p.name()
+			if name == "on" {
+				p.fail("a fragment cannot be named on")
+			}
+			p.expect("on")
+			f := &gqlFragment{on: p.name()}
+			p.directives()
+			f.sel = p.selectionSet()
+			if doc.fragments[name] != nil {
+				p.fail("fragment %q is defined twice", name)
+			}
+			doc.fragments[name] = f
+		case p.tok == "query" || p.tok == "mutation" || p.tok == "subscription":
+			op := &gqlOperation{kind: p.tok}
+			p.next()
+			if p.kind == 'n' {
+				op.name = p.name()
+			}
+			if p.skip("(") {
+				for !p.skip(")") {
+					p.expect("$")
+					v := gqlVarDef{name: p.name()}
+					p.expect(":")
+					v.typ = p.typeRef()
+					if p.skip("=") {
+						v.def, v.hasDef = p.value(true), true
+					}
+					p.directives()
+					op.vars = append(op.vars, v)
+				}
+			}
+			p.directives()
+			op.sel = p.selectionSet()
+			doc.operations = append(doc.operations, op)
+		default:
+			p.fail("expected an operation or a fragment, found %s", p.found())
+		}
+	}
+	if len(doc.operations) == 0 {
+		p.fail("the document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) fail(format string, args ...any) {
+	before := p.src[:p.start]
+	panic(gqlSyntaxError{
+		msg:  fmt.Sprintf(format, args...),
+		line: strings.Count(before, "\n") + 1,
+		col:  len(before) - strings.LastIndexByte(before, '\n'),
+	})
+}
+
+// next moves to the next token, skipping whitespace, commas and comments.
+func (p *gqlParser) next() {
+	for p.pos < len(p.src) {
+		if c := p.src[p.pos]; c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+		} else if strings.HasPrefix(p.src[p.pos:], "\uFEFF") {
+			p.pos += len("\uFEFF")
+		} else {
+			break
+		}
+	}
+	p.start = p.pos
+	if p.pos == len(p.src) {
+		p.tok, p.kind = "", 0
+		return
+	}
+	isName := func(c byte, first bool) bool {
+		return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+	}
+	switch c := p.src[p.pos]; {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.kind = 'p'
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		p.pos++
+		p.kind = 'p'
+	case isName(c, true):
+		for p.pos < len(p.src) && isName(p.src[p.pos], false) {
+			p.pos++
+		}
+		p.kind = 'n'
+	case c == '-' || '0' <= c && c <= '9':
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		p.kind = '0'
+	case c == '"':
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			p.fail("block strings are not supported")
+		}
+		for p.pos++; p.pos < len(p.src) && p.src[p.pos] != '"' && p.src[p.pos] != '\n'; p.pos++ {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+		}
+		if p.pos >= len(p.src) || p.src[p.pos] != '"' {
+			p.fail("unterminated string")
+		}
+		p.pos++
+		p.kind = '"'
+	default:
+		p.fail("unexpected character %q", c)
+	}
+	p.tok = p.src[p.start:p.pos]
+}
+
+func (p *gqlParser) found() string {
+	if p.kind == 0 {
+		return "the end of the document"
+	}
+	return strconv.Quote(p.tok)
+}
+
+// skip consumes tok if it is next.
+func (p *gqlParser) skip(tok string) bool {
+	if p.kind == '"' || p.tok != tok {
+		return false
+	}
+	p.next()
+	return true
+}
+
+func (p *gqlParser) expect(tok string) {
+	if !p.skip(tok) {
+		p.fail("expected %q, found %s", tok, p.found())
+	}
+}
+
+func (p *gqlParser) name() string {
+	if p.kind != 'n' {
+		p.fail("expected a name, found %s", p.found())
+	}
+	name := p.tok
+	p.next()
+	return name
+}
+
+// typeRef parses a variable's type, e.g. [String!]!.
+func (p *gqlParser) typeRef() string {
+	var t string
+	if p.skip("[") {
+		t = "[" + p.typeRef() + "]"
+		p.expect("]")
+	} else {
+		t = p.name()
+	}
+	if p.skip("!") {
+		t += "!"
+	}
+	return t
+}
+
+func (p *gqlParser) selectionSet() []gqlSelection {
+	p.expect("{")
+	var sel []gqlSelection
+	for !p.skip("}") {
+		if p.kind == 0 {
+			p.fail("expected \"}\", found %s", p.found())
+		}
+		sel = append(sel, p.selection())
+	}
+	if len(sel) == 0 {
+		p.fail("empty selection set")
+	}
+	return sel
+}
+
+func (p *gqlParser) selection() gqlSelection {
+	if p.skip("...") {
+		if p.kind == 'n' && p.tok != "on" {
+			return gqlSelection{spread: p.name(), directives: p.directives()}
+		}
+		s := gqlSelection{inline: true}
+		if p.skip("on") {
+			s.on = p.name()
+		}
+		s.directives = p.directives()
+		s.sel = p.selectionSet()
+		return s
+	}
+	s := gqlSelection{name: p.name()}
+	if p.skip(":") {
+		s.alias, s.name = s.name, p.name()
+	}
+	s.args = p.arguments(false)
+	s.directives = p.directives()
+	if p.tok == "{" && p.kind == 'p' {
+		s.sel = p.selectionSet()
+	}
+	return s
+}
+
+func (p *gqlParser) arguments(constant bool) map[string]any {
+	if !p.skip("(") {
+		return nil
+	}
+	args := map[string]any{}
+	for !p.skip(")") {
+		name := p.name()
+		p.expect(":")
+		args[name] = p.value(constant)
+	}
+	return args
+}
+
+func (p *gqlParser) directives() []gqlDirective {
+	var directives []gqlDirective
+	for p.skip("@") {
+		directives = append(directives, gqlDirective{name: p.name(), args: p.arguments(false)})
+	}
+	return directives
+}
+
+// value parses an argument value; constant ones (variable defaults) may not
+// reference variables. Enum values are kept as strings.
+func (p *gqlParser) value(constant bool) any {
+	switch {
+	case p.tok == "$" && p.kind == 'p':
+		if constant {
+			p.fail("a default value cannot reference a variable")
+		}
+		p.next()
+		return gqlVariable(p.name())
+	case p.skip("["):
+		list := []any{}
+		for !p.skip("]") {
+			list = append(list, p.value(constant))
+		}
+		return list
+	case p.skip("{"):
+		obj := map[string]any{}
+		for !p.skip("}") {
+			name := p.name()
+			p.expect(":")
+			obj[name] = p.value(constant)
+		}
+		return obj
+	}
+	tok := p.tok
+	switch p.kind {
+	case '"':
+		var s string
+		if json.Unmarshal([]byte(tok), &s) != nil {
+			p.fail("invalid string %s", tok)
+		}
+		p.next()
+		return s
+	case '0':
+		if n, err := strconv.Atoi(tok); err == nil {
+			p.next()
+			return n
+		}
+		if f, err := strconv.ParseFloat(tok, 64); err == nil {
+			p.next()
+			return f
+		}
+		p.fail("invalid number %s", tok)
+	case 'n':
+		p.next()
+		switch tok {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return tok
+	}
+	p.fail("expected a value, found %s", p.found())
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every call (dry runs excluded) leaves a record of who placed it, for which gate,
+// how it ended and how long it took, appended to calls.jsonl in --data-dir: one
+// JSON object a line, which grep, jq and any log shipper read as they are, and
+// which survives a crash mid-write with at most its last line torn. The latest
+// maxHistoryRecords are also kept in memory, loaded from the file at startup, and
+// served by GET /api/history, and by the GraphQL history query, the Go client's
+// History and iftach history, which all read it. With --cluster-db the records go
+// to its database instead, and every read fetches what the other instance added
+// first.
+//
+// The history was asked for in SQLite, but the only SQLite drivers for Go need cgo
+// or a large transpiled dependency, and the static CGO_ENABLED=0 build this server
+// ships as rules out the former. An append-only file covers what the history needs
+// (appends, and reads of the latest calls, which are in memory anyway), and with
+// --cluster-db the records do live in a database.
+
+const (
+	maxHistoryRecords = 10000
+	historyPageSize   = 50
+	maxHistoryPage    = 500
+)
+
+// callRecord is one call in the history.
+type callRecord struct {
+	At         time.Time `json:"at"` // UTC, when the call was placed
+	CallID     string    `json:"call_id"`
+	User       string    `json:"user,omitempty"` // the named call token, "" for --call-token
+	Source     string    `json:"source"`
+	Gate       string    `json:"gate"`
+	Result     string    `json:"result"` // answered, busy or failed
+	Code       errorCode `json:"code,omitempty"`
+	SIPCode    int       `json:"sip_code,omitempty"` // the final SIP response, 0 if none came
+	DurationMS int64     `json:"duration_ms"`
+	AnswerMS   int64     `json:"answer_ms,omitempty"` // until the 200 OK
+	Trunk      string    `json:"trunk,omitempty"`     // the SIP domain it went through, with --backup-sip-domain
+}
+
+var callHistory = &historyStore{}
+
+type historyStore struct {
+	mu      sync.Mutex
+	path    string
+	records []callRecord // oldest first
+	seq     int64        // with --cluster-db, the newest row of iftach_calls in records
+}
+
+// load reads path (calls.jsonl) into memory, skipping lines that don't parse.
+func (h *historyStore) load(path string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.path, h.records, h.seq = path, nil, 0
+	if cluster != nil {
+		h.path = ""
+		return h.syncLocked()
+	}
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load call history: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec callRecord
+		if json.Unmarshal(sc.Bytes(), &rec) == nil && rec.CallID != "" {
+			h.records = append(h.records, rec)
+		}
+	}
+	if n := len(h.records); n > maxHistoryRecords {
+		h.records = slices.Delete(h.records, 0, n-maxHistoryRecords)
+	}
+	return sc.Err()
+}
+
+// record adds finished call s to the history.
+func (h *historyStore) record(s *callSession) {
+	s.mu.Lock()
+	rec := callRecord{
+		At:         s.StartedAt,
+		CallID:     s.ID,
+		User:       s.User,
+		Source:     s.Source,
+		Gate:       cmp.Or(s.Gate, defaultGate),
+		DurationMS: s.endedAt.Sub(s.StartedAt).Milliseconds(),
+		SIPCode:    int(s.log.sipFinal.Load()),
+		Trunk:      s.trunkLocked(),
+	}
+	if !s.answerAt.IsZero() {
+		rec.AnswerMS = s.answerAt.Sub(s.StartedAt).Milliseconds()
+	}
+	s.mu.Unlock()
+	rec.Result, rec.Code = s.result(), s.Status().Code
+
+	if cluster != nil {
+		line, _ := json.Marshal(rec)
+		_, err := cluster.db.Exec(`INSERT INTO iftach_calls (call_id, record) VALUES ($1, $2) ON CONFLICT (call_id) DO NOTHING`, rec.CallID, line)
+		if err == nil {
+			return // the next syncLocked reads it back
+		}
+		logWarn("Could not write the call history record to --cluster-db: %v\n", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, rec)
+	if n := len(h.records); n > maxHistoryRecords {
+		h.records = slices.Delete(h.records, 0, n-maxHistoryRecords)
+	}
+	if h.path == "" {
+		return
+	}
+	line, _ := json.Marshal(rec)
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		err = cmp.Or(err, f.Close())
+	}
+	if err != nil {
+		logWarn("Could not write the call history record: %v\n", err)
+	}
+}
+
+// syncLocked appends the --cluster-db records newer than h.seq, whichever
+// instance placed them. h.mu is held.
+func (h *historyStore) syncLocked() error {
+	if cluster == nil {
+		return nil
+	}
+	rows, err := cluster.db.Query(`SELECT seq, record FROM iftach_calls WHERE seq > $1 ORDER BY seq DESC LIMIT $2`, h.seq, maxHistoryRecords)
+	if err != nil {
+		return fmt.Errorf("load call history: %w", err)
+	}
+	defer rows.Close()
+	var newer []callRecord // newest first
+	seq := h.seq
+	for rows.Next() {
+		var n int64
+		var b []byte
+		if err := rows.Scan(&n, &b); err != nil {
+			return fmt.Errorf("load call history: %w", err)
+		}
+		seq = max(seq, n)
+		var rec callRecord
+		if json.Unmarshal(b, &rec) == nil && rec.CallID != "" {
+			newer = append(newer, rec)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("load call history: %w", err)
+	}
+	slices.Reverse(newer)
+	h.records, h.seq = append(h.records, newer...), seq
+	if n := len(h.records); n > maxHistoryRecords {
+		h.records = slices.Delete(h.records, 0, n-maxHistoryRecords)
+	}
+	return nil
+}
+
+// rewriteUser replaces named call token from with to in the records of its calls,
+// in memory and in calls.jsonl, or in --cluster-db (the other instance's memory
+// keeps the old name until it restarts). It returns how many records changed: in
+// the file or database, or in memory without either.
+func (h *historyStore) rewriteUser(from, to string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changed := 0
+	for i := range h.records {
+		if h.records[i].User == from {
+			h.records[i].User = to
+			changed++
+		}
+	}
+	if cluster != nil {
+		res, err := cluster.db.Exec(`UPDATE iftach_calls SET record = jsonb_set(record, '{user}', to_jsonb($2::text)) WHERE record->>'user' = $1`, from, to)
+		if err != nil {
+			return 0, fmt.Errorf("anonymize call history: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		return int(n), nil
+	}
+	if h.path == "" {
+		return changed, nil
+	}
+	return rewriteLines(h.path, func(line []byte) ([]byte, bool) {
+		var rec callRecord
+		if json.Unmarshal(line, &rec) != nil || rec.User != from {
+			return nil, false
+		}
+		rec.User = to
+		b, _ := json.Marshal(rec)
+		return b, true
+	})
+}
+
+// handleHistory is GET /api/history: finished calls, newest first, filtered by
+// ?gate=, ?user= (a named call token; - for --call-token), ?result= (answered,
+// busy or failed), ?since= and ?until= (RFC 3339), ?limit= of them (default 50,
+// at most 500) a page. The answer's next_cursor, passed back as ?cursor=, is the
+// next page; it is absent on the last.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if v := q.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "history_time_invalid", name)
+				return
+			}
+			*t = parsed
+		}
+	}
+	limit := historyPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHistoryPage {
+			writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "history_limit_invalid", maxHistoryPage)
+			return
+		}
+		limit = n
+	}
+	f := historyFilter{gate: q.Get("gate"), result: q.Get("result"), since: since, until: until, cursor: q.Get("cursor"), limit: limit}
+	if q.Has("user") {
+		user := q.Get("user")
+		if user == "-" {
+			user = ""
+		}
+		f.user = &user
+	}
+	page, next := callHistory.query(f)
+	resp := map[string]any{"calls": page}
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// historyFilter selects calls from the history: those of gate, user (nil for
+// anyone, "" for --call-token) and result, placed from since until before until,
+// the ones after the call cursor names, limit of them (historyPageSize if 0).
+type historyFilter struct {
+	gate, result string
+	user         *string
+	since, until time.Time
+	cursor       string
+	limit        int
+}
+
+// query returns the calls f selects, newest first with their times in
+// --timezone, and the cursor of the next page, "" on the last.
+func (h *historyStore) query(f historyFilter) (page []callRecord, next string) {
+	if f.limit <= 0 {
+		f.limit = historyPageSize
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.syncLocked(); err != nil {
+		logWarn("%v\n", err) // serve what is here
+	}
+	page = []callRecord{}
+	skipping := f.cursor != ""
+	for _, rec := range slices.Backward(h.records) {
+		if skipping {
+			skipping = rec.CallID != f.cursor
+			continue
+		}
+		switch {
+		case f.gate != "" && rec.Gate != f.gate,
+			f.user != nil && rec.User != *f.user,
+			f.result != "" && rec.Result != f.result,
+			!f.since.IsZero() && rec.At.Before(f.since),
+			!f.until.IsZero() && !rec.At.Before(f.until):
+			continue
+		}
+		if len(page) == f.limit {
+			next = page[len(page)-1].CallID
+			break
+		}
+		page = append(page, rec)
+	}
+	for i := range page {
+		page[i].At = displayTime(page[i].At)
+	}
+	return page, next
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultLang is used when the client asks for nothing we have, and fills in any
+// key a translation is missing.
+const defaultLang = "en"
+
+// catalog holds every user-facing string: error code messages (keyed by the code),
+// call status labels ("status.<status>"), batch/macro event labels ("batch.<status>"), UI strings ("ui.*") and API error details.
+// The UI loads it from GET /api/messages, so the gate page and the API always agree.
+// Details with verbs are fmt formats.
+var catalog = map[string]map[string]string{
+	"en": {
+		string(errAuth):         "Wrong credentials",
+		string(errForbidden):    "Not allowed for this token",
+		string(errTokenExpired): "This link has expired (or is not valid yet)",
+		string(errTokenUsed):    "This one-time link has already been used",
+		string(errBadRequest):   "Bad request",
+		string(errNotFound):     "Not found",
+		string(errRateLimited):  "Too many requests",
+		string(errIPDiscovery):  "Could not discover public IP",
+		string(errSipSetup):     "Could not start SIP client",
+		string(errSipAuth):      "SIP authentication failed",
+		string(errNoTrying):     "No response from provider (100 Trying)",
+		string(errBusy):         "Destination busy",
+		string(errSip4xx):       "Call rejected by provider",
+		string(errSip5xx):       "Provider error",
+		string(errSip6xx):       "Call declined",
+		string(errRedirect):     "The provider redirected the call somewhere it can't be followed",
+		string(errProviderDown): "Provider unreachable",
+		string(errDialRefused):  "Destination not allowed",
+		string(errBadNumber):    "Not a valid phone number",
+		string(errNoAnswer):     "No answer",
+		string(errIntercom):     "The intercom call failed",
+		string(errBudget):       "This month's call budget is used up — ask an admin",
+		string(errNotApproved):  "The request to open was not approved",
+		string(errStandby):      "This is the standby — calls go through the other unit",
+		string(errInternal):     "Internal error",
+
+		"status." + statusSendingInvite:  "Sending INVITE...",
+		"status." + statusAuthenticating: "Authenticating...",
+		"status." + statusTrying:         "Trying (100)...",
+		"status." + statusAnswered:       "Answered (200 OK)",
+		"status." + statusHangingUpTimer: "Hanging up (call timer)",
+		"status." + statusBusy:           "Busy (486)",
+		"status." + statusError:          "Error — check logs",
+		"status." + statusWatchdogKilled: "Call stuck — terminated",
+		"status." + statusHungUp:         "Hung up by an admin",
+		"status." + statusClientLeft:     "Hung up — the page was closed",
+		"status." + statusCancelled:      "Cancelled",
+		"status." + statusApprovalWait:   "Waiting for approval...",
+		"status." + statusRingingYou:     "Ringing your phone...",
+		"status." + statusBridging:       "You answered — calling the gate...",
+		"status." + statusBridgeEnded:    "Call ended",
+		"status." + statusIntercom:       "Someone is at the intercom — ringing your phone...",
+		"status." + statusRetryWait:      "Provider busy — trying again in %ds...",
+		"status." + statusRedirected:     "Redirected — dialing the new number...",
+		"status." + statusTerminated:     "Not answered — call cancelled",
+		"status." + statusFailover:       "Provider down — trying the backup...",
+		"status." + statusRinging:        "Ringing the gate...",
+		"status." + statusRang:           "The gate rang — cancelled before answering",
+		"status." + statusLegRinging:     "Ringing...",
+		"status." + statusLegUp:          "Answered",
+		"status." + statusLegFailed:      "Not reached",
+		"status." + statusLegDropped:     "Hung up",
+		"status." + statusLegRedialing:   "Calling again...",
+		"status." + statusLegEnded:       "Call ended",
+
+		"batch." + batchWaiting:       "Waiting...",
+		"batch." + batchWebhook:       "Calling webhook...",
+		"batch." + batchWebhookFailed: "Webhook failed",
+		"batch." + batchStepDone:      "Done",
+		"batch." + batchCompleted:     "Completed",
+		"batch." + batchFailed:        "Failed",
+
+		"ui.ready":           "Ready",
+		"ui.connected":       "Connected — call started",
+		"ui.invalid_message": "Invalid message received",
+		"ui.ws_error":        "WebSocket connection error",
+		"ui.closed":          "Connection closed",
+		"ui.reconnecting":    "Connection lost — reconnecting...",
+		"ui.call_lost":       "Lost track of the call — check the gate",
+		"ui.token_saved":     "Token saved",
+		"ui.token_cleared":   "Token cleared",
+		"ui.upgrading":       "New version available — reloading...",
+		"ui.upgrade_failed":  "This page is out of date — please reload it",
+		"ui.autoclose_in":    "closes in",
+		"ui.cancel":          "Cancel",
+		"ui.autoclose_off":   "Auto-close cancelled",
+
+		"admin_disabled":         "admin endpoints are disabled (no --admin-token)",
+		"budget_not_blocked":     "the call budget is not blocking calls",
+		"approval_decided":       "the request is already %s",
+		"visit_name_missing":     "please enter your name",
+		"visit_captcha_failed":   "the CAPTCHA was not solved — please try again",
+		"visit_busy":             "too many visitors are waiting — please try again in a few minutes",
+		"visit_not_found":        "no such request (it may have expired)",
+		"visit_bad_decision":     "decision must be approve or deny",
+		"visit_decided":          "the request is already %s",
+		"admin_not_here":         "admin endpoints are not served on this address",
+		"answer_delay_invalid":   "answer_delay must be a duration (e.g. 5s)",
+		"autoclose_not_pending":  "no auto-close pending for %q",
+		"batch_invalid":          "invalid batch: %v",
+		"call_finished":          "the call is already over",
+		"callback_url_invalid":   "callback_url must be an absolute http(s) URL",
+		"config_invalid":         "invalid settings: %s",
+		"config_read_failed":     "could not read %s: %v",
+		"config_write_failed":    "could not write %s: %v",
+		"invalid_json":           "invalid JSON: %v",
+		"gate_unknown":           "no gate named %q",
+		"gate_forbidden":         "this token may not open gate %q",
+		"token_in_use":           "this one-time token is in use by a call in progress",
+		"idempotency_key_reused": "this Idempotency-Key was sent before with other parameters",
+		"token_one_time":         "one-time tokens cannot run batches or macros",
+		"token_name_invalid":     "name must be lowercase letters, digits, - or _",
+		"token_expiry_invalid":   "the validity window must end in the future and after it starts (expires_in, e.g. 2h, or valid_until, not both)",
+		"delegate_forbidden":     "a delegated admin token cannot manage delegations",
+		"delegation_expiry_bad":  "a delegation needs expires_in (e.g. 72h) or valid_until, not both, ending in the future and within %d days",
+		"macro_not_found":        "no macro named %q",
+		"history_time_invalid":   "%s must be an RFC 3339 time, e.g. 2026-05-01T09:00:00+03:00",
+		"anonymize_failed":       "could not anonymize: %v",
+		"history_limit_invalid":  "limit must be between 1 and %d",
+		"manual_dial_disabled":   "manual dialing needs --dial-allow",
+		"manual_dial_plan":       "dial plan: %v",
+		"manual_dial_refused":    "%s matches no --dial-allow pattern",
+		"manual_dtmf_invalid":    "dtmf must be up to 32 of 0-9 * # A-D",
+		"manual_duration_bad":    "duration must be between 1s and %v",
+		"manual_number_invalid":  "%q is not a dialable number",
+		"manual_reason_missing":  "a reason of up to %d characters is required, for the audit log",
+		"no_test_destination":    "no --test-destination configured",
+		"probe_failed":           "provider check failed: %s",
+		"ringme_unknown":         "no --ring-me phone named %q",
+		"setup_code_wrong":       "wrong setup code (see the server console)",
+		"setup_probe_ok":         "%s accepted the credentials for %s",
+		"setup_saved":            "Configuration saved — the gate is ready.",
+		"test_call_running":      "a test call is already running",
+		"timeout_invalid":        "timeout must be a positive duration (e.g. 30s)",
+		"wait_invalid":           "wait must be accepted, answered or completed",
+		"webhook_bad_signature":  "X-Iftach-Signature does not match the body",
+		"webhook_replayed":       "this webhook was already received",
+		"webhook_stale":          "X-Iftach-Timestamp is missing or too far off",
+		"webhook_unknown":        "no webhook integration named %q",
+		"webhook_unsigned":       "X-Iftach-Timestamp and X-Iftach-Signature are required",
+	},
+	"he": {
+		string(errAuth):         "פרטי גישה שגויים",
+		string(errForbidden):    "אין הרשאה לטוקן הזה",
+		string(errTokenExpired): "תוקף הקישור פג (או שעדיין אינו בתוקף)",
+		string(errTokenUsed):    "הקישור החד-פעמי הזה כבר נוצל",
+		string(errBadRequest):   "בקשה שגויה",
+		string(errNotFound):     "לא נמצא",
+		string(errRateLimited):  "יותר מדי בקשות",
+		string(errIPDiscovery):  "לא ניתן לזהות את כתובת ה-IP הציבורית",
+		string(errSipSetup):     "לא ניתן להפעיל את לקוח ה-SIP",
+		string(errSipAuth):      "אימות SIP נכשל",
+		string(errNoTrying):     "אין תגובה מהספק (100 Trying)",
+		string(errBusy):         "היעד תפוס",
+		string(errSip4xx):       "השיחה נדחתה על ידי הספק",
+		string(errSip5xx):       "שגיאה אצל הספק",
+		string(errSip6xx):       "השיחה סורבה",
+		string(errRedirect):     "הספק הפנה את השיחה ליעד שאי אפשר לעקוב אחריו",
+		string(errProviderDown): "הספק אינו זמין",
+		string(errDialRefused):  "היעד אינו מורשה לחיוג",
+		string(errBadNumber):    "מספר טלפון לא תקין",
+		string(errNoAnswer):     "אין מענה",
+		string(errIntercom):     "שיחת האינטרקום נכשלה",
+		string(errBudget):       "תקציב השיחות של החודש נוצל — פנו למנהל",
+		string(errNotApproved):  "הבקשה לפתוח לא אושרה",
+		string(errStandby):      "זוהי יחידת הגיבוי — השיחות יוצאות מהיחידה השנייה",
+		string(errInternal):     "שגיאה פנימית",
+
+		"status." + statusSendingInvite:  "שולח INVITE...",
+		"status." + statusAuthenticating: "מאמת...",
+		"status." + statusTrying:         "מנסה (100)...",
+		"status." + statusAnswered:       "נענה (200 OK)",
+		"status." + statusHangingUpTimer: "מנתק (טיימר שיחה)",
+		"status." + statusBusy:           "תפוס (486)",
+		"status." + statusError:          "שגיאה — בדקו את הלוגים",
+		"status." + statusWatchdogKilled: "השיחה נתקעה — נותקה",
+		"status." + statusHungUp:         "נותק על ידי מנהל",
+		"status." + statusClientLeft:     "נותק — הדף נסגר",
+		"status." + statusCancelled:      "בוטל",
+		"status." + statusApprovalWait:   "ממתין לאישור...",
+		"status." + statusRingingYou:     "מחייג לטלפון שלך...",
+		"status." + statusBridging:       "ענית — מחייג לשער...",
+		"status." + statusBridgeEnded:    "השיחה הסתיימה",
+		"status." + statusIntercom:       "מישהו באינטרקום — מחייג לטלפון שלך...",
+		"status." + statusRetryWait:      "הספק עמוס — מנסה שוב בעוד %d שניות...",
+		"status." + statusRedirected:     "הופנה — מחייג למספר החדש...",
+		"status." + statusTerminated:     "לא נענה — השיחה בוטלה",
+		"status." + statusFailover:       "הספק לא זמין — מנסה את הגיבוי...",
+		"status." + statusRinging:        "מצלצל לשער...",
+		"status." + statusRang:           "השער צלצל — בוטל לפני מענה",
+		"status." + statusLegRinging:     "מצלצל...",
+		"status." + statusLegUp:          "נענה",
+		"status." + statusLegFailed:      "לא הושג",
+		"status." + statusLegDropped:     "ניתק",
+		"status." + statusLegRedialing:   "מחייג שוב...",
+		"status." + statusLegEnded:       "השיחה הסתיימה",
+
+		"batch." + batchWaiting:       "ממתין...",
+		"batch." + batchWebhook:       "קורא ל-webhook...",
+		"batch." + batchWebhookFailed: "ה-webhook נכשל",
+		"batch." + batchStepDone:      "בוצע",
+		"batch." + batchCompleted:     "הושלם",
+		"batch." + batchFailed:        "נכשל",
+
+		"ui.ready":           "מוכן",
+		"ui.connected":       "מחובר — השיחה התחילה",
+		"ui.invalid_message": "התקבלה הודעה לא תקינה",
+		"ui.ws_error":        "שגיאת חיבור WebSocket",
+		"ui.closed":          "החיבור נסגר",
+		"ui.reconnecting":    "החיבור נותק — מתחבר מחדש...",
+		"ui.call_lost":       "אין מידע על מצב השיחה — בדקו את השער",
+		"ui.token_saved":     "הטוקן נשמר",
+		"ui.token_cleared":   "הטוקן נמחק",
+		"ui.upgrading":       "גרסה חדשה זמינה — טוען מחדש...",
+		"ui.upgrade_failed":  "הדף אינו מעודכן — נא לרענן אותו",
+		"ui.autoclose_in":    "ייסגר בעוד",
+		"ui.cancel":          "ביטול",
+		"ui.autoclose_off":   "הסגירה האוטומטית בוטלה",
+
+		"admin_disabled":         "ממשק הניהול כבוי (לא הוגדר --admin-token)",
+		"budget_not_blocked":     "תקציב השיחות אינו חוסם שיחות",
+		"approval_decided":       "הבקשה כבר %s",
+		"visit_name_missing":     "נא להזין את שמכם",
+		"visit_captcha_failed":   "אימות ה-CAPTCHA נכשל — נא לנסות שוב",
+		"visit_busy":             "יותר מדי מבקרים ממתינים — נא לנסות שוב בעוד כמה דקות",
+		"visit_not_found":        "הבקשה לא נמצאה (ייתכן שפג תוקפה)",
+		"visit_bad_decision":     "ההחלטה חייבת להיות approve או deny",
+		"visit_decided":          "הבקשה כבר %s",
+		"admin_not_here":         "ממשק הניהול אינו זמין בכתובת זו",
+		"answer_delay_invalid":   "answer_delay חייב להיות משך זמן (למשל 5s)",
+		"autoclose_not_pending":  "אין סגירה אוטומטית ממתינה עבור %q",
+		"batch_invalid":          "אצווה לא תקינה: %v",
+		"call_finished":          "השיחה כבר הסתיימה",
+		"callback_url_invalid":   "callback_url חייב להיות כתובת http(s) מלאה",
+		"config_invalid":         "הגדרות לא תקינות: %s",
+		"config_read_failed":     "לא ניתן לקרוא את %s: %v",
+		"config_write_failed":    "לא ניתן לכתוב את %s: %v",
+		"invalid_json":           "JSON לא תקין: %v",
+		"gate_unknown":           "אין שער בשם %q",
+		"gate_forbidden":         "הטוקן הזה אינו רשאי לפתוח את השער %q",
+		"token_in_use":           "הטוקן החד-פעמי הזה בשימוש בשיחה פעילה",
+		"idempotency_key_reused": "מפתח ה-Idempotency-Key הזה נשלח בעבר עם פרמטרים אחרים",
+		"token_one_time":         "טוקן חד-פעמי אינו יכול להריץ אצוות או מאקרו",
+		"token_name_invalid":     "השם חייב להכיל אותיות קטנות, ספרות, - או _",
+		"token_expiry_invalid":   "חלון התוקף חייב להסתיים בעתיד ואחרי שהוא מתחיל (expires_in, למשל 2h, או valid_until, לא שניהם)",
+		"delegate_forbidden":     "טוקן ניהול מואצל אינו יכול לנהל האצלות",
+		"delegation_expiry_bad":  "האצלה דורשת expires_in (למשל 72h) או valid_until, לא שניהם, שמסתיים בעתיד ובתוך %d ימים",
+		"macro_not_found":        "אין מאקרו בשם %q",
+		"history_time_invalid":   "%s חייב להיות זמן RFC 3339, למשל 2026-05-01T09:00:00+03:00",
+		"anonymize_failed":       "האנונימיזציה נכשלה: %v",
+		"history_limit_invalid":  "limit חייב להיות בין 1 ל-%d",
+		"manual_dial_disabled":   "חיוג ידני דורש --dial-allow",
+		"manual_dial_plan":       "תוכנית חיוג: %v",
+		"manual_dial_refused":    "%s אינו תואם אף תבנית של --dial-allow",
+		"manual_dtmf_invalid":    "dtmf חייב להיות עד 32 תווים מתוך 0-9 * # A-D",
+		"manual_duration_bad":    "משך השיחה חייב להיות בין 1s ל-%v",
+		"manual_number_invalid":  "%q אינו מספר שניתן לחייג",
+		"manual_reason_missing":  "נדרשת סיבה של עד %d תווים, עבור יומן הביקורת",
+		"no_test_destination":    "לא הוגדר --test-destination",
+		"probe_failed":           "בדיקת הספק נכשלה: %s",
+		"ringme_unknown":         "אין טלפון --ring-me בשם %q",
+		"setup_code_wrong":       "קוד הגדרה שגוי (ראו את מסוף השרת)",
+		"setup_probe_ok":         "%s אישר את פרטי הגישה של %s",
+		"setup_saved":            "ההגדרות נשמרו — השער מוכן.",
+		"test_call_running":      "שיחת בדיקה כבר מתבצעת",
+		"timeout_invalid":        "timeout חייב להיות משך זמן חיובי (למשל 30s)",
+		"wait_invalid":           "wait חייב להיות accepted, answered או completed",
+		"webhook_bad_signature":  "X-Iftach-Signature אינה תואמת את גוף הבקשה",
+		"webhook_replayed":       "ה-webhook הזה כבר התקבל",
+		"webhook_stale":          "X-Iftach-Timestamp חסרה או רחוקה מדי מהשעה הנוכחית",
+		"webhook_unknown":        "אין אינטגרציית webhook בשם %q",
+		"webhook_unsigned":       "נדרשות הכותרות X-Iftach-Timestamp ו-X-Iftach-Signature",
+	},
+}
+
+// langAliases maps legacy or regional tags to a catalog language.
+var langAliases = map[string]string{"iw": "he"}
+
+// negotiateLang picks the catalog language for r: ?lang= if we have it, else the
+// highest-q Accept-Language entry we have (first one wins ties), else defaultLang.
+func negotiateLang(r *http.Request) string {
+	if l := r.URL.Query().Get("lang"); catalog[l] != nil {
+		return l
+	}
+	best, bestQ := defaultLang, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if alias, ok := langAliases[base]; ok {
+			base = alias
+		}
+		if catalog[base] != nil && q > bestQ {
+			best, bestQ = base, q
+		}
+	}
+	return best
+}
+
+// localize returns the text for key in lang (falling back to defaultLang, then the
+// key itself), formatted with args if any.
+func localize(lang, key string, args ...any) string {
+	msg, ok := catalog[lang][key]
+	if !ok {
+		msg, ok = catalog[defaultLang][key]
+	}
+	if !ok {
+		msg = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// handleMessages is GET /api/messages: the catalog for the negotiated language,
+// with defaultLang filling any gaps. Public — it holds no secrets.
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	lang := negotiateLang(r)
+	messages := maps.Clone(catalog[defaultLang])
+	maps.Copy(messages, catalog[lang])
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("Vary", "Accept-Language")
+	writeJSON(w, http.StatusOK, struct {
+		Lang     string            `json:"lang"`
+		Messages map[string]string `json:"messages"`
+	}{lang, messages})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Idle mode states, as reported by GET /api/status.
+const (
+	stateActive = "active"
+	stateIdle   = "idle"
+)
+
+var idleGauge = newGauge("iftach_idle", "1 while idle mode has background keepalives torn down.")
+
+// backgroundService is a keepalive-style subsystem (REGISTER refresh, broker
+// connections, monitors) that idle mode may tear down. start and stop must not
+// block: they only kick off or signal the service's own goroutines.
+type backgroundService struct {
+	name        string
+	start, stop func()
+	running     bool
+}
+
+// idleManager implements --idle-after for battery and solar powered deployments:
+// after that long without a request, every registered background service is
+// stopped; the next request starts them again before it is handled. Calls don't
+// need any of them, so nothing waits for a service to come back up.
+type idleManager struct {
+	mu           sync.Mutex
+	after        time.Duration // 0 = never idle
+	state        string
+	since        time.Time // UTC, when state last changed
+	lastActivity time.Time // UTC
+	services     []*backgroundService
+	timer        *time.Timer
+}
+
+var idle = &idleManager{state: stateActive, since: time.Now().UTC(), lastActivity: time.Now().UTC()}
+
+// idleExempt are paths that polling monitors hit; they don't count as activity,
+// or a scrape every 15s would keep the box awake forever.
+var idleExempt = map[string]bool{"/metrics": true, "/api/status": true, "/api/cluster": true}
+
+// Register adds a service, starting it right away unless the server is idle.
+func (m *idleManager) Register(name string, start, stop func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &backgroundService{name: name, start: start, stop: stop}
+	m.services = append(m.services, s)
+	if m.state == stateActive {
+		s.start()
+		s.running = true
+	}
+}
+
+// Kick starts the named service again unless the server is idle, for a service
+// whose start did nothing while it wasn't its turn (the --register registration of
+// a --cluster-db standby).
+func (m *idleManager) Kick(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state != stateActive {
+		return
+	}
+	for _, s := range m.services {
+		if s.name == name {
+			s.start()
+			s.running = true
+		}
+	}
+}
+
+// Start arms the inactivity timer; with after == 0 idle mode stays off.
+func (m *idleManager) Start(after time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.after = after
+	if after > 0 {
+		m.timer = time.AfterFunc(after, m.sleep)
+	}
+}
+
+// Touch records activity, waking the services up if the server was idle.
+func (m *idleManager) Touch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastActivity = time.Now().UTC()
+	if m.after == 0 {
+		return
+	}
+	m.timer.Reset(m.after)
+	if m.state == stateActive {
+		return
+	}
+	logInfo("Waking up after %v idle.\n", time.Since(m.since).Round(time.Second))
+	for _, s := range m.services {
+		s.start()
+		s.running = true
+	}
+	m.state, m.since = stateActive, m.lastActivity
+	idleGauge.add(-1)
+}
+
+func (m *idleManager) sleep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == stateIdle || time.Since(m.lastActivity) < m.after {
+		return // touched while the timer was firing
+	}
+	logInfo("No requests for %v — going idle (%d background service(s) stopped).\n", m.after, len(m.services))
+	for _, s := range m.services {
+		s.stop()
+		s.running = false
+	}
+	m.state, m.since = stateIdle, time.Now().UTC()
+	idleGauge.add(1)
+}
+
+// Middleware counts every request outside idleExempt as activity.
+func (m *idleManager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !idleExempt[r.URL.Path] {
+			m.Touch()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type serviceStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+}
+
+type statusResponse struct {
+	State        string              `json:"state"`
+	Since        time.Time           `json:"since"`
+	LastActivity time.Time           `json:"last_activity"`
+	IdleAfter    string              `json:"idle_after,omitempty"`
+	Services     []serviceStatus     `json:"services"`
+	Registration *registrationStatus `json:"registration,omitempty"` // with --register
+	PublicIP     *publicIPStatus     `json:"public_ip,omitempty"`    // with --ip-watch
+	Cluster      *clusterStatus      `json:"cluster,omitempty"`      // with --cluster-db
+}
+
+func (m *idleManager) status() statusResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := statusResponse{
+		State:        m.state,
+		Since:        displayTime(m.since),
+		LastActivity: displayTime(m.lastActivity),
+		Services:     []serviceStatus{},
+		Registration: registrar.Status(),
+		PublicIP:     ipWatch.Status(),
+		Cluster:      cluster.Status(),
+	}
+	if m.after > 0 {
+		st.IdleAfter = m.after.String()
+	}
+	for _, s := range m.services {
+		st.Services = append(st.Services, serviceStatus{s.name, s.running})
+	}
+	return st
+}
+
+// handleStatus is GET /api/status. It doesn't count as activity, so checking on an
+// idle server doesn't wake it.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if _, ok := callAuth(r); !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	writeJSON(w, http.StatusOK, idle.status())
+}
+
+// Stop disarms the inactivity timer and stops the running services, for shutdown.
+func (m *idleManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	for _, s := range slices.Backward(m.services) {
+		if s.running {
+			s.stop()
+			s.running = false
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// Intercom mode makes Iftach a small back-to-back user agent for the gate line: the
+// intercom is pointed at --intercom-listen, and a call from it is answered once the
+// --intercom-phone picks up, with the audio relayed between the two (rtprelay.go).
+// Unlike ring-me, the media can't go straight between the far ends: the intercom
+// is on the LAN, usually with no route to the provider's media or the other way.
+
+// intercomCall is an intercom INVITE being handled as a call (callOptions.Intercom).
+type intercomCall struct {
+	dialog  *sipgo.DialogServerSession
+	localIP netip.Addr // ours, as the intercom reaches us: for its Contact and SDP
+	port    int        // --intercom-listen's
+}
+
+// intercomServer answers the intercom on --intercom-listen.
+type intercomServer struct {
+	ua      *sipgo.UserAgent
+	srv     *sipgo.Server
+	dialogs *sipgo.DialogServerCache
+	conn    net.PacketConn
+	listen  netip.AddrPort
+	allow   []netip.Prefix // empty: private and loopback addresses
+}
+
+// intercomSubsystem is the lifecycle subsystem running the intercom server. It
+// binds in start, so a busy --intercom-listen fails startup.
+func intercomSubsystem() subsystem {
+	var s *intercomServer
+	return subsystem{
+		name:  "intercom",
+		after: []string{"store", "callbacks"},
+		start: func(context.Context) (err error) {
+			if s, err = newIntercomServer(&cli); err != nil {
+				return err
+			}
+			go func() {
+				logInfo("Answering the intercom on %s/udp, bridged to your phone (%s)\n", cli.IntercomListen, cli.IntercomPhone)
+				_ = s.srv.ServeUDP(s.conn)
+			}()
+			return nil
+		},
+		stop: func(context.Context) error {
+			s.conn.Close()
+			return s.ua.Close()
+		},
+	}
+}
+
+func newIntercomServer(cfg *Config) (*intercomServer, error) {
+	listen, err := netip.ParseAddrPort(cfg.IntercomListen)
+	if err != nil {
+		return nil, fmt.Errorf("--intercom-listen: %w", err)
+	}
+	allow, err := parseIntercomAllow(cfg.IntercomAllow)
+	if err != nil {
+		return nil, err
+	}
+	ua, err := sipgo.NewUA(sipgo.WithUserAgent("Iftach"))
+	if err != nil {
+		return nil, err
+	}
+	s := &intercomServer{ua: ua, listen: listen, allow: allow}
+	client, err := sipgo.NewClient(ua)
+	if err != nil {
+		ua.Close()
+		return nil, err
+	}
+	if s.srv, err = sipgo.NewServer(ua); err != nil {
+		ua.Close()
+		return nil, err
+	}
+	if s.conn, err = net.ListenPacket("udp", cfg.IntercomListen); err != nil {
+		ua.Close()
+		return nil, fmt.Errorf("listen on %s: %w", cfg.IntercomListen, err)
+	}
+	contact := sip.ContactHeader{Address: sip.Uri{User: "iftach", Host: listen.Addr().String(), Port: int(listen.Port())}}
+	s.dialogs = sipgo.NewDialogServerCache(client, contact)
+	s.srv.OnInvite(s.onInvite)
+	s.srv.OnAck(func(req *sip.Request, tx sip.ServerTransaction) {
+		_ = s.dialogs.ReadAck(req, tx)
+	})
+	s.srv.OnBye(func(req *sip.Request, tx sip.ServerTransaction) {
+		if err := s.dialogs.ReadBye(req, tx); err != nil {
+			_ = tx.Respond(sip.NewResponseFromRequest(req, 481, "Call/Transaction Does Not Exist", nil))
+		}
+	})
+	return s, nil
+}
+
+// onInvite takes an intercom call: it starts a session for it and stays until the
+// session is over, as the INVITE transaction only lives as long as its handler.
+func (s *intercomServer) onInvite(req *sip.Request, tx sip.ServerTransaction) {
+	src := req.Source()
+	if !s.allowed(src) {
+		logWarn("Intercom INVITE from %s refused: not in --intercom-allow.\n", src)
+		_ = tx.Respond(sip.NewResponseFromRequest(req, 403, "Forbidden", nil))
+		return
+	}
+	if _, ok := req.To().Params.Get("tag"); ok {
+		// A re-INVITE (session refresh, hold): the call goes on as it is.
+		_ = tx.Respond(sip.NewResponseFromRequest(req, 488, "Not Acceptable Here", nil))
+		return
+	}
+	if !hasSDP(req.Body()) {
+		// The phone is called with the intercom's offer, so there must be one.
+		_ = tx.Respond(sip.NewResponseFromRequest(req, 488, "Not Acceptable Here", nil))
+		return
+	}
+	dialog, err := s.dialogs.ReadInvite(req, tx)
+	if err != nil {
+		logWarn("Intercom INVITE from %s: %v\n", src, err)
+		_ = tx.Respond(sip.NewResponseFromRequest(req, 400, "Bad Request", nil))
+		return
+	}
+	defer dialog.Close()
+	_ = dialog.Respond(100, "Trying", nil)
+
+	host, _, _ := net.SplitHostPort(src)
+	call := &intercomCall{dialog: dialog, localIP: s.localIPFor(src), port: int(s.listen.Port())}
+	cfg := cli
+	<-sessions.Start(&cfg, callOptions{Intercom: call, Source: "intercom " + host}).done
+}
+
+func (s *intercomServer) allowed(src string) bool {
+	ap, err := netip.ParseAddrPort(src)
+	if err != nil {
+		return false
+	}
+	addr := ap.Addr().Unmap()
+	if len(s.allow) == 0 {
+		return addr.IsPrivate() || addr.IsLoopback()
+	}
+	return slices.ContainsFunc(s.allow, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// localIPFor is our address as seen from src: --intercom-listen's, unless that is
+// every interface, in which case the one the route to src goes out of.
+func (s *intercomServer) localIPFor(src string) netip.Addr {
+	if !s.listen.Addr().IsUnspecified() {
+		return s.listen.Addr()
+	}
+	conn, err := net.Dial("udp", src) // connects a socket only; nothing is sent
+	if err != nil {
+		return netip.IPv4Unspecified()
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+}
+
+// parseIntercomAllow parses --intercom-allow: addresses and CIDR prefixes.
+func parseIntercomAllow(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("--intercom-allow %q is neither an address nor a CIDR prefix", s)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// runIntercom is run() for intercom calls (callOptions.Intercom): it rings the
+// --intercom-phone with the intercom's offer, answers the intercom once the phone
+// does, relays the audio, and hangs both up when either does.
+func runIntercom(ctx context.Context, cfg *Config, opts callOptions, trace *callTrace, statusChan chan<- callStatusMsg) {
+	defer close(statusChan)
+	report := statusSink(func(m callStatusMsg) {
+		trace.status(m)
+		select {
+		case statusChan <- m:
+		default:
+		}
+	})
+	defer recoverCall(ctx, report)
+	ctx, cancel := context.WithTimeoutCause(ctx, cfg.BridgeCap, errBridgeCapped)
+	defer cancel()
+	log := callLog(ctx)
+	in := opts.Intercom
+	refuse := func(code int, reason string) { _ = in.dialog.Respond(code, reason, nil) }
+
+	number, _, err := cfg.dialNumber(dialPlanAll, cfg.RingMe[cfg.IntercomPhone])
+	if err != nil {
+		log.Failure(dialFailure(err), "Dial plan for --intercom-phone %s: %v", cfg.IntercomPhone, err)
+		refuse(500, "Server Internal Error")
+		report.fail(statusError, dialFailure(err))
+		return
+	}
+	if !cfg.dialAllowed(number) {
+		dialRefused.inc("gate", defaultGate)
+		log.Failure(errDialRefused, "Refusing to dial %s: it matches no --dial-allow pattern", number)
+		refuse(403, "Forbidden")
+		report.fail(statusError, errDialRefused)
+		return
+	}
+	offer := in.dialog.InviteRequest.Body()
+	intercomRTP, err := sdpAudio(offer)
+	if err != nil {
+		log.Failure(errIntercom, "The intercom's offer: %v", err)
+		refuse(488, "Not Acceptable Here")
+		report.fail(statusError, errIntercom)
+		return
+	}
+
+	publicIP, err := discoverPublicIP(ctx, cfg)
+	if err != nil {
+		log.Failure(errIPDiscovery, "Discover public IP: %v", err)
+		refuse(503, "Service Unavailable")
+		report.fail(statusError, errIPDiscovery)
+		return
+	}
+	trace.add("public IP %s (used in Contact and SDP)", publicIP)
+	b, err := newBridgeStack(cfg, publicIP, opts.User, report, trace)
+	if err != nil {
+		log.Failure(errSipSetup, "SIP stack: %v", err)
+		refuse(503, "Service Unavailable")
+		report.fail(statusError, errSipSetup)
+		return
+	}
+	defer b.Close()
+	relay, err := newRTPRelay("intercom", "phone")
+	if err != nil {
+		log.Failure(errSipSetup, "RTP relay: %v", err)
+		refuse(503, "Service Unavailable")
+		report.fail(statusError, errSipSetup)
+		return
+	}
+	defer relay.Close()
+	relay.legs[0].expect(intercomRTP)
+
+	report.status(statusIntercom)
+	_ = in.dialog.Respond(180, "Ringing", nil)
+	// The phone is only called while the intercom is there: its CANCEL or BYE stops
+	// the phone ringing, the first time or on a redial.
+	phoneCtx, stopPhone := context.WithCancel(ctx)
+	defer stopPhone()
+	context.AfterFunc(in.dialog.Context(), stopPhone)
+	phoneOffer := relaySDP(offer, netip.MustParseAddr(publicIP), relay.legs[1].port())
+	phone := &bridgeLeg{name: "phone", number: number}
+	if err := b.dial(phoneCtx, phone, defaultGate, phoneOffer); err != nil {
+		switch {
+		case in.dialog.Context().Err() != nil:
+			log.Println("The intercom hung up before your phone answered.")
+			report.leg("intercom", statusLegDropped, "")
+			report.status(statusBridgeEnded)
+		case ctx.Err() != nil:
+			refuse(487, "Request Terminated")
+			b.dialFailed(ctx, "", err)
+		default:
+			refuse(intercomFailure(err))
+			b.dialFailed(ctx, fmt.Sprintf("Your phone (%s)", cfg.IntercomPhone), err)
+		}
+		return
+	}
+	defer func() { b.hangup(phone) }() // phone changes on a redial
+	if err := relayPhone(ctx, phone, relay); err != nil {
+		log.Failure(errSipSetup, "Your phone's answer: %v", err)
+		refuse(488, "Not Acceptable Here")
+		report.fail(statusError, errSipSetup)
+		return
+	}
+	relay.start()
+
+	contact := &sip.ContactHeader{Address: sip.Uri{User: "iftach", Host: in.localIP.String(), Port: in.port}}
+	defer hangupIntercom(in.dialog, report)
+	answer := relaySDP(phone.dialog.InviteResponse.Body(), in.localIP, relay.legs[0].port())
+	if err := in.dialog.Respond(200, "OK", answer, sip.NewHeader("Content-Type", "application/sdp"), contact); err != nil {
+		log.Failure(errIntercom, "Answering the intercom: %v", err)
+		report.fail(statusError, errIntercom)
+		return
+	}
+	report.leg("intercom", statusLegUp, "")
+	log.Printf("Bridged the intercom to your phone (%s).\n", cfg.IntercomPhone)
+	report.status(statusAnswered)
+
+	redials := 0
+bridged:
+	for {
+		select {
+		case <-phone.ended():
+			b.dropped(ctx, phone.name)
+			if cfg.BridgeOnDrop[phone.name] != dropRedial || redials == bridgeMaxRedials {
+				break bridged
+			}
+			redials++
+			report.leg(phone.name, statusLegRedialing, "")
+			log.Printf("Calling your phone again (%d of %d); the intercom waits.\n", redials, bridgeMaxRedials)
+			next := &bridgeLeg{name: "phone", number: number}
+			if err := b.dial(phoneCtx, next, defaultGate, phoneOffer); err != nil {
+				switch {
+				case in.dialog.Context().Err() != nil:
+					b.dropped(ctx, "intercom")
+				case !bridgeStopped(ctx):
+					log.Warnf("Your phone (%s) again: %v\n", cfg.IntercomPhone, err)
+				}
+				break bridged
+			}
+			phone = next
+			if err := relayPhone(ctx, phone, relay); err != nil {
+				log.Warnf("Your phone's answer: %v\n", err)
+				break bridged
+			}
+			log.Println("Your phone is back on the intercom.")
+		case <-in.dialog.Context().Done():
+			b.dropped(ctx, "intercom")
+			break bridged
+		case <-ctx.Done():
+			bridgeStopped(ctx)
+			break bridged
+		}
+	}
+	b.hangup(phone)
+	hangupIntercom(in.dialog, report)
+	report.status(statusBridgeEnded)
+}
+
+// relayPhone ACKs the phone's answer and points the relay's phone side at it.
+func relayPhone(ctx context.Context, phone *bridgeLeg, relay *rtpRelay) error {
+	_ = phone.ack(ctx, nil)
+	addr, err := sdpAudio(phone.dialog.InviteResponse.Body())
+	if err != nil {
+		return err
+	}
+	relay.legs[1].expect(addr)
+	return nil
+}
+
+// intercomFailure is the final response the intercom gets when the phone can't be
+// reached: the phone's own busy or decline, or else that nobody is there.
+func intercomFailure(err error) (int, string) {
+	var res *sipgo.ErrDialogResponse
+	if errors.As(err, &res) && (res.Res.StatusCode == 486 || res.Res.StatusCode >= 600) {
+		return res.Res.StatusCode, res.Res.Reason
+	}
+	if errors.Is(err, errLegUnanswered) {
+		return 480, "Temporarily Unavailable"
+	}
+	return 503, "Service Unavailable"
+}
+
+// hangupIntercom sends the intercom BYE if its call is still up.
+func hangupIntercom(d *sipgo.DialogServerSession, report statusSink) {
+	if d.LoadState() != sip.DialogStateConfirmed {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = d.Bye(ctx)
+	report.leg("intercom", statusLegEnded, "")
+}
+
+// checkIntercom reports --intercom-* problems for check().
+func (c *Config) checkIntercom() []string {
+	if c.IntercomListen == "" {
+		return nil
+	}
+	var problems []string
+	if _, err := netip.ParseAddrPort(c.IntercomListen); err != nil {
+		problems = append(problems, fmt.Sprintf("--intercom-listen %q must be an IP:port, e.g. 0.0.0.0:5080", c.IntercomListen))
+	}
+	if _, ok := c.RingMe[c.IntercomPhone]; !ok {
+		problems = append(problems, fmt.Sprintf("--intercom-phone %q is not one of the --ring-me phones", c.IntercomPhone))
+	}
+	if _, err := parseIntercomAllow(c.IntercomAllow); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
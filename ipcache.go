@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// --ip-cache keeps the discovered public IP for a while, so pressing the button
+// costs the SIP round trips only, not the seconds of asking the IP services first.
+// While the server is active the address is looked up again in the background
+// every half --ip-cache, so a call finds it fresh; a lookup that fails there keeps
+// the old address until it runs out. An idle server doesn't poll (like --ip-watch,
+// it is a background service of idle mode), and its first call after waking looks
+// the address up itself if the copy ran out meanwhile.
+//
+// A copy can go stale before it runs out when the router fails over: --ip-watch
+// replaces it as soon as it sees the change, and a REGISTER that goes unanswered
+// drops it.
+
+const minIPCache = time.Minute
+
+var publicIPLookups = newCounter("iftach_public_ip_lookups_total", "Public IPs calls and registrations needed, by result (cached, looked_up, failed).")
+
+// ipCache is the --ip-cache copy, nil without it (and outside serve).
+var ipCache *publicIPCache
+
+type publicIPCache struct {
+	cfg *Config
+	ttl time.Duration
+
+	mu     sync.Mutex
+	ip     string
+	at     time.Time // when ip was looked up
+	cancel context.CancelFunc
+}
+
+// ipCacheSubsystem runs --ip-cache.
+func ipCacheSubsystem() subsystem {
+	return subsystem{
+		name: "ipcache",
+		start: func(context.Context) error {
+			ipCache = &publicIPCache{cfg: &cli, ttl: cli.IpCache}
+			idle.Register("ipcache", ipCache.start, ipCache.stop)
+			return nil
+		},
+		stop: func(context.Context) error {
+			ipCache.stop()
+			return nil
+		},
+	}
+}
+
+// get returns the cached address and its age, ok false when there is none or it
+// ran out.
+func (c *publicIPCache) get() (ip string, age time.Duration, ok bool) {
+	if c == nil {
+		return "", 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	age = time.Since(c.at)
+	if c.ip == "" || age >= c.ttl {
+		return "", 0, false
+	}
+	return c.ip, age, true
+}
+
+// set caches ip as just looked up.
+func (c *publicIPCache) set(ip string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ip, c.at = ip, time.Now()
+}
+
+// forget drops the cached address, so the next call looks it up again.
+func (c *publicIPCache) forget() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ip = ""
+}
+
+// start begins refreshing. It doesn't block (see backgroundService).
+func (c *publicIPCache) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.loop(ctx)
+}
+
+func (c *publicIPCache) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+}
+
+func (c *publicIPCache) loop(ctx context.Context) {
+	ctx = withCallLogger(ctx, componentLogger("ip-cache"))
+	for {
+		if _, age, ok := c.get(); !ok || age >= c.ttl/2 {
+			c.refresh(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.ttl / 2):
+		}
+	}
+}
+
+// refresh looks the address up again, keeping the old one if that fails.
+func (c *publicIPCache) refresh(ctx context.Context) {
+	ip, err := lookupPublicIP(ctx, c.cfg)
+	switch {
+	case ctx.Err() != nil:
+	case err != nil:
+		publicIPLookups.inc("result", "failed")
+		logWarn("Refreshing the cached public IP: %v\n", err)
+	default:
+		c.set(ip)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --ip-watch checks the public IP every so often while the server runs. A router
+// that fails over to its LTE backup (and back) changes the address the provider
+// sees mid-operation; the --register binding keeps pointing at the old Contact
+// until a restart, and calls use the --ip-cache copy until it runs out. The watch
+// always looks the address up afresh and keeps --ip-cache current; on a change it
+// logs it, has the registration sent again with the new Contact, POSTs an
+// ip_changed event to --notify-url, and reports it in GET /api/status.
+//
+// The watch is a background service of idle mode, like the registration it keeps
+// current: an idle server doesn't poll the IP services.
+
+const minIPWatch = 30 * time.Second
+
+var publicIPChanges = newCounter("iftach_public_ip_changes_total", "Public IP changes seen by --ip-watch.")
+
+// ipWatch is the --ip-watch watcher, nil without it.
+var ipWatch *ipWatcher
+
+// publicIPStatus is the watched address, as GET /api/status reports it.
+type publicIPStatus struct {
+	IP        string    `json:"ip,omitempty"` // empty until the first check succeeds
+	Previous  string    `json:"previous,omitempty"`
+	Since     time.Time `json:"since,omitzero"` // when IP was first seen
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+	Changes   int       `json:"changes"`
+	Error     string    `json:"error,omitempty"` // of the latest check
+}
+
+type ipWatcher struct {
+	cfg   *Config
+	every time.Duration
+
+	mu     sync.Mutex
+	status publicIPStatus
+	cancel context.CancelFunc
+}
+
+// ipWatchSubsystem runs --ip-watch.
+func ipWatchSubsystem() subsystem {
+	return subsystem{
+		name:  "ipwatch",
+		after: []string{"register", "notify"},
+		start: func(context.Context) error {
+			ipWatch = &ipWatcher{cfg: &cli, every: cli.IpWatch}
+			idle.Register("ipwatch", ipWatch.start, ipWatch.stop)
+			return nil
+		},
+		stop: func(context.Context) error {
+			ipWatch.stop()
+			return nil
+		},
+	}
+}
+
+// start begins watching. It doesn't block (see backgroundService).
+func (w *ipWatcher) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	go w.loop(ctx)
+}
+
+func (w *ipWatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+}
+
+func (w *ipWatcher) loop(ctx context.Context) {
+	ctx = withCallLogger(ctx, componentLogger("ip-watch"))
+	for {
+		w.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.every):
+		}
+	}
+}
+
+// check discovers the public IP once, acting on a change.
+func (w *ipWatcher) check(ctx context.Context) {
+	ip, err := lookupPublicIP(ctx, w.cfg) // never the cached one
+	if ctx.Err() != nil {
+		return
+	}
+	now := time.Now().UTC()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.CheckedAt = now
+	if err != nil {
+		w.status.Error = err.Error()
+		return
+	}
+	w.status.Error = ""
+	ipCache.set(ip)
+	prev := w.status.IP
+	if ip == prev {
+		return
+	}
+	w.status.IP, w.status.Since = ip, now
+	if prev == "" {
+		return // the first check: nothing to compare with
+	}
+	w.status.Previous = prev
+	w.status.Changes++
+	publicIPChanges.inc()
+	logInfo("Public IP changed from %s to %s (a failover?)\n", prev, ip)
+	registrar.readdress(ip)
+	if notifications != nil {
+		notifications.send(notification{
+			Event: notifyIPChanged, Since: displayTime(now),
+			IP: ip, PreviousIP: prev,
+			Text: fmt.Sprintf("public IP changed from %s to %s", prev, ip),
+		})
+	}
+}
+
+// Status is the watched address, nil without --ip-watch.
+func (w *ipWatcher) Status() *publicIPStatus {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.status
+	if !st.Since.IsZero() {
+		st.Since = displayTime(st.Since)
+	}
+	if !st.CheckedAt.IsZero() {
+		st.CheckedAt = displayTime(st.CheckedAt)
+	}
+	return &st
+}
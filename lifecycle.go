@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	subsystemReadyTimeout = 10 * time.Second
+	subsystemReadyPoll    = 100 * time.Millisecond
+	shutdownTimeout       = 10 * time.Second
+)
+
+var subsystemUp = newGauge("iftach_subsystem_up", "1 while a subsystem is started, by subsystem.")
+
+// subsystem is one part of the server that lifecycle starts and stops: the store,
+// the dispatchers, integrations, HTTP. Subsystems that aren't configured simply
+// aren't added, so nothing is set up that the deployment doesn't use.
+type subsystem struct {
+	name  string
+	after []string // started before this one; names that weren't added are ignored
+
+	// start sets the subsystem up and returns. Long-running work goes in its own
+	// goroutines, bound to ctx, which is cancelled before stop is called.
+	start func(ctx context.Context) error
+	// ready, if set, is polled after start until it returns nil; the subsystems
+	// that come after wait for it, and startup fails if it never does.
+	ready func() error
+	// stop, if set, tears down what start set up, within ctx's deadline.
+	stop func(ctx context.Context) error
+
+	cancel context.CancelFunc
+}
+
+// lifecycle starts subsystems in dependency order and stops them in reverse, so
+// e.g. HTTP stops taking calls before the stores those calls write to are saved.
+type lifecycle struct {
+	subsystems []*subsystem
+	started    []*subsystem
+}
+
+func (l *lifecycle) add(s subsystem) {
+	l.subsystems = append(l.subsystems, &s)
+}
+
+// order sorts the subsystems so each comes after those it names in after, keeping
+// the order they were added in otherwise.
+func (l *lifecycle) order() ([]*subsystem, error) {
+	added := map[string]bool{}
+	for _, s := range l.subsystems {
+		added[s.name] = true
+	}
+	var sorted []*subsystem
+	placed := map[string]bool{}
+	for len(sorted) < len(l.subsystems) {
+		progress := false
+		for _, s := range l.subsystems {
+			if placed[s.name] {
+				continue
+			}
+			if slices.ContainsFunc(s.after, func(dep string) bool { return added[dep] && !placed[dep] }) {
+				continue
+			}
+			sorted = append(sorted, s)
+			placed[s.name] = true
+			progress = true
+		}
+		if !progress {
+			var stuck []string
+			for _, s := range l.subsystems {
+				if !placed[s.name] {
+					stuck = append(stuck, s.name)
+				}
+			}
+			return nil, fmt.Errorf("subsystems depend on each other in a cycle: %v", stuck)
+		}
+	}
+	return sorted, nil
+}
+
+// start starts every subsystem, waiting for each to be ready before the next. If
+// one fails, those already started are stopped again and the error returned.
+func (l *lifecycle) start(ctx context.Context) error {
+	sorted, err := l.order()
+	if err != nil {
+		return err
+	}
+	for _, s := range sorted {
+		sctx, cancel := context.WithCancel(ctx)
+		s.cancel = cancel
+		if err := s.start(sctx); err != nil {
+			cancel()
+			l.stop()
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+		l.started = append(l.started, s)
+		subsystemUp.add(1, "subsystem", s.name)
+		if s.ready != nil {
+			if err := waitReady(s.ready); err != nil {
+				l.stop()
+				return fmt.Errorf("%s: %w", s.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func waitReady(ready func() error) error {
+	deadline := time.Now().Add(subsystemReadyTimeout)
+	for {
+		err := ready()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not ready after %v: %w", subsystemReadyTimeout, err)
+		}
+		time.Sleep(subsystemReadyPoll)
+	}
+}
+
+// stop stops the started subsystems, newest first, giving them shutdownTimeout in
+// all. A subsystem that fails to stop is reported, and the rest still stopped.
+func (l *lifecycle) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range slices.Backward(l.started) {
+		s.cancel()
+		if s.stop != nil {
+			if err := s.stop(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				logWarn("Stopping %s: %v\n", s.name, err)
+			}
+		}
+		subsystemUp.add(-1, "subsystem", s.name)
+	}
+	l.started = nil
+}
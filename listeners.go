@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Besides --listen-address/--listen-port, --listeners serves the same routes on
+// more addresses from one process: plain HTTP on the LAN for the wall tablet and
+// HTTPS on the tailnet, say. Each has its own TLS certificate and scope; a
+// listener with scope=calls answers the admin endpoints with 404, so an address
+// reachable from outside never exposes them even to someone holding the admin
+// token. Each is a subsystem of its own, bound at startup like the main one. An
+// address of unix:PATH listens on a Unix socket instead, for a reverse proxy on the
+// same host, with mode=0660 (say) setting who may connect to it.
+//
+// Each listener also has its own middleware: auth=none serves the call endpoints
+// without a call token (a tailnet whose members are all trusted; the admin token is
+// still required), and rate=N answers a client's requests past N a minute with 429.
+
+// Listener scopes and auth policies.
+const (
+	scopeAll   = "all"
+	scopeCalls = "calls"
+	authToken  = "token"
+	authNone   = "none"
+)
+
+// Every listener is internet-facing as far as it knows: request headers are capped
+// well below net/http's 1MB, and a client gets readHeaderWait to send them, so a
+// slow one can't hold connections open for nothing.
+const (
+	maxHeaderBytes = 16 << 10
+	readHeaderWait = 10 * time.Second
+)
+
+var httpRateLimited = newCounter("iftach_http_rate_limited_total", "HTTP requests answered 429 by a --listeners rate limit, by listener.")
+
+// listenerSpec is one HTTP listener.
+type listenerSpec struct {
+	name      string // "" for the main listener
+	addr      string // host:port, or unix:PATH
+	cert, key string // PEM files, for HTTPS
+	scope     string
+	auth      string
+	rate      int         // requests a minute per client, 0 for no limit
+	mode      os.FileMode // of a Unix socket; 0 leaves the umask's
+}
+
+func (l listenerSpec) tls() bool { return l.cert != "" }
+
+// socket returns the path of a Unix socket listener.
+func (l listenerSpec) socket() (string, bool) { return strings.CutPrefix(l.addr, "unix:") }
+
+func (l listenerSpec) listen() (net.Listener, error) {
+	path, ok := l.socket()
+	if !ok {
+		return net.Listen("tcp", l.addr)
+	}
+	// A socket left behind by a process that didn't shut down cleanly would make the
+	// bind fail; one a live process is serving on would answer.
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s is in use", path)
+	}
+	_ = os.Remove(path)
+	if l.mode == 0 {
+		return net.Listen("unix", path)
+	}
+	// Bound at path and chmodded after, the socket would take the umask's mode for a
+	// moment. Bound in a directory only we can enter, then given its mode and moved
+	// into place, it is never reachable with any other.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".iftach-socket-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	bound := filepath.Join(dir, "s")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false) // it won't be at bound
+	if err := os.Chmod(bound, l.mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(bound, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return movedSocket{ln, path}, nil
+}
+
+// movedSocket is a Unix socket listener moved to path after it was bound: it
+// reports path as its address, and removes it on Close as one bound there would.
+type movedSocket struct {
+	*net.UnixListener
+	path string
+}
+
+func (m movedSocket) Addr() net.Addr { return &net.UnixAddr{Name: m.path, Net: "unix"} }
+
+func (m movedSocket) Close() error {
+	err := m.UnixListener.Close()
+	_ = os.Remove(m.path)
+	return err
+}
+
+// parseListener parses a --listeners spec: ADDRESS:PORT or unix:PATH, then
+// comma-separated cert=FILE, key=FILE, scope=all|calls, auth=token|none, rate=N and
+// (for a socket) mode=OCTAL options.
+func parseListener(name, spec string) (listenerSpec, error) {
+	fields := strings.Split(spec, ",")
+	l := listenerSpec{name: name, addr: strings.TrimSpace(fields[0]), scope: scopeAll, auth: authToken}
+	if path, ok := l.socket(); ok {
+		if !filepath.IsAbs(path) {
+			return l, fmt.Errorf("the socket path %q must be absolute", path)
+		}
+	} else if _, port, err := net.SplitHostPort(l.addr); err != nil || port == "" {
+		return l, fmt.Errorf("%q is not an ADDRESS:PORT or unix:PATH", l.addr)
+	}
+	for _, opt := range fields[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "cert":
+			l.cert = value
+		case "key":
+			l.key = value
+		case "scope":
+			if !slices.Contains([]string{scopeAll, scopeCalls}, value) {
+				return l, fmt.Errorf("scope must be %s or %s", scopeAll, scopeCalls)
+			}
+			l.scope = value
+		case "auth":
+			if !slices.Contains([]string{authToken, authNone}, value) {
+				return l, fmt.Errorf("auth must be %s or %s", authToken, authNone)
+			}
+			l.auth = value
+		case "rate":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return l, fmt.Errorf("rate must be a positive number of requests a minute")
+			}
+			l.rate = n
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if _, unix := l.socket(); err != nil || mode > 0o777 || !unix {
+				return l, fmt.Errorf("mode must be octal permissions, e.g. 0660, and is for unix: sockets only")
+			}
+			l.mode = os.FileMode(mode)
+		default:
+			return l, fmt.Errorf("unknown option %q (cert, key, scope, auth, rate or mode)", opt)
+		}
+	}
+	if (l.cert == "") != (l.key == "") {
+		return l, fmt.Errorf("cert and key must be given together")
+	}
+	return l, nil
+}
+
+// listenerSpecs returns the --listeners, sorted by name.
+func (c *Config) listenerSpecs() ([]listenerSpec, error) {
+	var specs []listenerSpec
+	for name, spec := range c.Listeners {
+		if !gateName.MatchString(name) {
+			return nil, fmt.Errorf("--listeners name %q must be lowercase letters, digits, - or _", name)
+		}
+		l, err := parseListener(name, spec)
+		if err != nil {
+			return nil, fmt.Errorf("--listeners %s: %v", name, err)
+		}
+		specs = append(specs, l)
+	}
+	slices.SortFunc(specs, func(a, b listenerSpec) int { return strings.Compare(a.name, b.name) })
+	return specs, nil
+}
+
+// checkListeners returns --listeners problems: specs that don't parse, addresses
+// taken twice and certificates that don't load.
+func (c *Config) checkListeners() (problems []string) {
+	specs, err := c.listenerSpecs()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	addrs := map[string]string{c.listenAddr(): "--listen-port"}
+	for _, l := range specs {
+		if other, ok := addrs[l.addr]; ok {
+			problems = append(problems, fmt.Sprintf("--listeners %s: %s is already taken by %s", l.name, l.addr, other))
+		}
+		addrs[l.addr] = "--listeners " + l.name
+		if l.tls() {
+			if _, err := tls.LoadX509KeyPair(l.cert, l.key); err != nil {
+				problems = append(problems, fmt.Sprintf("--listeners %s: %v", l.name, err))
+			}
+		}
+	}
+	return problems
+}
+
+type listenerKey struct{}
+
+// listenerOf returns the --listeners listener r came in on, or nil for the main one.
+func listenerOf(r *http.Request) *listenerSpec {
+	l, _ := r.Context().Value(listenerKey{}).(*listenerSpec)
+	return l
+}
+
+// callsOnly reports whether r came in on a scope=calls listener.
+func callsOnly(r *http.Request) bool {
+	l := listenerOf(r)
+	return l != nil && l.scope == scopeCalls
+}
+
+// trustedListener reports whether r came in on an auth=none listener.
+func trustedListener(r *http.Request) bool {
+	l := listenerOf(r)
+	return l != nil && l.auth == authNone
+}
+
+// router puts h behind l's middleware: the listener in the request context (for
+// callsOnly and trustedListener), then its rate limit.
+func (l *listenerSpec) router(h http.Handler) http.Handler {
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey{}, l)))
+		})
+	})
+	if l.rate > 0 {
+		r.Use(newRateLimiter(l.name, l.rate).middleware)
+	}
+	r.Mount("/", h)
+	return r
+}
+
+// rateLimiter counts each client's requests in the current minute.
+type rateLimiter struct {
+	listener string
+	limit    int
+
+	mu     sync.Mutex
+	window time.Time
+	counts map[string]int
+}
+
+func newRateLimiter(listener string, limit int) *rateLimiter {
+	return &rateLimiter{listener: listener, limit: limit, counts: map[string]int{}}
+}
+
+func (rl *rateLimiter) allow(client string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now := time.Now().Truncate(time.Minute); !now.Equal(rl.window) {
+		rl.window, rl.counts = now, map[string]int{}
+	}
+	rl.counts[client]++
+	return rl.counts[client] <= rl.limit
+}
+
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if !rl.allow(client) {
+			httpRateLimited.inc("listener", rl.listener)
+			w.Header().Set("Retry-After", strconv.Itoa(60-time.Now().Second()))
+			writeAPIError(w, r, http.StatusTooManyRequests, errRateLimited, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// policy describes l's middleware for its startup line.
+func (l *listenerSpec) policy() string {
+	p := fmt.Sprintf("scope %s, auth %s", l.scope, l.auth)
+	if l.rate > 0 {
+		p += fmt.Sprintf(", %d requests/min per client", l.rate)
+	}
+	return p
+}
+
+// httpSubsystem serves h on l. It binds in start, so a bad or busy address (or a
+// certificate that doesn't load) fails startup instead of leaving a process that
+// serves nothing.
+func httpSubsystem(l listenerSpec, h http.Handler) subsystem {
+	srv := &http.Server{Addr: l.addr, Handler: h, MaxHeaderBytes: maxHeaderBytes, ReadHeaderTimeout: readHeaderWait}
+	name := "http"
+	if l.name != "" {
+		name += "-" + l.name
+		srv.Handler = l.router(h)
+	}
+	return subsystem{
+		name:  name,
+		after: []string{"store", "audit", "tokens", "callbacks", "autoclose", "integrations", "register", "notify"},
+		start: func(context.Context) error {
+			if l.tls() {
+				cert, err := tls.LoadX509KeyPair(l.cert, l.key)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			}
+			ln, err := l.listen()
+			if err != nil {
+				return fmt.Errorf("listen on %s: %w", srv.Addr, err)
+			}
+			go func() {
+				var err error
+				switch {
+				case l.name == "":
+					logInfo("HTTP server listening on %s (WebSocket /call to start a call)\n", l.addr)
+					err = srv.Serve(ln)
+				case l.tls():
+					logInfo("HTTPS listener %s on %s (%s)\n", l.name, l.addr, l.policy())
+					err = srv.ServeTLS(ln, "", "")
+				default:
+					logInfo("HTTP listener %s on %s (%s)\n", l.name, l.addr, l.policy())
+					err = srv.Serve(ln)
+				}
+				if err != nil && err != http.ErrServerClosed {
+					logError("%s: %v\n", name, err)
+				}
+			}()
+			return nil
+		},
+		stop: srv.Shutdown,
+	}
+}
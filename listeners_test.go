@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSocketMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0o600, 0o660, 0o666} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "iftach.sock")
+		l, err := parseListener("test", fmt.Sprintf("unix:%s,mode=%o", path, mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := l.listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != mode {
+			t.Errorf("socket mode %v, want %v", fi.Mode(), os.ModeSocket|mode)
+		}
+		if ln.Addr().String() != path {
+			t.Errorf("Addr = %s, want %s", ln.Addr(), path)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("left behind next to the socket: %v", entries)
+		}
+		go func() {
+			if c, err := net.Dial("unix", path); err == nil {
+				c.Close()
+			}
+		}()
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		ln.Close()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("the socket is still there after Close: %v", err)
+		}
+	}
+}
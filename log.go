@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The server logs through log/slog. Every line is a record with a level, which
+// --log-level filters (debug adds the SIP stack's own records), and, on a call's
+// lines, the call's fields: call_id, source, gate, token (the named call token,
+// absent for --call-token) and trace_id. Records go straight to the output
+// setupLogging chose, where --log-format lays them out: text as the human lines of
+// old, the call's fields as the "[call … via … gate … token …]" prefix; json and
+// ecs with the fields as keys, for Loki and ELK to index as they are. Anything
+// else written to stdout (a panic, a library) still takes the parseLogLine path.
+//
+// Messages are plain text, without the emoji the stdout log of old led with: the
+// level says what they said.
+
+// logLevel is --log-level.
+var logLevel = new(slog.LevelVar)
+
+var logLevels = map[string]slog.Level{"debug": slog.LevelDebug, "info": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError}
+
+// logNames are the level names the layouts and shippers use.
+var logNames = map[slog.Level]string{slog.LevelDebug: "debug", slog.LevelInfo: "info", slog.LevelWarn: "warning", slog.LevelError: "error"}
+
+func init() {
+	slog.SetDefault(slog.New(&logHandler{}))
+}
+
+// logSink takes the records: stdout, or setupLogging's fan-out.
+type logSink interface {
+	emit(l logLine) error
+}
+
+var logOutput logSink = stdoutLog{}
+
+// stdoutLog writes records to stdout as text, without --log-file, shippers or a
+// structured --log-format.
+type stdoutLog struct{}
+
+func (stdoutLog) emit(l logLine) error {
+	_, err := fmt.Fprintln(os.Stdout, l.text)
+	return err
+}
+
+// logHandler is the slog.Handler of the server: it turns records into logLines for
+// logOutput.
+type logHandler struct {
+	attrs []slog.Attr // from WithAttrs, qualified by their group
+	group string      // from WithGroup, "" or ending in "."
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *logHandler) Handle(_ context.Context, r slog.Record) error {
+	l := logLine{at: r.Time, level: logLevelName(r.Level), msg: strings.TrimSpace(r.Message)}
+	for _, a := range h.attrs {
+		l.set(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		l.set(slog.Attr{Key: h.group + a.Key, Value: a.Value})
+		return true
+	})
+	l.text = l.layout(r.Message)
+	return logOutput.emit(l)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := &logHandler{attrs: append([]slog.Attr(nil), h.attrs...), group: h.group}
+	for _, a := range attrs {
+		c.attrs = append(c.attrs, slog.Attr{Key: h.group + a.Key, Value: a.Value})
+	}
+	return c
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &logHandler{attrs: h.attrs, group: h.group + name + "."}
+}
+
+func logLevelName(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return logNames[slog.LevelDebug]
+	case level < slog.LevelWarn:
+		return logNames[slog.LevelInfo]
+	case level < slog.LevelError:
+		return logNames[slog.LevelWarn]
+	}
+	return logNames[slog.LevelError]
+}
+
+// set puts a record's attribute where it belongs in l: the call's fields, which
+// the layouts know, or attrs.
+func (l *logLine) set(a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, g := range v.Group() {
+			l.set(slog.Attr{Key: a.Key + "." + g.Key, Value: g.Value})
+		}
+		return
+	}
+	switch a.Key {
+	case "call_id":
+		l.callID = v.String()
+	case "source":
+		l.source = v.String()
+	case "gate":
+		l.gate = v.String()
+	case "token":
+		l.token = v.String()
+	case "trace_id":
+		l.trace = v.String()
+	case "component":
+		l.component = v.String()
+	case "code":
+		l.code = v.String()
+	case "sip_status":
+		l.sipStatus = int(v.Int64())
+	default:
+		if a.Key != "" {
+			l.attrs = append(l.attrs, slog.Attr{Key: a.Key, Value: v})
+		}
+	}
+}
+
+// layout is l as a text line: msg's leading blank lines, the call's prefix (see
+// callPrefix) or the component's, the message, and the attributes the message
+// doesn't carry as key=value.
+func (l *logLine) layout(msg string) string {
+	var b strings.Builder
+	trimmed := strings.TrimLeft(msg, "\n")
+	b.WriteString(msg[:len(msg)-len(trimmed)])
+	switch {
+	case l.callID != "":
+		b.WriteString("[call " + l.callID)
+		for _, f := range [][2]string{{"via", l.source}, {"gate", l.gate}, {"token", l.token}, {"trace", l.trace}} {
+			if f[1] != "" {
+				b.WriteString(" " + f[0] + " " + f[1])
+			}
+		}
+		b.WriteString("] ")
+	case l.component != "":
+		b.WriteString("[" + l.component + "] ")
+	}
+	b.WriteString(strings.TrimRight(trimmed, "\n"))
+	for _, a := range l.attrs {
+		v := a.Value.String()
+		if strings.ContainsAny(v, " \"=") || v == "" {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(" " + a.Key + "=" + v)
+	}
+	return b.String()
+}
+
+// logDebug, logInfo, logWarn and logError log a server line at their level,
+// formatted as by fmt.Printf. A call's lines go through its callLogger instead.
+func logDebug(format string, args ...any) { logAt(slog.LevelDebug, format, args...) }
+func logInfo(format string, args ...any)  { logAt(slog.LevelInfo, format, args...) }
+func logWarn(format string, args ...any)  { logAt(slog.LevelWarn, format, args...) }
+func logError(format string, args ...any) { logAt(slog.LevelError, format, args...) }
+
+func logAt(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	if l := slog.Default(); l.Enabled(ctx, level) {
+		l.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingFile is --log-file: an append-only log that is rotated once it reaches
+// maxSize bytes or has been open for every (0 = size only). Rotated files are
+// renamed path.YYYYMMDD-HHMMSS.mmm, gzipped in the background if compress is set, and
+// only the newest keep of them are kept. Routers running this under a minimal init
+// have neither journald nor logrotate to do it for us.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	every    time.Duration
+	keep     int
+	compress bool
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+	gzipping sync.WaitGroup
+	errs     io.Writer // the real stderr: os.Stderr may be redirected into us
+}
+
+func openRotatingFile(path string, maxSize int64, every time.Duration, keep int, compress bool) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, every: every, keep: keep, compress: compress, errs: os.Stderr}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.openedAt = f, st.Size(), time.Now()
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file past its limits. Callers
+// write whole lines, so a line is never split across two files.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	due := r.size > 0 && (r.size+int64(len(p)) > r.maxSize || (r.every > 0 && time.Since(r.openedAt) >= r.every))
+	if due {
+		if err := r.rotateLocked(); err != nil {
+			fmt.Fprintf(r.errs, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotateLocked() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	rotated := r.path + "." + time.Now().UTC().Format("20060102-150405.000")
+	if err := os.Rename(r.path, rotated); err != nil {
+		_ = r.open()
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.compress {
+		r.gzipping.Add(1)
+		go func() {
+			defer r.gzipping.Done()
+			if err := gzipFile(rotated); err != nil {
+				fmt.Fprintf(r.errs, "log compression failed: %v\n", err)
+			}
+			r.prune()
+		}()
+	} else {
+		r.prune()
+	}
+	return nil
+}
+
+// prune removes all but the newest keep rotated files. Their names sort by time.
+func (r *rotatingFile) prune() {
+	old, _ := filepath.Glob(r.path + ".*")
+	old = slices.DeleteFunc(old, func(p string) bool { return strings.HasSuffix(p, ".tmp") })
+	slices.Sort(old)
+	for len(old) > r.keep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (r *rotatingFile) Close() error {
+	r.gzipping.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// redirectOutput sends everything printed to os.Stdout and os.Stderr rather than
+// logged (the request log, panics) into w, a line at a time. The returned
+// func restores them and flushes what is still in flight; call it before exiting.
+func redirectOutput(w io.WriteCloser) (func(), error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = pw, pw
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		br := bufio.NewReader(pr)
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(line) > 0 {
+				_, _ = w.Write(line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		pw.Close()
+		<-done
+		pr.Close()
+		w.Close()
+	}, nil
+}
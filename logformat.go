@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// --log-format json writes each line of stdout or --log-file as a JSON object, and
+// --log-format ecs as one in the Elastic Common Schema
+// (https://www.elastic.co/guide/en/ecs-logging/overview/current/intro.html), which
+// Filebeat and Elasticsearch take as is: @timestamp, log.level and message first,
+// then the host, the process and, on a call's lines, the trace ID and the call's
+// ID, trigger, gate and token as labels. The level is the one shippers get (debug,
+// info, warning or error); the message is the line without the call logger's
+// prefix, whose parts have fields of their own, as have a record's other
+// attributes (log.go): json's attrs, ecs's labels. Log shippers still get the text
+// lines.
+
+// ecsVersion is the ECS version the ecs layout follows.
+const ecsVersion = "8.11.0"
+
+// jsonLogLine is the json layout of a line.
+type jsonLogLine struct {
+	Time    string         `json:"time"`
+	Level   string         `json:"level"`
+	Msg     string         `json:"msg"`
+	CallID  string         `json:"call_id,omitempty"`
+	Source  string         `json:"source,omitempty"`
+	Gate    string         `json:"gate,omitempty"`
+	Token   string         `json:"token,omitempty"`
+	TraceID string         `json:"trace_id,omitempty"`
+	Comp    string         `json:"component,omitempty"`
+	Code    string         `json:"code,omitempty"`
+	SIP     int            `json:"sip_status,omitempty"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// ecsLogLine is the ecs layout of a line. ECS logging allows dotted names for
+// nested fields, as its own libraries write them.
+type ecsLogLine struct {
+	Timestamp  string            `json:"@timestamp"`
+	Level      string            `json:"log.level"`
+	Message    string            `json:"message"`
+	ECSVersion string            `json:"ecs.version"`
+	Service    string            `json:"service.name"`
+	Dataset    string            `json:"event.dataset"`
+	Host       string            `json:"host.hostname,omitempty"`
+	PID        int               `json:"process.pid"`
+	TraceID    string            `json:"trace.id,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+var logHostname, _ = os.Hostname()
+
+// json is l in the json or ecs layout, newline-terminated.
+func (l logLine) json(format string) []byte {
+	at := l.at.UTC().Format(time.RFC3339Nano)
+	j := jsonLogLine{
+		Time: at, Level: l.level, Msg: l.msg, CallID: l.callID, Source: l.source, Gate: l.gate, Token: l.token, TraceID: l.trace,
+		Comp: l.component, Code: l.code, SIP: l.sipStatus,
+	}
+	for _, a := range l.attrs {
+		if j.Attrs == nil {
+			j.Attrs = map[string]any{}
+		}
+		switch a.Value.Kind() {
+		case slog.KindString, slog.KindInt64, slog.KindUint64, slog.KindFloat64, slog.KindBool:
+			j.Attrs[a.Key] = a.Value.Any()
+		default: // durations, times and errors as they read
+			j.Attrs[a.Key] = a.Value.String()
+		}
+	}
+	var v any = j
+	if format == "ecs" {
+		e := ecsLogLine{
+			Timestamp: at, Level: l.level, Message: l.msg, ECSVersion: ecsVersion,
+			Service: "iftach", Dataset: "iftach.log", Host: logHostname, PID: os.Getpid(), TraceID: l.trace,
+		}
+		labels := map[string]string{"call_id": l.callID, "call_source": l.source, "gate": l.gate, "token": l.token, "component": l.component, "code": l.code}
+		if l.sipStatus != 0 {
+			labels["sip_status"] = strconv.Itoa(l.sipStatus)
+		}
+		for _, a := range l.attrs {
+			labels[a.Key] = a.Value.String()
+		}
+		for k, v := range labels {
+			if v == "" {
+				delete(labels, k)
+			}
+		}
+		if len(labels) > 0 {
+			e.Labels = labels
+		}
+		v = e
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false) // SIP URIs are in angle brackets
+	_ = enc.Encode(v)
+	return b.Bytes()
+}
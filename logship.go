@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log shipping (--log-syslog, --log-loki) for centralizing the logs of several
+// gate controllers. Shippers get a copy of every line next to stdout or
+// --log-file and must never hold logging up: lines wait in a bounded queue, and
+// are dropped (and counted) when the remote end can't keep up or is down.
+const (
+	logShipQueue     = 1000
+	logShipRetry     = 5 * time.Second // between reconnect attempts
+	lokiBatchLines   = 500
+	lokiBatchEvery   = time.Second
+	syslogEnterprise = "32473" // RFC 5612 documentation number, for our SD-ID
+)
+
+var logLinesDropped = newCounter("iftach_log_lines_dropped_total", "Log lines a shipper (syslog, loki) dropped because its queue was full.")
+
+// logLine is one line of output, with what shippers index it by.
+type logLine struct {
+	at     time.Time
+	text   string // without the trailing newline
+	msg    string // text without the call logger's prefix
+	level  string // debug, info, warning or error
+	callID string // from the call logger's prefix, if any
+	source string // the call's trigger, e.g. "ws 203.0.113.7"
+	gate   string
+	token  string // the named call token that placed the call
+	trace  string // the call's W3C trace ID
+
+	// Only records (log.go) have these.
+	component string // e.g. "ip-cache", for lines of no call
+	code      string // the error code of a failure
+	sipStatus int    // the SIP response the line reports
+	attrs     []slog.Attr
+}
+
+// callPrefix matches the call logger's prefix (see logLine.layout).
+var callPrefix = regexp.MustCompile(`^\[call ([0-9a-f]+)(?: via (.+?))?(?: gate (\S+?))?(?: token (\S+?))?(?: trace ([0-9a-f]{32}))?\] `)
+
+// parseLogLine reads a line that was written to stdout rather than logged, taking
+// its level from its emoji.
+func parseLogLine(b []byte) logLine {
+	l := logLine{at: time.Now(), text: strings.TrimRight(string(b), "\r\n"), level: "info"}
+	l.msg = l.text
+	if m := callPrefix.FindStringSubmatch(l.text); m != nil {
+		l.callID, l.source, l.gate, l.token, l.trace = m[1], m[2], m[3], m[4], m[5]
+		l.msg = l.text[len(m[0]):]
+	}
+	l.msg = strings.TrimSpace(l.msg)
+	switch {
+	case strings.HasPrefix(l.msg, "❌"):
+		l.level = "error"
+	case strings.HasPrefix(l.msg, "⚠️"):
+		l.level = "warning"
+	}
+	return l
+}
+
+// logShipper queues lines for one remote destination.
+type logShipper struct {
+	name  string
+	lines chan logLine
+	done  chan struct{}
+}
+
+func newLogShipper(name string, run func(lines <-chan logLine)) *logShipper {
+	s := &logShipper{name: name, lines: make(chan logLine, logShipQueue), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		run(s.lines)
+	}()
+	return s
+}
+
+func (s *logShipper) ship(l logLine) {
+	select {
+	case s.lines <- l:
+	default:
+		logLinesDropped.inc("shipper", s.name)
+	}
+}
+
+// close flushes what is queued, giving the remote end a moment at most.
+func (s *logShipper) close() {
+	close(s.lines)
+	select {
+	case <-s.done:
+	case <-time.After(3 * time.Second):
+	}
+}
+
+// logFanout is the logOutput of setupLogging, and what redirectOutput writes
+// into: every line goes to primary (stdout or --log-file), laid out as
+// --log-format says, and to each shipper.
+type logFanout struct {
+	primary  io.WriteCloser
+	format   string // --log-format; "" is text
+	shippers []*logShipper
+
+	mu sync.Mutex // records come from every goroutine, stdout from redirectOutput's
+}
+
+func (f *logFanout) structured() bool {
+	return f.format == "json" || f.format == "ecs"
+}
+
+func (f *logFanout) Write(p []byte) (int, error) {
+	if len(bytes.TrimSpace(p)) == 0 {
+		if f.structured() {
+			return len(p), nil // the spacing of the text log
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.primary.Write(p)
+	}
+	if err := f.emit(parseLogLine(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *logFanout) emit(l logLine) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.shippers {
+		s.ship(l)
+	}
+	if f.structured() {
+		_, err := f.primary.Write(l.json(f.format))
+		return err
+	}
+	_, err := io.WriteString(f.primary, l.text+"\n")
+	return err
+}
+
+func (f *logFanout) Close() error {
+	for _, s := range f.shippers {
+		s.close()
+	}
+	return f.primary.Close()
+}
+
+// newSyslogShipper sends RFC 5424 messages to target: unix:///dev/log,
+// udp://host:514, tcp://host:601 or tls://host:6514 (octet-counted framing, as
+// RFC 5425/6587 have it, on the stream transports).
+func newSyslogShipper(target string, errs io.Writer) (*logShipper, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	var network, addr string
+	switch u.Scheme {
+	case "unix":
+		network, addr = "unixgram", u.Path
+	case "udp", "tcp", "tls":
+		network, addr = u.Scheme, u.Host
+	default:
+		return nil, fmt.Errorf("%q: want unix://, udp://, tcp:// or tls://", target)
+	}
+	host, _ := os.Hostname()
+	stream := network == "tcp" || network == "tls"
+	dial := func() (net.Conn, error) {
+		d := &net.Dialer{Timeout: 5 * time.Second}
+		if network == "tls" {
+			return tls.DialWithDialer(d, "tcp", addr, &tls.Config{ServerName: u.Hostname()})
+		}
+		return d.Dial(network, addr)
+	}
+	return newLogShipper("syslog", func(lines <-chan logLine) {
+		var conn net.Conn
+		var lastDial time.Time
+		for l := range lines {
+			if conn == nil {
+				if time.Since(lastDial) < logShipRetry {
+					logLinesDropped.inc("shipper", "syslog")
+					continue
+				}
+				lastDial = time.Now()
+				if conn, err = dial(); err != nil {
+					fmt.Fprintf(errs, "syslog %s: %v\n", target, err)
+					conn = nil
+					logLinesDropped.inc("shipper", "syslog")
+					continue
+				}
+			}
+			msg := syslogMessage(l, host)
+			if stream {
+				msg = strconv.Itoa(len(msg)) + " " + msg
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.WriteString(conn, msg); err != nil {
+				conn.Close()
+				conn = nil
+				logLinesDropped.inc("shipper", "syslog")
+			}
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}), nil
+}
+
+// syslogSeverity maps our levels to RFC 5424 severities.
+var syslogSeverity = map[string]int{"error": 3, "warning": 4, "info": 6, "debug": 7}
+
+// syslogMessage formats l as RFC 5424, facility daemon, with the call ID as
+// structured data so a collector can filter one call's lines.
+func syslogMessage(l logLine, host string) string {
+	const facilityDaemon = 3
+	sd := "-"
+	if l.callID != "" {
+		sd = fmt.Sprintf(`[call@%s id="%s"]`, syslogEnterprise, l.callID)
+	}
+	return fmt.Sprintf("<%d>1 %s %s iftach %d - %s %s",
+		facilityDaemon*8+syslogSeverity[l.level], l.at.UTC().Format(time.RFC3339Nano), cmp.Or(host, "-"), os.Getpid(), sd, l.text)
+}
+
+// newLokiShipper pushes batches of lines to a Loki push endpoint
+// (.../loki/api/v1/push), one stream per level, labelled with job and host.
+func newLokiShipper(pushURL string, errs io.Writer) (*logShipper, error) {
+	if err := validateCallbackURL(pushURL); err != nil {
+		return nil, fmt.Errorf("%q: must be an absolute http(s) URL", pushURL)
+	}
+	host, _ := os.Hostname()
+	client := &http.Client{Timeout: 10 * time.Second}
+	var mu sync.Mutex
+	var lastErr time.Time
+	push := func(batch []logLine) {
+		type stream struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		}
+		byLevel := map[string]*stream{}
+		var streams []*stream
+		for _, l := range batch {
+			s, ok := byLevel[l.level]
+			if !ok {
+				s = &stream{Stream: map[string]string{"job": "iftach", "host": host, "level": l.level}}
+				byLevel[l.level] = s
+				streams = append(streams, s)
+			}
+			s.Values = append(s.Values, [2]string{strconv.FormatInt(l.at.UnixNano(), 10), l.text})
+		}
+		body, _ := json.Marshal(map[string]any{"streams": streams})
+		resp, err := client.Post(pushURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("HTTP %d", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			logLinesDropped.add(float64(len(batch)), "shipper", "loki")
+			mu.Lock()
+			if time.Since(lastErr) > time.Minute { // don't fill the log with its own failures
+				lastErr = time.Now()
+				fmt.Fprintf(errs, "loki %s: %v\n", pushURL, err)
+			}
+			mu.Unlock()
+		}
+	}
+	return newLogShipper("loki", func(lines <-chan logLine) {
+		tick := time.NewTicker(lokiBatchEvery)
+		defer tick.Stop()
+		var batch []logLine
+		for {
+			select {
+			case l, ok := <-lines:
+				if !ok {
+					if len(batch) > 0 {
+						push(batch)
+					}
+					return
+				}
+				if batch = append(batch, l); len(batch) >= lokiBatchLines {
+					push(batch)
+					batch = nil
+				}
+			case <-tick.C:
+				if len(batch) > 0 {
+					push(batch)
+					batch = nil
+				}
+			}
+		}
+	}), nil
+}
+
+// stdoutCloser is the primary log output without --log-file: the real stdout,
+// which closing the fan-out must leave open.
+type stdoutCloser struct{ io.Writer }
+
+func (stdoutCloser) Close() error { return nil }
+
+// setupLogging sets --log-level, and routes output to --log-file and the log
+// shippers, and lays it out as --log-format says, if any of them is set. The
+// returned func flushes and restores; call it before exiting.
+func (c *Config) setupLogging() (func(), error) {
+	logLevel.Set(logLevels[cmp.Or(c.LogLevel, "info")])
+	if c.LogFile == "" && c.LogSyslog == "" && c.LogLoki == "" && cmp.Or(c.LogFormat, "text") == "text" {
+		return func() {}, nil
+	}
+	fan := &logFanout{primary: stdoutCloser{os.Stdout}, format: c.LogFormat}
+	if c.LogFile != "" {
+		lf, err := openRotatingFile(c.LogFile, int64(c.LogMaxSize)<<20, c.LogRotateEvery, c.LogKeep, c.LogCompress)
+		if err != nil {
+			return nil, fmt.Errorf("--log-file: %w", err)
+		}
+		fan.primary = lf
+	}
+	if c.LogSyslog != "" {
+		s, err := newSyslogShipper(c.LogSyslog, os.Stderr)
+		if err != nil {
+			fan.Close()
+			return nil, fmt.Errorf("--log-syslog: %w", err)
+		}
+		fan.shippers = append(fan.shippers, s)
+	}
+	if c.LogLoki != "" {
+		s, err := newLokiShipper(c.LogLoki, os.Stderr)
+		if err != nil {
+			fan.Close()
+			return nil, fmt.Errorf("--log-loki: %w", err)
+		}
+		fan.shippers = append(fan.shippers, s)
+	}
+	restore, err := redirectOutput(fan)
+	if err != nil {
+		fan.Close()
+		return nil, err
+	}
+	logOutput = fan
+	return func() {
+		logOutput = stdoutLog{}
+		restore()
+	}, nil
+}
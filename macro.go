@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/alecthomas/kong"
+	"github.com/go-chi/chi/v5"
+)
+
+// macroSet is --macros: named step sequences (the same steps POST /api/batch
+// takes) run with one button or POST /api/macros/{name}/run. On the command line
+// and in IFTACH_MACROS it is a JSON object; in the --config file a plain object:
+//
+//	"macros": {"arrive": [{"gate": "outer", "dtmf": "1234#"}, {"wait": "20s"},
+//	    {"gate": "inner"}, {"webhook": "http://hass.local/api/webhook/arrived"}]}
+type macroSet map[string][]batchStep
+
+func (m *macroSet) Decode(ctx *kong.DecodeContext) error {
+	t, err := ctx.Scan.PopValue("macros")
+	if err != nil {
+		return err
+	}
+	data, ok := t.Value.(string)
+	if !ok {
+		// Already parsed by the --config resolver.
+		b, err := json.Marshal(t.Value)
+		if err != nil {
+			return err
+		}
+		data = string(b)
+	}
+	if err := json.Unmarshal([]byte(data), (*map[string][]batchStep)(m)); err != nil {
+		return fmt.Errorf("--macros: %w", err)
+	}
+	return nil
+}
+
+// macroSteps returns a fresh, validated copy of the named macro's steps.
+func (c *Config) macroSteps(name string) ([]batchStep, bool, error) {
+	steps, ok := c.Macros[name]
+	if !ok {
+		return nil, false, nil
+	}
+	steps = slices.Clone(steps)
+	return steps, true, parseBatchSteps(c, steps)
+}
+
+// handleMacros is GET /api/macros: the configured macros, sorted by name, for the
+// UI's buttons.
+func handleMacros(w http.ResponseWriter, r *http.Request) {
+	if _, ok := callAuth(r); !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	type macro struct {
+		Name  string      `json:"name"`
+		Steps []batchStep `json:"steps"`
+	}
+	macros := []macro{}
+	for _, name := range slices.Sorted(maps.Keys(cli.Macros)) {
+		macros = append(macros, macro{name, cli.Macros[name]})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"macros": macros})
+}
+
+// handleMacroRun is POST /api/macros/{name}/run. It runs the macro as a batch job,
+// so the answer, ?stream=1, ?dry_run=1 and GET /api/batch/{id} all work as for
+// POST /api/batch.
+func handleMacroRun(w http.ResponseWriter, r *http.Request) {
+	token, ok := callAuth(r)
+	if !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	name := chi.URLParam(r, "name")
+	steps, ok, err := cli.macroSteps(name)
+	switch {
+	case !ok:
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "macro_not_found", name)
+		return
+	case err != nil:
+		// check() rejects bad macros at startup, so this is a bug, not a bad request.
+		writeAPIError(w, r, http.StatusInternalServerError, errInternal, "batch_invalid", err)
+		return
+	}
+	if token != nil && token.OneTime {
+		writeAPIError(w, r, http.StatusForbidden, errForbidden, "token_one_time")
+		return
+	}
+	if gate, ok := token.allowsSteps(steps); !ok {
+		writeAPIError(w, r, http.StatusForbidden, errForbidden, "gate_forbidden", gate)
+		return
+	}
+	logInfo("Macro %s triggered\n", name)
+	opts := callOptions{DryRun: r.URL.Query().Get("dry_run") == "1", User: token.user(), Duress: token.underDuress(), Trace: requestTrace(r)}
+	serveBatch(w, r, startBatch(cli, name, steps, opts))
+}
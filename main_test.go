@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// loopbackUAS is a SIP server on loopback UDP that answers every INVITE with the
+// next of codes (the last one again once they run out), and hands each INVITE to
+// the channel it returns. cfg dials it.
+func loopbackUAS(t *testing.T, codes ...int) (*Config, <-chan *sip.Request) {
+	t.Helper()
+	srvUA, err := sipgo.NewUA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srvUA.Close() })
+	srv, err := sipgo.NewServer(srvUA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invites := make(chan *sip.Request, 16)
+	answers := make(chan int, len(codes))
+	for _, code := range codes {
+		answers <- code
+	}
+	last := codes[len(codes)-1]
+	srv.OnInvite(func(req *sip.Request, tx sip.ServerTransaction) {
+		invites <- req
+		code := last
+		select {
+		case code = <-answers:
+		default:
+		}
+		_ = tx.Respond(sip.NewResponseFromRequest(req, code, "", nil))
+	})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.ServeUDP(conn) }()
+	t.Cleanup(func() { conn.Close() })
+
+	cfg := &Config{
+		SipDomain: "127.0.0.1", SipPort: conn.LocalAddr().(*net.UDPAddr).Port, SipUser: "acct", SipPass: "p",
+		Destination: "123", CallDuration: 5 * time.Second, Wait100Timeout: 2 * time.Second, SipUdpMax: 1300,
+	}
+	prevIPCache := ipCache
+	ipCache = &publicIPCache{cfg: cfg, ttl: time.Hour}
+	ipCache.set("127.0.0.1")
+	t.Cleanup(func() { ipCache = prevIPCache })
+	return cfg, invites
+}
+
+// dial runs a call with cfg and opts to its end, returning its last status.
+func dial(t *testing.T, cfg *Config, opts callOptions) callStatusMsg {
+	t.Helper()
+	done := make(chan callStatusMsg, 16)
+	go run(context.Background(), cfg, opts, nil, done)
+	var last callStatusMsg
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case st, ok := <-done:
+			if !ok {
+				return last
+			}
+			last = st
+		case <-timeout:
+			t.Fatal("the call didn't end")
+		}
+	}
+}
+
+func TestRetryIsFreshInvite(t *testing.T) {
+	cfg, invites := loopbackUAS(t, 486, 486, 486)
+	cfg.Retry, cfg.RetryBackoff = 2, time.Millisecond
+	if st := dial(t, cfg, callOptions{}); st.Code != errBusy {
+		t.Errorf("ended with %+v, want %s", st, errBusy)
+	}
+	callIDs, tags := map[string]bool{}, map[string]bool{}
+	n := 0
+	for len(invites) > 0 {
+		req := <-invites
+		n++
+		if seq := req.CSeq().SeqNo; n > 1 && seq != 1 {
+			t.Errorf("retry %d has CSeq %d, want 1", n-1, seq)
+		}
+		callIDs[req.CallID().Value()] = true
+		tag, _ := req.From().Params.Get("tag")
+		tags[tag] = true
+	}
+	if n != 3 {
+		t.Fatalf("%d INVITEs, want 3 (the first and 2 retries)", n)
+	}
+	if len(callIDs) != n || len(tags) != n {
+		t.Errorf("%d Call-IDs and %d From tags over %d INVITEs, want a new one each", len(callIDs), len(tags), n)
+	}
+}
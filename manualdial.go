@@ -0,0 +1,168 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manual dialing lets an admin call any number --dial-allow permits, with its own
+// duration and DTMF: the gate vendor's test line, a relay that needs a code keyed
+// in once. It is off without --dial-allow, since "any number" must never mean any
+// number. Every attempt, refused ones included, and every outcome is written to
+// the log and appended to manual-dials.jsonl in --data-dir.
+
+const (
+	maxManualReason = 200
+	maxManualDials  = 50 // kept in memory for the dashboard
+)
+
+// manualDial is one audit record.
+type manualDial struct {
+	At       time.Time `json:"at"` // UTC
+	Event    string    `json:"event"`
+	By       string    `json:"by"` // e.g. "manual 203.0.113.7"
+	Reason   string    `json:"reason"`
+	Number   string    `json:"number"`
+	Duration string    `json:"duration,omitempty"`
+	DTMF     string    `json:"dtmf,omitempty"`
+	CallID   string    `json:"call_id,omitempty"`
+	Result   string    `json:"result,omitempty"` // finished: answered, busy or failed
+	Code     errorCode `json:"code,omitempty"`
+}
+
+// Audit events.
+const (
+	manualDialled  = "dialled"
+	manualRefused  = "refused"
+	manualFinished = "finished"
+)
+
+// manualDials are the latest audit records, newest last.
+var manualDials struct {
+	mu     sync.Mutex
+	recent []manualDial
+}
+
+// audit logs d and records it, in memory and in the audit file.
+func (d manualDial) audit() {
+	d.At = time.Now().UTC()
+	switch d.Event {
+	case manualRefused:
+		logWarn("Manual dial of %s by %s refused [%s] (%s)\n", d.Number, d.By, d.Code, d.Reason)
+	case manualFinished:
+		loggerFor(d.CallID).Printf("Manual dial of %s %s\n", d.Number, d.Result)
+	default:
+		loggerFor(d.CallID).Printf("Manual dial of %s by %s (%s, reason: %s)\n", d.Number, d.By, d.Duration, d.Reason)
+	}
+
+	manualDials.mu.Lock()
+	defer manualDials.mu.Unlock()
+	manualDials.recent = append(manualDials.recent, d)
+	if n := len(manualDials.recent); n > maxManualDials {
+		manualDials.recent = slices.Delete(manualDials.recent, 0, n-maxManualDials)
+	}
+	path := dataPath("manual-dials.jsonl")
+	if path == "" {
+		return
+	}
+	line, _ := json.Marshal(d)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		err = cmp.Or(err, f.Close())
+	}
+	if err != nil {
+		logWarn("Could not write the manual dial audit record: %v\n", err)
+	}
+}
+
+// handleManualDial is POST /api/admin/dial with {"number", "duration", "dtmf",
+// "reason"}: call number (after the * dial plan) for duration (default
+// --call-duration), keying in dtmf once answered. reason is required, for the
+// audit. It answers 202 with the call, which shows among the active calls.
+func handleManualDial(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Number   string `json:"number"`
+		Duration string `json:"duration"`
+		DTMF     string `json:"dtmf"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+		return
+	}
+	number, reason := strings.TrimSpace(req.Number), strings.TrimSpace(req.Reason)
+	duration := cli.CallDuration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d < time.Second || d > callHardCap/2 {
+			writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "manual_duration_bad", callHardCap/2)
+			return
+		}
+		duration = d
+	}
+	switch {
+	case !dialableNumber.MatchString(number):
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "manual_number_invalid", number)
+		return
+	case req.DTMF != "" && !dtmfDigits.MatchString(req.DTMF):
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "manual_dtmf_invalid")
+		return
+	case reason == "" || len(reason) > maxManualReason:
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "manual_reason_missing", maxManualReason)
+		return
+	}
+
+	d := manualDial{Event: manualDialled, By: callSource("manual", r), Reason: reason, Number: number, Duration: duration.String(), DTMF: req.DTMF}
+	refuse := func(status int, code errorCode, key string, args ...any) {
+		d.Event, d.Code = manualRefused, code
+		d.audit()
+		writeAPIError(w, r, status, code, key, args...)
+	}
+	if len(cli.DialAllow) == 0 {
+		refuse(http.StatusForbidden, errDialRefused, "manual_dial_disabled")
+		return
+	}
+	dialled, _, err := cli.dialNumber(dialPlanAll, number)
+	if err != nil {
+		refuse(http.StatusBadRequest, dialFailure(err), "manual_dial_plan", err)
+		return
+	}
+	if !cli.dialAllowed(dialled) {
+		dialRefused.inc("gate", dialPlanAll)
+		refuse(http.StatusForbidden, errDialRefused, "manual_dial_refused", dialled)
+		return
+	}
+
+	cfg := cli
+	cfg.Destination, cfg.CallDuration, cfg.DtmfCode = number, duration, "" // only the DTMF given here
+	s := sessions.Start(&cfg, callOptions{Gate: dialPlanAll, DTMF: req.DTMF, Source: d.By, Admin: true, Trace: requestTrace(r)})
+	d.CallID = s.ID
+	d.audit()
+	go func() {
+		<-s.done
+		d.Event, d.Result, d.Code = manualFinished, s.result(), s.Status().Code
+		d.audit()
+	}()
+	writeJSON(w, http.StatusAccepted, newCallResponse(s))
+}
+
+// handleManualDials is GET /api/admin/dials: the latest manual dial audit records,
+// newest first.
+func handleManualDials(w http.ResponseWriter, r *http.Request) {
+	manualDials.mu.Lock()
+	dials := slices.Clone(manualDials.recent)
+	manualDials.mu.Unlock()
+	slices.Reverse(dials)
+	if dials == nil {
+		dials = []manualDial{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"dials": dials, "enabled": len(cli.DialAllow) > 0})
+}
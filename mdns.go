@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --mdns=NAME the server answers multicast DNS (RFC 6762) on the LAN, so a
+// phone can open http://NAME.local:PORT/ui without anyone knowing the Pi's address,
+// and DNS-SD (RFC 6763) browsers list an _http._tcp service called NAME. It is a
+// minimal IPv4 responder: it answers A, SRV, TXT and PTR questions for its own
+// names (and ANY), announces them at startup and says goodbye at shutdown. It
+// doesn't probe for conflicts, so NAME should be unique on the LAN; it shares port
+// 5353 with Avahi or Bonjour if either is running.
+
+const (
+	mdnsPort    = 5353
+	mdnsTTL     = 120 // seconds, as RFC 6762 recommends for host records
+	mdnsService = "_http._tcp.local."
+)
+
+var (
+	mdnsGroup    = net.IPv4(224, 0, 0, 251)
+	mdnsHostName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+// DNS record types and classes used here.
+const (
+	dnsTypeA     = 1
+	dnsTypePTR   = 12
+	dnsTypeTXT   = 16
+	dnsTypeSRV   = 33
+	dnsTypeANY   = 255
+	dnsClassIN   = 1
+	mdnsFlush    = 0x8000 // cache-flush bit of an answer's class
+	mdnsUnicast  = 0x8000 // unicast-response bit of a question's class
+	dnsFlagReply = 0x8400 // QR and AA
+)
+
+// mdnsResponder answers for NAME.local and the NAME._http._tcp.local service.
+type mdnsResponder struct {
+	host     string // NAME.local.
+	instance string // NAME._http._tcp.local.
+	port     uint16
+
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+}
+
+func newMDNSResponder(name string, port int) *mdnsResponder {
+	return &mdnsResponder{host: name + ".local.", instance: name + "." + mdnsService, port: uint16(port)}
+}
+
+func mdnsSubsystem() subsystem {
+	m := newMDNSResponder(cli.Mdns, cli.ListenPort)
+	return subsystem{
+		name:  "mdns",
+		after: []string{"http"},
+		start: func(context.Context) error {
+			conn, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: mdnsGroup, Port: mdnsPort})
+			if err != nil {
+				return fmt.Errorf("mdns: %w", err)
+			}
+			m.conn = conn
+			m.wg.Add(1)
+			go m.serve()
+			m.announce(mdnsTTL)
+			logInfo("Advertising http://%s:%d/ui over mDNS\n", strings.TrimSuffix(m.host, "."), m.port)
+			return nil
+		},
+		stop: func(context.Context) error {
+			m.announce(0) // goodbye: TTL 0 tells caches to drop the records
+			m.conn.Close()
+			m.wg.Wait()
+			return nil
+		},
+	}
+}
+
+// announce multicasts every record, twice a second apart as RFC 6762 asks (once
+// for a goodbye, which mustn't hold up shutdown).
+func (m *mdnsResponder) announce(ttl uint32) {
+	msg := m.reply(0, nil, append(m.records(dnsTypePTR, mdnsService, ttl), m.service(ttl)...), nil)
+	group := &net.UDPAddr{IP: mdnsGroup, Port: mdnsPort}
+	_, _ = m.conn.WriteToUDP(msg, group)
+	if ttl == 0 {
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		time.Sleep(time.Second)
+		_, _ = m.conn.WriteToUDP(msg, group)
+	}()
+}
+
+func (m *mdnsResponder) serve() {
+	defer m.wg.Done()
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logWarn("mDNS: %v\n", err)
+			}
+			return
+		}
+		id, questions, ok := parseMDNSQuery(buf[:n])
+		if !ok {
+			continue
+		}
+		var answers, extra [][]byte
+		legacy := from.Port != mdnsPort // a plain DNS resolver, not an mDNS peer
+		unicast := legacy
+		for _, q := range questions {
+			if a := m.records(q.qtype, q.name, mdnsTTL); len(a) > 0 {
+				answers = append(answers, a...)
+				if q.qclass&mdnsUnicast != 0 {
+					unicast = true
+				}
+			}
+		}
+		if len(answers) == 0 {
+			continue
+		}
+		if len(questions) == 1 && questions[0].qtype == dnsTypePTR {
+			extra = m.service(mdnsTTL) // saving the browser a round trip
+		}
+		switch {
+		case legacy: // which expects its question back, as from any DNS server
+			_, _ = m.conn.WriteToUDP(m.reply(id, questions, answers, extra), from)
+		case unicast:
+			_, _ = m.conn.WriteToUDP(m.reply(0, nil, answers, extra), from)
+		default:
+			_, _ = m.conn.WriteToUDP(m.reply(0, nil, answers, extra), &net.UDPAddr{IP: mdnsGroup, Port: mdnsPort})
+		}
+	}
+}
+
+// records returns the encoded resource records answering a question of type qtype
+// for name, none if it isn't one of ours.
+func (m *mdnsResponder) records(qtype uint16, name string, ttl uint32) [][]byte {
+	name = strings.ToLower(strings.TrimSuffix(name, ".") + ".")
+	wants := func(t uint16) bool { return qtype == t || qtype == dnsTypeANY }
+	var out [][]byte
+	if name == mdnsService && wants(dnsTypePTR) {
+		out = append(out, dnsRecord(mdnsService, dnsTypePTR, dnsClassIN, ttl, dnsName(m.instance)))
+	}
+	if name == m.instance && wants(dnsTypeSRV) {
+		rdata := binary.BigEndian.AppendUint16(make([]byte, 4), m.port) // priority and weight 0
+		out = append(out, dnsRecord(m.instance, dnsTypeSRV, dnsClassIN|mdnsFlush, ttl, append(rdata, dnsName(m.host)...)))
+	}
+	if name == m.instance && wants(dnsTypeTXT) {
+		out = append(out, dnsRecord(m.instance, dnsTypeTXT, dnsClassIN|mdnsFlush, ttl, []byte("\x07path=/ui")))
+	}
+	if name == m.host && wants(dnsTypeA) {
+		for _, ip := range localIPv4s() {
+			out = append(out, dnsRecord(m.host, dnsTypeA, dnsClassIN|mdnsFlush, ttl, ip))
+		}
+	}
+	return out
+}
+
+// service returns the records that resolve the service once its PTR is known:
+// SRV, TXT and the host's A records.
+func (m *mdnsResponder) service(ttl uint32) [][]byte {
+	return append(m.records(dnsTypeANY, m.instance, ttl), m.records(dnsTypeA, m.host, ttl)...)
+}
+
+// reply encodes a response repeating questions, with answers and additional
+// records.
+func (m *mdnsResponder) reply(id uint16, questions []dnsQuestion, answers, extra [][]byte) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsFlagReply)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(questions)))
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(extra)))
+	for _, q := range questions {
+		msg = append(msg, dnsName(q.name)...)
+		msg = binary.BigEndian.AppendUint16(msg, q.qtype)
+		msg = binary.BigEndian.AppendUint16(msg, q.qclass&^mdnsUnicast)
+	}
+	for _, rr := range append(answers, extra...) {
+		msg = append(msg, rr...)
+	}
+	return msg
+}
+
+// localIPv4s returns the host's IPv4 addresses on interfaces that are up, loopback
+// excluded.
+func localIPv4s() []net.IP {
+	var ips []net.IP
+	ifaces, _ := net.Interfaces()
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+				ips = append(ips, ipn.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+// dnsName encodes name (dot-terminated) as DNS labels, uncompressed.
+func dnsName(name string) []byte {
+	var b []byte
+	for label := range strings.SplitSeq(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func dnsRecord(name string, rtype, class uint16, ttl uint32, rdata []byte) []byte {
+	b := dnsName(name)
+	b = binary.BigEndian.AppendUint16(b, rtype)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+type dnsQuestion struct {
+	name          string // dot-terminated
+	qtype, qclass uint16
+}
+
+// parseMDNSQuery returns a query's ID and questions; responses and malformed
+// messages aren't ok.
+func parseMDNSQuery(msg []byte) (id uint16, questions []dnsQuestion, ok bool) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[2:])&0x8000 != 0 {
+		return 0, nil, false
+	}
+	off := 12
+	for range binary.BigEndian.Uint16(msg[4:]) {
+		name, next, ok := readDNSName(msg, off)
+		if !ok || next+4 > len(msg) {
+			return 0, nil, false
+		}
+		questions = append(questions, dnsQuestion{name, binary.BigEndian.Uint16(msg[next:]), binary.BigEndian.Uint16(msg[next+2:])})
+		off = next + 4
+	}
+	return binary.BigEndian.Uint16(msg), questions, true
+}
+
+// readDNSName decodes the name at off, following compression pointers, and
+// returns it with the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, bool) {
+	var labels []string
+	next := -1
+	for jumps := 0; off < len(msg); {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, true
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, false
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, false
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, false
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --media, gate calls carry audio like any phone would: the INVITE offers
+// PCMU and PCMA from a local RTP port, and once answered a packet of silence goes
+// out every 20ms until the BYE. Some PBXes reject an INVITE without SDP, and
+// others hang up a call that sends no media after their RTP timeout. Silence in
+// the negotiated codec rather than comfort noise, since every endpoint plays it.
+// Whatever the far end sends is read and dropped; its first packet fixes where
+// ours go (symmetric RTP), as behind NAT the SDP address is usually wrong. DTMF
+// goes in the stream as RFC 4733 telephone-events when the answer accepts them,
+// SIP INFO otherwise.
+
+const (
+	rtpPacketInterval = 20 * time.Millisecond
+	rtpSamples        = 160 // 20ms at 8kHz
+	rtpEventPT        = 101 // telephone-event, in our offer
+
+	// Each digit is 160ms of tone, its end packet sent three times as RFC 4733
+	// asks, then 100ms of silence before the next.
+	dtmfEventPackets = 8
+	dtmfEndPackets   = 3
+	dtmfGapPackets   = 5
+)
+
+// Offered payload types and the byte a silent sample is in each.
+var rtpSilence = map[int]byte{
+	0: 0xFF, // PCMU
+	8: 0xD5, // PCMA
+}
+
+var (
+	rtpSilenceSent = newCounter("iftach_rtp_silence_packets_total", "Silent RTP packets sent on answered --media calls.")
+	rtpEventsSent  = newCounter("iftach_rtp_dtmf_packets_total", "RTP telephone-event (DTMF) packets sent on answered --media calls.")
+)
+
+// mediaStream is one call's RTP port.
+type mediaStream struct {
+	conn *net.UDPConn
+	ip   string // advertised in the SDP offer
+
+	mu      sync.Mutex
+	peer    netip.AddrPort
+	latched bool
+
+	eventPT int              // the answer's telephone-event payload type, -1 without one
+	events  chan dtmfRequest // to send()
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newMediaStream binds an RTP port on every interface, to be offered at ip (our
+// public address).
+func newMediaStream(ip string) (*mediaStream, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &mediaStream{conn: conn, ip: ip, eventPT: -1, events: make(chan dtmfRequest), stop: make(chan struct{})}, nil
+}
+
+// dtmfRequest is digits for send() to play, as telephone-event codes; done is
+// closed once the last one has been sent.
+type dtmfRequest struct {
+	events []byte
+	done   chan struct{}
+}
+
+func (m *mediaStream) port() int {
+	return m.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// offer is the INVITE's SDP.
+func (m *mediaStream) offer() []byte {
+	id := time.Now().Unix()
+	return []byte(fmt.Sprintf("v=0\r\no=iftach %d %d IN IP4 %s\r\ns=iftach\r\nc=IN IP4 %s\r\nt=0 0\r\n"+
+		"m=audio %d RTP/AVP 0 8 %d\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:8 PCMA/8000\r\n"+
+		"a=rtpmap:%d telephone-event/8000\r\na=fmtp:%d 0-15\r\na=ptime:20\r\na=sendrecv\r\n",
+		id, id, m.ip, m.ip, m.port(), rtpEventPT, rtpEventPT, rtpEventPT))
+}
+
+// start sends silence to where answer (the 200 OK's SDP) receives audio, in the
+// first of our codecs it accepted, until Close.
+func (m *mediaStream) start(log *callLogger, answer []byte) {
+	if m == nil {
+		return
+	}
+	peer, err := sdpAudio(answer)
+	if err != nil {
+		log.Printf("No media sent: %v\n", err)
+		return
+	}
+	pt := sdpPayloadType(answer)
+	if _, ok := rtpSilence[pt]; !ok {
+		log.Printf("No media sent: the answer accepts neither PCMU nor PCMA\n")
+		return
+	}
+	m.mu.Lock()
+	m.peer = peer
+	m.mu.Unlock()
+	m.eventPT = sdpEventType(answer)
+	log.Printf("Sending silence (payload type %d) from port %d to %s\n", pt, m.port(), peer)
+	m.wg.Add(2)
+	go m.read()
+	go m.send(pt)
+}
+
+// read drops what the far end sends, latching onto where its first packet came from.
+func (m *mediaStream) read() {
+	defer m.wg.Done()
+	buf := make([]byte, 2048)
+	for {
+		_, src, err := m.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		if !m.latched {
+			m.peer, m.latched = netip.AddrPortFrom(src.Addr().Unmap(), src.Port()), true
+		}
+		m.mu.Unlock()
+	}
+}
+
+// send writes a packet every 20ms: silence, or the digits of a DTMF request while
+// one is playing.
+func (m *mediaStream) send(pt int) {
+	defer m.wg.Done()
+	silence := make([]byte, 12+rtpSamples)
+	for i := 12; i < len(silence); i++ {
+		silence[i] = rtpSilence[pt]
+	}
+	event := make([]byte, 12+4)
+	seq, ts, ssrc := uint16(rand.Uint32()), rand.Uint32(), rand.Uint32()
+	binary.BigEndian.PutUint32(silence[8:], ssrc)
+	binary.BigEndian.PutUint32(event[8:], ssrc)
+
+	var (
+		playing dtmfRequest
+		step    int // packet of the current digit, then of the gap after it
+	)
+	marker := true // on the first packet, and the first of each digit
+	tick := time.NewTicker(rtpPacketInterval)
+	defer tick.Stop()
+	for {
+		if playing.events == nil {
+			select {
+			case playing = <-m.events:
+				step = 0
+			default:
+			}
+		}
+		pkt, pktTS, isEvent := silence, ts, false
+		switch {
+		case playing.events == nil:
+		case step < dtmfEventPackets+dtmfEndPackets:
+			// Every packet of a digit carries its start time and how long it has
+			// lasted so far.
+			pkt, pktTS, isEvent = event, ts-uint32(step)*rtpSamples, true
+			marker = marker || step == 0
+			event[12] = playing.events[0]
+			event[13] = 10 // volume, -10 dBm0
+			if step >= dtmfEventPackets {
+				event[13] |= 0x80 // end
+			}
+			binary.BigEndian.PutUint16(event[14:], uint16(min(step+1, dtmfEventPackets)*rtpSamples))
+		case step == dtmfEventPackets+dtmfEndPackets+dtmfGapPackets-1:
+			if playing.events = playing.events[1:]; len(playing.events) == 0 {
+				close(playing.done)
+				playing = dtmfRequest{}
+			}
+			step = -1
+		}
+		pkt[0] = 0x80 // version 2
+		pkt[1] = byte(pt)
+		if isEvent {
+			pkt[1] = byte(m.eventPT)
+		}
+		if marker {
+			pkt[1] |= 0x80
+			marker = false
+		}
+		binary.BigEndian.PutUint16(pkt[2:], seq)
+		binary.BigEndian.PutUint32(pkt[4:], pktTS)
+		m.mu.Lock()
+		peer := m.peer
+		m.mu.Unlock()
+		if _, err := m.conn.WriteToUDPAddrPort(pkt, peer); err == nil {
+			if isEvent {
+				rtpEventsSent.inc()
+			} else {
+				rtpSilenceSent.inc()
+			}
+		}
+		seq++
+		ts += rtpSamples
+		if playing.events != nil {
+			step++
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// sendDTMF plays digits as telephone-events and returns once they are sent, or
+// false at once if the stream can't and they are left to SIP INFO.
+func (m *mediaStream) sendDTMF(log *callLogger, digits string) bool {
+	if m == nil || m.eventPT < 0 {
+		return false
+	}
+	req := dtmfRequest{done: make(chan struct{})}
+	for _, d := range digits {
+		req.events = append(req.events, byte(strings.IndexRune("0123456789*#ABCD", d)))
+	}
+	select {
+	case m.events <- req:
+	case <-m.stop:
+		return true
+	}
+	select {
+	case <-req.done:
+		log.Printf("DTMF %s sent as RTP telephone-events (payload type %d)\n", digits, m.eventPT)
+	case <-m.stop:
+	}
+	return true
+}
+
+// Close stops the stream and frees its port.
+func (m *mediaStream) Close() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	m.conn.Close()
+	m.wg.Wait()
+}
+
+// sdpPayloadType returns the first payload type on sdp's audio m= line that we can
+// send silence in, or -1.
+func sdpPayloadType(sdp []byte) int {
+	for _, line := range sdpLines(sdp) {
+		if fields := strings.Fields(strings.TrimPrefix(line, "m=")); strings.HasPrefix(line, "m=audio ") && len(fields) > 3 {
+			for _, f := range fields[3:] {
+				if pt, err := strconv.Atoi(f); err == nil {
+					if _, ok := rtpSilence[pt]; ok {
+						return pt
+					}
+				}
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+// sdpEventType returns the payload type sdp's audio m= line offers telephone-event
+// at 8kHz in, or -1.
+func sdpEventType(sdp []byte) int {
+	lines := sdpLines(sdp)
+	var offered []string
+	for _, line := range lines {
+		if fields := strings.Fields(line); strings.HasPrefix(line, "m=audio ") && len(fields) > 3 {
+			offered = fields[3:]
+			break
+		}
+	}
+	for _, line := range lines {
+		pt, codec, ok := strings.Cut(strings.TrimPrefix(line, "a=rtpmap:"), " ")
+		if ok && strings.HasPrefix(line, "a=rtpmap:") && strings.EqualFold(codec, "telephone-event/8000") && slices.Contains(offered, pt) {
+			if n, err := strconv.Atoi(pt); err == nil {
+				return n
+			}
+		}
+	}
+	return -1
+}
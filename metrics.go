@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// metricFamily is one Prometheus counter or gauge, with a value per label set.
+// Kept deliberately tiny: GET /metrics renders the text exposition format itself,
+// so there is no client library to pull in.
+type metricFamily struct {
+	name, help, kind string
+	fn               func() float64 // sampled at scrape time instead of values (newGaugeFunc)
+	persist          bool           // saved to --data-dir and restored on startup (metricstore.go)
+
+	mu     sync.Mutex
+	values map[string]float64 // rendered label set (`a="1",b="2"`) -> value
+}
+
+var (
+	metricsMu  sync.Mutex
+	allMetrics []*metricFamily
+)
+
+func newMetric(kind, name, help string) *metricFamily {
+	m := &metricFamily{name: name, help: help, kind: kind, values: map[string]float64{}}
+	metricsMu.Lock()
+	allMetrics = append(allMetrics, m)
+	metricsMu.Unlock()
+	return m
+}
+
+func newCounter(name, help string) *metricFamily { return newMetric("counter", name, help) }
+func newGauge(name, help string) *metricFamily   { return newMetric("gauge", name, help) }
+
+// newPersistentCounter is a counter that survives restarts (see metricstore.go).
+func newPersistentCounter(name, help string) *metricFamily {
+	m := newCounter(name, help)
+	m.persist = true
+	return m
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *metricFamily {
+	m := newGauge(name, help)
+	m.fn = fn
+	return m
+}
+
+// add adds v to the series for labels, given as name/value pairs.
+func (m *metricFamily) add(v float64, labels ...string) {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	m.mu.Lock()
+	m.values[b.String()] += v
+	m.mu.Unlock()
+}
+
+func (m *metricFamily) inc(labels ...string) { m.add(1, labels...) }
+
+// total is the sum of every series.
+func (m *metricFamily) total() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sum float64
+	for _, v := range m.values {
+		sum += v
+	}
+	return sum
+}
+
+func (m *metricFamily) write(w *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.fn != nil {
+		fmt.Fprintf(w, "%s %g\n", m.name, m.fn())
+		return
+	}
+	if len(m.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+		return
+	}
+	for _, labels := range slices.Sorted(maps.Keys(m.values)) {
+		if labels == "" {
+			fmt.Fprintf(w, "%s %g\n", m.name, m.values[labels])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %g\n", m.name, labels, m.values[labels])
+		}
+	}
+}
+
+// handleMetrics is GET /metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	metricsMu.Lock()
+	for _, m := range allMetrics {
+		m.write(&b)
+	}
+	metricsMu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(b.String()))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// metricsSaveEvery bounds how many counts a crash (rather than a clean shutdown,
+// which saves too) can lose.
+const metricsSaveEvery = time.Minute
+
+// Counters made with newPersistentCounter are saved to --data-dir/metrics.json and
+// added back on startup. This service is restarted on every upgrade, and without
+// it each restart dropped them to zero: Grafana's increase() copes with resets,
+// but "opens this month" panels and anyone reading raw values did not.
+
+// loadMetrics restores the persisted counters from path ("" = persistence off).
+// Series no longer produced (a renamed gate, say) are kept, so they still add up.
+func loadMetrics(path string) error {
+	if path == "" {
+		return nil
+	}
+	saved := map[string]map[string]float64{}
+	if err := loadJSON(path, &saved); err != nil {
+		return fmt.Errorf("load metrics: %w", err)
+	}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, m := range allMetrics {
+		if !m.persist {
+			continue
+		}
+		m.mu.Lock()
+		for labels, v := range saved[m.name] {
+			m.values[labels] += v
+		}
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// saveMetrics writes every persistent counter to path.
+func saveMetrics(path string) {
+	if path == "" {
+		return
+	}
+	snapshot := map[string]map[string]float64{}
+	metricsMu.Lock()
+	for _, m := range allMetrics {
+		if !m.persist {
+			continue
+		}
+		m.mu.Lock()
+		values := make(map[string]float64, len(m.values))
+		for labels, v := range m.values {
+			values[labels] = v
+		}
+		m.mu.Unlock()
+		snapshot[m.name] = values
+	}
+	metricsMu.Unlock()
+	if err := saveJSON(path, snapshot); err != nil {
+		logWarn("Could not persist metrics: %v\n", err)
+	}
+}
+
+// saveMetricsPeriodically saves to path every metricsSaveEvery until ctx is done.
+func saveMetricsPeriodically(ctx context.Context, path string) {
+	if path == "" {
+		return
+	}
+	t := time.NewTicker(metricsSaveEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			saveMetrics(path)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The config file and the --data-dir store each carry a schema version, and are
+// migrated forward on startup: the file is backed up, each migration from its
+// version to the current one runs in order, and the result is written back. A
+// version newer than this build knows is refused rather than misread, so a
+// downgrade can't half-understand what a newer Iftach wrote.
+//
+// To change a schema, bump its version and append a migration that takes the
+// previous version's data to the new one. Never edit a released migration.
+
+// configVersion is the config file's current schema version, stored in the file
+// as config_version. Files without one are version 1: what the setup wizard
+// wrote before versioning.
+const configVersion = 2
+
+const configVersionKey = "config_version"
+
+// configMigrations[i] migrates a config file from version i+1 to i+2.
+var configMigrations = []func(settings map[string]any) error{
+	migrateConfigStructured,
+}
+
+// storeVersion is the --data-dir store's current schema version, kept in
+// schema.json. A store without one is version 1.
+const storeVersion = 1
+
+// storeMigrations[i] migrates the store in dir from version i+1 to i+2.
+var storeMigrations = []func(dir string) error{}
+
+// Settings that are maps and lists, for migrateConfigStructured.
+var (
+	configMapKeys  = []string{"gates", "auto_close", "dial_plan", "sip_headers"}
+	configListKeys = []string{"sip_proxies"}
+)
+
+// migrateConfigStructured (1 → 2) turns map and list settings written as flag
+// strings ("outer=+9725...;inner=...", "a,b") into JSON objects and arrays, which
+// kong reads the same way. Settings that nest (per-gate and per-token options)
+// can only be added on top of the structured form.
+func migrateConfigStructured(settings map[string]any) error {
+	for _, key := range configMapKeys {
+		s, ok := settings[key].(string)
+		if !ok {
+			continue
+		}
+		m := map[string]string{}
+		for _, pair := range strings.Split(s, ";") {
+			if pair == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%s: %q is not a name=value pair", key, pair)
+			}
+			m[k] = v
+		}
+		settings[key] = m
+	}
+	for _, key := range configListKeys {
+		if s, ok := settings[key].(string); ok {
+			settings[key] = strings.Split(s, ",")
+		}
+	}
+	if s, ok := settings["dial_allow"].(string); ok {
+		settings["dial_allow"] = []string{s} // sep='none': one pattern per value
+	}
+	return nil
+}
+
+// migrateConfigFile brings the config file at path up to configVersion. A missing
+// file is left alone (the setup wizard writes a current one).
+func migrateConfigFile(path string) error {
+	settings := map[string]any{}
+	if err := loadJSON(path, &settings); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(settings) == 0 {
+		return nil
+	}
+	version := 1
+	if v, ok := settings[configVersionKey].(float64); ok {
+		version = int(v)
+	}
+	switch {
+	case version == configVersion:
+		return nil
+	case version > configVersion:
+		return fmt.Errorf("%s has config_version %d, but this Iftach only knows up to %d; upgrade it, or restore the backup the upgrade made", path, version, configVersion)
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", path, version)
+	if err := copyFile(path, backup); err != nil {
+		return fmt.Errorf("back up %s: %w", path, err)
+	}
+	for v := version; v < configVersion; v++ {
+		if err := configMigrations[v-1](settings); err != nil {
+			return fmt.Errorf("%s: migrating to version %d: %w", path, v+1, err)
+		}
+	}
+	settings[configVersionKey] = configVersion
+	if err := saveJSON(path, settings); err != nil {
+		return err
+	}
+	logInfo("Migrated %s from version %d to %d (backup in %s)\n", path, version, configVersion, backup)
+	return nil
+}
+
+// storeSchema is schema.json in --data-dir.
+type storeSchema struct {
+	Version int `json:"version"`
+}
+
+// migrateStore brings the --data-dir store up to storeVersion, backing the whole
+// store up first into backup-vN. It runs before anything loads from the store.
+func migrateStore() error {
+	path := dataPath("schema.json")
+	if path == "" {
+		return nil
+	}
+	schema := storeSchema{Version: 1}
+	if err := loadJSON(path, &schema); err != nil {
+		return err
+	}
+	switch {
+	case schema.Version == storeVersion:
+		return saveJSON(path, schema) // stamps a new or unversioned store
+	case schema.Version > storeVersion:
+		return fmt.Errorf("%s is schema version %d, but this Iftach only knows up to %d; upgrade it, or restore the backup the upgrade made", cli.DataDir, schema.Version, storeVersion)
+	}
+	backup := filepath.Join(cli.DataDir, fmt.Sprintf("backup-v%d", schema.Version))
+	files, err := filepath.Glob(filepath.Join(cli.DataDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(backup, 0o700); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := copyFile(f, filepath.Join(backup, filepath.Base(f))); err != nil {
+			return fmt.Errorf("back up %s: %w", f, err)
+		}
+	}
+	from := schema.Version
+	for ; schema.Version < storeVersion; schema.Version++ {
+		if err := storeMigrations[schema.Version-1](cli.DataDir); err != nil {
+			return fmt.Errorf("migrating %s to version %d: %w", cli.DataDir, schema.Version+1, err)
+		}
+	}
+	if err := saveJSON(path, schema); err != nil {
+		return err
+	}
+	logInfo("Migrated %s from schema version %d to %d (backup in %s)\n", cli.DataDir, from, storeVersion, backup)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --mqtt-url connects the server to an MQTT broker (3.1.1), for home automation
+// that already has one. Under --mqtt-topic (iftach by default):
+//   - TOPIC/open is subscribed to: each message opens a gate, the payload naming it
+//     (empty for the default gate) or a JSON {"gate": name, "dry_run": bool};
+//   - TOPIC/state gets every status of every call as JSON, the last with done set;
+//   - TOPIC/availability is online (retained) while connected, and the broker sets
+//     it to offline through our will when the connection is lost.
+//
+// Anyone who may publish to TOPIC/open can open the gates: restrict it with the
+// broker's ACLs. Commands are subscribed to at QoS 0, so a message the broker
+// redelivers after a reconnect doesn't open the gate a second time. The connection
+// is a background service of idle mode and is redialled every mqttRetry while the
+// broker is unreachable.
+
+const (
+	mqttKeepAlive = 60 * time.Second
+	mqttRetry     = 10 * time.Second
+	mqttTimeout   = 10 * time.Second // to connect and get the CONNACK
+	mqttMaxPacket = 64 << 10         // larger incoming packets drop the connection
+)
+
+// MQTT control packet types, shifted into the fixed header's high nibble.
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttSubscribe  = 0x82 // with the reserved flags 0010
+	mqttSuback     = 0x90
+	mqttPingreq    = 0xc0
+	mqttPingresp   = 0xd0
+	mqttDisconnect = 0xe0
+)
+
+var (
+	mqttConnected = newGauge("iftach_mqtt_connected", "1 while connected to the --mqtt-url broker.")
+	mqttCommands  = newCounter("iftach_mqtt_commands_total", "Messages received on the MQTT open topic by result (ok, invalid).")
+)
+
+type mqttBridge struct {
+	url      *url.URL
+	user     string
+	pass     string
+	clientID string
+	topic    string
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// mqttSubsystem keeps the --mqtt-url connection.
+func mqttSubsystem() subsystem {
+	var b *mqttBridge
+	return subsystem{
+		name:  "mqtt",
+		after: []string{"integrations"}, // idle mode
+		start: func(context.Context) error {
+			u, err := url.Parse(cli.MqttUrl)
+			if err != nil {
+				return fmt.Errorf("mqtt: %w", err)
+			}
+			b = &mqttBridge{url: u, user: cli.MqttUser, pass: cli.MqttPass, clientID: cli.MqttClientId, topic: strings.TrimSuffix(cli.MqttTopic, "/")}
+			idle.Register("mqtt", b.start, b.stop)
+			return nil
+		},
+		stop: func(ctx context.Context) error {
+			b.stop()
+			b.mu.Lock()
+			done := b.done
+			b.mu.Unlock()
+			if done != nil {
+				select {
+				case <-done:
+				case <-ctx.Done():
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// start begins connecting. It doesn't block (see backgroundService).
+func (b *mqttBridge) start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	prev, done := b.done, make(chan struct{})
+	b.cancel, b.done = cancel, done
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		b.loop(ctx)
+	}()
+}
+
+// stop disconnects. It doesn't block.
+func (b *mqttBridge) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel != nil {
+		b.cancel()
+		b.cancel = nil
+	}
+}
+
+func (b *mqttBridge) loop(ctx context.Context) {
+	for {
+		err := b.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		logWarn("MQTT %s: %v (reconnecting in %v)\n", b.url.Host, err, mqttRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(mqttRetry):
+		}
+	}
+}
+
+// session runs one connection until it fails or ctx ends.
+func (b *mqttBridge) session(ctx context.Context) error {
+	conn, r, err := b.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := &mqttConn{conn: conn}
+	logInfo("Connected to MQTT broker %s; opening gates on %s/open\n", b.url.Host, b.topic)
+	mqttConnected.add(1)
+	defer mqttConnected.add(-1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- b.read(ctx, c, r) }()
+	if err := c.write(mqttSubscribe, subscribePacket(1, b.topic+"/open")); err != nil {
+		return err
+	}
+	if err := c.publish(b.topic+"/availability", []byte("online"), true); err != nil {
+		return err
+	}
+	go b.publishStates(ctx, c)
+
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// A clean DISCONNECT discards the will, so say offline ourselves.
+			_ = c.publish(b.topic+"/availability", []byte("offline"), true)
+			_ = c.write(mqttDisconnect, nil)
+			return nil
+		case err := <-errc:
+			return err
+		case <-ping.C:
+			if err := c.write(mqttPingreq, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// connect dials the broker and completes the CONNECT/CONNACK handshake.
+func (b *mqttBridge) connect(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	ctx, cancel := context.WithTimeout(ctx, mqttTimeout)
+	defer cancel()
+	host := b.url.Host
+	if b.url.Port() == "" {
+		host = net.JoinHostPort(b.url.Hostname(), map[string]string{"mqtt": "1883", "mqtts": "8883"}[b.url.Scheme])
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if b.url.Scheme == "mqtts" {
+		d := &tls.Dialer{Config: &tls.Config{ServerName: b.url.Hostname()}}
+		conn, err = d.DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	c := &mqttConn{conn: conn}
+	if err := c.write(mqttConnect, b.connectPacket()); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	typ, body, err := readMQTTPacket(r)
+	switch {
+	case err != nil:
+	case typ&0xf0 != mqttConnack || len(body) != 2:
+		err = errors.New("no CONNACK from the broker")
+	case body[1] != 0:
+		err = fmt.Errorf("broker refused the connection: %s", connackReason(body[1]))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// connectPacket is the CONNECT's variable header and payload: a clean session with
+// TOPIC/availability offline as the will, and --mqtt-user/--mqtt-pass if set.
+func (b *mqttBridge) connectPacket() []byte {
+	flags := byte(0x02 | 0x04 | 0x20) // clean session, will, will retain
+	if b.user != "" {
+		flags |= 0x80
+		if b.pass != "" {
+			flags |= 0x40
+		}
+	}
+	p := mqttString(nil, "MQTT")
+	p = append(p, 4, flags) // protocol level 4: MQTT 3.1.1
+	p = binary.BigEndian.AppendUint16(p, uint16(mqttKeepAlive.Seconds()))
+	p = mqttString(p, b.clientID)
+	p = mqttString(p, b.topic+"/availability")
+	p = mqttString(p, "offline")
+	if b.user != "" {
+		p = mqttString(p, b.user)
+		if b.pass != "" {
+			p = mqttString(p, b.pass)
+		}
+	}
+	return p
+}
+
+// read handles what the broker sends until the connection fails: commands on
+// TOPIC/open, acknowledgements and pings, which are only read past. Nothing for a
+// keepalive and a half is a dead connection.
+func (b *mqttBridge) read(ctx context.Context, c *mqttConn, r *bufio.Reader) error {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		typ, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+		switch typ & 0xf0 {
+		case mqttPublish:
+			topic, payload, id, ok := parsePublish(typ, body)
+			if !ok {
+				return errors.New("malformed PUBLISH")
+			}
+			if id != 0 { // QoS 1 despite our QoS 0 subscription
+				if err := c.write(mqttPuback, binary.BigEndian.AppendUint16(nil, id)); err != nil {
+					return err
+				}
+			}
+			if topic == b.topic+"/open" && ctx.Err() == nil {
+				b.open(payload)
+			}
+		case mqttSuback:
+			if len(body) == 3 && body[2] == 0x80 {
+				return fmt.Errorf("broker refused the subscription to %s/open", b.topic)
+			}
+		}
+	}
+}
+
+// open starts the call a TOPIC/open message asks for.
+func (b *mqttBridge) open(payload []byte) {
+	var req struct {
+		Gate   string `json:"gate"`
+		DryRun bool   `json:"dry_run"`
+	}
+	if p := strings.TrimSpace(string(payload)); strings.HasPrefix(p, "{") {
+		if err := json.Unmarshal(payload, &req); err != nil {
+			mqttCommands.inc("result", "invalid")
+			logWarn("MQTT %s/open: invalid JSON: %v\n", b.topic, err)
+			return
+		}
+	} else {
+		req.Gate = p
+	}
+	if req.Gate == defaultGate {
+		req.Gate = ""
+	}
+	cfg, ok := cli.forGate(req.Gate)
+	if !ok {
+		mqttCommands.inc("result", "invalid")
+		logWarn("MQTT %s/open: no gate %q\n", b.topic, req.Gate)
+		return
+	}
+	mqttCommands.inc("result", "ok")
+	s := sessions.Start(&cfg, callOptions{DryRun: req.DryRun, Gate: req.Gate, Source: "mqtt " + b.url.Hostname()})
+	s.log.Printf("MQTT opens %s\n", cmp.Or(req.Gate, defaultGate))
+}
+
+// mqttState is what TOPIC/state gets for every status of a call.
+type mqttState struct {
+	CallID   string    `json:"call_id"`
+	Gate     string    `json:"gate"`
+	Source   string    `json:"source"`
+	Status   string    `json:"status"`
+	Code     errorCode `json:"code,omitempty"`
+	Leg      string    `json:"leg,omitempty"`
+	Answered bool      `json:"answered"`
+	Done     bool      `json:"done"` // the call is over; this is its result
+}
+
+// publishStates follows every call started while connected, publishing its
+// statuses to TOPIC/state.
+func (b *mqttBridge) publishStates(ctx context.Context, c *mqttConn) {
+	for s := range sessions.Watch(ctx) {
+		go func() {
+			st := mqttState{CallID: s.ID, Gate: cmp.Or(s.Gate, defaultGate), Source: s.Source}
+			for msg := range s.Subscribe() {
+				st.Status, st.Code, st.Leg, st.Answered = msg.Status, msg.Code, msg.Leg, s.Answered()
+				b.publishState(c, st)
+			}
+			last := s.Status()
+			st.Status, st.Code, st.Leg, st.Answered, st.Done = last.Status, last.Code, "", s.Answered(), true
+			b.publishState(c, st)
+		}()
+	}
+}
+
+func (b *mqttBridge) publishState(c *mqttConn, st mqttState) {
+	payload, err := json.Marshal(st)
+	if err == nil {
+		err = c.publish(b.topic+"/state", payload, false)
+	}
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		logWarn("MQTT %s/state: %v\n", b.topic, err)
+	}
+}
+
+// mqttConn serializes writes to a broker connection.
+type mqttConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// write sends one control packet of type typ (its fixed header's first byte).
+func (c *mqttConn) write(typ byte, body []byte) error {
+	pkt := []byte{typ}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if n == 0 {
+			break
+		}
+	}
+	pkt = append(pkt, body...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	_, err := c.conn.Write(pkt)
+	return err
+}
+
+// publish sends a QoS 0 PUBLISH.
+func (c *mqttConn) publish(topic string, payload []byte, retain bool) error {
+	typ := byte(mqttPublish)
+	if retain {
+		typ |= 0x01
+	}
+	return c.write(typ, append(mqttString(nil, topic), payload...))
+}
+
+// readMQTTPacket reads one control packet, returning its fixed header's first byte
+// and the rest.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if mult *= 128; i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	if n > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("packet of %d bytes is too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// parsePublish splits a PUBLISH into its topic and payload, with the packet ID of
+// a QoS 1 or 2 message (0 for QoS 0).
+func parsePublish(typ byte, body []byte) (topic string, payload []byte, id uint16, ok bool) {
+	if len(body) < 2 {
+		return "", nil, 0, false
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if 2+n > len(body) {
+		return "", nil, 0, false
+	}
+	topic, rest := string(body[2:2+n]), body[2+n:]
+	if typ&0x06 != 0 {
+		if len(rest) < 2 {
+			return "", nil, 0, false
+		}
+		id, rest = binary.BigEndian.Uint16(rest), rest[2:]
+	}
+	return topic, rest, id, true
+}
+
+// subscribePacket subscribes to filter at QoS 0.
+func subscribePacket(id uint16, filter string) []byte {
+	p := binary.BigEndian.AppendUint16(nil, id)
+	return append(mqttString(p, filter), 0)
+}
+
+// mqttString appends s as a length-prefixed UTF-8 string.
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func connackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client ID rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("return code %d", code)
+}
@@ -0,0 +1,6 @@
+//go:build !cgo
+
+package main
+
+// cgoBuild: built without cgo, every feature on its pure-Go implementation.
+const cgoBuild = false
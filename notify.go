@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --notify-url gets a JSON POST when an open nobody is watching fails: an
+// auto-close, a batch or macro step, an inbound webhook. Such opens fail the same
+// way over and over (a gate that lost power, a trunk that's down), so failures are
+// coalesced per rule, i.e. per trigger and gate: the first failure is sent at
+// once, later ones as a summary at most every --notify-every, and the first
+// success after them as recovered. A person opening the gate sees the outcome and
+// is never notified. --ip-watch also sends an ip_changed event when the public IP
+// changes, the --visitor page a visit_request event for each entry request, and
+// a call waiting for approval (approval.go) an approval_request event, and a
+// --duress-token call a duress alarm (duress.go).
+
+// Notification events.
+const (
+	notifyFailing      = "failing"       // first failure of a rule
+	notifyStillFailing = "still_failing" // summary of the failures since the last notification
+	notifyRecovered    = "recovered"     // it worked again
+	notifyIPChanged    = "ip_changed"    // --ip-watch saw a new public IP
+)
+
+var notificationsSent = newCounter("iftach_notifications_total", "Notifications POSTed to --notify-url by event (failing, still_failing, recovered, ip_changed, budget_soft, budget_hard, visit_request, approval_request, duress) and result (ok, failed).")
+
+// notifications is the --notify-url dispatcher, nil without one.
+var notifications *notifyDispatcher
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second} // Telegram and duress alarms
+
+// notification is what --notify-url receives.
+type notification struct {
+	Event    string    `json:"event"`
+	Rule     string    `json:"rule"` // e.g. "macro morning outer"
+	Gate     string    `json:"gate"`
+	Code     errorCode `json:"code,omitempty"` // of the latest failure
+	Failures int       `json:"failures"`       // in a row, so far
+	New      int       `json:"new,omitempty"`  // since the previous notification
+	Since    time.Time `json:"since"`          // the first of them
+	CallID   string    `json:"call_id"`        // the latest call
+	Text     string    `json:"text"`           // one line for chat webhooks
+
+	IP         string `json:"ip,omitempty"` // ip_changed: the new public IP
+	PreviousIP string `json:"previous_ip,omitempty"`
+	Link       string `json:"link,omitempty"`     // visit_request: where to approve or deny it
+	Priority   string `json:"priority,omitempty"` // duress: high
+}
+
+// notifyState is a rule's run of failures.
+type notifyState struct {
+	gate     string
+	since    time.Time // UTC
+	failures int
+	unsent   int // failures since the last notification
+	code     errorCode
+	callID   string
+	sentAt   time.Time
+	timer    *time.Timer // sends the summary of unsent failures
+}
+
+type notifyDispatcher struct {
+	url    string
+	every  time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	rules map[string]*notifyState
+}
+
+// notifySubsystem dispatches --notify-url notifications.
+func notifySubsystem() subsystem {
+	return subsystem{
+		name: "notify",
+		start: func(context.Context) error {
+			notifications = &notifyDispatcher{
+				url:    cli.NotifyURL,
+				every:  cli.NotifyEvery,
+				client: &http.Client{Timeout: 10 * time.Second},
+				rules:  map[string]*notifyState{},
+			}
+			return nil
+		},
+		stop: func(context.Context) error {
+			notifications.Stop()
+			return nil
+		},
+	}
+}
+
+// notifyRule names the automated trigger a call belongs to, for coalescing, or ""
+// for a call a person placed.
+func notifyRule(opts callOptions) string {
+	fields := strings.Fields(opts.Source)
+	if len(fields) == 0 {
+		return ""
+	}
+	gate := cmp.Or(opts.Gate, defaultGate)
+	switch fields[0] {
+	case "auto-close", "batch": // a batch's own ID is new every time
+		return fields[0] + " " + gate
+	case "macro", "hook":
+		if len(fields) > 1 {
+			return fields[0] + " " + fields[1] + " " + gate
+		}
+	}
+	return ""
+}
+
+// Observe records how a finished call went, notifying as the rule's state calls for.
+func (n *notifyDispatcher) Observe(opts callOptions, s *callSession) {
+	rule := notifyRule(opts)
+	if n == nil || opts.DryRun || rule == "" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st := n.rules[rule]
+	if s.Answered() {
+		if st != nil {
+			if st.timer != nil {
+				st.timer.Stop()
+			}
+			delete(n.rules, rule)
+			n.send(notification{
+				Event: notifyRecovered, Rule: rule, Gate: st.gate, Failures: st.failures, Since: displayTime(st.since), CallID: s.ID,
+				Text: fmt.Sprintf("%s: works again after %d failure(s)", rule, st.failures),
+			})
+		}
+		return
+	}
+	now := time.Now().UTC()
+	if st == nil {
+		st = &notifyState{gate: cmp.Or(opts.Gate, defaultGate), since: now}
+		n.rules[rule] = st
+	}
+	st.failures++
+	st.unsent++
+	st.code, st.callID = s.Status().Code, s.ID
+	switch {
+	case now.Sub(st.sentAt) >= n.every:
+		n.flushLocked(rule, st)
+	case st.timer == nil:
+		st.timer = time.AfterFunc(st.sentAt.Add(n.every).Sub(now), func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			st.timer = nil
+			if n.rules[rule] == st {
+				n.flushLocked(rule, st)
+			}
+		})
+	}
+}
+
+// flushLocked sends what st has not sent yet.
+func (n *notifyDispatcher) flushLocked(rule string, st *notifyState) {
+	if st.unsent == 0 {
+		return
+	}
+	note := notification{
+		Event: notifyFailing, Rule: rule, Gate: st.gate, Code: st.code, Failures: st.failures, Since: displayTime(st.since), CallID: st.callID,
+		Text: fmt.Sprintf("%s: failed (%s)", rule, cmp.Or(st.code, "not answered")),
+	}
+	if st.failures > 1 {
+		note.Event, note.New = notifyStillFailing, st.unsent
+		note.Text = fmt.Sprintf("%s: %d more failure(s), %d in a row since %s (last %s)", rule, st.unsent, st.failures, note.Since.Format(time.DateTime), cmp.Or(st.code, "not answered"))
+	}
+	st.unsent, st.sentAt = 0, time.Now().UTC()
+	n.send(note)
+}
+
+// send POSTs note in the background. A notification that can't be delivered is
+// logged, not retried: the next one carries the count anyway.
+func (n *notifyDispatcher) send(note notification) {
+	go func() {
+		result := "ok"
+		if err := n.post(note); err != nil {
+			result = "failed"
+			logWarn("Notification %q could not be sent: %v\n", note.Text, err)
+		} else {
+			logInfo("Notified: %s\n", note.Text)
+		}
+		notificationsSent.inc("event", note.Event, "result", result)
+	}()
+}
+
+func (n *notifyDispatcher) post(note notification) error {
+	body, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if note.CallID != "" {
+		req.Header.Set(callIDHeader, note.CallID)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// sendTelegram sends text to every --telegram-chats chat in the background, with a
+// button to link unless it is empty. A message that can't be sent is logged, not
+// retried.
+func sendTelegram(text, link string) {
+	if cli.TelegramToken == "" {
+		return
+	}
+	for _, chat := range cli.TelegramChats {
+		go func() {
+			if err := postTelegram(chat, text, link); err != nil {
+				logWarn("Telegram message to %s could not be sent: %v\n", chat, err)
+			}
+		}()
+	}
+}
+
+// postTelegram sends text to chat, with a button to link unless it is empty.
+func postTelegram(chat, text, link string) error {
+	msg := map[string]any{"chat_id": chat, "text": text}
+	if link != "" {
+		msg["text"] = text + "\n" + link
+		msg["reply_markup"] = map[string]any{"inline_keyboard": [][]map[string]string{{
+			{"text": "Approve or deny", "url": link},
+		}}}
+	}
+	body, _ := json.Marshal(msg)
+	resp, err := notifyClient.Post("https://api.telegram.org/bot"+cli.TelegramToken+"/sendMessage", "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error may quote the URL, and with it the bot token.
+		return errors.New(strings.ReplaceAll(err.Error(), cli.TelegramToken, redacted(cli.TelegramToken)))
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// Stop drops pending summaries, for shutdown.
+func (n *notifyDispatcher) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, st := range n.rules {
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+	}
+}
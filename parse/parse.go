@@ -0,0 +1,17 @@
+// Package parse holds the parsers of what the internet can send the server (call
+// tokens, signed webhooks and their payloads, WebSocket /call messages) apart from
+// the handlers using them, so that each can be fuzzed on its own:
+//
+//	go test ./parse -fuzz=FuzzWSMessage
+//
+// Every parser caps what it accepts: input over its limits is an error (or no
+// token), never a large allocation or a long string carried further in.
+package parse
+
+import "errors"
+
+// MaxName is the longest name (a gate, a UI version) a parser lets through.
+const MaxName = 64
+
+// ErrTooLong is returned for input, or a field of it, over its limit.
+var ErrTooLong = errors.New("too long")
@@ -0,0 +1,73 @@
+package parse
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func FuzzToken(f *testing.F) {
+	f.Add("Token abc123", "")
+	f.Add("", "token=abc123")
+	f.Add("Token ", "token=x")
+	f.Add("Bearer abc", "token=%00")
+	f.Fuzz(func(t *testing.T, authorization, rawQuery string) {
+		query, _ := url.ParseQuery(rawQuery)
+		tok := Token(authorization, query)
+		if tok == "" {
+			return
+		}
+		if len(tok) > MaxToken || strings.ContainsFunc(tok, func(r rune) bool { return r <= ' ' || r > '~' }) {
+			t.Fatalf("Token let %q through", tok)
+		}
+	})
+}
+
+func FuzzSignature(f *testing.F) {
+	f.Add("1760000000", "sha256="+strings.Repeat("ab", 32))
+	f.Add("-1", "sha256=zz")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, timestamp, signature string) {
+		at, mac, err := Signature(timestamp, signature)
+		if err != nil {
+			return
+		}
+		if len(mac) != 32 || at.Unix() < 0 {
+			t.Fatalf("Signature(%q, %q) = %v, %x", timestamp, signature, at, mac)
+		}
+	})
+}
+
+func FuzzHookOpen(f *testing.F) {
+	f.Add([]byte(`{"gate":"outer","dry_run":true}`))
+	f.Add([]byte(``))
+	f.Add([]byte(`{"gate":1}`))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req, err := HookOpen(body)
+		if err == nil && len(req.Gate) > MaxName {
+			t.Fatalf("HookOpen let a %d-byte gate through", len(req.Gate))
+		}
+	})
+}
+
+func FuzzWSMessage(f *testing.F) {
+	f.Add([]byte(`{"type":"hello","ui_version":"2026.10.16","protocol":6,"commands":true}`))
+	f.Add([]byte(`{"type":"ping","id":"1"}`))
+	f.Add([]byte(`{"type":"select_gate","gate":"outer"}`))
+	f.Add([]byte(`[]`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := WSMessage(data)
+		if err != nil {
+			return
+		}
+		// What was accepted survives a round trip unchanged.
+		again, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back, err := WSMessage(again); err != nil || back != msg {
+			t.Fatalf("round trip of %q: %+v, %v", again, back, err)
+		}
+	})
+}
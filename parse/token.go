@@ -0,0 +1,37 @@
+package parse
+
+import (
+	"net/url"
+	"strings"
+)
+
+// MaxToken is the longest call or admin token accepted; real ones are far shorter.
+const MaxToken = 256
+
+// Token returns a request's token from its Authorization header ("Token <value>")
+// or, failing that, its token query parameter. It is "" unless the token is 1 to
+// MaxToken printable ASCII characters, so nothing else ever reaches a lookup.
+func Token(authorization string, query url.Values) string {
+	if strings.HasPrefix(authorization, "Token ") {
+		if t := strings.TrimSpace(authorization[6:]); validToken(t) {
+			return t
+		}
+		return ""
+	}
+	if t := query.Get("token"); validToken(t) {
+		return t
+	}
+	return ""
+}
+
+func validToken(t string) bool {
+	if t == "" || len(t) > MaxToken {
+		return false
+	}
+	for i := 0; i < len(t); i++ {
+		if t[i] <= ' ' || t[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
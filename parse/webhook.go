@@ -0,0 +1,70 @@
+package parse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxWebhookBody is the largest inbound webhook body read.
+const MaxWebhookBody = 64 << 10
+
+// What Signature finds wrong with a webhook's signature headers.
+var (
+	ErrUnsigned     = errors.New("unsigned")
+	ErrBadTimestamp = errors.New("bad timestamp")
+	ErrBadSignature = errors.New("bad signature")
+)
+
+// Signature parses a webhook's X-Iftach-Timestamp (unix seconds) and
+// X-Iftach-Signature ("sha256=<hex>") headers into the time it claims and the
+// HMAC-SHA256 it carries. Checking them is up to the caller.
+func Signature(timestamp, signature string) (at time.Time, mac []byte, err error) {
+	sig := strings.TrimPrefix(signature, "sha256=")
+	if timestamp == "" || sig == "" {
+		return time.Time{}, nil, ErrUnsigned
+	}
+	if len(timestamp) > 12 { // unix seconds until the year 33658
+		return time.Time{}, nil, ErrBadTimestamp
+	}
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, nil, ErrBadTimestamp
+	}
+	if len(sig) != 2*32 {
+		return time.Time{}, nil, ErrBadSignature
+	}
+	if mac, err = hex.DecodeString(sig); err != nil {
+		return time.Time{}, nil, ErrBadSignature
+	}
+	return time.Unix(secs, 0), mac, nil
+}
+
+// HookOpenRequest is the body of POST /api/hooks/{integration}/open.
+type HookOpenRequest struct {
+	Gate   string `json:"gate"` // "" for the default gate
+	DryRun bool   `json:"dry_run"`
+}
+
+// HookOpen decodes the body of a webhook opening a gate; an empty one opens the
+// default gate.
+func HookOpen(body []byte) (HookOpenRequest, error) {
+	var req HookOpenRequest
+	if len(body) > MaxWebhookBody {
+		return req, ErrTooLong
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return req, nil
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return HookOpenRequest{}, err
+	}
+	if len(req.Gate) > MaxName {
+		return HookOpenRequest{}, ErrTooLong
+	}
+	return req, nil
+}
@@ -0,0 +1,39 @@
+package parse
+
+import "encoding/json"
+
+// MaxWSMessage is the largest message a client may send on WebSocket /call; the
+// connection's read limit, so a longer one closes it.
+const MaxWSMessage = 4096
+
+// maxID is the longest ping ID echoed back.
+const maxID = 128
+
+// ClientMessage is what a client may send on WebSocket /call: a hello, and from
+// protocol 6 the commands.
+type ClientMessage struct {
+	Type      string `json:"type"`
+	UIVersion string `json:"ui_version"` // hello
+	Protocol  int    `json:"protocol"`   // hello
+	Commands  bool   `json:"commands"`   // hello: don't place a call until a start
+	Gate      string `json:"gate"`       // select_gate
+	DryRun    bool   `json:"dry_run"`    // start
+	Confirm   bool   `json:"confirm"`    // start: don't dial until a confirm
+	ID        string `json:"id"`         // ping: echoed in the pong
+}
+
+// WSMessage decodes one message of a /call client: a JSON object of at most
+// MaxWSMessage bytes, whose strings are within their limits.
+func WSMessage(data []byte) (ClientMessage, error) {
+	var msg ClientMessage
+	if len(data) > MaxWSMessage {
+		return msg, ErrTooLong
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return ClientMessage{}, err
+	}
+	if len(msg.Type) > MaxName || len(msg.UIVersion) > MaxName || len(msg.Gate) > MaxName || len(msg.ID) > maxID {
+		return ClientMessage{}, ErrTooLong
+	}
+	return msg, nil
+}
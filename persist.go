@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// dataPath returns name inside --data-dir, or "" when persistence is disabled.
+func dataPath(name string) string {
+	if cli.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(cli.DataDir, name)
+}
+
+// loadJSON decodes path into v. A missing file is not an error (v is left untouched).
+func loadJSON(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveJSON writes v to path atomically (temp file + rename), so a crash or power cut
+// mid-write never leaves a truncated file behind.
+func saveJSON(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeFileAtomic writes b to path as saveJSON does.
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// rewriteLines replaces each line of the JSON Lines file path with what edit
+// returns for it, if it changed it, writing the result atomically. Lines edit
+// leaves alone, torn ones included, are kept as they are. It returns how many
+// lines changed; a missing file has none.
+func rewriteLines(path string, edit func(line []byte) ([]byte, bool)) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	changed := 0
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if edited, ok := edit(bytes.TrimSuffix(line, []byte("\n"))); ok {
+			lines[i] = append(edited, '\n')
+			changed++
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	return changed, writeFileAtomic(path, bytes.Join(lines, nil))
+}
+
+// checkDataDir reports whether --data-dir can be written to, so a read-only or
+// misowned directory fails startup instead of the first save after a call.
+func checkDataDir() error {
+	if cli.DataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cli.DataDir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(cli.DataDir, ".write-check.*.tmp")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
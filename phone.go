@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// With --default-region, every number is read as a phone number of that region
+// (or +E.164) and normalized to +E.164 before --dial-plan runs, so a typo'd or
+// truncated number is refused at config load with a reason instead of being
+// dialled and rejected by the provider with a bare 404 or 484.
+
+// errInvalidNumber wraps every parsePhoneNumber error, so callers can tell a bad
+// number from a broken dial plan.
+var errInvalidNumber = errors.New("not a valid phone number")
+
+// phoneRegion is what parsing a number of one region takes: its country code, the
+// prefixes dialled there for national (trunk) and international calls, and how
+// many digits follow the country code. The lengths are those of subscriber
+// numbers; short codes and feature codes are not covered.
+type phoneRegion struct {
+	cc             string
+	trunk, intl    string // "" when the region has no trunk prefix
+	minNSN, maxNSN int
+}
+
+// phoneRegions are the --default-region values, by ISO 3166 code.
+var phoneRegions = map[string]phoneRegion{
+	"AE": {"971", "0", "00", 8, 9},
+	"AT": {"43", "0", "00", 4, 13},
+	"AU": {"61", "0", "0011", 9, 9},
+	"BE": {"32", "0", "00", 8, 9},
+	"BR": {"55", "0", "00", 10, 11},
+	"CA": {"1", "1", "011", 10, 10},
+	"CH": {"41", "0", "00", 9, 9},
+	"DE": {"49", "0", "00", 5, 13},
+	"DK": {"45", "", "00", 8, 8},
+	"ES": {"34", "", "00", 9, 9},
+	"FR": {"33", "0", "00", 9, 9},
+	"GB": {"44", "0", "00", 9, 10},
+	"GR": {"30", "", "00", 10, 10},
+	"IE": {"353", "0", "00", 7, 9},
+	"IL": {"972", "0", "00", 8, 9},
+	"IN": {"91", "0", "00", 10, 10},
+	"IT": {"39", "", "00", 6, 11}, // the leading 0 of landlines is part of the number
+	"JP": {"81", "0", "010", 9, 10},
+	"MX": {"52", "", "00", 10, 10},
+	"NL": {"31", "0", "00", 9, 9},
+	"NO": {"47", "", "00", 8, 8},
+	"NZ": {"64", "0", "00", 8, 10},
+	"PL": {"48", "", "00", 9, 9},
+	"PT": {"351", "", "00", 9, 9},
+	"RU": {"7", "8", "810", 10, 10},
+	"SE": {"46", "0", "00", 7, 13},
+	"TR": {"90", "0", "00", 10, 10},
+	"UA": {"380", "0", "00", 9, 9},
+	"US": {"1", "1", "011", 10, 10},
+	"ZA": {"27", "0", "00", 9, 9},
+}
+
+// phoneRegionNames lists the supported --default-region values, for errors.
+func phoneRegionNames() string {
+	return strings.Join(slices.Sorted(maps.Keys(phoneRegions)), ", ")
+}
+
+// isFeatureCode reports whether number is a provider feature code (* or #), which
+// is dialled as is.
+func isFeatureCode(number string) bool {
+	return strings.ContainsAny(number, "*#")
+}
+
+// parsePhoneNumber reads number as dialled in region — +E.164, the region's
+// international prefix, or a national number with or without its trunk prefix —
+// and returns it as +E.164. Spaces, dashes, dots and parentheses are ignored.
+func parsePhoneNumber(number, region string) (string, error) {
+	reg, ok := phoneRegions[strings.ToUpper(region)]
+	if !ok {
+		return "", fmt.Errorf("unknown region %q", region)
+	}
+	n := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" -.()", r) {
+			return -1
+		}
+		return r
+	}, number)
+	var digits string
+	switch {
+	case strings.HasPrefix(n, "+"):
+		digits = n[1:]
+	case strings.HasPrefix(n, reg.intl):
+		digits = strings.TrimPrefix(n, reg.intl)
+	case reg.trunk != "" && strings.HasPrefix(n, reg.trunk):
+		digits = reg.cc + strings.TrimPrefix(n, reg.trunk)
+	default:
+		digits = reg.cc + n
+	}
+	switch {
+	case !isDigits(digits):
+		return "", fmt.Errorf("%w: only digits, an optional leading + and spaces, dashes, dots or parentheses are allowed", errInvalidNumber)
+	case digits[0] == '0':
+		return "", fmt.Errorf("%w: a country code never starts with 0", errInvalidNumber)
+	}
+	// Check the length for the regions we know; any other country passes on the
+	// E.164 bounds alone.
+	for _, r := range phoneRegions {
+		if rest, ok := strings.CutPrefix(digits, r.cc); ok && (len(rest) < r.minNSN || len(rest) > r.maxNSN) {
+			want := fmt.Sprint(r.minNSN)
+			if r.maxNSN != r.minNSN {
+				want += "-" + fmt.Sprint(r.maxNSN)
+			}
+			return "", fmt.Errorf("%w: +%s numbers have %s digits after the country code, not %d", errInvalidNumber, r.cc, want, len(rest))
+		}
+	}
+	if len(digits) < 7 || len(digits) > 15 {
+		return "", fmt.Errorf("%w: +E.164 numbers have 7 to 15 digits, not %d", errInvalidNumber, len(digits))
+	}
+	return "+" + digits, nil
+}
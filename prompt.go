@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Started by hand on a terminal with some of the SIP settings missing (a password
+// that shouldn't sit in shell history, say), serve asks for them instead of failing
+// on them: the password, and the call and admin tokens of the client subcommands,
+// without echoing what is typed. Not on a terminal (a service, a container), or
+// with --no-prompt, nothing is asked and the missing settings fail as before.
+
+// errNoHiddenInput is echoOff's error where the terminal can't hide input.
+var errNoHiddenInput = errors.New("hidden input is not supported on this platform")
+
+// interactive reports whether both stdin and stdout are a terminal.
+func interactive() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		fi, err := f.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+var stdinLines = bufio.NewReader(os.Stdin)
+
+// fromPrompt records which flags were typed in at the terminal, for the banner.
+var fromPrompt = map[string]bool{}
+
+// prompt asks for a value on the terminal, without echo if secret.
+func prompt(label string, secret bool) (string, error) {
+	if secret {
+		restore, err := echoOff(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		defer fmt.Println() // the Enter that wasn't echoed
+		defer restore()
+	}
+	fmt.Printf("%s: ", label)
+	line, err := stdinLines.ReadString('\n')
+	return strings.TrimSpace(line), err
+}
+
+// promptMissing asks for the SIP settings check() would reject as empty.
+func (c *Config) promptMissing() error {
+	fields := []struct {
+		flag   string
+		label  string
+		value  *string
+		secret bool
+	}{
+		{"sip-user", "SIP user", &c.SipUser, false},
+		{"sip-pass", "SIP password", &c.SipPass, true},
+		{"sip-domain", "SIP domain", &c.SipDomain, false},
+		{"destination", "Number to call", &c.Destination, false},
+	}
+	for _, f := range fields {
+		if *f.value != "" {
+			continue
+		}
+		v, err := prompt(fmt.Sprintf("%s (--%s)", f.label, f.flag), f.secret)
+		if errors.Is(err, errNoHiddenInput) {
+			continue // left empty, for check() to report
+		}
+		if err != nil {
+			return fmt.Errorf("read --%s: %w", f.flag, err)
+		}
+		*f.value, fromPrompt[f.flag] = v, v != ""
+	}
+	return nil
+}
+
+// promptSecret fills an empty secret flag of a client subcommand from the
+// terminal, when there is one that hides input.
+func promptSecret(value *string, label string) error {
+	if *value != "" || !interactive() {
+		return nil
+	}
+	v, err := prompt(label, true)
+	if errors.Is(err, errNoHiddenInput) {
+		return nil
+	}
+	*value = v
+	return err
+}
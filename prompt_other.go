@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// echoOff can't turn echo off here, so secrets are never prompted for.
+func echoOff(*os.File) (func(), error) { return nil, errNoHiddenInput }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// providerPreset is what --provider fills in for a SIP trunk: settings (by flag
+// name) that stay at their default otherwise, plus checks for what the provider
+// insists on and won't tell you about beyond a bare 403 or 484.
+type providerPreset struct {
+	settings map[string]any
+	// domainSuffix, if set, is what --sip-domain must end with (per-account hosts).
+	domainSuffix string
+	// e164 providers reject numbers not in +E.164 form.
+	e164 bool
+	// fromNumber providers only accept a number of the account as the From user.
+	fromNumber bool
+}
+
+var providerPresets = map[string]providerPreset{
+	"zadarma": {
+		settings: map[string]any{"sip-domain": "sip.zadarma.com", "use-tls": true},
+	},
+	"telnyx": {
+		settings: map[string]any{"sip-domain": "sip.telnyx.com", "use-tls": true},
+		e164:     true,
+	},
+	"twilio": {
+		settings:     map[string]any{"use-tls": true},
+		domainSuffix: ".pstn.twilio.com", // the trunk's termination URI
+		e164:         true,
+		fromNumber:   true,
+	},
+	"asterisk": {
+		settings: map[string]any{"use-tls": false, "sip-port": 5060},
+	},
+}
+
+// fromProvider records which flags took their value from the --provider preset,
+// for the startup banner and `config dump`.
+var fromProvider = map[string]bool{}
+
+// AfterApply fills in the --provider preset once flags, env vars and the config
+// file are resolved, so that any of them still wins over the preset. It runs for
+// every command embedding Config.
+func (c *Config) AfterApply(kctx *kong.Context) error {
+	preset, ok := providerPresets[c.Provider]
+	if !ok {
+		return nil
+	}
+	for _, flag := range kctx.Flags() {
+		v, ok := preset.settings[flag.Name]
+		if !ok || !flag.Target.IsValid() || flagOnCommandLine(kctx, flag) || envFor(flag) != "" || fromConfigFile[flag.Name] {
+			continue
+		}
+		flag.Target.Set(reflect.ValueOf(v).Convert(flag.Target.Type()))
+		fromProvider[flag.Name] = true
+	}
+	return nil
+}
+
+// checkProvider reports what the --provider preset requires but the configuration
+// lacks, for check().
+func (c *Config) checkProvider() []string {
+	preset, ok := providerPresets[c.Provider]
+	if !ok {
+		return nil
+	}
+	var problems []string
+	if preset.domainSuffix != "" && !strings.HasSuffix(c.SipDomain, preset.domainSuffix) {
+		problems = append(problems, fmt.Sprintf("--provider %s: --sip-domain must be your trunk's *%s termination host", c.Provider, preset.domainSuffix))
+	}
+	if from := cmp.Or(c.FromUser, c.SipUser); preset.fromNumber && !strings.HasPrefix(from, "+") && !strings.Contains(from, "{{") {
+		problems = append(problems, fmt.Sprintf("--provider %s: set --from-user to a +E.164 number of your account; calls from anything else are rejected", c.Provider))
+	}
+	if preset.e164 {
+		gates := map[string]string{defaultGate: c.Destination}
+		maps.Copy(gates, c.Gates)
+		for _, gate := range slices.Sorted(maps.Keys(gates)) {
+			if d, _, err := c.dialNumber(gate, gates[gate]); err == nil && !strings.HasPrefix(d, "+") {
+				problems = append(problems, fmt.Sprintf("--provider %s only dials +E.164 numbers, not %s (try --dial-plan '*=e164:CC')", c.Provider, d))
+				break
+			}
+		}
+	}
+	return problems
+}
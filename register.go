@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// --register keeps a registration with --sip-domain alive while the server runs:
+// REGISTER on startup, refreshed halfway through whatever lifetime the provider
+// grants, and removed (Expires: 0) on shutdown. Calls don't need it, they punch
+// their own way out; what it adds is knowing the trunk's state before a call. A
+// REGISTER that got no answer at all means the trunk is unreachable, and calls
+// fail fast with E_PROVIDER_DOWN instead of waiting out their own timeouts (each
+// such call also has the registration retried right away, so the trunk coming back
+// is noticed without waiting for registerRetry).
+//
+// The refresh is a background service of idle mode: an idle server lets the
+// registration lapse, and waking up registers again. A --cluster-db standby
+// doesn't register at all until it takes the call lease over.
+
+// Registration states, as GET /api/status reports them.
+const (
+	regRegistering = "registering"
+	regRegistered  = "registered"
+	regFailed      = "failed"
+	regStopped     = "stopped" // idle, or shutting down
+)
+
+const (
+	registerTimeout = 10 * time.Second
+	registerRetry   = 30 * time.Second // after a failed REGISTER
+	minRegister     = time.Minute      // shortest --register-expiry
+)
+
+var (
+	sipRegistered = newGauge("iftach_sip_registered", "1 while the --register registration with the trunk is current.")
+	sipRegisters  = newCounter("iftach_sip_registers_total", "REGISTER requests of --register by result (ok, auth, unreachable, rejected).")
+)
+
+// registrar is the --register registration, nil without it.
+var registrar *sipRegistrar
+
+type registrationStatus struct {
+	State   string    `json:"state"`
+	Code    errorCode `json:"code,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+type sipRegistrar struct {
+	cfg    *Config
+	ua     *sipgo.UserAgent
+	client *sipgo.Client
+	callID sip.CallIDHeader // one per registrar, with CSeq counting up (RFC 3261 10.2.4)
+	tag    string
+	wake   chan struct{}
+
+	// Only the loop touches these; a new loop waits for the previous one to exit.
+	seq     uint32
+	contact *sip.ContactHeader
+	expiry  time.Duration // what we ask for; raised by a 423
+
+	mu     sync.Mutex
+	status registrationStatus
+	nextIP string             // the Contact's next address, set by readdress
+	cancel context.CancelFunc // stops the running loop
+	done   chan struct{}      // closed once the loop has exited and unregistered
+}
+
+// registerSubsystem keeps the --register registration.
+func registerSubsystem() subsystem {
+	return subsystem{
+		name:  "register",
+		after: []string{"integrations", "cluster"}, // idle mode, the call lease
+		start: func(context.Context) error {
+			r, err := newSIPRegistrar(&cli)
+			if err != nil {
+				return err
+			}
+			registrar = r
+			idle.Register("register", r.start, r.stop)
+			return nil
+		},
+		stop: func(ctx context.Context) error {
+			registrar.stop()
+			registrar.mu.Lock()
+			done := registrar.done
+			registrar.mu.Unlock()
+			if done != nil {
+				select {
+				case <-done:
+				case <-ctx.Done():
+				}
+			}
+			return registrar.ua.Close()
+		},
+	}
+}
+
+func newSIPRegistrar(cfg *Config) (*sipRegistrar, error) {
+	ua, err := newSIPUA(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sipgo.NewClient(ua)
+	if err != nil {
+		ua.Close()
+		return nil, err
+	}
+	return &sipRegistrar{
+		cfg:    cfg,
+		ua:     ua,
+		client: client,
+		callID: sip.CallIDHeader(newSessionID() + "@iftach"),
+		tag:    sip.GenerateTagN(16),
+		wake:   make(chan struct{}, 1),
+		expiry: cfg.RegisterExpiry,
+		status: registrationStatus{State: regStopped, Since: time.Now().UTC()},
+	}, nil
+}
+
+// start begins registering. It doesn't block (see backgroundService).
+func (r *sipRegistrar) start() {
+	if !cluster.active() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	prev, done := r.done, make(chan struct{})
+	r.cancel, r.done = cancel, done
+	r.setLocked(regRegistering, "", "", time.Time{})
+	go func() {
+		if prev != nil {
+			<-prev
+		}
+		r.loop(ctx, done)
+	}()
+}
+
+// stop ends the loop, which unregisters on its way out. It doesn't block.
+func (r *sipRegistrar) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
+
+func (r *sipRegistrar) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for {
+		wait := r.register(ctx)
+		select {
+		case <-ctx.Done():
+			r.unregister()
+			return
+		case <-time.After(wait):
+		case <-r.wake:
+		}
+	}
+}
+
+// register sends one REGISTER and returns how long until the next.
+func (r *sipRegistrar) register(ctx context.Context) time.Duration {
+	r.mu.Lock()
+	ip := r.nextIP
+	r.nextIP = ""
+	r.mu.Unlock()
+	if r.contact == nil || ip != "" {
+		if ip == "" {
+			var err error
+			if ip, err = discoverPublicIP(ctx, r.cfg); err != nil {
+				r.fail(errIPDiscovery, fmt.Sprintf("public IP discovery: %v", err))
+				return registerRetry
+			}
+		}
+		r.contact = &sip.ContactHeader{Address: r.cfg.sipContact(r.cfg.SipUser, ip), Params: sip.NewParams()}
+	}
+	res, err := r.send(ctx, r.expiry)
+	switch {
+	case ctx.Err() != nil:
+		return 0
+	case err != nil:
+		sipRegisters.inc("result", "unreachable")
+		r.fail(errProviderDown, fmt.Sprintf("no answer from %s: %v", r.cfg.SipDomain, err))
+		r.contact = nil // a failover may have moved us; the retry discovers the IP again
+		ipCache.forget()
+		return registerRetry
+	case res.StatusCode == 423:
+		if h := res.GetHeader("Min-Expires"); h != nil {
+			if s, err := strconv.Atoi(h.Value()); err == nil && time.Duration(s)*time.Second > r.expiry {
+				r.expiry = time.Duration(s) * time.Second
+				logInfo("%s wants registrations of at least %v.\n", r.cfg.SipDomain, r.expiry)
+				return 0
+			}
+		}
+		sipRegisters.inc("result", "rejected")
+		r.fail(sipErrorCode(res), fmt.Sprintf("%d %s", res.StatusCode, res.Reason))
+		return registerRetry
+	case res.StatusCode == 401, res.StatusCode == 403, res.StatusCode == 407:
+		sipRegisters.inc("result", "auth")
+		r.fail(errSipAuth, withClockSkew(fmt.Sprintf("credentials rejected: %d %s", res.StatusCode, res.Reason)))
+		return registerRetry
+	case res.StatusCode < 200 || res.StatusCode >= 300:
+		sipRegisters.inc("result", "rejected")
+		r.fail(sipErrorCode(res), fmt.Sprintf("%d %s", res.StatusCode, res.Reason))
+		return registerRetry
+	}
+	sipRegisters.inc("result", "ok")
+	granted := r.granted(res)
+	r.mu.Lock()
+	if r.status.State != regRegistered {
+		logInfo("Registered with %s as %s for %v.\n", r.cfg.SipDomain, r.cfg.SipUser, granted)
+		sipRegistered.add(1)
+	}
+	r.setLocked(regRegistered, "", "", time.Now().UTC().Add(granted))
+	r.mu.Unlock()
+	return granted / 2
+}
+
+// unregister removes our binding as the loop exits, if there is one.
+func (r *sipRegistrar) unregister() {
+	r.mu.Lock()
+	registered := r.status.State == regRegistered
+	if registered {
+		sipRegistered.add(-1)
+	}
+	r.setLocked(regStopped, "", "", time.Time{})
+	r.mu.Unlock()
+	if !registered {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), registerTimeout)
+	defer cancel()
+	if res, err := r.send(ctx, 0); err != nil {
+		logWarn("Unregistering from %s: %v\n", r.cfg.SipDomain, err)
+	} else {
+		logInfo("Unregistered from %s — %d %s\n", r.cfg.SipDomain, res.StatusCode, res.Reason)
+	}
+}
+
+// send sends a REGISTER for our Contact with the given lifetime (0 removes it),
+// answering a digest challenge.
+func (r *sipRegistrar) send(ctx context.Context, expires time.Duration) (*sip.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, registerTimeout)
+	defer cancel()
+	cfg := r.cfg
+	uri := cfg.sipURI("")
+	aor := sip.Uri{Scheme: cfg.sipScheme(), User: cfg.SipUser, Host: cfg.SipDomain}
+	req := sip.NewRequest(sip.REGISTER, uri)
+	from := &sip.FromHeader{Address: aor, Params: sip.NewParams()}
+	from.Params.Add("tag", r.tag)
+	req.AppendHeader(from)
+	req.AppendHeader(&sip.ToHeader{Address: aor, Params: sip.NewParams()})
+	req.AppendHeader(&r.callID)
+	r.seq++
+	req.AppendHeader(&sip.CSeqHeader{SeqNo: r.seq, MethodName: sip.REGISTER})
+	req.AppendHeader(r.contact)
+	req.AppendHeader(sip.NewHeader("Expires", strconv.Itoa(int(expires.Seconds()))))
+	res, err := r.client.Do(ctx, req)
+	if err == nil {
+		observeSIPClock(res, false)
+	}
+	if err == nil && (res.StatusCode == 401 || res.StatusCode == 407) {
+		res, err = r.client.DoDigestAuth(ctx, req, res, sipgo.DigestAuth{Username: cfg.SipUser, Password: cfg.SipPass})
+		r.seq = req.CSeq().SeqNo
+		if err == nil {
+			observeSIPClock(res, true)
+		}
+	}
+	return res, err
+}
+
+// granted is the lifetime a 2xx gave our Contact: its expires parameter, else the
+// Expires header, else what we asked for.
+func (r *sipRegistrar) granted(res *sip.Response) time.Duration {
+	for _, h := range res.GetHeaders("Contact") {
+		c, ok := h.(*sip.ContactHeader)
+		if !ok || c.Address.Host != r.contact.Address.Host || c.Address.User != r.contact.Address.User {
+			continue
+		}
+		if v, ok := c.Params.Get("expires"); ok {
+			if s, err := strconv.Atoi(v); err == nil && s > 0 {
+				return time.Duration(s) * time.Second
+			}
+		}
+	}
+	if h := res.GetHeader("Expires"); h != nil {
+		if s, err := strconv.Atoi(h.Value()); err == nil && s > 0 {
+			return time.Duration(s) * time.Second
+		}
+	}
+	return r.expiry
+}
+
+func (r *sipRegistrar) fail(code errorCode, detail string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status.State == regRegistered {
+		sipRegistered.add(-1)
+	}
+	if r.status.State != regFailed || r.status.Code != code {
+		logError("[%s] Registration with %s failed: %s (retrying every %v)\n", code, r.cfg.SipDomain, detail, registerRetry)
+	}
+	r.setLocked(regFailed, code, detail, time.Time{})
+}
+
+func (r *sipRegistrar) setLocked(state string, code errorCode, detail string, expires time.Time) {
+	if state != r.status.State {
+		r.status.Since = time.Now().UTC()
+	}
+	r.status.State, r.status.Code, r.status.Detail, r.status.Expires = state, code, detail, expires
+}
+
+// Status is the registration's state, nil without --register.
+func (r *sipRegistrar) Status() *registrationStatus {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.status
+	st.Since = displayTime(st.Since)
+	if !st.Expires.IsZero() {
+		st.Expires = displayTime(st.Expires)
+	}
+	return &st
+}
+
+// readdress has the registration sent again now with ip in the Contact, the public
+// IP having changed (see ipwatch.go). The binding of the old address is left to
+// expire: the provider couldn't reach it anyway.
+func (r *sipRegistrar) readdress(ip string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.nextIP = ip
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// errTrunkDown is what failFast returns while the trunk doesn't answer REGISTERs.
+var errTrunkDown = errors.New("the trunk did not answer the last REGISTER")
+
+// failFast returns errTrunkDown if the last REGISTER got no answer at all, in which
+// case a call through cfg's trunk wouldn't get through either. It also has the
+// registration retried now, so the next call finds out whether the trunk is back.
+// A call through another trunk (--backup-sip-domain) is never held back.
+func (r *sipRegistrar) failFast(cfg *Config) error {
+	if r == nil || cfg.SipDomain != r.cfg.SipDomain {
+		return nil
+	}
+	r.mu.Lock()
+	down := r.status.State == regFailed && r.status.Code == errProviderDown
+	since := r.status.Since
+	r.mu.Unlock()
+	if !down {
+		return nil
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return fmt.Errorf("%w (down since %s)", errTrunkDown, displayTime(since).Format(time.TimeOnly))
+}
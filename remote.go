@@ -0,0 +1,107 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"myphone/client"
+)
+
+// The call and history subcommands are clients of a running server (through the
+// client package), so a laptop terminal can open the gate with only its address
+// and a call token: no SIP credentials, no SIP traffic from here.
+
+// CallCmd places a call through a running server and follows it until it is over.
+type CallCmd struct {
+	Gate    string        `kong:"arg,optional,help='Gate to open (default: the --destination one)'"`
+	Server  string        `kong:"help='Base URL of the running server',default='http://127.0.0.1:8080',env='IFTACH_SERVER'"`
+	Token   string        `kong:"help='Call token (--call-token or a named one)',env='IFTACH_CALL_TOKEN'"`
+	DryRun  bool          `kong:"help='Walk through the statuses without any SIP traffic'"`
+	Timeout time.Duration `kong:"help='Give up following the call after this long (it carries on on the server)',default='2m'"`
+}
+
+func (c *CallCmd) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	if err := promptSecret(&c.Token, "Call token"); err != nil {
+		return err
+	}
+
+	cl := client.New(c.Server, c.Token)
+	call, err := cl.StartCall(ctx, client.StartOptions{Gate: c.Gate, DryRun: c.DryRun})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("📞 Call %s to %s via %s\n", call.ID, cmp.Or(c.Gate, defaultGate), c.Server)
+	err = cl.StreamStatus(ctx, call.ID, func(st client.Status) {
+		line := localize(defaultLang, "status."+st.Status)
+		if st.Leg != "" {
+			line = st.Leg + ": " + line
+		}
+		if st.Code != "" {
+			line += " [" + st.Code + "]"
+		}
+		fmt.Printf("   %s\n", line)
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("stopped following call %s after %v; see iftach history", call.ID, c.Timeout)
+	}
+	if err != nil {
+		return err
+	}
+	if call, err = cl.GetCall(ctx, call.ID); err == nil && !call.Answered {
+		return fmt.Errorf("call %s was not answered", call.ID)
+	}
+	fmt.Println("✅ Answered")
+	return nil
+}
+
+// HistoryCmd lists a running server's call history.
+type HistoryCmd struct {
+	Server     string    `kong:"help='Base URL of the running server',default='http://127.0.0.1:8080',env='IFTACH_SERVER'"`
+	AdminToken string    `kong:"help='The server --admin-token',env='IFTACH_ADMIN_TOKEN'"`
+	Gate       string    `kong:"help='Only calls to this gate'"`
+	User       string    `kong:"help='Only calls placed with this named call token, - for --call-token'"`
+	Result     string    `kong:"help='Only calls with this result',enum='answered,busy,failed,',default=''"`
+	Since      time.Time `kong:"help='Only calls placed from this time on (RFC 3339)'"`
+	Until      time.Time `kong:"help='Only calls placed before this time (RFC 3339)'"`
+	Limit      int       `kong:"help='At most this many calls',default='20'"`
+	Cursor     string    `kong:"help='The page after this call ID, as the last page ended with'"`
+}
+
+func (c *HistoryCmd) Run() error {
+	if err := promptSecret(&c.AdminToken, "Admin token"); err != nil {
+		return err
+	}
+	cl := client.New(c.Server, "")
+	cl.AdminToken = c.AdminToken
+	calls, next, err := cl.History(context.Background(), client.HistoryQuery{
+		Gate: c.Gate, User: c.User, Result: c.Result, Since: c.Since, Until: c.Until, Limit: c.Limit, Cursor: c.Cursor,
+	})
+	if err != nil {
+		return err
+	}
+	if len(calls) == 0 {
+		fmt.Println("No calls.")
+		return nil
+	}
+	for _, call := range calls {
+		result := call.Result
+		if call.Code != "" {
+			result = call.Code
+		}
+		fmt.Printf("%s  %-10s %-12s %-16s %6.1fs  %s\n", call.At.Format(time.DateTime), call.Gate, cmp.Or(call.User, "-"), result, float64(call.DurationMS)/1000, call.Source)
+	}
+	if next != "" {
+		fmt.Printf("More: --cursor %s\n", next)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// Ring-me mode: instead of just ringing the gate, Iftach first calls one of the
+// --ring-me phones and, once it is answered, calls the gate and joins the two, so
+// whoever is at the intercom can be talked to over the normal phone network. The
+// legs are joined by third party call control (RFC 3725, flow I): the phone's
+// INVITE carries no SDP, so its 200 OK makes the offer; the gate's INVITE carries
+// that offer, and its answer goes back to the phone in the ACK. Media flows
+// between the far ends through the provider; Iftach only does the signalling.
+
+// runRingMe is run() for ring-me calls (callOptions.RingMe): it rings the phone,
+// bridges it to the gate at cfg.Destination, and hangs both up when either does.
+func runRingMe(ctx context.Context, cfg *Config, opts callOptions, trace *callTrace, statusChan chan<- callStatusMsg) {
+	defer close(statusChan)
+	report := statusSink(func(m callStatusMsg) {
+		trace.status(m)
+		select {
+		case statusChan <- m:
+		default:
+		}
+	})
+	defer recoverCall(ctx, report)
+	ctx, cancel := context.WithTimeoutCause(ctx, cfg.BridgeCap, errBridgeCapped)
+	defer cancel()
+	log := callLog(ctx)
+	gate := cmp.Or(opts.Gate, defaultGate)
+
+	phoneNumber, _, err := cfg.dialNumber(dialPlanAll, cfg.RingMe[opts.RingMe])
+	if err != nil {
+		log.Failure(dialFailure(err), "Dial plan for --ring-me %s: %v", opts.RingMe, err)
+		report.fail(statusError, dialFailure(err))
+		return
+	}
+	gateNumber, _, err := cfg.dialNumber(opts.Gate, cfg.Destination)
+	if err != nil {
+		log.Failure(dialFailure(err), "Dial plan for %s: %v", cfg.Destination, err)
+		report.fail(statusError, dialFailure(err))
+		return
+	}
+	for _, n := range []string{phoneNumber, gateNumber} {
+		if !cfg.dialAllowed(n) {
+			dialRefused.inc("gate", gate)
+			log.Failure(errDialRefused, "Refusing to dial %s: it matches no --dial-allow pattern", n)
+			report.fail(statusError, errDialRefused)
+			return
+		}
+	}
+
+	publicIP, err := discoverPublicIP(ctx, cfg)
+	if err != nil {
+		log.Failure(errIPDiscovery, "Discover public IP: %v", err)
+		report.fail(statusError, errIPDiscovery)
+		return
+	}
+	trace.add("public IP %s (used in Contact)", publicIP)
+	b, err := newBridgeStack(cfg, publicIP, opts.User, report, trace)
+	if err != nil {
+		log.Failure(errSipSetup, "SIP stack: %v", err)
+		report.fail(statusError, errSipSetup)
+		return
+	}
+	defer b.Close()
+
+	phone := &bridgeLeg{name: "phone", number: phoneNumber}
+	report.status(statusRingingYou)
+	if err := b.dial(ctx, phone, gate, nil); err != nil {
+		b.dialFailed(ctx, fmt.Sprintf("Your phone (%s)", opts.RingMe), err)
+		return
+	}
+	defer b.hangup(phone)
+	offer := phone.dialog.InviteResponse.Body()
+	if !hasSDP(offer) {
+		_ = phone.ack(ctx, nil)
+		log.Failure(errSipSetup, "Your phone answered without an SDP offer — the provider does not support calls set up this way")
+		report.fail(statusError, errSipSetup)
+		return
+	}
+
+	gateLeg := &bridgeLeg{name: "gate", number: gateNumber}
+	report.status(statusBridging)
+	if err := b.dial(ctx, gateLeg, gate, offer); err != nil {
+		_ = phone.ack(context.WithoutCancel(ctx), rejectOffer(offer))
+		b.dialFailed(ctx, "Gate "+gate, err)
+		return
+	}
+	defer b.hangup(gateLeg)
+	_ = gateLeg.ack(ctx, nil)
+	if err := phone.ack(ctx, gateLeg.dialog.InviteResponse.Body()); err != nil {
+		log.Failure(errProviderDown, "ACK to your phone: %v", err)
+		report.fail(statusError, errProviderDown)
+		return
+	}
+	log.Printf("Bridged your phone (%s) to gate %s.\n", opts.RingMe, gate)
+	report.status(statusAnswered)
+
+	// Neither leg can be redialled (the phone's session would need renegotiating
+	// with a new gate), so --bridge-on-drop is hangup either way.
+	select {
+	case <-phone.ended():
+		b.dropped(ctx, phone.name)
+	case <-gateLeg.ended():
+		b.dropped(ctx, gateLeg.name)
+	case <-ctx.Done():
+		bridgeStopped(ctx)
+	}
+	b.hangup(phone)
+	b.hangup(gateLeg)
+	report.status(statusBridgeEnded)
+}
+
+// handleRingMe is POST /api/ringme?to=NAME[&gate=GATE]: ring the --ring-me phone
+// NAME (optional with only one configured) and bridge it to the gate once answered.
+func handleRingMe(w http.ResponseWriter, r *http.Request) {
+	token, ok := callAuth(r)
+	if !ok {
+		writeAPIError(w, r, http.StatusUnauthorized, callAuthFailure(r), "")
+		return
+	}
+	to := r.URL.Query().Get("to")
+	if to == "" && len(cli.RingMe) == 1 {
+		to = slices.Collect(maps.Keys(cli.RingMe))[0]
+	}
+	if _, ok := cli.RingMe[to]; !ok {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "ringme_unknown", to)
+		return
+	}
+	gate := r.URL.Query().Get("gate")
+	cfg, ok := cli.forGate(gate)
+	if !ok {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "gate_unknown", gate)
+		return
+	}
+	if !token.allows(gate) {
+		writeAPIError(w, r, http.StatusForbidden, errForbidden, "gate_forbidden", cmp.Or(gate, defaultGate))
+		return
+	}
+	if !tokens.claim(token) {
+		writeAPIError(w, r, http.StatusConflict, errTokenUsed, "token_in_use")
+		return
+	}
+	s := sessions.Start(&cfg, callOptions{Gate: gate, RingMe: to, Source: callSource("api", r), User: token.user(), Duress: token.underDuress(), Trace: requestTrace(r)})
+	tokens.settle(token, s)
+	writeJSON(w, http.StatusAccepted, newCallResponse(s))
+}
+
+// checkRingMe reports --ring-me problems for check().
+func (c *Config) checkRingMe() []string {
+	var problems []string
+	for name, number := range c.RingMe {
+		if !gateName.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("--ring-me name %q must be lowercase letters, digits, - or _", name))
+		}
+		if !dialableNumber.MatchString(number) {
+			problems = append(problems, fmt.Sprintf("--ring-me %s=%q is not a dialable number", name, number))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var rtpRelayed = newCounter("iftach_rtp_relayed_packets_total", "RTP packets relayed between the legs of intercom calls, by the leg they came from.")
+
+// rtpRelay carries the audio of a call whose legs can't reach each other directly:
+// the intercom on the LAN and the provider on the internet. Each leg gets its own
+// UDP port, advertised to that leg in SDP; what arrives on one leg's port is sent
+// out of the other's. Where a leg's packets go is taken from its SDP until it
+// sends one, and from then on is wherever that came from (symmetric latching), as
+// behind NAT the SDP address is usually wrong. Only RTP is relayed, not RTCP.
+type rtpRelay struct {
+	legs [2]*relayLeg
+	wg   sync.WaitGroup
+}
+
+// relayLeg is one leg's side of the relay.
+type relayLeg struct {
+	name string // for metrics: "intercom", "phone"
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	peer    netip.AddrPort // where the leg's RTP is sent
+	latched bool           // peer is from a received packet, not SDP
+}
+
+// newRTPRelay binds a port on every interface for each of the two named legs.
+func newRTPRelay(a, b string) (*rtpRelay, error) {
+	r := &rtpRelay{}
+	for i, name := range []string{a, b} {
+		conn, err := net.ListenUDP("udp4", nil)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.legs[i] = &relayLeg{name: name, conn: conn}
+	}
+	return r, nil
+}
+
+// start relays in both directions until Close.
+func (r *rtpRelay) start() {
+	r.wg.Add(2)
+	go r.pump(r.legs[0], r.legs[1])
+	go r.pump(r.legs[1], r.legs[0])
+}
+
+func (r *rtpRelay) pump(from, to *relayLeg) {
+	defer r.wg.Done()
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := from.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if !from.latch(netip.AddrPortFrom(src.Addr().Unmap(), src.Port())) {
+			continue
+		}
+		if dst := to.target(); dst.IsValid() {
+			_, _ = to.conn.WriteToUDPAddrPort(buf[:n], dst)
+			rtpRelayed.inc("leg", from.name)
+		}
+	}
+}
+
+// Close stops the relay and releases its ports.
+func (r *rtpRelay) Close() {
+	for _, leg := range r.legs {
+		if leg != nil {
+			leg.conn.Close()
+		}
+	}
+	r.wg.Wait()
+}
+
+func (l *relayLeg) port() int {
+	return l.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// expect sets where the leg's RTP goes until it sends some, from its SDP. A leg
+// that is redialled is expected anew, and latched anew.
+func (l *relayLeg) expect(addr netip.AddrPort) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peer, l.latched = addr, false
+}
+
+// latch reports whether a packet from src is the leg's: the first one received
+// is, and fixes the peer; after that, only those from the same address.
+func (l *relayLeg) latch(src netip.AddrPort) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.latched {
+		l.peer, l.latched = src, true
+		return true
+	}
+	return src == l.peer
+}
+
+func (l *relayLeg) target() netip.AddrPort {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.peer
+}
+
+// sdpAudio returns where an SDP receives its audio: the audio m= line's port at its
+// media-level c= address, or the session-level one.
+func sdpAudio(sdp []byte) (netip.AddrPort, error) {
+	var session, media netip.Addr
+	port, inMedia, inAudio := 0, false, false
+scan:
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if port != 0 {
+				break scan // only the first audio stream is relayed
+			}
+			fields := strings.Fields(line[2:])
+			inMedia, inAudio = true, len(fields) > 1 && fields[0] == "audio"
+			if inAudio {
+				port, _ = strconv.Atoi(fields[1])
+			}
+		case strings.HasPrefix(line, "c="):
+			fields := strings.Fields(line[2:])
+			if len(fields) < 3 {
+				continue
+			}
+			addr, err := netip.ParseAddr(strings.Split(fields[2], "/")[0])
+			if err != nil {
+				return netip.AddrPort{}, fmt.Errorf("SDP connection address %q: %w", fields[2], err)
+			}
+			switch {
+			case inAudio:
+				media = addr
+			case !inMedia:
+				session = addr
+			}
+		}
+	}
+	if port == 0 {
+		return netip.AddrPort{}, errors.New("SDP has no audio stream")
+	}
+	addr := media
+	if !addr.IsValid() {
+		addr = session
+	}
+	if !addr.IsValid() {
+		return netip.AddrPort{}, errors.New("SDP has no connection address")
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// relaySDP rewrites sdp for the other leg, so that its audio is received by the
+// relay at ip:port. Other streams are refused (port 0), and the candidates and
+// RTCP addresses of the leg it came from are dropped.
+func relaySDP(sdp []byte, ip netip.Addr, port int) []byte {
+	var out bytes.Buffer
+	audio := false
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "c="):
+			line = "c=IN IP4 " + ip.String()
+		case strings.HasPrefix(line, "m="):
+			fields := strings.Fields(line)
+			if len(fields) > 1 {
+				fields[1] = "0"
+				if fields[0] == "m=audio" && !audio {
+					fields[1], audio = strconv.Itoa(port), true
+				}
+			}
+			line = strings.Join(fields, " ")
+		case strings.HasPrefix(line, "a=candidate:"), strings.HasPrefix(line, "a=rtcp:"):
+			continue
+		}
+		out.WriteString(line + "\r\n")
+	}
+	return out.Bytes()
+}
+
+func sdpLines(sdp []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(string(sdp), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a finished session stays queryable before it is dropped from the registry.
+const sessionRetention = 15 * time.Minute
+
+// Watchdog: a call still running callHardCap after it started is stuck (a normal
+// one is over in well under 30s). Its context is cancelled, which sends CANCEL/BYE
+// and terminates its transactions; if run() still hasn't returned watchdogGrace
+// later, the session is finished without it so its subscribers aren't left hanging.
+const (
+	callHardCap   = 120 * time.Second
+	watchdogGrace = 10 * time.Second
+)
+
+var (
+	watchdogKills = newPersistentCounter("iftach_watchdog_kills_total", "Calls terminated by the watchdog after running longer than the hard cap.")
+	callsTotal    = newPersistentCounter("iftach_calls_total", "Calls placed (dry runs excluded) by gate, trigger (ws, api, batch, macro, auto-close) and result (answered, busy, failed).")
+)
+
+// result is how the call ended, for iftach_calls_total.
+func (s *callSession) result() string {
+	switch {
+	case s.Answered():
+		return "answered"
+	case s.Status().Code == errBusy:
+		return "busy"
+	default:
+		return "failed"
+	}
+}
+
+// sourceKind is the trigger part of a callOptions.Source, e.g. "ws" for
+// "ws 203.0.113.7".
+func sourceKind(source string) string {
+	kind, _, _ := strings.Cut(source, " ")
+	return cmp.Or(kind, "other")
+}
+
+// callSession is one triggered call: the run() goroutine feeding it, the statuses
+// seen so far, and the milestones API clients can wait for.
+type callSession struct {
+	ID        string
+	StartedAt time.Time // UTC
+	Gate      string    // gate name ("" is the default gate)
+	Source    string    // what triggered it (callOptions.Source)
+	User      string    // callOptions.User
+	Trace     traceParent
+	log       *callLogger
+
+	mu        sync.Mutex
+	statuses  []callStatusMsg
+	listeners []chan callStatusMsg
+	answered  chan struct{} // closed on 200 OK
+	done      chan struct{} // closed when run() returns (or the watchdog gives up on it)
+	finished  sync.Once
+	endedAt   time.Time          // UTC, set when done is closed
+	answerAt  time.Time          // UTC, set when answered is closed
+	cancel    context.CancelFunc // cancels run()'s context: CANCEL/BYE and teardown
+	clients   int                // WebSocket clients following the call, see leave
+}
+
+// Status returns the latest status of the call as a whole (not of one of its legs),
+// or a zero message if run() hasn't reported anything yet.
+func (s *callSession) Status() callStatusMsg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range slices.Backward(s.statuses) {
+		if st.Leg == "" {
+			return st
+		}
+	}
+	return callStatusMsg{}
+}
+
+// Subscribe returns a channel that replays every status seen so far and then follows
+// the call live. It is closed once the call is over.
+func (s *callSession) Subscribe() <-chan callStatusMsg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan callStatusMsg, len(s.statuses)+16)
+	for _, st := range s.statuses {
+		ch <- st
+	}
+	select {
+	case <-s.done:
+		close(ch)
+	default:
+		s.listeners = append(s.listeners, ch)
+	}
+	return ch
+}
+
+// Statuses returns every status seen so far, legs included.
+func (s *callSession) Statuses() []callStatusMsg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.statuses)
+}
+
+// Answered reports whether the call got a 200 OK or, with --ring-only, rang as
+// long as it should: either way, the gate opened.
+func (s *callSession) Answered() bool {
+	select {
+	case <-s.answered:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done reports whether run() has returned.
+func (s *callSession) Done() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *callSession) publish(msg callStatusMsg) {
+	msg.CallID = s.ID
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses = append(s.statuses, msg)
+	if (msg.Status == statusAnswered || msg.Status == statusRang) && !s.Answered() {
+		s.answerAt = time.Now().UTC()
+		close(s.answered)
+	}
+	for _, ch := range s.listeners {
+		select {
+		case ch <- msg:
+		default:
+			wsDropped.inc()
+		}
+	}
+}
+
+func (s *callSession) finish() {
+	s.finished.Do(func() {
+		sessionsActive.add(-1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.endedAt = time.Now().UTC()
+		close(s.done)
+		for _, ch := range s.listeners {
+			close(ch)
+		}
+		s.listeners = nil
+	})
+}
+
+// Hangup ends a call early (admin dashboard). It reports false if the call was
+// already over.
+func (s *callSession) Hangup(by string) bool {
+	return s.hangup(statusHungUp, by)
+}
+
+func (s *callSession) hangup(status, by string) bool {
+	if s.Done() {
+		return false
+	}
+	s.log.Printf("Hung up by %s.\n", by)
+	s.publish(callStatusMsg{Status: status})
+	s.cancel()
+	return true
+}
+
+// attach counts a WebSocket client following the call, until its leave.
+func (s *callSession) attach() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients++
+}
+
+// leave is a WebSocket client going away before the call is over: closed (a close
+// frame, i.e. the page was closed or navigated away) or dropped. Once no client is
+// left, --ws-disconnect=hangup ends a call started over WebSocket, at once if the
+// last one closed and after --ws-resume-wait if it dropped, unless a client
+// resumes it by then. Calls started otherwise only had watchers, and carry on.
+func (s *callSession) leave(closed bool, by string) {
+	s.mu.Lock()
+	s.clients--
+	left := s.clients == 0
+	s.mu.Unlock()
+	if !left || cli.WsDisconnect == "continue" || sourceKind(s.Source) != "ws" || s.Done() {
+		return
+	}
+	if closed {
+		s.hangup(statusClientLeft, by)
+		return
+	}
+	s.log.Printf("Lost its WebSocket client — hanging up unless it resumes within %v.\n", cli.WsResumeWait)
+	time.AfterFunc(cli.WsResumeWait, func() {
+		s.mu.Lock()
+		resumed := s.clients > 0
+		s.mu.Unlock()
+		if !resumed {
+			s.hangup(statusClientLeft, by)
+		}
+	})
+}
+
+// kill is the watchdog firing on a stuck call.
+func (s *callSession) kill() {
+	s.log.Warnf("Watchdog: still %q after %v — terminating the call.\n", s.Status().Status, callHardCap)
+	watchdogKills.inc()
+	s.cancel()
+	s.publish(callStatusMsg{Status: statusWatchdogKilled})
+	time.AfterFunc(watchdogGrace, func() {
+		if !s.Done() {
+			s.log.Warnf("Watchdog: the call did not exit after cancellation — abandoning it.\n")
+			s.finish()
+		}
+	})
+}
+
+// callOptions are per-call parameters that don't come from Config.
+type callOptions struct {
+	DryRun   bool          // walk through the statuses without IP discovery or any SIP traffic
+	DTMF     string        // digits to send once answered, e.g. a gate's entry code (see sendDTMF)
+	Gate     string        // gate name the call opens ("" is the default gate), for auto-close
+	Close    bool          // this is an auto-close call, which mustn't schedule another
+	RingMe   string        // --ring-me phone to call first and bridge to the gate (ringme.go)
+	Intercom *intercomCall // the intercom call to answer and bridge to --intercom-phone (intercom.go)
+	Admin    bool          // placed by an admin (a manual dial), which --budget-hard never holds back
+	Approval *approval     // the approval to wait for before dialing (approval.go); Start fills it in when the call needs one
+	Source   string        // what triggered the call, e.g. "ws 203.0.113.7", for its log lines
+	User     string        // the named call token that placed it, "" for --call-token
+	Duress   bool          // placed with --duress-token, which raises a silent alarm (duress.go)
+	Trace    traceParent   // the triggering request's W3C trace context, if it sent one
+}
+
+// sessionRegistry owns every in-flight (and recently finished) call.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*callSession
+	keys     map[string]idempotentCall
+	watchers []chan *callSession // see Watch
+}
+
+// idempotentCall remembers which session an Idempotency-Key started, and with what
+// parameters, until expires.
+type idempotentCall struct {
+	session *callSession
+	params  string
+	expires time.Time
+}
+
+// errIdempotencyMismatch is StartOnce's answer to a key repeated with parameters
+// other than those it was first sent with.
+var errIdempotencyMismatch = errors.New("idempotency key reused with other parameters")
+
+// idempotencyScope is where Idempotency-Key key is unique for a call with opts: per
+// token (named, --call-token or --duress-token) and gate, so one client's key never
+// replays another's call, nor a call to another gate.
+func idempotencyScope(opts callOptions, key string) string {
+	who := opts.User
+	if opts.Duress {
+		who = "(duress)" // no token name has parentheses
+	}
+	return who + "\x00" + cmp.Or(opts.Gate, defaultGate) + "\x00" + key
+}
+
+var sessions = &sessionRegistry{
+	sessions: map[string]*callSession{},
+	keys:     map[string]idempotentCall{},
+}
+
+// StartOnce is Start, deduplicated by an Idempotency-Key: a key seen within window
+// in the same idempotencyScope returns the session it started (reused=true)
+// instead of placing another call, or errIdempotencyMismatch if params, the rest
+// of the request, differ from the first time's. An empty key never deduplicates.
+func (r *sessionRegistry) StartOnce(cfg *Config, opts callOptions, key, params string, window time.Duration) (s *callSession, reused bool, err error) {
+	if key == "" || window <= 0 {
+		return r.Start(cfg, opts), false, nil
+	}
+	key = idempotencyScope(opts, key)
+	r.mu.Lock()
+	now := time.Now()
+	for k, c := range r.keys {
+		if now.After(c.expires) {
+			delete(r.keys, k)
+		}
+	}
+	if c, ok := r.keys[key]; ok {
+		r.mu.Unlock()
+		if c.params != params {
+			return nil, false, errIdempotencyMismatch
+		}
+		return c.session, true, nil
+	}
+	// Register the session under the same lock as the key, so a concurrent retry
+	// with it can't slip in and place a second call.
+	s, ctx := r.registerLocked(opts)
+	r.keys[key] = idempotentCall{session: s, params: params, expires: now.Add(window)}
+	r.mu.Unlock()
+	r.launch(ctx, cfg, opts, s)
+	return s, false, nil
+}
+
+// Start places a call with cfg and returns its session immediately.
+func (r *sessionRegistry) Start(cfg *Config, opts callOptions) *callSession {
+	r.mu.Lock()
+	s, ctx := r.registerLocked(opts)
+	r.mu.Unlock()
+	r.launch(ctx, cfg, opts, s)
+	return s
+}
+
+// registerLocked adds a new session for opts to the registry, with the context its
+// call will run in. r.mu is held, so it does nothing that waits on other locks or
+// on the network: the call's side effects (the duress alarm, the approval request,
+// the budget) are launch's.
+func (r *sessionRegistry) registerLocked(opts callOptions) (*callSession, context.Context) {
+	id := newSessionID()
+	s := &callSession{
+		ID:        id,
+		StartedAt: time.Now().UTC(),
+		Gate:      opts.Gate,
+		Source:    opts.Source,
+		User:      opts.User,
+		Trace:     opts.Trace,
+		log:       newCallLogger(id, opts),
+		answered:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	r.sessions[s.ID] = s
+	sessionsActive.add(1)
+	for _, w := range r.watchers {
+		select {
+		case w <- s:
+		default:
+		}
+	}
+
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(withCallLogger(context.Background(), s.log))
+	return s, ctx
+}
+
+// launch starts registered session s's call in ctx, with r.mu not held.
+func (r *sessionRegistry) launch(ctx context.Context, cfg *Config, opts callOptions, s *callSession) {
+	statusChan := make(chan callStatusMsg, 16)
+	hardCap := callHardCap
+	if !opts.DryRun {
+		opts.Approval = approvalFor(opts)
+	}
+	if opts.Duress && !opts.DryRun {
+		duress.raise(opts, s)
+	}
+	switch {
+	case opts.DryRun:
+		go runDry(ctx, statusChan)
+	case !cluster.active():
+		go runStandby(ctx, statusChan)
+	case opts.Approval != nil:
+		hardCap += opts.Approval.wait + cfg.retryAllowance() + cfg.failoverAllowance()
+		go runAfterApproval(ctx, cfg, opts, approvals.submit(opts.Approval, s), statusChan)
+	case !budget.admit(opts.Admin):
+		go runOverBudget(ctx, statusChan)
+	case opts.RingMe != "":
+		hardCap += cfg.BridgeCap
+		go runRingMe(ctx, cfg, opts, nil, statusChan)
+	case opts.Intercom != nil:
+		hardCap += cfg.BridgeCap
+		go runIntercom(ctx, cfg, opts, nil, statusChan)
+	default:
+		hardCap += cfg.retryAllowance() + cfg.failoverAllowance()
+		go runFailover(ctx, cfg, opts, statusChan)
+	}
+	watchdog := time.AfterFunc(hardCap, s.kill)
+	go func() {
+		for st := range statusChan {
+			s.publish(st)
+		}
+		watchdog.Stop()
+		s.cancel()
+		// Schedule before finishing, so whoever waits for the call sees its close.
+		// An intercom call opens nothing itself.
+		if s.Answered() && !opts.DryRun && !opts.Close && opts.Intercom == nil {
+			autoClose.Schedule(opts.Gate)
+		}
+		if !opts.DryRun {
+			callsTotal.inc("gate", cmp.Or(opts.Gate, defaultGate), "trigger", sourceKind(opts.Source), "result", s.result())
+			notifications.Observe(opts, s)
+		}
+		s.finish()
+		if !opts.DryRun {
+			callHistory.record(s)
+		}
+		time.AfterFunc(sessionRetention, func() {
+			r.mu.Lock()
+			delete(r.sessions, s.ID)
+			r.mu.Unlock()
+		})
+	}()
+}
+
+// hangupAll hangs up every call still running and waits (briefly) for their
+// CANCEL/BYE to go out, on server shutdown.
+func (r *sessionRegistry) hangupAll() {
+	var running []*callSession
+	for _, s := range r.List() {
+		if s.hangup(statusHungUp, "server shutdown") {
+			running = append(running, s)
+		}
+	}
+	deadline := time.After(2 * time.Second)
+	for _, s := range running {
+		select {
+		case <-s.done:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// List returns every retained session, newest first.
+func (r *sessionRegistry) List() []*callSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*callSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	slices.SortFunc(list, func(a, b *callSession) int { return b.StartedAt.Compare(a.StartedAt) })
+	return list
+}
+
+// Watch returns a channel that receives every call started from now on, until
+// ctx ends. A watcher that falls 16 calls behind misses calls.
+func (r *sessionRegistry) Watch(ctx context.Context) <-chan *callSession {
+	ch := make(chan *callSession, 16)
+	r.mu.Lock()
+	r.watchers = append(r.watchers, ch)
+	r.mu.Unlock()
+	context.AfterFunc(ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.watchers = slices.DeleteFunc(r.watchers, func(w chan *callSession) bool { return w == ch })
+		close(ch)
+	})
+	return ch
+}
+
+// Duration is how long the call has been running, or ran if it is over.
+func (s *callSession) Duration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.endedAt.IsZero() {
+		return time.Since(s.StartedAt)
+	}
+	return s.endedAt.Sub(s.StartedAt)
+}
+
+// Get returns the session with the given ID, if it is still retained.
+func (r *sessionRegistry) Get(id string) (*callSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// dryRunStep is the pause between simulated statuses in a dry run.
+const dryRunStep = 50 * time.Millisecond
+
+// runDry emits the status sequence of a successful call without touching the network,
+// so load tests (iftach bench) and UI checks never ring the gate.
+func runDry(ctx context.Context, statusChan chan<- callStatusMsg) {
+	defer close(statusChan)
+	for _, st := range []string{statusSendingInvite, statusTrying, statusAnswered, statusHangingUpTimer} {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dryRunStep):
+		}
+		statusChan <- callStatusMsg{Status: st}
+	}
+}
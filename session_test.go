@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// checkLeaks records the goroutine count and returns a func that fails t if it
+// hasn't come back down within a few seconds, dumping the extra stacks.
+func checkLeaks(t *testing.T) func() {
+	t.Helper()
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if n := runtime.NumGoroutine(); n > before {
+			var b strings.Builder
+			_ = pprof.Lookup("goroutine").WriteTo(&b, 1)
+			t.Errorf("%d goroutine(s) leaked:\n%s", n-before, b.String())
+		}
+	}
+}
+
+// gaugeValue reads an unlabelled gauge.
+func gaugeValue(m *metricFamily) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[""]
+}
+
+func TestSessionsDoNotLeak(t *testing.T) {
+	defer checkLeaks(t)()
+	var started []*callSession
+	for range 50 {
+		started = append(started, sessions.Start(&Config{}, callOptions{DryRun: true}))
+	}
+	for _, s := range started {
+		for range s.Subscribe() {
+		}
+		<-s.done
+	}
+	if n := gaugeValue(sessionsActive); n != 0 {
+		t.Errorf("iftach_call_sessions_active = %v after every call ended", n)
+	}
+}
+
+// TestPerCallUADoesNotLeak mirrors run(): a fresh UA and client per call, one
+// transaction, then ua.Close. Over TCP so the server's own transactions end at once
+// instead of lingering for UDP's Timer J.
+func TestPerCallUADoesNotLeak(t *testing.T) {
+	srvUA, err := sipgo.NewUA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvUA.Close()
+	srv, err := sipgo.NewServer(srvUA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.OnOptions(func(req *sip.Request, tx sip.ServerTransaction) {
+		_ = tx.Respond(sip.NewResponseFromRequest(req, 200, "OK", nil))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() { _ = srv.ServeTCP(ln) }()
+	port := ln.Addr().(*net.TCPAddr).Port
+	ctx := context.Background()
+
+	defer checkLeaks(t)()
+	for range 20 {
+		ua, err := sipgo.NewUA()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := sipgo.NewClient(ua)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uri := sip.Uri{Host: "127.0.0.1", Port: port, UriParams: sip.HeaderParams{}}
+		uri.UriParams.Add("transport", "tcp")
+		reqCtx, reqCancel := context.WithTimeout(ctx, 2*time.Second)
+		res, err := client.Do(reqCtx, sip.NewRequest(sip.OPTIONS, uri))
+		reqCancel()
+		if err != nil || res.StatusCode != 200 {
+			t.Fatalf("OPTIONS: %v %v", res, err)
+		}
+		ua.Close()
+	}
+}
+
+func TestStartOnceScope(t *testing.T) {
+	cfg := &Config{}
+	const window = time.Minute
+	first, _, err := sessions.StartOnce(cfg, callOptions{DryRun: true, User: "family", Gate: "outer"}, "k1", "p", window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		opts    callOptions
+		params  string
+		reused  bool
+		wantErr error
+	}{
+		{"replay", callOptions{DryRun: true, User: "family", Gate: "outer"}, "p", true, nil},
+		{"another token", callOptions{DryRun: true, User: "guest", Gate: "outer"}, "p", false, nil},
+		{"the call token", callOptions{DryRun: true, Gate: "outer"}, "p", false, nil},
+		{"the duress token", callOptions{DryRun: true, Duress: true, Gate: "outer"}, "p", false, nil},
+		{"another gate", callOptions{DryRun: true, User: "family", Gate: "inner"}, "p", false, nil},
+		{"other parameters", callOptions{DryRun: true, User: "family", Gate: "outer"}, "q", false, errIdempotencyMismatch},
+	}
+	for _, tt := range tests {
+		s, reused, err := sessions.StartOnce(cfg, tt.opts, "k1", tt.params, window)
+		if err != tt.wantErr || reused != tt.reused {
+			t.Errorf("%s: reused %v, err %v; want %v, %v", tt.name, reused, err, tt.reused, tt.wantErr)
+			continue
+		}
+		if err == nil && (s == first) != tt.reused {
+			t.Errorf("%s: got the first call %v, want %v", tt.name, s == first, tt.reused)
+		}
+	}
+}
+
+func TestAPICallIdempotencyMismatch(t *testing.T) {
+	withTokens(t)
+	prevTTL := cli.IdempotencyTTL
+	cli.IdempotencyTTL = time.Minute
+	t.Cleanup(func() { cli.IdempotencyTTL = prevTTL })
+	post := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/call?"+query, nil)
+		r.Header.Set("Authorization", "Token call-token")
+		r.Header.Set("Idempotency-Key", "mismatch-test")
+		rec := httptest.NewRecorder()
+		handleAPICall(rec, r)
+		return rec
+	}
+	if rec := post("dry_run=1"); rec.Code != http.StatusAccepted {
+		t.Fatalf("first POST = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := post("dry_run=1"); rec.Code != http.StatusAccepted || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replay = %d, Idempotent-Replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if rec := post(""); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("replay without dry_run = %d, want 422: %s", rec.Code, rec.Body)
+	}
+}
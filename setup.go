@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/go-chi/chi/v5"
+)
+
+// configPath is the --config flag. Unlike kong.ConfigFlag a missing file is not an
+// error: that is the first-run case, and the setup wizard creates it. Keys are flag
+// names in snake_case (sip_user, call_token, ...); flags and env vars override them.
+type configPath string
+
+// configFile is the resolved --config path (where the setup wizard writes).
+var configFile string
+
+// fromConfigFile records which flags took their value from configFile, for the
+// startup banner and `config dump`.
+var fromConfigFile = map[string]bool{}
+
+func (c configPath) BeforeResolve(ctx *kong.Context, trace *kong.Path) error {
+	configFile = kong.ExpandPath(string(ctx.FlagValue(trace.Flag).(configPath)))
+	if err := migrateConfigFile(configFile); err != nil {
+		return err
+	}
+	f, err := os.Open(configFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resolver, err := kong.JSON(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configFile, err)
+	}
+	// kong applies env vars like defaults, so any resolver would beat them. Skip flags
+	// whose env var is set: IFTACH_* in a compose file must win over the file. Empty
+	// counts as unset, since compose passes undefined ${VARS} through as "".
+	ctx.AddResolver(kong.ResolverFunc(func(kctx *kong.Context, parent *kong.Path, flag *kong.Flag) (any, error) {
+		for _, env := range flag.Envs {
+			if os.Getenv(env) != "" {
+				return nil, nil
+			}
+		}
+		v, err := resolver.Resolve(kctx, parent, flag)
+		if v != nil {
+			fromConfigFile[flag.Name] = true
+		}
+		return v, err
+	}))
+	return nil
+}
+
+// unconfigured reports whether no SIP settings were given at all (first run).
+func (c *Config) unconfigured() bool {
+	return c.SipUser == "" && c.SipPass == "" && (c.SipDomain == "" || fromProvider["sip-domain"]) && c.Destination == ""
+}
+
+// sipPort is --sip-port, or the transport's default port.
+func (c *Config) sipPort() int {
+	switch {
+	case c.SipPort != 0:
+		return c.SipPort
+	case c.sipTransport() == "tls":
+		return 5061
+	default:
+		return 5060
+	}
+}
+
+// setupListenPort is used by the wizard when --listen-port isn't set either.
+const setupListenPort = 8080
+
+// setupMaxFailures wrong setup codes in a row rotate the code.
+const setupMaxFailures = 5
+
+// setupWizard serves the first-run configuration pages. Every request must carry
+// the setup code, which is only ever printed to the console: whoever can read the
+// server's output owns it, a passer-by who finds the port open does not.
+type setupWizard struct {
+	base       Config // flags/env given at startup; the wizard fills in the rest
+	pickedPort bool   // no --listen-port was given; persist the one we serve on
+	saved      chan Config
+
+	mu       sync.Mutex
+	code     string
+	failures int
+}
+
+// setupRequest is the wizard form, posted as JSON to /setup/test and /setup/save.
+type setupRequest struct {
+	Code           string `json:"code"`
+	SipUser        string `json:"sip_user"`
+	SipPass        string `json:"sip_pass"`
+	SipDomain      string `json:"sip_domain"`
+	SipPort        int    `json:"sip_port"`
+	UseTls         bool   `json:"use_tls"`
+	Destination    string `json:"destination"`
+	OutgoingNumber string `json:"outgoing_number"`
+	CallToken      string `json:"call_token"`
+}
+
+type setupResult struct {
+	Message    string `json:"message"`
+	ConfigFile string `json:"config_file,omitempty"`
+	CallToken  string `json:"call_token,omitempty"`
+	AdminToken string `json:"admin_token,omitempty"`
+}
+
+func (s *setupRequest) config(base Config) Config {
+	cfg := base
+	cfg.SipUser = strings.TrimSpace(s.SipUser)
+	cfg.SipPass = s.SipPass
+	cfg.SipDomain = strings.TrimSpace(s.SipDomain)
+	cfg.SipPort = s.SipPort
+	cfg.UseTls = s.UseTls
+	cfg.Destination = strings.TrimSpace(s.Destination)
+	cfg.OutgoingNumber = strings.TrimSpace(s.OutgoingNumber)
+	cfg.CallToken = strings.TrimSpace(s.CallToken)
+	return cfg
+}
+
+// runSetupWizard serves the wizard until a configuration is saved, and returns it.
+// It returns nil if the server is interrupted first.
+func runSetupWizard(base Config) (*Config, error) {
+	wiz := &setupWizard{base: base, pickedPort: base.ListenPort == 0, saved: make(chan Config, 1)}
+	if wiz.pickedPort {
+		wiz.base.ListenPort = setupListenPort
+	}
+	wiz.rotateCode()
+
+	r := chi.NewRouter()
+	r.Use(requestLogger())
+	r.Get("/setup", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(setupHTML))
+	})
+	r.Post("/setup/test", wiz.handleTest)
+	r.Post("/setup/save", wiz.handleSave)
+	r.Post("/setup/discover", wiz.handleDiscover)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/setup", http.StatusFound)
+	})
+
+	srv := &http.Server{Addr: wiz.base.listenAddr(), Handler: r, MaxHeaderBytes: maxHeaderBytes, ReadHeaderTimeout: readHeaderWait}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", srv.Addr, err)
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logError("Setup server: %v\n", err)
+		}
+	}()
+	logInfo("No SIP configuration found — setup wizard on http://%s/setup\n", srv.Addr)
+	logInfo("The configuration will be written to %s\n", configFile)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var cfg *Config
+	select {
+	case c := <-wiz.saved:
+		cfg = &c
+	case <-ctx.Done():
+		logInfo("Shutting down setup wizard...")
+	}
+	_ = srv.Shutdown(context.Background())
+	return cfg, nil
+}
+
+func (s *setupWizard) rotateCode() {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	s.code = strings.ToUpper(hex.EncodeToString(b))
+	s.failures = 0
+	logInfo("Setup code: %s\n", s.code)
+}
+
+// checkCode compares the code in constant time; too many misses rotate it.
+func (s *setupWizard) checkCode(code string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if subtle.ConstantTimeCompare([]byte(strings.ToUpper(strings.TrimSpace(code))), []byte(s.code)) == 1 {
+		s.failures = 0
+		return true
+	}
+	s.failures++
+	if s.failures >= setupMaxFailures {
+		logWarn("%d wrong setup codes — issuing a new one.\n", s.failures)
+		s.rotateCode()
+	}
+	return false
+}
+
+// decode reads and authorizes a wizard request and builds the resulting config.
+// On failure it has already written the error response.
+func (s *setupWizard) decode(w http.ResponseWriter, r *http.Request) (Config, bool) {
+	var req setupRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+		return Config{}, false
+	}
+	if !s.checkCode(req.Code) {
+		writeAPIError(w, r, http.StatusUnauthorized, errAuth, "setup_code_wrong")
+		return Config{}, false
+	}
+	cfg := req.config(s.base)
+	if problems, _ := cfg.check(); len(problems) > 0 {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "config_invalid", strings.Join(problems, "; "))
+		return Config{}, false
+	}
+	return cfg, true
+}
+
+// probe checks the credentials against the provider and writes the failure, if any.
+func (s *setupWizard) probe(w http.ResponseWriter, r *http.Request, cfg *Config) bool {
+	code, detail := probeSIP(r.Context(), cfg)
+	if code != "" {
+		writeAPIError(w, r, http.StatusUnprocessableEntity, code, "probe_failed", detail)
+		return false
+	}
+	return true
+}
+
+// handleTest is POST /setup/test: validate and probe without saving.
+func (s *setupWizard) handleTest(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := s.decode(w, r)
+	if !ok || !s.probe(w, r, &cfg) {
+		return
+	}
+	writeJSON(w, http.StatusOK, setupResult{Message: localize(negotiateLang(r), "setup_probe_ok", cfg.SipDomain, cfg.SipUser)})
+}
+
+// handleSave is POST /setup/save: probe again, generate the tokens, write the config
+// file, and hand the config over to the real server.
+func (s *setupWizard) handleSave(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := s.decode(w, r)
+	if !ok || !s.probe(w, r, &cfg) {
+		return
+	}
+	if cfg.CallToken == "" {
+		cfg.CallToken = newToken()
+	}
+	if cfg.AdminToken == "" {
+		cfg.AdminToken = newToken()
+	}
+
+	// Keep whatever else is already in the file; the wizard only owns its own keys.
+	settings := map[string]any{}
+	if err := loadJSON(configFile, &settings); err != nil {
+		writeAPIError(w, r, http.StatusInternalServerError, errInternal, "config_read_failed", configFile, err)
+		return
+	}
+	settings[configVersionKey] = configVersion
+	settings["sip_user"] = cfg.SipUser
+	settings["sip_pass"] = cfg.SipPass
+	settings["sip_domain"] = cfg.SipDomain
+	settings["use_tls"] = cfg.UseTls
+	settings["destination"] = cfg.Destination
+	settings["call_token"] = cfg.CallToken
+	settings["admin_token"] = cfg.AdminToken
+	if cfg.SipPort != 0 {
+		settings["sip_port"] = cfg.SipPort
+	}
+	if cfg.OutgoingNumber != "" {
+		settings["outgoing_number"] = cfg.OutgoingNumber
+	}
+	if s.pickedPort {
+		settings["listen_port"] = cfg.ListenPort
+	}
+	if err := saveJSON(configFile, settings); err != nil {
+		writeAPIError(w, r, http.StatusInternalServerError, errInternal, "config_write_failed", configFile, err)
+		return
+	}
+	logInfo("Configuration written to %s\n", configFile)
+
+	writeJSON(w, http.StatusOK, setupResult{
+		Message:    localize(negotiateLang(r), "setup_saved"),
+		ConfigFile: configFile,
+		CallToken:  cfg.CallToken,
+		AdminToken: cfg.AdminToken,
+	})
+	select {
+	case s.saved <- cfg:
+	default: // a concurrent save already won
+	}
+}
+
+// newToken returns a random 128-bit token for --call-token/--admin-token.
+func newToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// probeSIP checks cfg's credentials with a REGISTER that carries no Contact. That is
+// a bindings query (RFC 3261 10.2.3): the provider authenticates it like any other
+// REGISTER, but no existing registration (e.g. a desk phone) is added or removed.
+// It returns "" on success, else an error code and a human-readable detail.
+func probeSIP(ctx context.Context, cfg *Config) (errorCode, string) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	ua, err := newSIPUA(cfg)
+	if err != nil {
+		return errSipSetup, err.Error()
+	}
+	defer ua.Close()
+	client, err := sipgo.NewClient(ua)
+	if err != nil {
+		return errSipSetup, err.Error()
+	}
+
+	uri := cfg.sipURI("")
+	req := sip.NewRequest(sip.REGISTER, uri)
+	aor := fmt.Sprintf("<sip:%s@%s>", cfg.SipUser, cfg.SipDomain)
+	req.AppendHeader(sip.NewHeader("From", fmt.Sprintf("%s;tag=%d", aor, time.Now().UnixNano())))
+	req.AppendHeader(sip.NewHeader("To", aor))
+
+	logInfo("Probing %s as %s (REGISTER query)...\n", uri.Addr(), cfg.SipUser)
+	res, err := client.Do(ctx, req)
+	if err == nil {
+		observeSIPClock(res, false)
+	}
+	if err == nil && (res.StatusCode == 401 || res.StatusCode == 407) {
+		if res, err = client.DoDigestAuth(ctx, req, res, sipgo.DigestAuth{Username: cfg.SipUser, Password: cfg.SipPass}); err == nil {
+			observeSIPClock(res, true)
+		}
+	}
+	if err != nil {
+		logWarn("Probe of %s: no answer: %v\n", uri.Addr(), err)
+		return errProviderDown, fmt.Sprintf("no answer from %s: %v", uri.Addr(), err)
+	}
+	logInfo("Probe of %s: %d %s\n", uri.Addr(), res.StatusCode, res.Reason)
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return "", ""
+	case res.StatusCode == 401, res.StatusCode == 403, res.StatusCode == 407:
+		return errSipAuth, withClockSkew(fmt.Sprintf("credentials rejected: %d %s", res.StatusCode, res.Reason))
+	default:
+		return sipErrorCode(res), fmt.Sprintf("%d %s", res.StatusCode, res.Reason)
+	}
+}
+
+const setupHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0, viewport-fit=cover">
+    <title>Gate Setup</title>
+    <style>
+        :root {
+            --bg-color: #000000;
+            --main-green: #00ff41;
+            --main-grey: #666666;
+            --main-red: #ff3333;
+            --font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, Helvetica, Arial, sans-serif;
+        }
+
+        body {
+            background-color: var(--bg-color);
+            color: white;
+            font-family: var(--font-family);
+            margin: 0;
+            padding: 24px 16px;
+            display: flex;
+            justify-content: center;
+        }
+
+        form {
+            width: 100%;
+            max-width: 420px;
+        }
+
+        h1 {
+            color: var(--main-green);
+            font-size: 1.5rem;
+            margin: 0 0 4px;
+        }
+
+        .hint {
+            color: var(--main-grey);
+            font-size: 0.85rem;
+            margin: 0 0 16px;
+        }
+
+        label {
+            display: block;
+            font-size: 0.85rem;
+            margin: 12px 0 4px;
+        }
+
+        input[type=text], input[type=password], input[type=number] {
+            width: 100%;
+            box-sizing: border-box;
+            padding: 10px;
+            background: #111;
+            color: white;
+            border: 1px solid var(--main-grey);
+            border-radius: 6px;
+            font-size: 1rem;
+        }
+
+        input:focus {
+            outline: none;
+            border-color: var(--main-green);
+        }
+
+        .check {
+            display: flex;
+            gap: 8px;
+            align-items: center;
+        }
+
+        .buttons {
+            display: flex;
+            gap: 12px;
+            margin-top: 20px;
+        }
+
+        button {
+            flex: 1;
+            padding: 12px;
+            background: transparent;
+            color: var(--main-green);
+            border: 2px solid currentColor;
+            border-radius: 6px;
+            font-size: 1rem;
+            font-weight: 600;
+            cursor: pointer;
+        }
+
+        button:disabled {
+            color: var(--main-grey);
+            cursor: default;
+        }
+
+        #result {
+            margin-top: 16px;
+            font-size: 0.9rem;
+            white-space: pre-wrap;
+            word-break: break-all;
+        }
+
+        button.small {
+            width: 100%;
+            margin-top: 8px;
+            padding: 8px;
+            font-size: 0.85rem;
+        }
+
+        #devices button {
+            display: block;
+            width: 100%;
+            margin-top: 6px;
+            padding: 8px;
+            color: white;
+            border-width: 1px;
+            font-size: 0.85rem;
+            font-weight: normal;
+            text-align: left;
+        }
+
+        .ok { color: var(--main-green); }
+        .err { color: var(--main-red); }
+        a { color: var(--main-green); }
+    </style>
+</head>
+<body>
+    <form id="setup">
+        <h1>Gate setup</h1>
+        <p class="hint">No configuration was found. Fill in your SIP provider details; they are tested before anything is saved.</p>
+
+        <label for="code">Setup code (printed in the server console)</label>
+        <input type="text" id="code" autocomplete="off" required>
+
+        <label for="sip_user">SIP user</label>
+        <input type="text" id="sip_user" autocomplete="off" required>
+
+        <label for="sip_pass">SIP password</label>
+        <input type="password" id="sip_pass" autocomplete="off" required>
+
+        <label for="sip_domain">SIP domain</label>
+        <input type="text" id="sip_domain" placeholder="sip.zadarma.com" autocomplete="off" required>
+
+        <button type="button" id="discover" class="small">Find intercoms and PBXes on the LAN</button>
+        <div id="devices"></div>
+
+        <label for="sip_port">SIP port (empty for the default)</label>
+        <input type="number" id="sip_port" min="1" max="65535">
+
+        <label class="check"><input type="checkbox" id="use_tls" checked> Use TLS</label>
+
+        <label for="destination">Number to call (the gate)</label>
+        <input type="text" id="destination" placeholder="+972..." autocomplete="off" required>
+
+        <label for="outgoing_number">Caller ID (optional)</label>
+        <input type="text" id="outgoing_number" autocomplete="off">
+
+        <label for="call_token">Call token (empty to generate one)</label>
+        <input type="text" id="call_token" autocomplete="off">
+
+        <div class="buttons">
+            <button type="button" id="test">Test</button>
+            <button type="submit" id="save">Save</button>
+        </div>
+        <div id="result"></div>
+    </form>
+
+    <script>
+        const form = document.getElementById('setup');
+        const result = document.getElementById('result');
+        const buttons = [document.getElementById('test'), document.getElementById('save')];
+
+        function settings() {
+            const v = id => document.getElementById(id).value.trim();
+            return {
+                code: v('code'),
+                sip_user: v('sip_user'),
+                sip_pass: document.getElementById('sip_pass').value,
+                sip_domain: v('sip_domain'),
+                sip_port: parseInt(v('sip_port'), 10) || 0,
+                use_tls: document.getElementById('use_tls').checked,
+                destination: v('destination'),
+                outgoing_number: v('outgoing_number'),
+                call_token: v('call_token'),
+            };
+        }
+
+        function show(cls, text) {
+            result.className = cls;
+            result.textContent = text;
+        }
+
+        async function submit(path) {
+            if (!form.reportValidity()) return null;
+            buttons.forEach(b => b.disabled = true);
+            show('', path.endsWith('save') ? 'Testing and saving…' : 'Testing…');
+            try {
+                const res = await fetch(path, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify(settings()),
+                });
+                const body = await res.json();
+                if (!res.ok) {
+                    show('err', body.error + ' [' + body.code + ']');
+                    return null;
+                }
+                show('ok', body.message);
+                return body;
+            } catch (e) {
+                show('err', 'Request failed: ' + e);
+                return null;
+            } finally {
+                buttons.forEach(b => b.disabled = false);
+            }
+        }
+
+        document.getElementById('test').addEventListener('click', () => submit('/setup/test'));
+
+        // Direct dialing: pick a SIP device found on the LAN as the SIP domain.
+        const discover = document.getElementById('discover');
+        const devices = document.getElementById('devices');
+        discover.addEventListener('click', async () => {
+            discover.disabled = true;
+            devices.textContent = 'Looking for SIP devices…';
+            try {
+                const res = await fetch('/setup/discover', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ code: document.getElementById('code').value.trim() }),
+                });
+                const body = await res.json();
+                devices.textContent = '';
+                if (!res.ok) {
+                    devices.className = 'err';
+                    devices.textContent = body.error + ' [' + body.code + ']';
+                    return;
+                }
+                devices.className = '';
+                if (body.devices.length === 0) {
+                    devices.textContent = 'No SIP devices answered on this network.';
+                }
+                for (const d of body.devices) {
+                    const b = document.createElement('button');
+                    b.type = 'button';
+                    b.textContent = d.host + ':' + d.port + ' — ' + (d.name || d.agent || 'SIP device') + ' (' + d.via + ')';
+                    b.addEventListener('click', () => {
+                        document.getElementById('sip_domain').value = d.host;
+                        document.getElementById('sip_port').value = d.port;
+                        document.getElementById('use_tls').checked = false;
+                    });
+                    devices.appendChild(b);
+                }
+            } catch (e) {
+                devices.className = 'err';
+                devices.textContent = 'Request failed: ' + e;
+            } finally {
+                discover.disabled = false;
+            }
+        });
+
+        form.addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const body = await submit('/setup/save');
+            if (!body) return;
+            buttons.forEach(b => b.disabled = true);
+            result.innerHTML = '';
+            const lines = [
+                body.message,
+                'Written to: ' + body.config_file,
+                'Call token: ' + body.call_token,
+                'Admin token: ' + body.admin_token + ' (shown once — keep it safe)',
+            ];
+            lines.forEach(l => result.appendChild(document.createTextNode(l + '\n')));
+            const link = document.createElement('a');
+            link.href = '/ui?token=' + encodeURIComponent(body.call_token);
+            link.textContent = 'Open the gate UI';
+            result.appendChild(link);
+        });
+    </script>
+</body>
+</html>
+`
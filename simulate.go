@@ -0,0 +1,284 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/icholy/digest"
+)
+
+// SimulateProviderCmd runs a minimal SIP UAS that answers every INVITE with a scripted
+// response sequence, so the UI, WebSocket and call engine can be exercised end to end
+// without touching the real trunk or gate. Point the server at it with e.g.
+// --sip-domain=127.0.0.1 --sip-port=5070 --use-tls=false.
+type SimulateProviderCmd struct {
+	Listen    string        `kong:"help='Address to listen on',default='127.0.0.1:5070'"`
+	Transport string        `kong:"help='SIP transport',default='udp',enum='udp,tcp'"`
+	Sequence  string        `kong:"help='Comma-separated responses to each INVITE; a 401 challenges and the rest answers the authenticated INVITE',default='401,100,180,200'"`
+	Step      time.Duration `kong:"help='Delay between consecutive responses',default='300ms'"`
+	SipUser   string        `kong:"help='If set (with --sip-pass), digest credentials are verified'"`
+	SipPass   string        `kong:"help='Password checked against digest responses'"`
+	ByeAfter  time.Duration `kong:"help='Hang up answered calls with a BYE this long after the 200 OK (0 = leave that to the caller)',default='0'"`
+	Overload  int           `kong:"help='Answer the first N INVITEs with 503 and a Retry-After, as a provider shedding load does'"`
+	RetryIn   int           `kong:"help='Seconds the --overload 503s ask to wait in Retry-After',default='2'"`
+	ClockOff  time.Duration `kong:"help='Send a Date header this far from the real time on INVITE and REGISTER responses, as a provider sees a caller with a wrong clock (negative for behind)'"`
+	Stale     bool          `kong:"help='Challenge every authenticated INVITE again with stale=true, as providers with timestamped nonces do when the caller clock is off'"`
+	Redirect  string        `kong:"help='Number a 302 in --sequence moves the call to; INVITEs for it get the sequence without its 302s (unset: the number dialled, a redirect loop)'"`
+}
+
+// simulatedRingFor is how long an INVITE whose --sequence has no final response
+// rings, waiting for a CANCEL.
+const simulatedRingFor = 5 * time.Minute
+
+var simulatedReasons = map[int]string{
+	100: "Trying",
+	180: "Ringing",
+	183: "Session Progress",
+	200: "OK",
+	302: "Moved Temporarily",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	407: "Proxy Authentication Required",
+	480: "Temporarily Unavailable",
+	486: "Busy Here",
+	487: "Request Terminated",
+	500: "Server Internal Error",
+	503: "Service Unavailable",
+	603: "Decline",
+}
+
+// parseSequence turns "401,100,180,200" into status codes.
+func parseSequence(s string) ([]int, error) {
+	var codes []int
+	for _, part := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || code < 100 || code > 699 {
+			return nil, fmt.Errorf("invalid status code %q in sequence", part)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func (c *SimulateProviderCmd) Run() error {
+	codes, err := parseSequence(c.Sequence)
+	if err != nil {
+		return err
+	}
+	// Split at the challenge: the plain INVITE gets everything up to the 401,
+	// the authenticated retry gets the rest.
+	first, afterAuth := codes, []int(nil)
+	for i, code := range codes {
+		if code == 401 || code == 407 {
+			first, afterAuth = codes[:i+1], codes[i+1:]
+			break
+		}
+	}
+
+	ua, err := sipgo.NewUA(sipgo.WithUserAgent("Iftach-Simulator"))
+	if err != nil {
+		return err
+	}
+	defer ua.Close()
+	srv, err := sipgo.NewServer(ua)
+	if err != nil {
+		return err
+	}
+	client, err := sipgo.NewClient(ua)
+	if err != nil {
+		return err
+	}
+
+	chal := digest.Challenge{
+		Realm:     "iftach-simulator",
+		Nonce:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		Opaque:    "iftach",
+		Algorithm: "MD5",
+	}
+
+	var overloaded atomic.Int32
+	srv.OnInvite(func(req *sip.Request, tx sip.ServerTransaction) {
+		if int(overloaded.Add(1)) <= c.Overload {
+			fmt.Printf("🧪 INVITE %s (Call-ID %s) — 503, Retry-After %d\n", req.Recipient.User, req.CallID().Value(), c.RetryIn)
+			res := sip.NewResponseFromRequest(req, 503, "Service Unavailable", nil)
+			res.AppendHeader(sip.NewHeader("Retry-After", strconv.Itoa(c.RetryIn)))
+			_ = tx.Respond(res)
+			return
+		}
+		seq := first
+		if h := req.GetHeader("Authorization"); h != nil {
+			if c.Stale {
+				fmt.Println("🧪 Authenticated INVITE — 401 stale=true.")
+				stale := chal
+				stale.Stale = true
+				res := sip.NewResponseFromRequest(req, 401, "Unauthorized", nil)
+				res.AppendHeader(sip.NewHeader("WWW-Authenticate", stale.String()))
+				_ = tx.Respond(c.dated(res))
+				return
+			}
+			seq = afterAuth
+			if c.SipUser != "" && !c.checkCredentials(req, h.Value(), &chal) {
+				fmt.Println("🧪 INVITE with bad credentials — 403.")
+				_ = tx.Respond(sip.NewResponseFromRequest(req, 403, "Forbidden", nil))
+				return
+			}
+		}
+		fmt.Printf("🧪 INVITE %s (Call-ID %s) — replying %v\n", req.Recipient.User, req.CallID().Value(), seq)
+		// The transaction answers a CANCEL, and the INVITE with 487, by itself.
+		cancelled := make(chan struct{})
+		tx.OnCancel(func(*sip.Request) { close(cancelled) })
+		terminated := func() {
+			fmt.Printf("🧪 CANCEL (Call-ID %s) — 200 OK, INVITE → 487 Request Terminated\n", req.CallID().Value())
+		}
+		for i, code := range seq {
+			if code == 302 && c.Redirect != "" && req.Recipient.User == c.Redirect {
+				continue
+			}
+			if i > 0 {
+				select {
+				case <-cancelled:
+					terminated()
+					return
+				case <-time.After(c.Step):
+				}
+			}
+			var body []byte
+			if code == 200 {
+				body = simulatedSDP(c.Listen)
+			}
+			res := sip.NewResponseFromRequest(req, code, simulatedReasons[code], body)
+			if body != nil {
+				res.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+			}
+			if code == 401 {
+				res.AppendHeader(sip.NewHeader("WWW-Authenticate", chal.String()))
+			}
+			if code == 407 {
+				res.AppendHeader(sip.NewHeader("Proxy-Authenticate", chal.String()))
+			}
+			if code == 302 {
+				res.AppendHeader(sip.NewHeader("Contact", fmt.Sprintf("<sip:%s@%s>", cmp.Or(c.Redirect, req.Recipient.User), c.Listen)))
+			}
+			if err := tx.Respond(c.dated(res)); err != nil {
+				fmt.Printf("🧪 Respond %d failed: %v\n", code, err)
+				return
+			}
+			fmt.Printf("🧪 → %d %s\n", code, res.Reason)
+			if code == 200 && c.ByeAfter > 0 {
+				time.AfterFunc(c.ByeAfter, func() { c.hangup(client, req, res) })
+			}
+			if code >= 200 {
+				return
+			}
+		}
+		// A sequence without a final response rings until the caller cancels.
+		select {
+		case <-cancelled:
+			terminated()
+		case <-time.After(simulatedRingFor):
+		}
+	})
+	// REGISTER (the setup wizard's credential probe, --register) is always challenged once.
+	srv.OnRegister(func(req *sip.Request, tx sip.ServerTransaction) {
+		h := req.GetHeader("Authorization")
+		switch {
+		case h == nil:
+			res := sip.NewResponseFromRequest(req, 401, "Unauthorized", nil)
+			res.AppendHeader(sip.NewHeader("WWW-Authenticate", chal.String()))
+			_ = tx.Respond(c.dated(res))
+		case c.SipUser != "" && !c.checkCredentials(req, h.Value(), &chal):
+			fmt.Println("🧪 REGISTER with bad credentials — 403.")
+			_ = tx.Respond(c.dated(sip.NewResponseFromRequest(req, 403, "Forbidden", nil)))
+		default:
+			fmt.Println("🧪 REGISTER authenticated — 200 OK.")
+			_ = tx.Respond(c.dated(sip.NewResponseFromRequest(req, 200, "OK", nil)))
+		}
+	})
+	srv.OnInfo(func(req *sip.Request, tx sip.ServerTransaction) {
+		fmt.Printf("🧪 INFO (Call-ID %s): %q — 200 OK\n", req.CallID().Value(), strings.TrimSpace(string(req.Body())))
+		_ = tx.Respond(sip.NewResponseFromRequest(req, 200, "OK", nil))
+	})
+	srv.OnAck(func(req *sip.Request, tx sip.ServerTransaction) {
+		fmt.Printf("🧪 ACK (Call-ID %s)\n", req.CallID().Value())
+	})
+	srv.OnBye(func(req *sip.Request, tx sip.ServerTransaction) {
+		fmt.Printf("🧪 BYE (Call-ID %s) — 200 OK\n", req.CallID().Value())
+		_ = tx.Respond(sip.NewResponseFromRequest(req, 200, "OK", nil))
+	})
+	srv.OnCancel(func(req *sip.Request, tx sip.ServerTransaction) {
+		fmt.Printf("🧪 CANCEL (Call-ID %s) — 200 OK\n", req.CallID().Value())
+		_ = tx.Respond(sip.NewResponseFromRequest(req, 200, "OK", nil))
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("🧪 SIP provider simulator on %s/%s — INVITE sequence %s\n", c.Listen, c.Transport, c.Sequence)
+	if err := srv.ListenAndServe(ctx, c.Transport, c.Listen); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// dated adds the Date header of --clock-off to res.
+func (c *SimulateProviderCmd) dated(res *sip.Response) *sip.Response {
+	if c.ClockOff != 0 {
+		res.AppendHeader(sip.NewHeader("Date", time.Now().Add(c.ClockOff).UTC().Format(http.TimeFormat)))
+	}
+	return res
+}
+
+// hangup sends the BYE of --bye-after, back to where the INVITE came from (as a
+// provider does for a caller behind NAT).
+func (c *SimulateProviderCmd) hangup(client *sipgo.Client, invite *sip.Request, res *sip.Response) {
+	bye := sip.NewRequest(sip.BYE, invite.Contact().Address)
+	bye.AppendHeader(&sip.FromHeader{Address: res.To().Address, Params: res.To().Params})
+	bye.AppendHeader(&sip.ToHeader{Address: invite.From().Address, Params: invite.From().Params})
+	bye.AppendHeader(sip.HeaderClone(invite.CallID()))
+	bye.AppendHeader(&sip.CSeqHeader{SeqNo: 1, MethodName: sip.BYE})
+	bye.SetDestination(invite.Source())
+	bye.SetTransport(invite.Transport())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := client.Do(ctx, bye)
+	if err != nil {
+		fmt.Printf("🧪 BYE (Call-ID %s) failed: %v\n", invite.CallID().Value(), err)
+		return
+	}
+	fmt.Printf("🧪 Hung up (Call-ID %s) — %d %s\n", invite.CallID().Value(), res.StatusCode, res.Reason)
+}
+
+func (c *SimulateProviderCmd) checkCredentials(req *sip.Request, header string, chal *digest.Challenge) bool {
+	cred, err := digest.ParseCredentials(header)
+	if err != nil || cred.Username != c.SipUser {
+		return false
+	}
+	want, err := digest.Digest(chal, digest.Options{
+		Method:   string(req.Method),
+		URI:      cred.URI,
+		Username: c.SipUser,
+		Password: c.SipPass,
+	})
+	return err == nil && want.Response == cred.Response
+}
+
+// simulatedSDP is the 200 OK's SDP: the answer to an INVITE's offer, or the offer
+// itself for one without (as third party call control sends, see ringme.go). Its
+// media port takes nothing; only the signalling is simulated.
+func simulatedSDP(listen string) []byte {
+	host, _, _ := net.SplitHostPort(listen)
+	id := time.Now().Unix()
+	return []byte(fmt.Sprintf("v=0\r\no=iftach-sim %d %d IN IP4 %s\r\ns=-\r\nc=IN IP4 %s\r\nt=0 0\r\nm=audio 40000 RTP/AVP 0 8 101\r\na=rtpmap:101 telephone-event/8000\r\na=sendrecv\r\n", id, id, host, host))
+}
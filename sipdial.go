@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// Provider edge racing: with several edges to choose from, each gets an OPTIONS
+// probe, started sipRaceStagger apart (happy-eyeballs style), and the INVITE goes
+// to whichever answers first; the other probes are cancelled. The INVITE itself
+// is never raced: a gate answers straight away, so two INVITEs could open it twice.
+const (
+	sipRaceStagger = 250 * time.Millisecond
+	sipRaceTimeout = 3 * time.Second
+)
+
+// lookupSIPTargets returns the provider edges worth racing, as host:port:
+// --sip-proxies, else the domain's SRV records (only with --sip-port unset, as RFC
+// 3263 has it), else its A/AAAA addresses (not with TLS, whose certificate names
+// the host rather than an address). Fewer than two means there is nothing to race;
+// sipTargets is the same from --dns-cache.
+func (c *Config) lookupSIPTargets(ctx context.Context) []string {
+	port := fmt.Sprint(c.sipPort())
+	if len(c.SipProxies) > 0 {
+		var targets []string
+		for _, p := range c.SipProxies {
+			if _, _, err := net.SplitHostPort(p); err != nil {
+				p = net.JoinHostPort(p, port)
+			}
+			targets = append(targets, p)
+		}
+		return targets
+	}
+	if net.ParseIP(c.SipDomain) != nil {
+		return nil
+	}
+	var resolver net.Resolver
+	if c.SipPort == 0 {
+		service, proto := "sip", c.sipTransport()
+		if proto == "tls" {
+			service, proto = "sips", "tcp"
+		}
+		if _, srvs, err := resolver.LookupSRV(ctx, service, proto, c.SipDomain); err == nil && len(srvs) > 0 {
+			var targets []string
+			for _, s := range srvs {
+				targets = append(targets, net.JoinHostPort(strings.TrimSuffix(s.Target, "."), fmt.Sprint(s.Port)))
+			}
+			return targets
+		}
+	}
+	if c.sipTransport() == "tls" {
+		return nil
+	}
+	addrs, err := resolver.LookupHost(ctx, c.SipDomain)
+	if err != nil {
+		return nil
+	}
+	var targets []string
+	for _, a := range addrs {
+		targets = append(targets, net.JoinHostPort(a, port))
+	}
+	return targets
+}
+
+// raceSIPTargets probes targets and returns the first to answer, or "" if none
+// did within sipRaceTimeout (the INVITE then goes wherever sipgo resolves uri to).
+func raceSIPTargets(ctx context.Context, client *sipgo.Client, uri sip.Uri, targets []string) (string, time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, sipRaceTimeout)
+	defer cancel() // the losers
+	start := time.Now()
+	won := make(chan string, len(targets))
+	for i, target := range targets {
+		go func() {
+			select {
+			case <-time.After(time.Duration(i) * sipRaceStagger):
+			case <-ctx.Done():
+				return
+			}
+			probe := sip.NewRequest(sip.OPTIONS, uri)
+			probe.SetDestination(target)
+			// Any answer will do, even 401 or 405: the edge is up.
+			if _, err := client.Do(ctx, probe); err == nil {
+				won <- target
+			}
+		}()
+	}
+	select {
+	case target := <-won:
+		return target, time.Since(start)
+	case <-ctx.Done():
+		return "", time.Since(start)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"fmt"
+	"maps"
+	"math/big"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// sipTemplateData is what --sip-headers, --from-user and --outgoing-number can
+// use as Go templates, rendered per call, e.g. "{{.Gate}}-{{rand 4}}" or
+// "{{.Time.Format \"0601\"}}". Values without {{ are used as they are.
+type sipTemplateData struct {
+	Gate        string    // gate being opened (default for --destination)
+	User        string    // the named call token placing the call, "" for --call-token
+	Account     string    // --sip-user
+	Destination string    // the number dialled
+	Time        time.Time // call start, in --timezone
+}
+
+// sipTemplateFuncs: rand N is N random digits (1-32), for providers that want a
+// unique routing or tracking prefix per call.
+var sipTemplateFuncs = template.FuncMap{"rand": randDigits}
+
+func randDigits(n int) (string, error) {
+	if n < 1 || n > 32 {
+		return "", fmt.Errorf("rand %d: want 1-32 digits", n)
+	}
+	b := make([]byte, n)
+	for i := range b {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b[i] = byte('0' + d.Int64())
+	}
+	return string(b), nil
+}
+
+// reservedHeaders are built by the call engine itself, so --sip-headers can't
+// replace them (the From user has --from-user).
+var reservedHeaders = map[string]bool{
+	"via": true, "from": true, "to": true, "call-id": true, "cseq": true, "contact": true,
+	"max-forwards": true, "content-length": true, "content-type": true,
+	"authorization": true, "proxy-authorization": true, "p-asserted-identity": true,
+}
+
+// sipHeaderName is an RFC 3261 token.
+var sipHeaderName = regexp.MustCompile("^[A-Za-z0-9!%'*+._`~-]+$")
+
+func renderSIPTemplate(text string, data sipTemplateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := template.New("").Funcs(sipTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(b.String(), "\r\n") {
+		return "", fmt.Errorf("%q renders a line break", text)
+	}
+	return b.String(), nil
+}
+
+// sipHeaders is one call's rendered From user, P-Asserted-Identity and extra
+// headers.
+type sipHeaders struct {
+	FromUser string
+	PAI      string // empty = no P-Asserted-Identity
+	Extra    []sip.Header
+}
+
+// diversionCauses are the History-Info causes (RFC 4458) of the --diversion-reason
+// values.
+var diversionCauses = map[string]int{
+	"unconditional": 302,
+	"user-busy":     486,
+	"no-answer":     408,
+	"unavailable":   503,
+	"deflection":    480,
+	"unknown":       404,
+}
+
+// telNumber is a global tel: URI number (RFC 3966), the only kind that means the
+// same to every trunk.
+var telNumber = regexp.MustCompile(`^\+[0-9]{3,15}$`)
+
+// sipIdentity makes value — a number, or a sip:, sips: or tel: URI, optionally in
+// <> — the <URI> of an identity header such as P-Asserted-Identity. A number
+// becomes sip:NUMBER@domain.
+func sipIdentity(value, domain string) (string, error) {
+	uri := strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+	switch lower := strings.ToLower(uri); {
+	case strings.HasPrefix(lower, "tel:"):
+		if !telNumber.MatchString(uri[len("tel:"):]) {
+			return "", fmt.Errorf("%q is not a tel: URI of a +number", value)
+		}
+	case strings.HasPrefix(lower, "sip:"), strings.HasPrefix(lower, "sips:"):
+		var u sip.Uri
+		if err := sip.ParseUri(uri, &u); err != nil || u.User == "" || u.Host == "" || strings.ContainsAny(uri, " <>") {
+			return "", fmt.Errorf("%q is not a sip: URI with a user and a host", value)
+		}
+	case dialableNumber.MatchString(uri):
+		uri = "sip:" + uri + "@" + domain
+	default:
+		return "", fmt.Errorf("%q is neither a dialable number nor a sip:, sips: or tel: URI", value)
+	}
+	return "<" + uri + ">", nil
+}
+
+func (c *Config) renderSIPHeaders(data sipTemplateData) (sipHeaders, error) {
+	var h sipHeaders
+	var err error
+	if h.FromUser, err = renderSIPTemplate(cmp.Or(c.FromUser, c.SipUser), data); err != nil {
+		return h, fmt.Errorf("--from-user: %w", err)
+	}
+	if h.PAI, err = c.renderIdentity(c.OutgoingNumber, data); err != nil {
+		return h, fmt.Errorf("--outgoing-number: %w", err)
+	}
+	if c.Diversion != "" {
+		from, err := c.renderIdentity(c.Diversion, data)
+		if err != nil {
+			return h, fmt.Errorf("--diversion: %w", err)
+		}
+		h.Extra = append(h.Extra, sip.NewHeader("Diversion", fmt.Sprintf("%s;reason=%s;counter=1", from, c.diversionReason())))
+	}
+	if c.HistoryInfo != "" {
+		target, err := c.renderIdentity(c.HistoryInfo, data)
+		if err != nil {
+			return h, fmt.Errorf("--history-info: %w", err)
+		}
+		h.Extra = append(h.Extra, sip.NewHeader("History-Info", fmt.Sprintf("%s;index=1,<sip:%s@%s;cause=%d>;index=1.1;mp=1",
+			target, data.Destination, c.SipDomain, diversionCauses[c.diversionReason()])))
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.SipHeaders)) {
+		v, err := renderSIPTemplate(c.SipHeaders[name], data)
+		if err != nil {
+			return h, fmt.Errorf("--sip-headers %s: %w", name, err)
+		}
+		h.Extra = append(h.Extra, sip.NewHeader(name, v))
+	}
+	return h, nil
+}
+
+// renderIdentity renders an identity template and makes it a URI (see
+// sipIdentity); "" stays "".
+func (c *Config) renderIdentity(text string, data sipTemplateData) (string, error) {
+	v, err := renderSIPTemplate(text, data)
+	if err != nil || v == "" {
+		return v, err
+	}
+	return sipIdentity(v, c.SipDomain)
+}
+
+// diversionReason is --diversion-reason, which is unset (and so empty) in
+// configs not parsed by kong.
+func (c *Config) diversionReason() string {
+	return cmp.Or(c.DiversionReason, "unconditional")
+}
+
+// sipRequestHeadroom is what the client still adds to a request we built: its Via,
+// and the Authorization of the digest retry most providers ask for.
+const sipRequestHeadroom = 400
+
+var sipOverTCP = newCounter("iftach_sip_tcp_fallbacks_total", "INVITEs sent over TCP because they were over --sip-udp-max.")
+
+// sipRequestSize estimates req's size on the wire once sent.
+func sipRequestSize(req *sip.Request) int {
+	return len(req.String()) + sipRequestHeadroom
+}
+
+// checkSIPHeaders reports template and header problems for check(), rendering
+// once with sample data so mistakes surface at startup rather than on a call.
+func (c *Config) checkSIPHeaders() []string {
+	var problems []string
+	for name := range c.SipHeaders {
+		if !sipHeaderName.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("--sip-headers name %q is not a valid SIP header name", name))
+		} else if reservedHeaders[strings.ToLower(name)] {
+			problems = append(problems, fmt.Sprintf("--sip-headers may not set %s (built by the call itself)", name))
+		}
+		if lower := strings.ToLower(name); lower == "diversion" && c.Diversion != "" || lower == "history-info" && c.HistoryInfo != "" {
+			problems = append(problems, fmt.Sprintf("--sip-headers sets %s, which --%s builds too", name, lower))
+		}
+	}
+	h, err := c.renderSIPHeaders(sipTemplateData{Gate: defaultGate, Account: c.SipUser, Destination: c.Destination, Time: time.Now()})
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if h.FromUser != "" && strings.ContainsAny(h.FromUser, " <>@;:") {
+		problems = append(problems, fmt.Sprintf("--from-user renders %q, which is not a SIP user", h.FromUser))
+	}
+	for gate, text := range c.GateOutgoing {
+		number, ok := c.gateNumber(gate)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("--gate-outgoing gate %q is not configured", gate))
+			continue
+		}
+		if _, err := c.renderIdentity(text, sipTemplateData{Gate: gate, Account: c.SipUser, Destination: number, Time: time.Now()}); err != nil {
+			problems = append(problems, fmt.Sprintf("--gate-outgoing %s: %v", gate, err))
+		}
+	}
+	return problems
+}
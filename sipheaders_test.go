@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// TestTemplateUser places a call with a named token and with --call-token against a
+// UAS on loopback, and checks what {{.User}} and {{.Account}} rendered to in the
+// INVITE.
+func TestTemplateUser(t *testing.T) {
+	cfg, invites := loopbackUAS(t, 486)
+	cfg.SipHeaders = map[string]string{"X-Caller": "{{with .User}}{{.}}{{else}}owner{{end}}@{{.Gate}}"}
+	cfg.FromUser = "{{.Account}}"
+
+	tests := []struct {
+		name string
+		opts callOptions
+		want string
+	}{
+		{"named token", callOptions{User: "guest", Gate: "outer"}, "guest@outer"},
+		{"call token", callOptions{}, "owner@" + defaultGate},
+	}
+	for _, tt := range tests {
+		dial(t, cfg, tt.opts)
+		var req *sip.Request
+		select {
+		case req = <-invites:
+		default:
+			t.Fatalf("%s: no INVITE arrived", tt.name)
+		}
+		if h := req.GetHeader("X-Caller"); h == nil || h.Value() != tt.want {
+			t.Errorf("%s: X-Caller = %v, want %s", tt.name, h, tt.want)
+		}
+		if from := req.From(); from == nil || from.Address.User != "acct" {
+			t.Errorf("%s: From = %v, want the SIP account acct", tt.name, from)
+		}
+	}
+}
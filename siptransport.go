@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// --sip-transport picks what SIP goes to the provider over: udp (cleartext,
+// credentials digested but signalling readable), tcp, or tls; unset, it follows the
+// older --use-tls. Over TLS the provider's certificate is verified against the
+// system roots, or --sip-tls-ca, and must name --sip-domain (--sip-tls-insecure
+// skips that, for a test PBX with a self-signed certificate); --sips also asks for
+// TLS on every hop past the provider by addressing it with sips: URIs (RFC 3261
+// 26.2), which some providers refuse.
+
+// sipTransport is the transport of --sip-transport, or --use-tls: udp, tcp or tls.
+func (c *Config) sipTransport() string {
+	switch {
+	case c.SipTransport != "":
+		return c.SipTransport
+	case c.UseTls:
+		return "tls"
+	default:
+		return "udp"
+	}
+}
+
+// sipScheme is the scheme of the provider URIs: sips with --sips, sip otherwise.
+func (c *Config) sipScheme() string {
+	if c.Sips {
+		return "sips"
+	}
+	return "sip"
+}
+
+// sipURI is the provider's URI for user (none if ""), on --sip-port and with the
+// transport parameter of --sip-transport (none for udp, the default).
+func (c *Config) sipURI(user string) sip.Uri {
+	uri := sip.Uri{Scheme: c.sipScheme(), User: user, Host: c.SipDomain, Port: c.sipPort(), UriParams: sip.NewParams()}
+	if t := c.sipTransport(); t != "udp" {
+		uri.UriParams.Add("transport", t)
+	}
+	return uri
+}
+
+// sipContact is our Contact URI for user at host, telling the provider which
+// transport to reach us back on.
+func (c *Config) sipContact(user, host string) sip.Uri {
+	uri := sip.Uri{Scheme: c.sipScheme(), User: user, Host: host, UriParams: sip.NewParams()}
+	if t := c.sipTransport(); t != "udp" {
+		uri.UriParams.Add("transport", t)
+	}
+	return uri
+}
+
+// sipTLSConfig is the TLS configuration the provider's certificate is verified
+// with; nil for the defaults (the system roots).
+func (c *Config) sipTLSConfig() (*tls.Config, error) {
+	if c.SipTlsCa == "" && !c.SipTlsInsecure {
+		return nil, nil
+	}
+	conf := &tls.Config{ServerName: c.SipDomain, InsecureSkipVerify: c.SipTlsInsecure}
+	if c.SipTlsCa != "" {
+		pem, err := os.ReadFile(c.SipTlsCa)
+		if err != nil {
+			return nil, fmt.Errorf("--sip-tls-ca: %w", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("--sip-tls-ca: no PEM certificates in %s", c.SipTlsCa)
+		}
+	}
+	return conf, nil
+}
+
+// newSIPUA is a user agent for talking to the provider, with --sip-tls-ca and
+// --sip-tls-insecure applied.
+func newSIPUA(cfg *Config) (*sipgo.UserAgent, error) {
+	opts := []sipgo.UserAgentOption{sipgo.WithUserAgentHostname(cfg.SipDomain)}
+	conf, err := cfg.sipTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil {
+		opts = append(opts, sipgo.WithUserAgenTLSConfig(conf))
+	}
+	return sipgo.NewUA(opts...)
+}
+
+func transportName(cfg *Config) string {
+	return strings.ToUpper(cfg.sipTransport())
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// With --sip-reuse the server keeps one SIP user agent and client for its calls instead of a new one
+// per call: a call then starts with a socket (and, over TLS, a connection) that is
+// already open, rather than paying for a handshake first. While the server is
+// active an OPTIONS goes to the provider every --sip-keepalive, keeping the NAT
+// binding and the connection alive between calls. A keepalive that gets no answer,
+// an INVITE that can't be sent and one without 100 Trying all drop the client,
+// and the next call (or keepalive) builds a new one.
+//
+// Bridged calls (ring-me, intercom) still have a user agent of their own, as they
+// answer the far end's BYE on it; so does the one-shot call command.
+
+const minSIPKeepalive = 5 * time.Second
+
+var (
+	sipClientsBuilt = newCounter("iftach_sip_clients_built_total", "Shared SIP clients built, by reason (first, failed).")
+	sipKeepalives   = newCounter("iftach_sip_keepalives_total", "--sip-keepalive OPTIONS sent, by result (ok, failed).")
+)
+
+// caller is the shared client, nil outside serve or without --sip-reuse.
+var caller *sipCaller
+
+type sipCaller struct {
+	cfg   *Config
+	every time.Duration
+
+	mu     sync.Mutex
+	ua     *sipgo.UserAgent
+	client *sipgo.Client
+	failed bool // the previous client was dropped for failing
+	silent bool // the provider didn't answer the last keepalive (logged once)
+	cancel context.CancelFunc
+}
+
+// callerSubsystem runs the shared client and its keepalives.
+func callerSubsystem() subsystem {
+	return subsystem{
+		name: "caller",
+		start: func(context.Context) error {
+			caller = &sipCaller{cfg: &cli, every: cli.SipKeepalive}
+			idle.Register("caller", caller.start, caller.stop)
+			return nil
+		},
+		stop: func(context.Context) error {
+			caller.stop()
+			caller.drop(nil)
+			return nil
+		},
+	}
+}
+
+// sipClientFor returns the client a call sends its requests with, and what to call
+// once the call is over, saying whether the client let it down: the shared one
+// in serve, one of the call's own otherwise (and for --backup-sip-domain, which
+// the shared one isn't set up for).
+func sipClientFor(cfg *Config) (*sipgo.Client, func(failed bool), error) {
+	if caller != nil && cfg.SipDomain == caller.cfg.SipDomain {
+		client, err := caller.get()
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func(failed bool) {
+			if failed {
+				caller.drop(client)
+			}
+		}, nil
+	}
+	// The library will automatically load TLS transport if we dial a TLS destination.
+	ua, err := newSIPUA(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SIP user agent: %w", err)
+	}
+	client, err := sipgo.NewClient(ua)
+	if err != nil {
+		ua.Close()
+		return nil, nil, fmt.Errorf("SIP client: %w", err)
+	}
+	sipUAsOpen.add(1)
+	return client, func(bool) {
+		ua.Close()
+		sipUAsOpen.add(-1)
+	}, nil
+}
+
+// get returns the shared client, building it first if there is none.
+func (c *sipCaller) get() (*sipgo.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		return c.client, nil
+	}
+	ua, err := newSIPUA(c.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("SIP user agent: %w", err)
+	}
+	client, err := sipgo.NewClient(ua)
+	if err != nil {
+		ua.Close()
+		return nil, fmt.Errorf("SIP client: %w", err)
+	}
+	reason := "first"
+	if c.failed {
+		reason = "failed"
+	}
+	sipClientsBuilt.inc("reason", reason)
+	c.ua, c.client, c.failed = ua, client, false
+	return client, nil
+}
+
+// drop closes the shared client if it is still client (any client if nil), so the
+// next call builds a new one.
+func (c *sipCaller) drop(client *sipgo.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil || (client != nil && client != c.client) {
+		return
+	}
+	c.failed = client != nil
+	c.ua.Close()
+	c.ua, c.client = nil, nil
+}
+
+// start begins the keepalives. It doesn't block (see backgroundService).
+func (c *sipCaller) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil || c.every == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.loop(ctx)
+}
+
+func (c *sipCaller) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+}
+
+func (c *sipCaller) loop(ctx context.Context) {
+	for {
+		c.keepalive(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.every):
+		}
+	}
+}
+
+// keepalive sends the provider an OPTIONS on the shared client. Any answer, even
+// 401 or 405, will do.
+func (c *sipCaller) keepalive(ctx context.Context) {
+	client, err := c.get()
+	if err != nil {
+		logWarn("SIP keepalive: %v\n", err)
+		return
+	}
+	uri := c.cfg.sipURI("")
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := client.Do(ctx, sip.NewRequest(sip.OPTIONS, uri)); err != nil {
+		if ctx.Err() != nil && ctx.Err() != context.DeadlineExceeded {
+			return // stopping
+		}
+		sipKeepalives.inc("result", "failed")
+		if !c.silent {
+			logWarn("SIP keepalive to %s got no answer, rebuilding the SIP client: %v\n", c.cfg.SipDomain, err)
+		}
+		c.silent = true
+		c.drop(client)
+		return
+	}
+	sipKeepalives.inc("result", "ok")
+	if c.silent {
+		logInfo("SIP keepalive to %s answered again\n", c.cfg.SipDomain)
+	}
+	c.silent = false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// --stun-servers are asked for our public address (RFC 5389 Binding requests) next
+// to the HTTP endpoints, their answers counting towards lookupPublicIP's quorum
+// like any other. STUN sees the address a UDP packet really leaves from, through
+// the same NAT the SIP traffic goes through, rather than what an HTTP service
+// behind a proxy happens to see. Every server is asked from one socket, so they
+// also tell us the public port it was mapped to: servers seeing different ports
+// mean a symmetric NAT, which is logged, as the provider will see yet another one.
+
+const (
+	stunMagicCookie = 0x2112a442
+	stunBindRequest = 0x0001
+	stunBindSuccess = 0x0101
+	stunRetransmit  = 500 * time.Millisecond
+	stunTimeout     = 3 * time.Second
+)
+
+// STUN attributes read from a Binding response.
+const (
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+)
+
+// stunQuery sends a Binding request to every server from one UDP socket and sends
+// exactly one answer per server to answers: its mapped address, or why there is none.
+func stunQuery(ctx context.Context, servers []string, answers chan<- ipAnswer) {
+	pending := map[[12]byte]ipAnswer{} // by transaction ID
+	fail := func(err error) {
+		for _, a := range pending {
+			a.err = err
+			answers <- a
+		}
+		clear(pending)
+	}
+	targets := map[[12]byte]*net.UDPAddr{}
+	for _, server := range servers {
+		a := ipAnswer{url: "stun:" + server}
+		addr, err := net.ResolveUDPAddr("udp4", server)
+		if err != nil {
+			a.err = err
+			answers <- a
+			continue
+		}
+		var id [12]byte
+		_, _ = rand.Read(id[:])
+		pending[id], targets[id] = a, addr
+	}
+	if len(pending) == 0 {
+		return
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(stunTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	ports := map[uint16]bool{} // the mapped ports seen
+	buf := make([]byte, 1500)
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		for id := range pending { // (again) to those that haven't answered
+			_, _ = conn.WriteToUDP(stunRequest(id), targets[id])
+		}
+		wait := time.Now().Add(stunRetransmit)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		_ = conn.SetReadDeadline(wait)
+		for len(pending) > 0 {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			id, addr, ok := parseSTUNResponse(buf[:n])
+			a, mine := pending[id]
+			if !mine {
+				continue
+			}
+			delete(pending, id)
+			if !ok {
+				a.err = errors.New("no mapped address in the response")
+			} else {
+				a.ip, a.port = addr.Addr().Unmap(), addr.Port()
+				if len(ports) > 0 && !ports[a.port] {
+					callLog(ctx).Warnf("   %s mapped us to port %d, other STUN servers to another: a symmetric NAT, which picks a new port for every destination\n", a.url, a.port)
+				}
+				ports[a.port] = true
+			}
+			answers <- a
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	fail(fmt.Errorf("no answer within %v", stunTimeout))
+}
+
+// stunRequest encodes a Binding request with transaction ID id.
+func stunRequest(id [12]byte) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, stunBindRequest)
+	msg = binary.BigEndian.AppendUint16(msg, 0) // no attributes
+	msg = binary.BigEndian.AppendUint32(msg, stunMagicCookie)
+	return append(msg, id[:]...)
+}
+
+// parseSTUNResponse returns a Binding success response's transaction ID and the
+// address it maps us to, XOR-MAPPED-ADDRESS preferred over the older
+// MAPPED-ADDRESS. ok is false for anything else.
+func parseSTUNResponse(msg []byte) (id [12]byte, addr netip.AddrPort, ok bool) {
+	if len(msg) < 20 || binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie {
+		return id, addr, false
+	}
+	copy(id[:], msg[8:20])
+	if binary.BigEndian.Uint16(msg) != stunBindSuccess {
+		return id, addr, false
+	}
+	end := min(20+int(binary.BigEndian.Uint16(msg[2:])), len(msg))
+	var mapped netip.AddrPort
+	for off := 20; off+4 <= end; {
+		typ, n := binary.BigEndian.Uint16(msg[off:]), int(binary.BigEndian.Uint16(msg[off+2:]))
+		val := msg[off+4 : min(off+4+n, end)]
+		off += 4 + (n+3)&^3 // attributes are padded to 4 bytes
+		if len(val) < 8 {
+			continue
+		}
+		switch typ {
+		case stunAttrXorMappedAddress:
+			port := binary.BigEndian.Uint16(val[2:]) ^ stunMagicCookie>>16
+			ip := append([]byte(nil), val[4:]...)
+			key := msg[4:20] // the cookie, then the transaction ID for IPv6
+			for i := range ip {
+				ip[i] ^= key[i%len(key)]
+			}
+			if a, good := netip.AddrFromSlice(ip); good && (len(ip) == 4 || len(ip) == 16) {
+				return id, netip.AddrPortFrom(a, port), true
+			}
+		case stunAttrMappedAddress:
+			if a, good := netip.AddrFromSlice(val[4:]); good {
+				mapped = netip.AddrPortFrom(a, binary.BigEndian.Uint16(val[2:]))
+			}
+		}
+	}
+	return id, mapped, mapped.IsValid()
+}
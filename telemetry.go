@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Telemetry is off unless --telemetry-url is set, and then sends once a day what
+// GET /api/admin/telemetry shows: the version, the platform, the SIP provider
+// preset and how many calls were placed, as a band. Nothing identifies the site,
+// its numbers or its users; the instance ID is random, kept in --data-dir only so
+// that reports from one installation can be told apart from ten, and made anew
+// without one. The collector may be anyone's, e.g. a self-hosted one.
+
+const (
+	telemetryFirst = 10 * time.Minute // after startup, so restart loops don't report
+	telemetryEvery = 24 * time.Hour
+)
+
+// telemetryReport is the whole payload; schema is bumped when a field changes.
+type telemetryReport struct {
+	Schema   int    `json:"schema"`
+	Instance string `json:"instance"`
+	Version  string `json:"version"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	Go       string `json:"go"`
+	Provider string `json:"provider"`     // --provider preset, or custom
+	Calls    string `json:"calls"`        // calls since the last report, as a band: 0, 1-9, 10-99, 100-999 or 1000+
+	Period   string `json:"period"`       // how long that was
+	At       string `json:"at,omitempty"` // UTC date of the report, no time of day
+}
+
+// telemetry is the --telemetry-url reporter, nil without one.
+var telemetry *telemetryReporter
+
+type telemetryReporter struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	instance string
+	since    time.Time // of the current period
+	base     float64   // callsTotal at since
+	lastSent time.Time
+	lastErr  string
+}
+
+// telemetrySubsystem sends --telemetry-url reports.
+func telemetrySubsystem() subsystem {
+	return subsystem{
+		name:  "telemetry",
+		after: []string{"store"},
+		start: func(ctx context.Context) error {
+			t := &telemetryReporter{url: cli.TelemetryURL, client: &http.Client{Timeout: 10 * time.Second}, since: time.Now(), base: callsTotal.total()}
+			var saved struct {
+				Instance string `json:"instance"`
+			}
+			path := dataPath("telemetry.json")
+			if path != "" {
+				if err := loadJSON(path, &saved); err != nil {
+					return err
+				}
+			}
+			if t.instance = saved.Instance; t.instance == "" {
+				t.instance = newSessionID()
+				saved.Instance = t.instance
+				if path != "" {
+					if err := saveJSON(path, saved); err != nil {
+						return err
+					}
+				}
+			}
+			telemetry = t
+			logInfo("Anonymous usage reports go to %s once a day (see GET /api/admin/telemetry)\n", t.url)
+			go t.run(ctx)
+			return nil
+		},
+	}
+}
+
+func (t *telemetryReporter) run(ctx context.Context) {
+	timer := time.NewTimer(telemetryFirst)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		t.send()
+		timer.Reset(telemetryEvery)
+	}
+}
+
+// report is what would be sent now.
+func (t *telemetryReporter) report() telemetryReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return telemetryReport{
+		Schema:   1,
+		Instance: t.instance,
+		Version:  uiVersion,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Go:       runtime.Version(),
+		Provider: cmp.Or(cli.Provider, "custom"),
+		Calls:    callBand(callsTotal.total() - t.base),
+		Period:   time.Since(t.since).Round(time.Minute).String(),
+		At:       time.Now().UTC().Format(time.DateOnly),
+	}
+}
+
+// send POSTs a report and starts the next period. A report that can't be
+// delivered is dropped; the next one covers its calls too.
+func (t *telemetryReporter) send() {
+	rep := t.report()
+	body, _ := json.Marshal(rep)
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.lastErr = err.Error()
+		logWarn("Usage report could not be sent: %v\n", err)
+		return
+	}
+	t.since, t.base, t.lastSent, t.lastErr = time.Now(), callsTotal.total(), time.Now().UTC(), ""
+	logInfo("Usage report sent (%s calls in %s)\n", rep.Calls, rep.Period)
+}
+
+// callBand makes a call count anonymous enough to send.
+func callBand(n float64) string {
+	switch {
+	case n < 1:
+		return "0"
+	case n < 10:
+		return "1-9"
+	case n < 100:
+		return "10-99"
+	case n < 1000:
+		return "100-999"
+	}
+	return "1000+"
+}
+
+// handleTelemetry is GET /api/admin/telemetry: whether usage reports are on, and
+// the exact payload the next one would carry.
+func handleTelemetry(w http.ResponseWriter, r *http.Request) {
+	type status struct {
+		Enabled  bool             `json:"enabled"`
+		URL      string           `json:"url,omitempty"`
+		LastSent time.Time        `json:"last_sent,omitzero"`
+		LastErr  string           `json:"last_error,omitempty"`
+		Next     *telemetryReport `json:"next,omitempty"`
+	}
+	t := telemetry
+	if t == nil {
+		writeJSON(w, http.StatusOK, status{})
+		return
+	}
+	next := t.report()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	writeJSON(w, http.StatusOK, status{Enabled: true, URL: t.url, LastSent: t.lastSent, LastErr: t.lastErr, Next: &next})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+	_ "time/tzdata" // Alpine/router images usually ship without zoneinfo
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// displayLoc is the timezone used when presenting timestamps (logs, API, UI).
+// Timestamps are always kept in UTC internally and only converted at those boundaries.
+var displayLoc = time.UTC
+
+// setTimezone loads the IANA timezone name (e.g. "Asia/Jerusalem", "UTC", "Local")
+// and makes it the display timezone.
+func setTimezone(name string) error {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("timezone %q: %w", name, err)
+	}
+	displayLoc = loc
+	return nil
+}
+
+// displayTime converts a stored (UTC) timestamp to the configured display timezone.
+func displayTime(t time.Time) time.Time {
+	return t.In(displayLoc)
+}
+
+// tzLogWriter prefixes every line written through it with a timestamp in displayLoc,
+// replacing the log package's own (process-local) timestamps.
+type tzLogWriter struct {
+	w io.Writer
+}
+
+func (t tzLogWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	buf.WriteString(displayTime(time.Now()).Format("2006/01/02 15:04:05 MST "))
+	buf.Write(p)
+	if _, err := t.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// requestLogger is chi's request logger with timestamps in the display timezone,
+// logging nothing above --log-level info.
+func requestLogger() func(http.Handler) http.Handler {
+	if logLevel.Level() > slog.LevelInfo {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	fi, err := os.Stdout.Stat()
+	isTTY := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	return middleware.RequestLogger(&middleware.DefaultLogFormatter{
+		Logger:  log.New(tzLogWriter{w: os.Stdout}, "", 0),
+		NoColor: !isTTY,
+	})
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Besides the one --call-token, admins can hand out named call tokens: one per
+// family member, a guest's that expires on Sunday, a courier's that opens only the
+// outer gate. Anywhere the call token is accepted, a named token that hasn't
+// expired is too, for the gates it allows. Tokens are kept in tokens.json in
+// --data-dir (in memory only without one) as SHA-256 hashes: the token itself is
+// shown once, when it is created, and a lost one is replaced, not recovered.
+//
+// A token may be valid only for a window, e.g. a guest link for the plumber that
+// works today between 9 and 17: outside it, requests fail with E_TOKEN_EXPIRED
+// (WebSocket close 4005) rather than E_AUTH, so the UI can tell the guest why.
+//
+// A one-time token opens a gate once, e.g. for a delivery: the call it places
+// reserves it (a second one meanwhile is refused), and an answered call uses it
+// up, after which it fails with E_TOKEN_USED (close 4005 too); a call that isn't
+// answered frees it for another try. Dry runs don't count, and one-time tokens
+// can't run batches or macros, which open more than once.
+//
+// A token that is no longer wanted is revoked, which forgets it, or deactivated,
+// which keeps its record (and so who placed which call) but refuses it with E_AUTH
+// until it is activated again. Anonymizing a token, e.g. on a departing tenant's
+// request, goes further: it deactivates the token and replaces its name, in the
+// token record, the call history and the audit log, with a pseudonym.
+
+// namedToken is one call token in the store.
+type namedToken struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash,omitempty"`  // SHA-256 of the token, hex
+	Gates     []string  `json:"gates,omitempty"` // gates it may open; empty for every gate
+	NotBefore time.Time `json:"not_before,omitzero"`
+	Expires   time.Time `json:"expires,omitzero"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last_used,omitzero"`
+	OneTime   bool      `json:"one_time,omitempty"`
+	Approval  bool      `json:"approval,omitempty"` // its calls wait for an admin's approval (approval.go)
+	Consumed  time.Time `json:"consumed,omitzero"`  // when a one-time token's call was answered
+
+	Deactivated time.Time `json:"deactivated,omitzero"` // when an admin deactivated it; zero while active
+
+	busy   bool // a one-time token's call is in progress
+	duress bool // this is duressToken
+}
+
+// valid reports whether t's validity window includes now, and it isn't used up or
+// deactivated.
+func (t *namedToken) valid(now time.Time) bool {
+	return !now.Before(t.NotBefore) && (t.Expires.IsZero() || now.Before(t.Expires)) && t.Consumed.IsZero() && t.Deactivated.IsZero()
+}
+
+// allows reports whether t may open gate. A nil t is --call-token, which may open
+// every gate.
+func (t *namedToken) allows(gate string) bool {
+	return t == nil || len(t.Gates) == 0 || slices.Contains(t.Gates, cmp.Or(gate, defaultGate))
+}
+
+// describe is t's name and limits, for the audit log.
+func (t *namedToken) describe() string {
+	d := t.Name
+	if len(t.Gates) > 0 {
+		d += ", gates " + strings.Join(t.Gates, " ")
+	}
+	if !t.NotBefore.IsZero() {
+		d += ", from " + t.NotBefore.Format(time.RFC3339)
+	}
+	if !t.Expires.IsZero() {
+		d += ", until " + t.Expires.Format(time.RFC3339)
+	}
+	if t.OneTime {
+		d += ", one-time"
+	}
+	if t.Approval {
+		d += ", needs approval"
+	}
+	return d
+}
+
+// user is t's name, for the call history; "" for --call-token.
+func (t *namedToken) user() string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// allowsSteps is allows for every gate a batch or macro opens, returning the first
+// it may not.
+func (t *namedToken) allowsSteps(steps []batchStep) (string, bool) {
+	for _, st := range steps {
+		if st.Gate != "" && !t.allows(st.Gate) {
+			return st.Gate, false
+		}
+	}
+	return "", true
+}
+
+// tokenStore holds the named call tokens, keyed by name. With --cluster-db they
+// are kept in its database instead of tokens.json (see cluster.go).
+type tokenStore struct {
+	path string
+
+	mu      sync.Mutex
+	tokens  map[string]*namedToken
+	updated time.Time // with --cluster-db, when the tokens in the database were written
+}
+
+var tokens *tokenStore
+
+func newTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path, tokens: map[string]*namedToken{}}
+	if path != "" {
+		if err := loadJSON(path, &s.tokens); err != nil {
+			return nil, fmt.Errorf("load call tokens: %w", err)
+		}
+	}
+	if cluster != nil {
+		if err := s.reload(); err != nil {
+			return nil, fmt.Errorf("load call tokens: %w", err)
+		}
+		if s.updated.IsZero() && len(s.tokens) > 0 {
+			// The first instance to join brings its tokens.json along.
+			s.mu.Lock()
+			s.persistLocked()
+			s.mu.Unlock()
+		}
+	}
+	return s, nil
+}
+
+// reload takes the tokens from --cluster-db if another instance changed them,
+// keeping the claims of this instance's calls.
+func (s *tokenStore) reload() error {
+	if s == nil || cluster == nil {
+		return nil
+	}
+	s.mu.Lock()
+	after := s.updated
+	s.mu.Unlock()
+	var loaded map[string]*namedToken
+	updated, err := cluster.loadState("tokens", after, &loaded)
+	if err != nil || loaded == nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !updated.After(s.updated) {
+		return nil // changed here meanwhile
+	}
+	for name, t := range loaded {
+		if old, ok := s.tokens[name]; ok && old.Hash == t.Hash {
+			t.busy = old.busy
+			if old.LastUsed.After(t.LastUsed) {
+				t.LastUsed = old.LastUsed
+			}
+		}
+	}
+	s.tokens, s.updated = loaded, updated
+	return nil
+}
+
+// sameToken reports whether token is secret, taking as long whatever token is (its
+// length included), so timing the answer gives nothing of secret away.
+func sameToken(token, secret string) bool {
+	a, b := sha256.Sum256([]byte(token)), sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the named token that token is, and whether it is within its
+// validity window.
+func (s *tokenStore) lookup(token string) (t *namedToken, valid bool) {
+	if s == nil || token == "" {
+		return nil, false
+	}
+	hash := hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			now := time.Now()
+			valid := t.valid(now)
+			if valid {
+				t.LastUsed = now.UTC() // not persisted on its own; the next change saves it
+			}
+			clone := *t
+			return &clone, valid
+		}
+	}
+	return nil, false
+}
+
+func (s *tokenStore) persistLocked() {
+	if cluster != nil {
+		updated, err := cluster.saveState("tokens", s.tokens)
+		if err != nil {
+			logWarn("Could not persist call tokens to --cluster-db: %v\n", err)
+			return
+		}
+		s.updated = updated
+		return
+	}
+	if s.path == "" {
+		return
+	}
+	if err := saveJSON(s.path, s.tokens); err != nil {
+		logWarn("Could not persist call tokens: %v\n", err)
+	}
+}
+
+// callAuth checks r's call token: --call-token, --duress-token, or a named token
+// that hasn't expired, which it returns (nil for --call-token, duressToken for
+// --duress-token). On an auth=none listener every request passes, as --call-token
+// unless it names a token.
+func callAuth(r *http.Request) (*namedToken, bool) {
+	token := tokenFromRequest(r)
+	if cli.DuressToken != "" && sameToken(token, cli.DuressToken) {
+		return duressToken, true
+	}
+	if sameToken(token, cli.CallToken) {
+		return nil, true
+	}
+	if t, ok := tokens.lookup(token); ok {
+		return t, true
+	}
+	return nil, trustedListener(r)
+}
+
+// callAuthFailure is the error code for a request callAuth refused: E_TOKEN_USED
+// for a used-up one-time token, E_TOKEN_EXPIRED for a named token outside its
+// validity window, E_AUTH otherwise (a deactivated token included).
+func callAuthFailure(r *http.Request) errorCode {
+	switch t, _ := tokens.lookup(tokenFromRequest(r)); {
+	case t == nil || !t.Deactivated.IsZero():
+		return errAuth
+	case !t.Consumed.IsZero():
+		return errTokenUsed
+	}
+	return errTokenExpired
+}
+
+// recheck is t as the store holds it now, for a connection that authenticated with
+// it a while ago and places another call: E_AUTH once it was revoked or deactivated
+// (or its name given a new token), E_TOKEN_EXPIRED or E_TOKEN_USED once it is no longer valid.
+// nil (--call-token) and the duress token always pass.
+func (s *tokenStore) recheck(t *namedToken) (*namedToken, errorCode) {
+	if t == nil || t.duress {
+		return t, ""
+	}
+	if s == nil {
+		return nil, errAuth
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.tokens[t.Name]
+	switch {
+	case !ok || stored.Hash != t.Hash || !stored.Deactivated.IsZero():
+		return nil, errAuth
+	case !stored.Consumed.IsZero():
+		return nil, errTokenUsed
+	case !stored.valid(time.Now()):
+		return nil, errTokenExpired
+	}
+	clone := *stored
+	return &clone, ""
+}
+
+// setActive deactivates named token name, or activates it again, returning it as
+// it now is; false if there is no such token.
+func (s *tokenStore) setActive(name string, active bool) (namedToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[name]
+	if !ok {
+		return namedToken{}, false
+	}
+	switch {
+	case active:
+		t.Deactivated = time.Time{}
+	case t.Deactivated.IsZero():
+		t.Deactivated = time.Now().UTC()
+	}
+	s.persistLocked()
+	return *t, true
+}
+
+// pseudonym is what anonymize renames named token name to: derived from its hash,
+// so the same token always gets the same one and nobody can work the name back
+// from it, or random if name has no record left (it was revoked).
+func (s *tokenStore) pseudonym(name string) string {
+	s.mu.Lock()
+	t, ok := s.tokens[name]
+	s.mu.Unlock()
+	if !ok {
+		return "anon-" + newToken()[:12]
+	}
+	return "anon-" + hashToken(t.Hash + "\x00" + name)[:12]
+}
+
+// anonymize renames named token name to pseudonym, deactivating it. It does
+// nothing if there is no such token.
+func (s *tokenStore) anonymize(name, pseudonym string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[name]
+	if !ok {
+		return
+	}
+	delete(s.tokens, name)
+	t.Name = pseudonym
+	if t.Deactivated.IsZero() {
+		t.Deactivated = time.Now().UTC()
+	}
+	s.tokens[pseudonym] = t
+	s.persistLocked()
+}
+
+// claim reserves one-time token t for a call about to be placed, reporting false if
+// another call holds it. Any other token (nil included) needs no claim.
+func (s *tokenStore) claim(t *namedToken) bool {
+	if t == nil || !t.OneTime {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.tokens[t.Name]
+	if !ok || stored.busy || !stored.Consumed.IsZero() || !stored.Deactivated.IsZero() {
+		return false
+	}
+	stored.busy = true
+	return true
+}
+
+// settle releases t's claim once call c is over, using t up if c was answered.
+// A nil c (nothing was placed after all) releases it at once.
+func (s *tokenStore) settle(t *namedToken, c *callSession) {
+	if t == nil || !t.OneTime {
+		return
+	}
+	go func() {
+		if c != nil {
+			<-c.done
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		stored, ok := s.tokens[t.Name]
+		if !ok {
+			return
+		}
+		stored.busy = false
+		if c != nil && c.Answered() {
+			stored.Consumed = time.Now().UTC()
+			s.persistLocked()
+			c.log.Printf("One-time call token %s used up\n", t.Name)
+		}
+	}()
+}
+
+// handleTokens is GET /api/admin/tokens: the named call tokens (without their
+// hashes), sorted by name.
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	list := []namedToken{}
+	if tokens != nil {
+		tokens.mu.Lock()
+		for _, name := range slices.Sorted(maps.Keys(tokens.tokens)) {
+			t := *tokens.tokens[name]
+			t.Hash = ""
+			list = append(list, t)
+		}
+		tokens.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tokens": list})
+}
+
+// handleTokenCreate is POST /api/admin/tokens with {"name", "gates", "valid_from",
+// "valid_until", "expires_in", "one_time", "approval"}: a new named call token for
+// gates (every gate if empty), valid from valid_from (RFC 3339; now if empty) until
+// valid_until, or for expires_in (e.g. "2h") after valid_from, or forever if neither
+// is given, and for a single answered call if one_time; its calls wait for an
+// admin's approval if approval. The
+// answer, with the token and a guest link to the UI that carries it, is the only
+// place the token appears. An existing name is replaced, revoking its old token.
+func handleTokenCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name       string    `json:"name"`
+		Gates      []string  `json:"gates"`
+		ValidFrom  time.Time `json:"valid_from"`
+		ValidUntil time.Time `json:"valid_until"`
+		ExpiresIn  string    `json:"expires_in"`
+		OneTime    bool      `json:"one_time"`
+		Approval   bool      `json:"approval"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+		return
+	}
+	if !gateName.MatchString(req.Name) {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "token_name_invalid")
+		return
+	}
+	for _, gate := range req.Gates {
+		if _, ok := cli.gateNumber(gate); !ok {
+			writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "gate_unknown", gate)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	t := &namedToken{Name: req.Name, Gates: req.Gates, NotBefore: req.ValidFrom.UTC(), Expires: req.ValidUntil.UTC(), Created: now, OneTime: req.OneTime, Approval: req.Approval}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || !req.ValidUntil.IsZero() {
+			writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "token_expiry_invalid")
+			return
+		}
+		t.Expires = cmp.Or(t.NotBefore, now).Add(d)
+	}
+	if !t.Expires.IsZero() && (!t.Expires.After(t.NotBefore) || !t.Expires.After(now)) {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "token_expiry_invalid")
+		return
+	}
+	token := newToken()
+	t.Hash = hashToken(token)
+
+	tokens.mu.Lock()
+	tokens.tokens[t.Name] = t
+	tokens.persistLocked()
+	tokens.mu.Unlock()
+	logInfo("Call token %s created by %s\n", t.Name, callSource("admin", r))
+	auditUserRequest(r, auditTokenCreated, t.Name, t.describe())
+	created := *t
+	created.Hash = ""
+	writeJSON(w, http.StatusCreated, map[string]any{"token": token, "link": guestLink(r, token), "info": created})
+}
+
+// guestLink is the UI's address as r reached it, with token in the fragment (which
+// browsers don't send, so it stays out of access logs); the UI stores it on load.
+func guestLink(r *http.Request, token string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/ui#token=%s", scheme, r.Host, token)
+}
+
+// handleTokenDelete is DELETE /api/admin/tokens/{name}: revoke a named call token.
+func handleTokenDelete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	tokens.mu.Lock()
+	_, ok := tokens.tokens[name]
+	delete(tokens.tokens, name)
+	tokens.persistLocked()
+	tokens.mu.Unlock()
+	if !ok {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "")
+		return
+	}
+	logInfo("Call token %s revoked by %s\n", name, callSource("admin", r))
+	auditUserRequest(r, auditTokenRevoked, name, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTokenActive is POST /api/admin/tokens/{name}/deactivate (active false) and
+// /activate: refuse a named call token, keeping its record and history, or accept
+// it again.
+func handleTokenActive(active bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		t, ok := tokens.setActive(name, active)
+		if !ok {
+			writeAPIError(w, r, http.StatusNotFound, errNotFound, "")
+			return
+		}
+		event, verb := auditTokenDeactivated, "deactivated"
+		if active {
+			event, verb = auditTokenActivated, "activated"
+		}
+		logInfo("Call token %s %s by %s\n", name, verb, callSource("admin", r))
+		auditUserRequest(r, event, name, "")
+		t.Hash = ""
+		writeJSON(w, http.StatusOK, map[string]any{"info": t})
+	}
+}
+
+// handleTokenAnonymize is POST /api/admin/tokens/{name}/anonymize: replace the name
+// of a named call token, deactivated, revoked or not, with a pseudonym everywhere
+// it is kept (anonymizeUser). The answer has the pseudonym, and how many call
+// history and audit records were rewritten.
+func handleTokenAnonymize(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !gateName.MatchString(name) {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "token_name_invalid")
+		return
+	}
+	pseudonym, calls, audited, err := anonymizeUser(name)
+	if err != nil {
+		logError("Could not anonymize call token %s: %v\n", name, err)
+		writeAPIError(w, r, http.StatusInternalServerError, errInternal, "anonymize_failed", err)
+		return
+	}
+	if calls == 0 && audited == 0 && pseudonym == "" {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "")
+		return
+	}
+	logInfo("Call token anonymized as %s by %s\n", pseudonym, callSource("admin", r))
+	rec := requestRecord(r, auditTokenAnonymized, "", name, "")
+	rec.anonymize(name, pseudonym) // the path names it
+	auditLog.add(rec)
+	writeJSON(w, http.StatusOK, map[string]any{"pseudonym": pseudonym, "calls": calls, "audit_records": audited})
+}
+
+// anonymizeUser replaces named token name with a pseudonym in the token store (the
+// record is kept, deactivated), the call history and the audit log. pseudonym is
+// "" if name appears in none of them.
+func anonymizeUser(name string) (pseudonym string, calls, audited int, err error) {
+	pseudonym = tokens.pseudonym(name)
+	if calls, err = callHistory.rewriteUser(name, pseudonym); err != nil {
+		return "", 0, 0, err
+	}
+	if audited, err = auditLog.rewriteUser(name, pseudonym); err != nil {
+		return "", calls, 0, err
+	}
+	tokens.mu.Lock()
+	_, known := tokens.tokens[name]
+	tokens.mu.Unlock()
+	if !known && calls == 0 && audited == 0 {
+		return "", 0, 0, nil
+	}
+	tokens.anonymize(name, pseudonym)
+	return pseudonym, calls, audited, nil
+}
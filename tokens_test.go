@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTokens puts a store with the given tokens, each token its name's secret
+// "secret-NAME", in place of tokens for the length of the test, with --call-token
+// set.
+func withTokens(t *testing.T, named ...*namedToken) *tokenStore {
+	t.Helper()
+	s := &tokenStore{tokens: map[string]*namedToken{}}
+	for _, nt := range named {
+		nt.Hash = hashToken("secret-" + nt.Name)
+		s.tokens[nt.Name] = nt
+	}
+	prevTokens, prevCallToken := tokens, cli.CallToken
+	tokens, cli.CallToken = s, "call-token"
+	t.Cleanup(func() { tokens, cli.CallToken = prevTokens, prevCallToken })
+	return s
+}
+
+// callRequest is a request to /call carrying token.
+func callRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/call", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Token "+token)
+	}
+	return r
+}
+
+func TestNamedTokenValid(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		token namedToken
+		want  bool
+	}{
+		{"no window", namedToken{}, true},
+		{"within", namedToken{NotBefore: now.Add(-time.Hour), Expires: now.Add(time.Hour)}, true},
+		{"starts now", namedToken{NotBefore: now}, true},
+		{"not yet", namedToken{NotBefore: now.Add(time.Second)}, false},
+		{"expires now", namedToken{Expires: now}, false},
+		{"expired", namedToken{Expires: now.Add(-time.Second)}, false},
+		{"expires later", namedToken{Expires: now.Add(time.Second)}, true},
+		{"used up", namedToken{OneTime: true, Consumed: now.Add(-time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.token.valid(now); got != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCallAuthValidityWindow(t *testing.T) {
+	now := time.Now()
+	withTokens(t,
+		&namedToken{Name: "family"},
+		&namedToken{Name: "plumber", NotBefore: now.Add(-time.Hour), Expires: now.Add(time.Hour)},
+		&namedToken{Name: "early", NotBefore: now.Add(time.Hour)},
+		&namedToken{Name: "late", Expires: now.Add(-time.Hour)},
+	)
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+		user  string
+		code  errorCode // callAuthFailure, when refused
+	}{
+		{"call token", "call-token", true, "", ""},
+		{"named", "secret-family", true, "family", ""},
+		{"within its window", "secret-plumber", true, "plumber", ""},
+		{"before its window", "secret-early", false, "", errTokenExpired},
+		{"after its window", "secret-late", false, "", errTokenExpired},
+		{"unknown", "secret-nobody", false, "", errAuth},
+		{"none", "", false, "", errAuth},
+	}
+	for _, tt := range tests {
+		r := callRequest(tt.token)
+		got, ok := callAuth(r)
+		if ok != tt.ok || got.user() != tt.user {
+			t.Errorf("%s: callAuth = %q, %v; want %q, %v", tt.name, got.user(), ok, tt.user, tt.ok)
+		}
+		if !ok {
+			if code := callAuthFailure(r); code != tt.code {
+				t.Errorf("%s: callAuthFailure = %s, want %s", tt.name, code, tt.code)
+			}
+		}
+	}
+}
+
+func TestTokenCreateValidity(t *testing.T) {
+	withTokens(t)
+	now := time.Now().UTC()
+	tests := []struct {
+		name        string
+		body        map[string]any
+		wantStatus  int
+		wantExpires time.Time // zero: none, or not checked on an error
+	}{
+		{"forever", map[string]any{"name": "family"}, http.StatusCreated, time.Time{}},
+		{"until", map[string]any{"name": "guest", "valid_until": now.Add(48 * time.Hour)}, http.StatusCreated, now.Add(48 * time.Hour)},
+		{"for a while from a start", map[string]any{"name": "plumber", "valid_from": now.Add(24 * time.Hour), "expires_in": "8h"}, http.StatusCreated, now.Add(32 * time.Hour)},
+		{"expires_in and valid_until", map[string]any{"name": "both", "valid_until": now.Add(time.Hour), "expires_in": "1h"}, http.StatusBadRequest, time.Time{}},
+		{"negative expires_in", map[string]any{"name": "negative", "expires_in": "-1h"}, http.StatusBadRequest, time.Time{}},
+		{"already expired", map[string]any{"name": "past", "valid_until": now.Add(-time.Hour)}, http.StatusBadRequest, time.Time{}},
+		{"ends before it starts", map[string]any{"name": "backwards", "valid_from": now.Add(2 * time.Hour), "valid_until": now.Add(time.Hour)}, http.StatusBadRequest, time.Time{}},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(tt.body)
+		rec := httptest.NewRecorder()
+		handleTokenCreate(rec, httptest.NewRequest(http.MethodPost, "/api/admin/tokens", bytes.NewReader(body)))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.wantStatus, rec.Body)
+			continue
+		}
+		if rec.Code != http.StatusCreated {
+			continue
+		}
+		var res struct {
+			Info namedToken `json:"info"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !res.Info.Expires.Truncate(time.Second).Equal(tt.wantExpires.Truncate(time.Second)) {
+			t.Errorf("%s: expires %v, want %v", tt.name, res.Info.Expires, tt.wantExpires)
+		}
+	}
+}
+
+// testSession is a call that is over, answered or not, for tokenStore.settle.
+func testSession(answered bool) *callSession {
+	s := &callSession{ID: "test", answered: make(chan struct{}), done: make(chan struct{}), log: newCallLogger("test", callOptions{})}
+	if answered {
+		close(s.answered)
+	}
+	close(s.done)
+	return s
+}
+
+// settled waits for settle's goroutine to have released t's claim.
+func settled(t *testing.T, s *tokenStore, name string) *namedToken {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		s.mu.Lock()
+		stored := *s.tokens[name]
+		s.mu.Unlock()
+		if !stored.busy {
+			return &stored
+		}
+	}
+	t.Fatalf("%s still claimed", name)
+	return nil
+}
+
+func TestOneTimeToken(t *testing.T) {
+	s := withTokens(t, &namedToken{Name: "courier", OneTime: true}, &namedToken{Name: "family"})
+	courier, ok := callAuth(callRequest("secret-courier"))
+	if !ok {
+		t.Fatal("callAuth refused an unused one-time token")
+	}
+
+	if !s.claim(courier) {
+		t.Fatal("claim refused an unused one-time token")
+	}
+	if s.claim(courier) {
+		t.Error("claim let a second call take a one-time token in use")
+	}
+	s.settle(courier, testSession(false))
+	if got := settled(t, s, "courier"); !got.Consumed.IsZero() {
+		t.Error("an unanswered call used the one-time token up")
+	}
+
+	if !s.claim(courier) {
+		t.Fatal("claim refused a one-time token an unanswered call freed")
+	}
+	s.settle(courier, testSession(true))
+	if got := settled(t, s, "courier"); got.Consumed.IsZero() {
+		t.Fatal("an answered call didn't use the one-time token up")
+	}
+	if s.claim(courier) {
+		t.Error("claim let a used-up one-time token place another call")
+	}
+	r := callRequest("secret-courier")
+	if _, ok := callAuth(r); ok {
+		t.Error("callAuth let a used-up one-time token in")
+	}
+	if code := callAuthFailure(r); code != errTokenUsed {
+		t.Errorf("callAuthFailure = %s, want %s", code, errTokenUsed)
+	}
+
+	// Nothing placed after all: released at once, not used up.
+	s.tokens["courier"].Consumed = time.Time{}
+	if !s.claim(courier) {
+		t.Fatal("claim refused a one-time token")
+	}
+	s.settle(courier, nil)
+	if got := settled(t, s, "courier"); !got.Consumed.IsZero() {
+		t.Error("settling without a call used the one-time token up")
+	}
+
+	family, _ := callAuth(callRequest("secret-family"))
+	for range 2 {
+		if !s.claim(family) || !s.claim(nil) {
+			t.Error("claim refused a token that isn't one-time")
+		}
+	}
+}
+
+func TestDeactivatedToken(t *testing.T) {
+	s := withTokens(t, &namedToken{Name: "tenant"})
+	tenant, ok := callAuth(callRequest("secret-tenant"))
+	if !ok {
+		t.Fatal("callAuth refused an active token")
+	}
+
+	if _, ok := s.setActive("tenant", false); !ok {
+		t.Fatal("setActive didn't find the token")
+	}
+	if _, kept := s.tokens["tenant"]; !kept {
+		t.Fatal("deactivating dropped the token record")
+	}
+	r := callRequest("secret-tenant")
+	if _, ok := callAuth(r); ok {
+		t.Error("callAuth let a deactivated token in")
+	}
+	if code := callAuthFailure(r); code != errAuth {
+		t.Errorf("callAuthFailure = %s, want %s", code, errAuth)
+	}
+	if _, code := s.recheck(tenant); code != errAuth {
+		t.Errorf("recheck = %s, want %s", code, errAuth)
+	}
+
+	if _, ok := s.setActive("tenant", true); !ok {
+		t.Fatal("setActive didn't find the token")
+	}
+	if _, ok := callAuth(callRequest("secret-tenant")); !ok {
+		t.Error("callAuth refused a token activated again")
+	}
+	if _, ok := s.setActive("nobody", false); ok {
+		t.Error("setActive found a token that doesn't exist")
+	}
+}
+
+// withStores points the call history and the audit log at calls.jsonl and
+// audit.jsonl in a fresh directory, holding lines, for the length of the test.
+func withStores(t *testing.T, calls, audit []string) (callsPath, auditPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	callsPath, auditPath = filepath.Join(dir, "calls.jsonl"), filepath.Join(dir, "audit.jsonl")
+	for path, lines := range map[string][]string{callsPath: calls, auditPath: audit} {
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prevHistory, prevAudit := callHistory, auditLog
+	callHistory, auditLog = &historyStore{}, &auditStore{}
+	t.Cleanup(func() { callHistory, auditLog = prevHistory, prevAudit })
+	if err := callHistory.load(callsPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := auditLog.load(auditPath); err != nil {
+		t.Fatal(err)
+	}
+	return callsPath, auditPath
+}
+
+func TestAnonymizeUser(t *testing.T) {
+	s := withTokens(t, &namedToken{Name: "dana"}, &namedToken{Name: "danaher"})
+	callsPath, auditPath := withStores(t, []string{
+		`{"at":"2026-03-01T10:00:00Z","call_id":"c1","user":"dana","source":"api","gate":"outer","result":"answered","duration_ms":900}`,
+		`{"at":"2026-03-01T11:00:00Z","call_id":"c2","user":"danaher","source":"api","gate":"outer","result":"answered","duration_ms":900}`,
+		`{"at":"2026-03-01T12:00:00Z","call_id":"c3","source":"ws","gate":"inner","result":"busy","duration_ms":400}`,
+		`{"at":"2026-03-01T13:00:00Z","call_id":"c4","user":"dana","sour`, // torn
+	}, []string{
+		`{"at":"2026-03-01T09:00:00Z","event":"token_created","user":"dana","detail":"dana, gates outer"}`,
+		`{"at":"2026-03-01T09:20:00Z","event":"token_deactivated","request":"POST /api/admin/tokens/dana/deactivate","user":"dana"}`,
+		`{"at":"2026-03-01T09:30:00Z","event":"approval_approved","user":"dana","detail":"c1: dana (token dana needs approval), after 5s"}`,
+		`{"at":"2026-03-01T09:40:00Z","event":"token_created","user":"danaher","detail":"danaher"}`,
+	})
+
+	stable := s.pseudonym("dana")
+	pseudonym, calls, audited, err := anonymizeUser("dana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(pseudonym, "anon-") || calls != 1 || audited != 3 {
+		t.Fatalf("anonymizeUser = %q, %d calls, %d audit records; want anon-..., 1, 3", pseudonym, calls, audited)
+	}
+	if pseudonym != stable {
+		t.Errorf("pseudonym %s, want %s, the token's own", pseudonym, stable)
+	}
+
+	b, _ := os.ReadFile(callsPath)
+	got := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	want := []string{
+		`"call_id":"c1","user":"` + pseudonym + `"`,
+		`"call_id":"c2","user":"danaher"`,
+		`"call_id":"c3","source"`,
+		`"call_id":"c4","user":"dana","sour`,
+	}
+	for i, w := range want {
+		if i >= len(got) || !strings.Contains(got[i], w) {
+			t.Errorf("calls.jsonl line %d = %q, want it to hold %s", i+1, got, w)
+		}
+	}
+	page, _ := callHistory.query(historyFilter{user: &pseudonym})
+	if len(page) != 1 || page[0].CallID != "c1" {
+		t.Errorf("history of %s = %v, want c1", pseudonym, page)
+	}
+
+	b, _ = os.ReadFile(auditPath)
+	audit := string(b)
+	if strings.Contains(strings.ReplaceAll(audit, "danaher", ""), "dana") {
+		t.Errorf("audit.jsonl still names dana:\n%s", audit)
+	}
+	if !strings.Contains(audit, "c1: "+pseudonym+" (token "+pseudonym+" needs approval)") || !strings.Contains(audit, `"user":"danaher"`) {
+		t.Errorf("audit.jsonl rewritten wrongly:\n%s", audit)
+	}
+
+	if _, ok := s.tokens["dana"]; ok {
+		t.Error("the token record still has the name")
+	}
+	if kept, ok := s.tokens[pseudonym]; !ok || kept.Deactivated.IsZero() {
+		t.Error("the token record wasn't kept, deactivated, under the pseudonym")
+	}
+	if _, ok := callAuth(callRequest("secret-dana")); ok {
+		t.Error("callAuth let an anonymized token in")
+	}
+	if pseudonym, _, _, _ := anonymizeUser("nobody"); pseudonym != "" {
+		t.Errorf("anonymizeUser of an unknown name = %q", pseudonym)
+	}
+}
+
+func TestSameToken(t *testing.T) {
+	tests := []struct {
+		token, secret string
+		want          bool
+	}{
+		{"s3cret", "s3cret", true},
+		{"s3cret", "s3creT", false},
+		{"s3cre", "s3cret", false},
+		{"s3cret-and-more", "s3cret", false},
+		{"", "s3cret", false},
+		{"", "", true}, // no --call-token: open to anyone, as validate warns
+	}
+	for _, tt := range tests {
+		if got := sameToken(tt.token, tt.secret); got != tt.want {
+			t.Errorf("sameToken(%q, %q) = %v, want %v", tt.token, tt.secret, got, tt.want)
+		}
+	}
+}
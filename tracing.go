@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// traceParent is a W3C Trace Context traceparent
+// (https://www.w3.org/TR/trace-context/), e.g. from Home Assistant or a reverse
+// proxy. A call triggered by a traced request carries it: the trace ID goes into
+// its log prefix and SIP trace timeline, and webhooks and callbacks it causes are
+// sent with a traceparent of their own in the same trace, so a request's path
+// through several systems can be stitched together. The zero value means untraced.
+type traceParent struct {
+	TraceID string // 32 hex digits
+	SpanID  string // 16 hex digits: the caller's span, or ours once child() is taken
+	Flags   string // 2 hex digits; 01 = sampled
+}
+
+var traceParentFormat = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// parseTraceParent accepts version 00 and, as the spec asks, later versions by
+// their 00 prefix. All-zero IDs are invalid.
+func parseTraceParent(h string) (traceParent, bool) {
+	m := traceParentFormat.FindStringSubmatch(h)
+	if m == nil || m[1] == "ff" || (m[1] == "00" && m[5] != "") {
+		return traceParent{}, false
+	}
+	tp := traceParent{TraceID: m[2], SpanID: m[3], Flags: m[4]}
+	if tp.TraceID == strings.Repeat("0", 32) || tp.SpanID == strings.Repeat("0", 16) {
+		return traceParent{}, false
+	}
+	return tp, true
+}
+
+func (t traceParent) Valid() bool {
+	return t.TraceID != ""
+}
+
+// String is the header value, or "" for an untraced call.
+func (t traceParent) String() string {
+	if !t.Valid() {
+		return ""
+	}
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + t.Flags
+}
+
+// child is a new span in the same trace, for a request we make on its behalf.
+func (t traceParent) child() traceParent {
+	if !t.Valid() {
+		return t
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	t.SpanID = hex.EncodeToString(b)
+	return t
+}
+
+// setHeader adds the traceparent to an outgoing request, if the call is traced.
+func (t traceParent) setHeader(h http.Header) {
+	if t.Valid() {
+		h.Set("traceparent", t.String())
+	}
+}
+
+type traceParentKey struct{}
+
+// withTraceParent is middleware that picks up a valid traceparent header. Our own
+// handling becomes a child span of the caller's.
+func withTraceParent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tp, ok := parseTraceParent(r.Header.Get("traceparent")); ok {
+			r = r.WithContext(context.WithValue(r.Context(), traceParentKey{}, tp.child()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestTrace is r's trace context, zero if the caller sent none.
+func requestTrace(r *http.Request) traceParent {
+	tp, _ := r.Context().Value(traceParentKey{}).(traceParent)
+	return tp
+}
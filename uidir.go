@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --ui-dir overlays files on the built-in UI, so its look can be changed without
+// rebuilding: every file in it is served under /ui/, in place of the built-in one
+// of the same name (index.html is the /ui page itself, call.js the WebSocket
+// client). Two files are also picked up by the built-in page: custom.css is linked
+// after its own styles, and messages/LANG.json adds to or overrides the strings
+// of language LANG (en, he, or a new one) for the page and API errors alike.
+//
+// Files are read on every request, so edits show up on the next reload. Each is
+// served with an ETag; references the page makes carry ?v=<version>, and only a
+// request whose version matches what is served now may be cached for good, so a
+// changed file is never stuck behind a stale cache.
+
+// uiFiles is the --ui-dir overlay, nil without one.
+var uiFiles fs.FS
+
+// uiBuiltin are the built-in files an overlay may replace.
+var uiBuiltin = map[string]string{
+	"index.html": uiHTML,
+	"call.js":    callJS,
+}
+
+// setupUIDir opens --ui-dir and merges its translations into the catalog.
+func setupUIDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	uiFiles = os.DirFS(dir)
+	names, err := fs.Glob(uiFiles, "messages/*.json")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := fs.ReadFile(uiFiles, name)
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("--ui-dir %s: %w", name, err)
+		}
+		lang := strings.TrimSuffix(path.Base(name), ".json")
+		if catalog[lang] == nil {
+			catalog[lang] = map[string]string{}
+		}
+		maps.Copy(catalog[lang], messages)
+		logInfo("%d UI strings for %q from --ui-dir\n", len(messages), lang)
+	}
+	return nil
+}
+
+// uiFile returns the named UI file, from --ui-dir if it has one by that name.
+func uiFile(name string) (content []byte, modTime time.Time, ok bool) {
+	if uiFiles != nil && fs.ValidPath(name) {
+		if data, err := fs.ReadFile(uiFiles, name); err == nil {
+			if info, err := fs.Stat(uiFiles, name); err == nil {
+				modTime = info.ModTime()
+			}
+			return data, modTime, true
+		}
+	}
+	builtin, ok := uiBuiltin[name]
+	return []byte(builtin), time.Time{}, ok
+}
+
+// uiFileVersion is what references to a UI file carry as ?v=: a hash of its
+// content, or uiVersion for the built-in files.
+func uiFileVersion(name string, content []byte) string {
+	if builtin, ok := uiBuiltin[name]; ok && string(content) == builtin {
+		return uiVersion
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:6])
+}
+
+// handleUI serves the /ui page: --ui-dir's index.html, or the built-in one with
+// the overlay's custom.css linked in and its call.js versioned.
+func handleUI(w http.ResponseWriter, r *http.Request) {
+	page, modTime, _ := uiFile("index.html")
+	if string(page) == uiHTML {
+		if css, _, ok := uiFile("custom.css"); ok {
+			link := fmt.Sprintf(`<link rel="stylesheet" href="/ui/custom.css?v=%s">`, uiFileVersion("custom.css", css))
+			page = bytes.Replace(page, []byte("</head>"), []byte(link+"\n</head>"), 1)
+		}
+		js, _, _ := uiFile("call.js")
+		page = bytes.Replace(page, []byte("/ui/call.js?v="+uiVersion), []byte("/ui/call.js?v="+uiFileVersion("call.js", js)), 1)
+	}
+	serveUIFile(w, r, "index.html", page, modTime)
+}
+
+// handleUIFile is GET /ui/*.
+func handleUIFile(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "*")
+	content, modTime, ok := uiFile(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	serveUIFile(w, r, name, content, modTime)
+}
+
+func serveUIFile(w http.ResponseWriter, r *http.Request, name string, content []byte, modTime time.Time) {
+	version := uiFileVersion(name, content)
+	w.Header().Set("ETag", `"`+version+`"`)
+	if r.URL.Query().Get("v") == version && name != "index.html" {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, modTime, bytes.NewReader(content))
+}
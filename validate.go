@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialableNumber matches what we put in the Request-URI user part: digits with an
+// optional leading +, plus * and # for provider feature codes.
+var dialableNumber = regexp.MustCompile(`^\+?[0-9*#]{2,20}$`)
+
+// ValidateConfigCmd checks a configuration without starting the server.
+type ValidateConfigCmd struct {
+	Config `kong:"embed"`
+}
+
+func (c *ValidateConfigCmd) Run() error {
+	problems, warnings := c.Config.check()
+	if len(problems) == 0 {
+		if ln, err := net.Listen("tcp", c.Config.listenAddr()); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot listen on %s: %v", c.Config.listenAddr(), err))
+		} else {
+			ln.Close()
+		}
+	}
+	if err := reportConfig(problems, warnings); err != nil {
+		return err
+	}
+	fmt.Println("✅ Configuration OK")
+	return nil
+}
+
+func (c *Config) listenAddr() string {
+	return net.JoinHostPort(c.ListenAddress, fmt.Sprint(c.ListenPort))
+}
+
+// check returns every configuration problem (fatal) and warning at once, so they can
+// all be fixed in one go instead of one per restart.
+func (c *Config) check() (problems, warnings []string) {
+	bad := func(format string, args ...any) { problems = append(problems, fmt.Sprintf(format, args...)) }
+
+	if c.SipUser == "" {
+		bad("--sip-user is empty")
+	}
+	if c.SipPass == "" {
+		bad("--sip-pass is empty")
+	}
+	if c.Destination == "" {
+		bad("--destination is empty")
+	} else if !dialableNumber.MatchString(c.Destination) {
+		bad("--destination %q is not a dialable number (digits, optional leading +)", c.Destination)
+	}
+	problems = append(problems, c.checkProvider()...)
+	problems = append(problems, c.checkSIPHeaders()...)
+	problems = append(problems, c.checkRingMe()...)
+	problems = append(problems, c.checkIntercom()...)
+	problems = append(problems, c.checkBridge()...)
+	problems = append(problems, c.checkDialPlan()...)
+	problems = append(problems, c.checkListeners()...)
+	if c.Mdns != "" && !mdnsHostName.MatchString(c.Mdns) {
+		bad("--mdns %q must be a host name: lowercase letters, digits and inner -, at most 63", c.Mdns)
+	}
+	for name, number := range c.Gates {
+		if !gateName.MatchString(name) || name == defaultGate {
+			bad("--gates name %q must be lowercase letters, digits, - or _ (and not %q)", name, defaultGate)
+		}
+		if !dialableNumber.MatchString(number) {
+			bad("--gates %s=%q is not a dialable number", name, number)
+		}
+	}
+	for name := range c.Macros {
+		if !gateName.MatchString(name) {
+			bad("--macros name %q must be lowercase letters, digits, - or _", name)
+		}
+		if _, _, err := c.macroSteps(name); err != nil {
+			bad("--macros %s: %v", name, err)
+		}
+	}
+	for gate, number := range c.AutoClose {
+		if _, ok := c.gateNumber(gate); !ok {
+			bad("--auto-close gate %q is not configured", gate)
+		}
+		if !dialableNumber.MatchString(number) {
+			bad("--auto-close %s=%q is not a dialable number", gate, number)
+		}
+	}
+	if len(c.AutoClose) > 0 && c.AutoCloseAfter <= 0 {
+		bad("--auto-close-after must be positive")
+	}
+	if c.TestDestination != "" && !dialableNumber.MatchString(c.TestDestination) {
+		bad("--test-destination %q is not a dialable number", c.TestDestination)
+	}
+	switch {
+	case c.SipDomain == "":
+		bad("--sip-domain is empty")
+	case strings.Contains(c.SipDomain, "://"), strings.HasPrefix(strings.ToLower(c.SipDomain), "sip:"),
+		strings.HasPrefix(strings.ToLower(c.SipDomain), "sips:"), strings.ContainsAny(c.SipDomain, "/@ "):
+		bad("--sip-domain %q must be a bare host name (no scheme, user or path)", c.SipDomain)
+	case strings.Contains(c.SipDomain, ":") && net.ParseIP(c.SipDomain) == nil:
+		bad("--sip-domain %q must not include a port; use --sip-port", c.SipDomain)
+	}
+	for _, p := range c.SipProxies {
+		host, port, err := net.SplitHostPort(p)
+		if err != nil {
+			host, port = p, "5060"
+		}
+		if n, err := strconv.Atoi(port); host == "" || strings.ContainsAny(host, "/@ ") || err != nil || n < 1 || n > 65535 {
+			bad("--sip-proxies %q must be a host or host:port", p)
+		}
+	}
+	if c.SipUdpMax < 500 || c.SipUdpMax > 1300 {
+		bad("--sip-udp-max must be between 500 and 1300 bytes")
+	}
+	if c.Sips && c.sipTransport() != "tls" {
+		bad("--sips needs --sip-transport tls")
+	}
+	if (c.SipTlsCa != "" || c.SipTlsInsecure) && c.sipTransport() != "tls" {
+		bad("--sip-tls-ca and --sip-tls-insecure need --sip-transport tls")
+	}
+	if _, err := c.sipTLSConfig(); err != nil {
+		bad("%v", err)
+	}
+	if c.SipPort < 0 || c.SipPort > 65535 {
+		bad("--sip-port %d is out of range (1-65535, or 0 for the transport default)", c.SipPort)
+	}
+	if c.ListenPort < 1 || c.ListenPort > 65535 {
+		bad("--listen-port %d is out of range (1-65535)", c.ListenPort)
+	}
+	if c.ListenAddress != "" && net.ParseIP(c.ListenAddress) == nil {
+		if _, err := net.LookupHost(c.ListenAddress); err != nil {
+			bad("--listen-address %q does not resolve: %v", c.ListenAddress, err)
+		}
+	}
+	if c.UiDir != "" {
+		if info, err := os.Stat(c.UiDir); err != nil || !info.IsDir() {
+			bad("--ui-dir %q is not a directory", c.UiDir)
+		}
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		bad("--timezone %q is not a known IANA timezone", c.Timezone)
+	}
+	if c.Register && c.RegisterExpiry < minRegister {
+		bad("--register-expiry must be at least %v", minRegister)
+	}
+	if c.BudgetSoft < 0 || c.BudgetHard < 0 {
+		bad("--budget-soft and --budget-hard must not be negative")
+	}
+	if c.BudgetSoft > 0 && c.BudgetHard > 0 && c.BudgetSoft >= c.BudgetHard {
+		bad("--budget-soft (%d) must be below --budget-hard (%d)", c.BudgetSoft, c.BudgetHard)
+	}
+	if !c.IpHttp && len(c.StunServers) == 0 {
+		bad("--ip-http=false needs --stun-servers to discover the public IP with")
+	}
+	for _, s := range c.StunServers {
+		if _, port, err := net.SplitHostPort(s); err != nil || port == "" {
+			bad("--stun-servers %q must be host:port", s)
+		}
+	}
+	for _, s := range c.ApprovalWindows {
+		if _, err := parseApprovalWindow(s); err != nil {
+			bad("--approval-windows: %v", err)
+		}
+	}
+	if c.ApprovalWait < 30*time.Second || c.ApprovalWait > 30*time.Minute {
+		bad("--approval-wait must be between 30s and 30m")
+	}
+	if c.SipKeepalive != 0 && c.SipKeepalive < minSIPKeepalive {
+		bad("--sip-keepalive must be 0 or at least %v", minSIPKeepalive)
+	}
+	if c.IpCache != 0 && c.IpCache < minIPCache {
+		bad("--ip-cache must be 0 or at least %v", minIPCache)
+	}
+	if c.IpWatch != 0 && c.IpWatch < minIPWatch {
+		bad("--ip-watch must be 0 or at least %v", minIPWatch)
+	}
+	if c.CallDuration < time.Second || c.CallDuration > callHardCap/2 {
+		bad("--call-duration must be between 1s and %v", callHardCap/2)
+	}
+	for gate, d := range c.GateDuration {
+		if _, ok := c.gateNumber(gate); !ok {
+			bad("--gate-duration gate %q is not configured", gate)
+		}
+		if d < time.Second || d > callHardCap/2 {
+			bad("--gate-duration %s must be between 1s and %v", gate, callHardCap/2)
+		}
+	}
+	for gate, d := range c.GateRingOnly {
+		if _, ok := c.gateNumber(gate); !ok {
+			bad("--gate-ring-only gate %q is not configured", gate)
+		}
+		if d < 0 {
+			bad("--gate-ring-only %s must not be negative", gate)
+		}
+	}
+	if c.RingOnly < 0 {
+		bad("--ring-only must not be negative")
+	}
+	for _, gate := range append([]string{defaultGate}, slices.Sorted(maps.Keys(c.Gates))...) {
+		g, _ := c.forGate(gate)
+		switch {
+		case g.RingOnly > 0 && g.RingOnly >= g.CallDuration:
+			bad("--ring-only for %s (%v) must be shorter than its --call-duration (%v), which hangs up first", gate, g.RingOnly, g.CallDuration)
+		case g.RingOnly > 0 && g.DtmfCode != "":
+			warnings = append(warnings, fmt.Sprintf("--dtmf-code is never keyed in on %s: --ring-only calls are not answered", gate))
+		}
+	}
+	if c.Wait100Timeout <= 0 || c.Wait100Timeout > 30*time.Second {
+		bad("--wait-100-timeout must be positive and at most 30s")
+	}
+	if c.RetryAfterMax < 0 || c.RetryAfterMax > 20*time.Second {
+		bad("--retry-after-max must be between 0 and 20s")
+	}
+	if c.BackupSipDomain != "" && c.BackupSipDomain == c.SipDomain {
+		bad("--backup-sip-domain must be another trunk than --sip-domain")
+	}
+	if c.BackupSipPort < 0 || c.BackupSipPort > 65535 {
+		bad("--backup-sip-port must be a port number")
+	}
+	if c.ClusterDb != "" && (c.ClusterLease < 3*time.Second || c.ClusterLease > 5*time.Minute) {
+		bad("--cluster-lease must be between 3s and 5m")
+	}
+	if c.DnsCache < 0 {
+		bad("--dns-cache must not be negative")
+	}
+	if c.InviteBudget < 0 {
+		bad("--invite-budget must not be negative")
+	}
+	if c.Retry < 0 || c.Retry > 5 {
+		bad("--retry must be between 0 and 5")
+	}
+	if c.Retry > 0 && (c.RetryBackoff < 100*time.Millisecond || c.RetryBackoff > 30*time.Second) {
+		bad("--retry-backoff must be between 100ms and 30s")
+	} else if waits := c.RetryBackoff<<c.Retry - c.RetryBackoff; waits > callHardCap {
+		bad("--retry-backoff doubled over %d retries waits %v in all, more than %v", c.Retry, waits, callHardCap)
+	}
+	if c.DtmfCode != "" && !dtmfDigits.MatchString(c.DtmfCode) {
+		bad("--dtmf-code must be up to 32 of 0-9 * # A-D")
+	}
+	if c.WsResumeWait < 0 || c.WsResumeWait > callHardCap/2 {
+		bad("--ws-resume-wait must be between 0 and %v", callHardCap/2)
+	}
+	if c.ApiWaitTimeout <= 0 {
+		bad("--api-wait-timeout must be positive")
+	}
+	if c.IdempotencyTTL < 0 {
+		bad("--idempotency-ttl must not be negative")
+	}
+	if c.IdleAfter < 0 {
+		bad("--idle-after must not be negative")
+	}
+	if c.LogFile != "" && c.LogMaxSize < 1 {
+		bad("--log-max-size must be at least 1 (MB)")
+	}
+	if c.LogRotateEvery < 0 || c.LogKeep < 0 {
+		bad("--log-rotate-every and --log-keep must not be negative")
+	}
+	if c.LogSyslog != "" {
+		if u, err := url.Parse(c.LogSyslog); err != nil || !slices.Contains([]string{"unix", "udp", "tcp", "tls"}, u.Scheme) ||
+			(u.Scheme == "unix") != (u.Host == "" && u.Path != "") {
+			bad("--log-syslog must be unix:///path, udp://host:port, tcp://host:port or tls://host:port")
+		}
+	}
+	if c.LogLoki != "" && validateCallbackURL(c.LogLoki) != nil {
+		bad("--log-loki must be an absolute http(s) URL")
+	}
+	for name, secret := range c.WebhookSecrets {
+		if !gateName.MatchString(name) {
+			bad("--webhook-secrets name %q must be lowercase letters, digits, - or _", name)
+		}
+		if len(secret) < 16 {
+			bad("--webhook-secrets %s: the secret must be at least 16 characters", name)
+		}
+	}
+	if len(c.WebhookSecrets) > 0 && c.WebhookSkew <= 0 {
+		bad("--webhook-skew must be positive")
+	}
+	if c.NotifyURL != "" && validateCallbackURL(c.NotifyURL) != nil {
+		bad("--notify-url must be an absolute http(s) URL")
+	}
+	if c.NotifyURL != "" && c.NotifyEvery <= 0 {
+		bad("--notify-every must be positive")
+	}
+	if c.MqttUrl != "" {
+		if u, err := url.Parse(c.MqttUrl); err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Hostname() == "" {
+			bad("--mqtt-url must be mqtt://host[:port] or mqtts://host[:port]")
+		}
+		if c.MqttTopic == "" || strings.ContainsAny(c.MqttTopic, "+#") {
+			bad("--mqtt-topic must be a topic without wildcards")
+		}
+		if c.MqttClientId == "" {
+			bad("--mqtt-client-id must not be empty")
+		}
+	}
+	if c.Visitor != "" {
+		if _, ok := c.gateNumber(c.Visitor); !ok {
+			bad("--visitor gate %q is not configured", c.Visitor)
+		}
+		if c.VisitorRate < 1 {
+			bad("--visitor-rate must be at least 1")
+		}
+		if c.VisitorWait < 30*time.Second || c.VisitorWait > 30*time.Minute {
+			bad("--visitor-wait must be between 30s and 30m")
+		}
+		if c.VisitorCaptcha != "" && (c.CaptchaKey == "" || c.CaptchaSecret == "") {
+			bad("--visitor-captcha needs --captcha-key and --captcha-secret")
+		}
+		if c.NotifyURL == "" && (c.TelegramToken == "" || len(c.TelegramChats) == 0) {
+			bad("--visitor needs --notify-url or --telegram-token and --telegram-chats to reach the residents")
+		}
+	}
+	if c.DuressToken != "" {
+		if c.DuressToken == c.CallToken || c.DuressToken == c.AdminToken {
+			bad("--duress-token must differ from --call-token and --admin-token")
+		}
+		if c.NotifyURL == "" && len(c.DuressUrls) == 0 && c.TelegramToken == "" {
+			bad("--duress-token needs --notify-url, --duress-urls or --telegram-token to raise the alarm with")
+		}
+	}
+	for _, u := range c.DuressUrls {
+		if validateCallbackURL(u) != nil {
+			bad("--duress-urls %q must be an absolute http(s) URL", u)
+		}
+	}
+	if c.TelegramToken != "" && len(c.TelegramChats) == 0 {
+		bad("--telegram-token needs --telegram-chats")
+	}
+	if c.TelemetryURL != "" && validateCallbackURL(c.TelemetryURL) != nil {
+		bad("--telemetry-url must be an absolute http(s) URL")
+	}
+	if c.TestEndpoints && c.CallToken == "" {
+		bad("--test-endpoints requires --call-token (chaos endpoints must not be open to anyone)")
+	}
+
+	if c.CallToken == "" {
+		warnings = append(warnings, "--call-token is empty: anyone who can reach the server can open the gate")
+	}
+	if c.SipTlsInsecure {
+		warnings = append(warnings, "--sip-tls-insecure: the provider certificate is not verified, so anyone on the path can pose as the provider")
+	}
+	if h, err := c.renderSIPHeaders(sipTemplateData{Gate: defaultGate, Account: c.SipUser, Destination: c.Destination, Time: time.Now()}); err == nil && c.sipTransport() == "udp" {
+		size := len(h.PAI)
+		for _, hdr := range h.Extra {
+			size += len(hdr.Name()) + len(hdr.Value()) + 4
+		}
+		if size > c.SipUdpMax/2 {
+			warnings = append(warnings, fmt.Sprintf("--sip-headers and identity headers add %d bytes to each INVITE: larger INVITEs go over TCP, which the provider must accept (or use --sip-compact)", size))
+		}
+	}
+	if c.DataDir == "" {
+		warnings = append(warnings, "--data-dir is empty: pending callbacks, auto-closes and counters are lost on restart")
+	}
+	return problems, warnings
+}
+
+// reportConfig prints check() results and returns an error if there were problems.
+func reportConfig(problems, warnings []string) error {
+	for _, w := range warnings {
+		fmt.Printf("⚠️  %s\n", w)
+	}
+	for _, p := range problems {
+		fmt.Printf("❌ %s\n", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d configuration problem(s)", len(problems))
+	}
+	return nil
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --visitor serves a public page, /visit, where someone at the gate without a token
+// can press "Request entry". The request is a call to the --visitor gate waiting
+// for approval (approval.go), so it lands in the history and on the admin
+// dashboard. It notifies the residents (a visit_request event to --notify-url, and
+// a message to --telegram-chats) with a link to approve or deny it; approving opens
+// the gate. The visitor's page follows the request until it is decided or
+// --visitor-wait passes without an answer.
+//
+// Anyone may ask, so asking is guarded: --visitor-rate requests a minute per
+// client, at most maxPendingVisits pending at once, and optionally a CAPTCHA
+// (--visitor-captcha). The decision link carries its own key in the fragment,
+// which browsers don't send, and opening it only shows the buttons: a chat app
+// fetching the link for a preview decides nothing.
+
+const (
+	maxPendingVisits = 5
+	maxVisitorName   = 60
+)
+
+// notifyVisitRequest is the notification event of a new visit request.
+const notifyVisitRequest = "visit_request"
+
+// captchaVerifyURLs are the siteverify endpoints of the --visitor-captcha services.
+var captchaVerifyURLs = map[string]string{
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+}
+
+var visitRequests = newCounter("iftach_visit_requests_total", "Visitor entry requests by result (requested, busy, captcha_failed); iftach_approvals_total counts how they were decided.")
+
+// visit is one visitor's request for entry: its call, and the keys to it.
+type visit struct {
+	ID   string // its approval's
+	Name string
+	From string // the visitor's address
+
+	key       string // the visitor's, to follow the request
+	decideKey string // the residents', to decide it
+	session   *callSession
+	approval  *approval
+}
+
+// visitDesk holds the recent visit requests.
+type visitDesk struct {
+	client *http.Client // CAPTCHA checks
+
+	mu     sync.Mutex
+	visits map[string]*visit
+}
+
+var visitors = &visitDesk{
+	client: &http.Client{Timeout: 10 * time.Second},
+	visits: map[string]*visit{},
+}
+
+// mountVisitor serves the --visitor page and its endpoints, without a token.
+func mountVisitor(r chi.Router) {
+	if cli.Visitor == "" {
+		return
+	}
+	r.Get("/visit", handleVisitPage)
+	r.With(newRateLimiter("visit", cli.VisitorRate).middleware).Post("/visit/request", handleVisitRequest)
+	r.Get("/visit/request/{id}", handleVisitStatus)
+	r.Get("/visit/decide/{id}", handleVisitDecidePage)
+	r.Post("/visit/decide/{id}", handleVisitDecide)
+}
+
+// visitorGate is the gate --visitor opens, "" for the default gate.
+func visitorGate() string {
+	if cli.Visitor == defaultGate {
+		return ""
+	}
+	return cli.Visitor
+}
+
+// handleVisitPage is GET /visit.
+func handleVisitPage(w http.ResponseWriter, r *http.Request) {
+	captcha := ""
+	switch cli.VisitorCaptcha {
+	case "turnstile":
+		captcha = `<script src="https://challenges.cloudflare.com/turnstile/v0/api.js" async defer></script>
+        <div class="cf-turnstile" data-sitekey="` + html.EscapeString(cli.CaptchaKey) + `"></div>`
+	case "hcaptcha":
+		captcha = `<script src="https://js.hcaptcha.com/1/api.js" async defer></script>
+        <div class="h-captcha" data-sitekey="` + html.EscapeString(cli.CaptchaKey) + `"></div>`
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, strings.Replace(visitHTML, "<!--captcha-->", captcha, 1))
+}
+
+// visitRequestBody is POST /visit/request.
+type visitRequestBody struct {
+	Name    string `json:"name"`
+	Captcha string `json:"captcha,omitempty"` // the widget's response token
+}
+
+// handleVisitRequest is POST /visit/request: ask the residents to let the caller
+// in. It returns the request's ID and the key to follow it with.
+func handleVisitRequest(w http.ResponseWriter, r *http.Request) {
+	var req visitRequestBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+		return
+	}
+	name := visitorName(req.Name)
+	if name == "" {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "visit_name_missing")
+		return
+	}
+	from, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		from = r.RemoteAddr
+	}
+	if cli.VisitorCaptcha != "" {
+		if err := visitors.verifyCaptcha(req.Captcha, from); err != nil {
+			visitRequests.inc("result", "captcha_failed")
+			logWarn("Visit request from %s refused: CAPTCHA: %v\n", from, err)
+			writeAPIError(w, r, http.StatusForbidden, errForbidden, "visit_captcha_failed")
+			return
+		}
+	}
+
+	v := &visit{
+		Name: name, From: from, key: newToken(), decideKey: newToken(),
+		approval: &approval{Who: "visitor " + name, Reason: "a visitor at the gate", wait: cli.VisitorWait},
+	}
+	visitors.mu.Lock()
+	if visitors.pendingLocked() >= maxPendingVisits {
+		visitors.mu.Unlock()
+		visitRequests.inc("result", "busy")
+		writeAPIError(w, r, http.StatusTooManyRequests, errRateLimited, "visit_busy")
+		return
+	}
+	gate := visitorGate()
+	cfg, _ := cli.forGate(gate) // checked at startup
+	v.session = sessions.Start(&cfg, callOptions{Gate: gate, Source: "visit " + from, Approval: v.approval, Trace: requestTrace(r)})
+	v.ID = v.approval.ID
+	_, a, filed := approvals.get(v.ID)
+	if !filed { // too many calls waiting for approval
+		visitors.mu.Unlock()
+		visitRequests.inc("result", "busy")
+		writeAPIError(w, r, http.StatusTooManyRequests, errRateLimited, "visit_busy")
+		return
+	}
+	visitors.visits[v.ID] = v
+	visitors.mu.Unlock()
+
+	visitRequests.inc("result", "requested")
+	v.session.log.Printf("%s (%s) asks to be let in through %s\n", name, from, cmp.Or(cli.Visitor, defaultGate))
+	auditRequest(r, auditVisitRequested, "", fmt.Sprintf("%s: %s", v.session.ID, name))
+	link := visitDecideLink(r, v)
+	text := fmt.Sprintf("%s is at the gate and asks to be let in", name)
+	if notifications != nil {
+		notifications.send(notification{
+			Event: notifyVisitRequest, Gate: cmp.Or(cli.Visitor, defaultGate), Since: displayTime(v.session.StartedAt),
+			CallID: v.session.ID, Text: text, Link: link,
+		})
+	}
+	sendTelegram(text, link)
+	writeJSON(w, http.StatusCreated, map[string]any{"id": v.ID, "key": v.key, "expires": a.Expires})
+}
+
+// visitorName cleans up the name a visitor gave: control characters dropped,
+// spaces collapsed, and cut to maxVisitorName characters.
+func visitorName(s string) string {
+	s = strings.Join(strings.Fields(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)), " ")
+	if r := []rune(s); len(r) > maxVisitorName {
+		s = string(r[:maxVisitorName])
+	}
+	return s
+}
+
+// visitDecideLink is the residents' link to decide v, as r reached the server,
+// with the key in the fragment like guestLink.
+func visitDecideLink(r *http.Request, v *visit) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/visit/decide/%s#key=%s", scheme, r.Host, v.ID, v.decideKey)
+}
+
+// verifyCaptcha checks a widget response with the --visitor-captcha service.
+func (d *visitDesk) verifyCaptcha(response, remoteIP string) error {
+	if response == "" {
+		return errors.New("no response")
+	}
+	form := url.Values{"secret": {cli.CaptchaSecret}, "response": {response}, "remoteip": {remoteIP}}
+	resp, err := d.client.PostForm(captchaVerifyURLs[cli.VisitorCaptcha], form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool     `json:"success"`
+		Errors  []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("%s: %w", resp.Status, err)
+	}
+	if !result.Success {
+		return fmt.Errorf("rejected (%s)", strings.Join(result.Errors, ", "))
+	}
+	return nil
+}
+
+// pendingLocked forgets the visits the approval engine has forgotten, and counts
+// those still waiting.
+func (d *visitDesk) pendingLocked() int {
+	n := 0
+	for id := range d.visits {
+		_, a, ok := approvals.get(id)
+		switch {
+		case !ok:
+			delete(d.visits, id)
+		case a.State == approvalPending:
+			n++
+		}
+	}
+	return n
+}
+
+// lookup returns the request id if key is the visitor's or the residents' key
+// to it, and whether it was the residents'.
+func (d *visitDesk) lookup(id, key string) (v *visit, resident bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v = d.visits[id]
+	switch {
+	case v == nil || key == "":
+		return nil, false
+	case subtle.ConstantTimeCompare([]byte(key), []byte(v.decideKey)) == 1:
+		return v, true
+	case subtle.ConstantTimeCompare([]byte(key), []byte(v.key)) == 1:
+		return v, false
+	}
+	return nil, false
+}
+
+// visitStatus is GET /visit/request/{id}.
+type visitStatus struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	At        time.Time     `json:"at"`
+	Expires   time.Time     `json:"expires"`
+	State     string        `json:"state"` // of its approval
+	Gate      string        `json:"gate"`
+	From      string        `json:"from,omitempty"` // for the residents
+	DecidedBy string        `json:"decided_by,omitempty"`
+	Call      *callResponse `json:"call,omitempty"` // once approved
+}
+
+func (v *visit) status(resident bool) visitStatus {
+	_, a, _ := approvals.get(v.ID)
+	st := visitStatus{
+		ID: v.ID, Name: v.Name, At: a.At, Expires: a.Expires,
+		State: cmp.Or(a.State, approvalExpired), Gate: a.Gate,
+	}
+	if resident {
+		st.From, st.DecidedBy = v.From, a.DecidedBy
+	}
+	if st.State == approvalApproved {
+		call := newCallResponse(v.session)
+		st.Call = &call
+	}
+	return st
+}
+
+// handleVisitStatus is GET /visit/request/{id}, with the visitor's or the
+// residents' key in X-Visit-Key.
+func handleVisitStatus(w http.ResponseWriter, r *http.Request) {
+	v, resident := visitors.lookup(chi.URLParam(r, "id"), r.Header.Get("X-Visit-Key"))
+	if v == nil {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "visit_not_found")
+		return
+	}
+	writeJSON(w, http.StatusOK, v.status(resident))
+}
+
+// handleVisitDecidePage is GET /visit/decide/{id}: the residents' page, which reads
+// the key from the fragment. It decides nothing by itself.
+func handleVisitDecidePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	fmt.Fprint(w, visitDecideHTML)
+}
+
+// visitDecision is POST /visit/decide/{id}.
+type visitDecision struct {
+	Key      string `json:"key"`
+	Decision string `json:"decision"` // approve or deny
+}
+
+// handleVisitDecide is POST /visit/decide/{id}: approve (opening the gate) or deny
+// a pending request. 409 once it is decided or expired.
+func handleVisitDecide(w http.ResponseWriter, r *http.Request) {
+	var req visitDecision
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+		return
+	}
+	if req.Decision != "approve" && req.Decision != "deny" {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "visit_bad_decision")
+		return
+	}
+	v, resident := visitors.lookup(chi.URLParam(r, "id"), req.Key)
+	if v == nil || !resident {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "visit_not_found")
+		return
+	}
+	by := callSource("resident", r)
+	if state, ok := decideApproval(r, v.approval, req.Decision == "approve", by); !ok {
+		writeAPIError(w, r, http.StatusConflict, errBadRequest, "visit_decided", state)
+		return
+	}
+	if req.Decision == "approve" {
+		logInfo("%s let %s in\n", by, v.Name)
+	} else {
+		logInfo("%s denied %s's request to be let in\n", by, v.Name)
+	}
+	writeJSON(w, http.StatusOK, v.status(true))
+}
+
+const visitPageStyle = `
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style>
+        :root {
+            --main-green: #00ff00;
+            --main-grey: #888;
+            --main-red: #ff4444;
+        }
+
+        body {
+            margin: 0;
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            background: black;
+            color: white;
+            font-family: system-ui, sans-serif;
+        }
+
+        main {
+            width: 100%;
+            max-width: 360px;
+            padding: 24px;
+            text-align: center;
+        }
+
+        h1 {
+            color: var(--main-green);
+            font-size: 1.5rem;
+        }
+
+        input[type=text] {
+            width: 100%;
+            box-sizing: border-box;
+            padding: 10px;
+            margin-bottom: 16px;
+            background: #111;
+            color: white;
+            border: 1px solid var(--main-grey);
+            border-radius: 6px;
+            font-size: 1rem;
+        }
+
+        .buttons {
+            display: flex;
+            gap: 12px;
+            margin-top: 16px;
+        }
+
+        button {
+            flex: 1;
+            padding: 14px;
+            background: transparent;
+            color: var(--main-green);
+            border: 2px solid currentColor;
+            border-radius: 6px;
+            font-size: 1.1rem;
+            font-weight: 600;
+            cursor: pointer;
+        }
+
+        button.deny {
+            color: var(--main-red);
+        }
+
+        button:disabled {
+            color: var(--main-grey);
+            cursor: default;
+        }
+
+        #state {
+            margin-top: 20px;
+            min-height: 1.5em;
+        }
+    </style>`
+
+const visitHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Iftach — Request entry</title>` + visitPageStyle + `
+</head>
+<body>
+<main>
+    <h1>Request entry</h1>
+    <input type="text" id="name" maxlength="60" placeholder="Your name" autocomplete="name">
+    <!--captcha-->
+    <div class="buttons"><button id="ask">Request entry</button></div>
+    <div id="state"></div>
+</main>
+<script>
+    const STATES = {
+        pending: 'Waiting for a resident to answer...',
+        approved: 'Approved — the gate is opening',
+        denied: 'Sorry, your request was declined',
+        expired: 'Nobody answered — please try again',
+    };
+    const ask = document.getElementById('ask');
+    const state = document.getElementById('state');
+
+    function captcha() {
+        const field = document.querySelector('[name=cf-turnstile-response], [name=h-captcha-response]');
+        return field ? field.value : '';
+    }
+
+    async function follow(id, key) {
+        const res = await fetch('/visit/request/' + id, {headers: {'X-Visit-Key': key}});
+        if (!res.ok) {
+            state.textContent = (await res.json()).error;
+            ask.disabled = false;
+            return;
+        }
+        const v = await res.json();
+        state.textContent = STATES[v.state] || v.state;
+        if (v.state === 'pending') {
+            setTimeout(() => follow(id, key), 2000);
+        } else if (v.state !== 'approved') {
+            ask.disabled = false;
+        }
+    }
+
+    ask.onclick = async () => {
+        ask.disabled = true;
+        state.textContent = '';
+        const res = await fetch('/visit/request', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({name: document.getElementById('name').value, captcha: captcha()}),
+        });
+        const body = await res.json();
+        if (!res.ok) {
+            state.textContent = body.error;
+            ask.disabled = false;
+            if (window.turnstile) turnstile.reset();
+            if (window.hcaptcha) hcaptcha.reset();
+            return;
+        }
+        follow(body.id, body.key);
+    };
+</script>
+</body>
+</html>
+`
+
+const visitDecideHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Iftach — Visitor</title>` + visitPageStyle + `
+</head>
+<body>
+<main>
+    <h1 id="who">Visitor</h1>
+    <div id="when"></div>
+    <div class="buttons">
+        <button id="approve" disabled>Approve</button>
+        <button id="deny" class="deny" disabled>Deny</button>
+    </div>
+    <div id="state"></div>
+</main>
+<script>
+    const id = location.pathname.split('/').pop();
+    const key = new URLSearchParams(location.hash.slice(1)).get('key') || '';
+    const state = document.getElementById('state');
+    const buttons = [document.getElementById('approve'), document.getElementById('deny')];
+
+    function show(v) {
+        document.getElementById('who').textContent = v.name;
+        document.getElementById('when').textContent = 'at the ' + v.gate + ' gate since ' +
+            new Date(v.at).toLocaleTimeString() + (v.from ? ' (' + v.from + ')' : '');
+        const pending = v.state === 'pending';
+        buttons.forEach(b => b.disabled = !pending);
+        state.textContent = pending ? '' : v.state + (v.call ? ' — call ' + v.call.status : '');
+    }
+
+    async function load() {
+        const res = await fetch('/visit/request/' + id, {headers: {'X-Visit-Key': key}});
+        const body = await res.json();
+        if (!res.ok) {
+            state.textContent = body.error;
+            return;
+        }
+        show(body);
+        if (body.call && !body.call.done) setTimeout(load, 2000);
+    }
+
+    async function decide(decision) {
+        buttons.forEach(b => b.disabled = true);
+        const res = await fetch('/visit/decide/' + id, {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({key, decision}),
+        });
+        const body = await res.json();
+        if (!res.ok) {
+            state.textContent = body.error;
+            return;
+        }
+        show(body);
+        if (body.call) setTimeout(load, 2000);
+    }
+
+    buttons[0].onclick = () => decide('approve');
+    buttons[1].onclick = () => decide('deny');
+    load();
+</script>
+</body>
+</html>
+`
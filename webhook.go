@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"myphone/parse"
+)
+
+// Inbound webhooks (a plate reader, an SMS gateway, a presence service) live at
+// URLs that are exposed by design, so a token in the URL isn't enough: one leaked
+// or captured request could be sent again to open the gate. Every route under
+// /api/hooks/{integration}/ goes through signedWebhook, which takes the
+// integration's secret from --webhook-secrets and requires
+//
+//	X-Iftach-Timestamp: <unix seconds>
+//	X-Iftach-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// A timestamp more than --webhook-skew off our clock is refused, and so is a
+// signature already accepted within that window. Receivers read the body as
+// usual; it has been checked by the time they see it.
+
+var webhookRejects = newCounter("iftach_webhook_rejected_total", "Inbound webhooks refused by integration and reason (unsigned, stale, bad_signature, replayed).")
+
+// webhookSeen remembers signatures accepted within --webhook-skew, until when.
+// A restart forgets them, which --webhook-skew bounds.
+var webhookSeen = struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}{until: map[string]time.Time{}}
+
+// mountWebhooks adds the inbound webhook receivers.
+func mountWebhooks(r chi.Router) {
+	r.Route("/api/hooks/{integration}", func(r chi.Router) {
+		r.Use(signedWebhook)
+		r.Post("/open", handleHookOpen)
+	})
+}
+
+// signedWebhook lets through only requests signed with the integration's secret,
+// fresh, and not seen before.
+func signedWebhook(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "integration")
+		secret, ok := cli.WebhookSecrets[name]
+		if !ok {
+			writeAPIError(w, r, http.StatusNotFound, errNotFound, "webhook_unknown", name)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, parse.MaxWebhookBody))
+		if err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+			return
+		}
+		if reason := checkWebhook(name, secret, r.Header, body, time.Now()); reason != "" {
+			webhookRejects.inc("integration", name, "reason", reason)
+			logWarn("Refused %s webhook (%s): %s\n", name, callSource("from", r), reason)
+			writeAPIError(w, r, http.StatusUnauthorized, errAuth, "webhook_"+reason)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkWebhook returns why a request to integration name must be refused, or ""
+// (and remembers its signature) if it may pass.
+func checkWebhook(name, secret string, h http.Header, body []byte, now time.Time) string {
+	ts := h.Get("X-Iftach-Timestamp")
+	at, got, err := parse.Signature(ts, h.Get("X-Iftach-Signature"))
+	switch {
+	case errors.Is(err, parse.ErrUnsigned):
+		return "unsigned"
+	case errors.Is(err, parse.ErrBadTimestamp):
+		return "stale"
+	case err != nil:
+		return "bad_signature"
+	}
+	if at.Before(now.Add(-cli.WebhookSkew)) || at.After(now.Add(cli.WebhookSkew)) {
+		return "stale"
+	}
+	if !hmac.Equal(got, webhookSignature(secret, ts, body)) {
+		return "bad_signature"
+	}
+
+	webhookSeen.mu.Lock()
+	defer webhookSeen.mu.Unlock()
+	for k, until := range webhookSeen.until {
+		if now.After(until) {
+			delete(webhookSeen.until, k)
+		}
+	}
+	key := name + " " + hex.EncodeToString(got)
+	if _, ok := webhookSeen.until[key]; ok {
+		return "replayed"
+	}
+	webhookSeen.until[key] = at.Add(cli.WebhookSkew)
+	return ""
+}
+
+// webhookSignature is the HMAC-SHA256 a sender puts in X-Iftach-Signature.
+func webhookSignature(secret, ts string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// handleHookOpen is POST /api/hooks/{integration}/open: a signed webhook opening a
+// gate, e.g. a plate reader that recognised a resident's car. The body, which the
+// signature covers, is {"gate": name} (empty for the default gate), optionally with
+// "dry_run": true. It answers 202 with the call, like POST /api/call?wait=accepted.
+func handleHookOpen(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body) // read and capped by signedWebhook
+	req, err := parse.HookOpen(body)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, errBadRequest, "invalid_json", err)
+		return
+	}
+	cfg, ok := cli.forGate(req.Gate)
+	if !ok {
+		writeAPIError(w, r, http.StatusNotFound, errNotFound, "gate_unknown", req.Gate)
+		return
+	}
+	name := chi.URLParam(r, "integration")
+	opts := callOptions{DryRun: req.DryRun, Gate: req.Gate, Source: callSource("hook "+name, r), Trace: requestTrace(r)}
+	s := sessions.Start(&cfg, opts)
+	s.log.Printf("%s webhook opens %s\n", name, cmp.Or(req.Gate, defaultGate))
+	writeJSON(w, http.StatusAccepted, newCallResponse(s))
+}
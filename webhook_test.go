@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// signedHeaders signs body with secret at ts, as a sender does.
+func signedHeaders(secret string, ts time.Time, body []byte) http.Header {
+	stamp := strconv.FormatInt(ts.Unix(), 10)
+	h := http.Header{}
+	h.Set("X-Iftach-Timestamp", stamp)
+	h.Set("X-Iftach-Signature", "sha256="+hex.EncodeToString(webhookSignature(secret, stamp, body)))
+	return h
+}
+
+// withWebhooks sets --webhook-skew and --webhook-secrets, and forgets the
+// signatures seen, for the length of the test.
+func withWebhooks(t *testing.T, skew time.Duration, secrets map[string]string) {
+	t.Helper()
+	prevSkew, prevSecrets := cli.WebhookSkew, cli.WebhookSecrets
+	cli.WebhookSkew, cli.WebhookSecrets = skew, secrets
+	webhookSeen.mu.Lock()
+	webhookSeen.until = map[string]time.Time{}
+	webhookSeen.mu.Unlock()
+	t.Cleanup(func() { cli.WebhookSkew, cli.WebhookSecrets = prevSkew, prevSecrets })
+}
+
+func TestCheckWebhook(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	body := []byte(`{"gate":"outer"}`)
+	tests := []struct {
+		name    string
+		headers func() http.Header
+		want    string
+	}{
+		{"signed", func() http.Header { return signedHeaders("s3cret", now, body) }, ""},
+		{"within skew", func() http.Header { return signedHeaders("s3cret", now.Add(-4*time.Minute), body) }, ""},
+		{"unsigned", func() http.Header { return http.Header{} }, "unsigned"},
+		{"no signature", func() http.Header {
+			h := signedHeaders("s3cret", now, body)
+			h.Del("X-Iftach-Signature")
+			return h
+		}, "unsigned"},
+		{"wrong secret", func() http.Header { return signedHeaders("guessed", now, body) }, "bad_signature"},
+		{"other body", func() http.Header { return signedHeaders("s3cret", now, []byte(`{"gate":"inner"}`)) }, "bad_signature"},
+		{"signature of another timestamp", func() http.Header {
+			h := signedHeaders("s3cret", now, body)
+			h.Set("X-Iftach-Timestamp", strconv.FormatInt(now.Unix()+1, 10))
+			return h
+		}, "bad_signature"},
+		{"malformed signature", func() http.Header {
+			h := signedHeaders("s3cret", now, body)
+			h.Set("X-Iftach-Signature", "sha256=zz")
+			return h
+		}, "bad_signature"},
+		{"sha1 signature", func() http.Header {
+			h := signedHeaders("s3cret", now, body)
+			h.Set("X-Iftach-Signature", strings.Replace(h.Get("X-Iftach-Signature"), "sha256=", "sha1=", 1))
+			return h
+		}, "bad_signature"},
+		{"stale", func() http.Header { return signedHeaders("s3cret", now.Add(-6*time.Minute), body) }, "stale"},
+		{"from the future", func() http.Header { return signedHeaders("s3cret", now.Add(6*time.Minute), body) }, "stale"},
+		{"bad timestamp", func() http.Header {
+			h := signedHeaders("s3cret", now, body)
+			h.Set("X-Iftach-Timestamp", "yesterday")
+			return h
+		}, "stale"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withWebhooks(t, 5*time.Minute, nil)
+			if got := checkWebhook("plates", "s3cret", tt.headers(), body, now); got != tt.want {
+				t.Errorf("checkWebhook = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckWebhookReplay(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	body := []byte(`{}`)
+	h := signedHeaders("s3cret", now, body)
+	tests := []struct {
+		name        string
+		integration string
+		at          time.Time
+		want        string
+	}{
+		{"first", "plates", now, ""},
+		{"again", "plates", now.Add(time.Second), "replayed"},
+		{"again, near the end of the skew", "plates", now.Add(4 * time.Minute), "replayed"},
+		{"to another integration", "sms", now.Add(time.Second), ""},
+		{"after the skew", "plates", now.Add(6 * time.Minute), "stale"},
+	}
+	withWebhooks(t, 5*time.Minute, nil)
+	for _, tt := range tests {
+		if got := checkWebhook(tt.integration, "s3cret", h, body, tt.at); got != tt.want {
+			t.Errorf("%s: checkWebhook = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSignedWebhookRefuses(t *testing.T) {
+	withWebhooks(t, 5*time.Minute, map[string]string{"plates": "s3cret"})
+	body := []byte(`{"gate":"outer"}`)
+	r := chi.NewRouter()
+	r.Route("/api/hooks/{integration}", func(r chi.Router) {
+		r.Use(signedWebhook)
+		r.Post("/open", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) })
+	})
+	post := func(integration string, h http.Header) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/hooks/"+integration+"/open", strings.NewReader(string(body)))
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	signed := signedHeaders("s3cret", time.Now(), body)
+	tests := []struct {
+		name        string
+		integration string
+		headers     http.Header
+		want        int
+	}{
+		{"unknown integration", "sms", signed, http.StatusNotFound},
+		{"unsigned", "plates", http.Header{}, http.StatusUnauthorized},
+		{"bad signature", "plates", signedHeaders("guessed", time.Now(), body), http.StatusUnauthorized},
+		{"stale", "plates", signedHeaders("s3cret", time.Now().Add(-time.Hour), body), http.StatusUnauthorized},
+		{"signed", "plates", signed, http.StatusAccepted},
+		{"replayed", "plates", signed, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := post(tt.integration, tt.headers); got != tt.want {
+			t.Errorf("%s: POST = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+
+	"myphone/parse"
+)
+
+// uiVersion is baked into the served UI, which reports it back in its hello
+// message. A PWA cached by a service worker keeps reporting its old version, so
+// iftach_ws_client_versions_total shows stale UIs still in the field after an upgrade.
+const uiVersion = "2026.10.16"
+
+// wsProtocol is the version of the /call message stream. Bump it whenever a change
+// (new statuses, new fields the UI must act on) would be misread by an older UI:
+// UIs whose hello carries a lower protocol get upgrade_required instead of a call.
+// Keep PROTOCOL in callJS in sync.
+const wsProtocol = 6
+
+// helloWait is how long /call waits for the client's hello before treating it as a
+// legacy client (scripts, pre-handshake UIs) and starting the call anyway.
+const helloWait = 500 * time.Millisecond
+
+var (
+	wsConnects     = newCounter("iftach_ws_connections_total", "WebSocket /call connections accepted.")
+	wsActive       = newGauge("iftach_ws_connections_active", "WebSocket /call connections currently open.")
+	wsAuthFailures = newCounter("iftach_ws_auth_failures_total", "WebSocket /call connections closed with 4001 (wrong token) or 4005 (expired named token).")
+	wsDisconnects  = newCounter("iftach_ws_disconnects_total", "WebSocket /call disconnects by reason: completed (server closed after the call), client_closed (clean close by the client mid-call), upgrade_required (stale UI sent away), resume_not_found (resumed call no longer known), gate_unknown (/call/{gate} names no gate), gate_forbidden (a named token may not open it), token_in_use (its one-time token is held by another call), token_lost (its named token was revoked or ran out since the connection opened), abnormal (dropped or errored connection).")
+	wsDropped      = newCounter("iftach_ws_messages_dropped_total", "Status messages dropped because a WebSocket client's backlog was full.")
+	wsVersions     = newCounter("iftach_ws_client_versions_total", "WebSocket /call connections by the UI version from the client's hello (none = no hello, i.e. a UI older than the handshake).")
+	wsUpgrades     = newCounter("iftach_ws_upgrade_required_total", "Stale UIs told to reload (hello protocol older than the server's).")
+	wsResumes      = newCounter("iftach_ws_resumes_total", "WebSocket /call reconnects that resumed a call (?resume=ID) instead of placing one.")
+)
+
+// clientMessage is what a client may send on /call: a hello, and from protocol 6
+// the commands (see handleCallWS).
+type clientMessage = parse.ClientMessage
+
+// serverMessage is a non-status message on /call: the hello reply, upgrade_required
+// for a UI that speaks an older protocol, call with the ID to resume it by, and the
+// replies to commands. Only clients that sent a hello ever get one, so legacy
+// clients keep seeing status messages only.
+type serverMessage struct {
+	Type     string    `json:"type"`
+	Protocol int       `json:"protocol,omitempty"`
+	CallID   string    `json:"call_id,omitempty"`
+	Gate     string    `json:"gate,omitempty"`   // gate, confirm_required
+	Status   string    `json:"status,omitempty"` // ended: the call's last status
+	Code     errorCode `json:"code,omitempty"`   // ended, error
+	For      string    `json:"for,omitempty"`    // error: the command refused
+	Detail   string    `json:"detail,omitempty"` // error
+	ID       string    `json:"id,omitempty"`     // pong
+}
+
+// wsCommandProtocol is the first protocol with client commands.
+const wsCommandProtocol = 6
+
+// confirmWait is how long a start with confirm waits for the confirm.
+const confirmWait = 30 * time.Second
+
+var wsCommands = newCounter("iftach_ws_commands_total", "WebSocket /call client commands by type (start, confirm, cancel, select_gate, ping, unknown) and result (ok, refused).")
+
+// metricLabel keeps client-supplied label values from blowing up series cardinality.
+var metricLabel = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+
+// Close codes of a failed call, by its error code's class.
+const (
+	wsCloseCallFailed  = 4010 // the provider or the far end failed it: SIP errors, no 100 Trying, no answer
+	wsCloseCallBusy    = 4011 // E_BUSY
+	wsCloseCallRefused = 4012 // never dialled: --dial-allow, the dial plan, the budget, approval, standby
+	wsCloseCallError   = 4013 // failed on our side: no public IP, the SIP stack, anything else
+)
+
+// wsCloseCode is the close code for a call that failed with code.
+func wsCloseCode(code errorCode) int {
+	switch code {
+	case errBusy:
+		return wsCloseCallBusy
+	case errSipAuth, errNoTrying, errSip4xx, errSip5xx, errSip6xx, errRedirect, errProviderDown, errNoAnswer, errIntercom:
+		return wsCloseCallFailed
+	case errDialRefused, errBadNumber, errBudget, errNotApproved, errStandby:
+		return wsCloseCallRefused
+	default:
+		return wsCloseCallError
+	}
+}
+
+// handleCallWS is WebSocket /call: authenticate, handshake, start a call, stream its
+// statuses and close once it is over. /call/{gate} opens that --gates gate instead
+// of the --destination one; an unknown gate closes with 4004, and one the named
+// call token may not open with 4003. A wrong token closes with 4001, and a named
+// one outside its validity window, or a one-time one used up or held by another
+// call, with 4005.
+//
+// Once the call is over the server closes with 1000, or, if it failed, with the
+// close code of its error code's class (see wsCloseCode) and the error code as
+// the reason.
+//
+// Handshake: the UI sends {"type":"hello","ui_version":...,"protocol":N} on open.
+// The server answers {"type":"hello","protocol":M}, or, if N < M, sends
+// {"type":"upgrade_required","protocol":M} and closes with 4002 without calling.
+// After a hello the server also sends {"type":"call","call_id":...}. Every status
+// message carries the call_id too, the one of the log lines, the history record
+// and the callbacks and notifications about the call.
+//
+// Resume: /call?resume=ID attaches to call ID instead of placing a new one (the UI
+// reconnecting after a dropped socket), replaying its statuses so far. An ID the
+// server no longer knows closes with 4004.
+//
+// A named token is checked again for every call the connection places: one
+// revoked since the connection opened closes it with 4001, and one that expired or
+// was used up with 4005.
+//
+// Commands (protocol 6): after a hello with protocol 6 or later, the client may
+// send these, each refused with {"type":"error","for":TYPE,"code":...,"detail":...}
+// when it can't be carried out:
+//   - {"type":"cancel"} ends the call (CANCEL, or BYE if answered) with the status
+//     cancelled, or drops a start waiting for its confirm;
+//   - {"type":"ping","id":...} is answered {"type":"pong","id":...};
+//   - {"type":"select_gate","gate":NAME} picks the gate the next start opens (""
+//     for the default one), answered {"type":"gate","gate":NAME}.
+//
+// A hello with "commands": true also places no call by itself; instead:
+//   - {"type":"start","dry_run":bool} places one, answered with the call message
+//     and its statuses, then {"type":"ended","call_id","status","code"} once it is
+//     over. The socket stays open for the next start until the client closes it;
+//   - a start with "confirm": true is answered {"type":"confirm_required","gate"},
+//     its gate and token checked, and dials only on {"type":"confirm"} within
+//     confirmWait.
+func handleCallWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	wsConnects.inc()
+	wsActive.add(1)
+	defer wsActive.add(-1)
+	token, ok := callAuth(r)
+	if !ok {
+		wsAuthFailures.inc()
+		code, closeCode := callAuthFailure(r), 4001
+		auditRequest(r, auditAuthFailed, code, "")
+		if code == errTokenExpired || code == errTokenUsed {
+			closeCode = 4005
+		}
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, string(code)))
+		return
+	}
+
+	// Whichever side ends the connection first decides the disconnect reason.
+	var once sync.Once
+	disconnect := func(reason string) { once.Do(func() { wsDisconnects.inc("reason", reason) }) }
+
+	var mu sync.Mutex
+	version := "none"
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		wsVersions.inc("ui_version", version)
+	}()
+
+	// Reader: handles hellos, commands (once a hello allowed them) and control
+	// frames, and notices the client going away (gone receives whether it closed
+	// rather than dropped the connection).
+	hello := make(chan clientMessage, 1)
+	commands := make(chan clientMessage, 16)
+	gone := make(chan bool, 1)
+	conn.SetReadLimit(parse.MaxWSMessage)
+	go func() {
+		speaksCommands := false
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				closed := websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+				if closed {
+					disconnect("client_closed")
+				} else {
+					disconnect("abnormal")
+				}
+				gone <- closed
+				return
+			}
+			msg, err := parse.WSMessage(data)
+			if err != nil {
+				continue
+			}
+			if msg.Type != "hello" {
+				if speaksCommands {
+					select {
+					case commands <- msg:
+					default:
+						wsCommands.inc("type", "unknown", "result", "refused") // flooding
+					}
+				}
+				continue
+			}
+			speaksCommands = msg.Protocol >= wsCommandProtocol
+			v := msg.UIVersion
+			if !metricLabel.MatchString(v) {
+				v = "invalid"
+			}
+			mu.Lock()
+			version = v
+			mu.Unlock()
+			select {
+			case hello <- msg:
+			default:
+			}
+		}
+	}()
+
+	helloed, commandMode := false, false
+	select {
+	case msg := <-hello:
+		// Protocol 0 is a hello from before the handshake existed: that UI can't act
+		// on upgrade_required, and handles the current stream fine, so serve it.
+		if msg.Protocol != 0 && msg.Protocol < wsProtocol {
+			logInfo("Stale UI %s (protocol %d < %d) — asking it to reload.\n", msg.UIVersion, msg.Protocol, wsProtocol)
+			wsUpgrades.inc()
+			disconnect("upgrade_required")
+			_ = conn.WriteJSON(serverMessage{Type: "upgrade_required", Protocol: wsProtocol})
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4002, "upgrade required"))
+			return
+		}
+		_ = conn.WriteJSON(serverMessage{Type: "hello", Protocol: wsProtocol})
+		helloed = true
+		commandMode = msg.Commands && msg.Protocol >= wsCommandProtocol
+	case <-time.After(helloWait):
+		// Legacy client: no handshake, plain status stream.
+	}
+
+	c := &wsCaller{r: r, token: token, gate: chi.URLParam(r, "gate"), dryRun: r.URL.Query().Get("dry_run") == "1"}
+	if id := r.URL.Query().Get("resume"); id != "" {
+		var ok bool
+		if c.s, ok = sessions.Get(id); !ok || !token.allows(c.s.Gate) {
+			disconnect("resume_not_found")
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4004, "call not found"))
+			return
+		}
+		wsResumes.inc()
+	} else if !commandMode {
+		if code := c.place(c.dryRun); code != "" {
+			closeCode, reason := map[errorCode]int{errNotFound: 4004, errForbidden: 4003, errTokenUsed: 4005, errTokenExpired: 4005, errAuth: 4001}[code], string(code)
+			switch {
+			case c.lost != "":
+				disconnect("token_lost")
+			case code == errNotFound:
+				disconnect("gate_unknown")
+				reason = "gate not found"
+			case code == errForbidden:
+				disconnect("gate_forbidden")
+			case code == errTokenUsed:
+				disconnect("token_in_use")
+			}
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason))
+			return
+		}
+	}
+
+	// Stream the call's statuses until run() exits. A client leaving mid-call hangs
+	// it up, or not, per --ws-disconnect (see leave).
+	var statuses <-chan callStatusMsg
+	follow := func() {
+		if helloed {
+			_ = conn.WriteJSON(serverMessage{Type: "call", CallID: c.s.ID})
+		}
+		c.s.attach()
+		statuses = c.s.Subscribe()
+	}
+	if c.s != nil {
+		follow()
+	}
+	var confirmBy <-chan time.Time
+	for {
+		select {
+		case closed := <-gone:
+			if c.s != nil {
+				c.s.leave(closed, callSource("ws disconnect", r))
+			}
+			return
+		case msg, ok := <-statuses:
+			if ok {
+				_ = conn.WriteJSON(msg)
+				continue
+			}
+			statuses = nil
+			last := c.s.Status()
+			if !commandMode {
+				disconnect("completed")
+				closeCode, reason := websocket.CloseNormalClosure, "call finished"
+				if last.Code != "" {
+					closeCode, reason = wsCloseCode(last.Code), string(last.Code)
+				}
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason))
+				return
+			}
+			_ = conn.WriteJSON(serverMessage{Type: "ended", CallID: c.s.ID, Status: last.Status, Code: last.Code})
+			c.s.leave(true, "") // over: only drops the count
+			c.s = nil
+		case <-confirmBy:
+			confirmBy, c.pending = nil, false
+			_ = conn.WriteJSON(serverMessage{Type: "error", For: "confirm", Code: errBadRequest, Detail: fmt.Sprintf("not confirmed within %v", confirmWait)})
+		case cmd := <-commands:
+			reply, code, detail := c.command(cmd, commandMode)
+			result := "ok"
+			if code != "" {
+				result = "refused"
+				reply = &serverMessage{Type: "error", For: cmd.Type, Code: code, Detail: cmp.Or(detail, code.Message())}
+			}
+			if metricLabel.MatchString(cmd.Type) && wsCommandTypes[cmd.Type] {
+				wsCommands.inc("type", cmd.Type, "result", result)
+			} else {
+				wsCommands.inc("type", "unknown", "result", result)
+			}
+			if reply != nil {
+				_ = conn.WriteJSON(reply)
+			}
+			if c.lost != "" {
+				// Revoked or run out since the connection opened: closed as at connect.
+				disconnect("token_lost")
+				closeCode := 4005
+				if c.lost == errAuth {
+					closeCode = 4001
+				}
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, string(c.lost)))
+				return
+			}
+			switch {
+			case c.pending && confirmBy == nil:
+				confirmBy = time.After(confirmWait)
+			case !c.pending:
+				confirmBy = nil
+			}
+			if c.s != nil && statuses == nil {
+				follow()
+			}
+		}
+	}
+}
+
+var wsCommandTypes = map[string]bool{"start": true, "confirm": true, "cancel": true, "select_gate": true, "ping": true}
+
+// wsCaller is the call side of one /call connection: the gate it opens, and the
+// call it follows, if any.
+type wsCaller struct {
+	r       *http.Request
+	token   *namedToken
+	gate    string
+	dryRun  bool         // ?dry_run=1: every call is a dry run
+	pending bool         // a start waits for its confirm
+	pendDry bool         // that start is a dry run
+	s       *callSession // the call followed, nil between calls in command mode
+	lost    errorCode    // the token was revoked or ran out since the connection opened
+}
+
+// place starts a call to c.gate, or returns why it may not. The token is checked
+// again for every call, as a command mode connection places calls for as long as
+// it stays open: one revoked or expired meanwhile sets lost.
+func (c *wsCaller) place(dryRun bool) errorCode {
+	token, code := tokens.recheck(c.token)
+	if code != "" {
+		c.lost = code
+		return code
+	}
+	c.token = token
+	cfg, ok := cli.forGate(c.gate)
+	if !ok {
+		return errNotFound
+	}
+	if !c.token.allows(c.gate) {
+		return errForbidden
+	}
+	token = c.token
+	if dryRun {
+		token = nil // a dry run doesn't use up a one-time token
+	}
+	if !tokens.claim(token) {
+		return errTokenUsed
+	}
+	opts := callOptions{DryRun: dryRun, Gate: c.gate, Source: callSource("ws", c.r), User: c.token.user(), Duress: c.token.underDuress(), Trace: requestTrace(c.r)}
+	c.s = sessions.Start(&cfg, opts)
+	tokens.settle(token, c.s)
+	return ""
+}
+
+// command carries out a client command, returning the reply (if any) or why it
+// was refused.
+func (c *wsCaller) command(cmd clientMessage, commandMode bool) (*serverMessage, errorCode, string) {
+	running := c.s != nil && !c.s.Done()
+	switch cmd.Type {
+	case "ping":
+		return &serverMessage{Type: "pong", ID: cmd.ID}, "", ""
+	case "select_gate":
+		gate := cmd.Gate
+		if gate == defaultGate {
+			gate = ""
+		}
+		if _, ok := cli.forGate(gate); !ok {
+			return nil, errNotFound, fmt.Sprintf("no gate %q", cmd.Gate)
+		}
+		if !c.token.allows(gate) {
+			return nil, errForbidden, ""
+		}
+		c.gate = gate
+		return &serverMessage{Type: "gate", Gate: cmp.Or(gate, defaultGate)}, "", ""
+	case "start":
+		switch {
+		case !commandMode:
+			return nil, errBadRequest, "this connection placed its call already (send a hello with commands: true)"
+		case running || c.pending:
+			return nil, errBadRequest, "a call is already in progress"
+		}
+		if cmd.Confirm {
+			if _, ok := cli.forGate(c.gate); !ok {
+				return nil, errNotFound, ""
+			}
+			if !c.token.allows(c.gate) {
+				return nil, errForbidden, ""
+			}
+			c.pending, c.pendDry = true, cmd.DryRun || c.dryRun
+			return &serverMessage{Type: "confirm_required", Gate: cmp.Or(c.gate, defaultGate)}, "", ""
+		}
+		if code := c.place(cmd.DryRun || c.dryRun); code != "" {
+			return nil, code, ""
+		}
+		return nil, "", ""
+	case "confirm":
+		if !c.pending {
+			return nil, errBadRequest, "nothing to confirm"
+		}
+		c.pending = false
+		if code := c.place(c.pendDry); code != "" {
+			return nil, code, ""
+		}
+		return nil, "", ""
+	case "cancel":
+		switch {
+		case c.pending:
+			c.pending = false
+			return &serverMessage{Type: "ended", Gate: cmp.Or(c.gate, defaultGate), Status: statusCancelled}, "", ""
+		case running:
+			c.s.hangup(statusCancelled, callSource("ws cancel", c.r))
+			return nil, "", ""
+		}
+		return nil, errBadRequest, "no call to cancel"
+	}
+	return nil, errBadRequest, fmt.Sprintf("unknown command %.32q", cmd.Type)
+}
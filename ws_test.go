@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+// TestCommandModeRechecksToken places a call over a command mode connection, then
+// revokes or expires its named token and asks for another: the connection must be
+// closed rather than open the gate again.
+func TestCommandModeRechecksToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		lose      func(srv *httptest.Server)
+		wantClose int
+	}{
+		{"revoked", func(srv *httptest.Server) {
+			req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/api/admin/tokens/guest", nil)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil || res.StatusCode != http.StatusNoContent {
+				t.Fatalf("DELETE /api/admin/tokens/guest = %v, %v", res, err)
+			}
+		}, 4001},
+		{"expired", func(*httptest.Server) {
+			tokens.mu.Lock()
+			tokens.tokens["guest"].Expires = time.Now().Add(-time.Second)
+			tokens.mu.Unlock()
+		}, 4005},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTokens(t, &namedToken{Name: "guest"})
+			r := chi.NewRouter()
+			r.HandleFunc("/call", handleCallWS)
+			r.Delete("/api/admin/tokens/{name}", handleTokenDelete)
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/call", http.Header{"Authorization": {"Token secret-guest"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.WriteJSON(map[string]any{"type": "hello", "protocol": wsProtocol, "commands": true}); err != nil {
+				t.Fatal(err)
+			}
+			// until reads messages until one of type typ, failing on a close.
+			until := func(typ string) {
+				t.Helper()
+				for {
+					var msg map[string]any
+					if err := conn.ReadJSON(&msg); err != nil {
+						t.Fatalf("waiting for %s: %v", typ, err)
+					}
+					if msg["type"] == typ {
+						return
+					}
+				}
+			}
+			until("hello")
+			if err := conn.WriteJSON(map[string]any{"type": "start", "dry_run": true}); err != nil {
+				t.Fatal(err)
+			}
+			until("ended")
+
+			tt.lose(srv)
+			if err := conn.WriteJSON(map[string]any{"type": "start", "dry_run": true}); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				var msg map[string]any
+				err := conn.ReadJSON(&msg)
+				if err == nil {
+					if msg["type"] == "call" {
+						t.Fatal("a call was placed with a lost token")
+					}
+					continue
+				}
+				var ce *websocket.CloseError
+				if !errors.As(err, &ce) || ce.Code != tt.wantClose {
+					t.Fatalf("got %v, want close %d", err, tt.wantClose)
+				}
+				return
+			}
+		})
+	}
+}